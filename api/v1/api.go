@@ -1,6 +1,7 @@
 package api
 
 import (
+	"github.com/application-research/estuary/autoretrieve"
 	"github.com/application-research/estuary/config"
 	content "github.com/application-research/estuary/content"
 	"github.com/application-research/estuary/content/stagingzone"
@@ -43,6 +44,7 @@ type apiV1 struct {
 	transferMgr    transfer.IManager
 	dealMgr        deal.IManager
 	stgZoneMgr     stagingzone.IManager
+	arProvider     *autoretrieve.Provider
 }
 
 func NewAPIV1(
@@ -63,6 +65,7 @@ func NewAPIV1(
 	transferMgr transfer.IManager,
 	dealMgr deal.IManager,
 	stgZoneMgr stagingzone.IManager,
+	arProvider *autoretrieve.Provider,
 ) *apiV1 {
 	return &apiV1{
 		cfg:            cfg,
@@ -83,6 +86,7 @@ func NewAPIV1(
 		transferMgr:    transferMgr,
 		dealMgr:        dealMgr,
 		stgZoneMgr:     stgZoneMgr,
+		arProvider:     arProvider,
 	}
 }
 
@@ -144,6 +148,7 @@ func (s *apiV1) RegisterRoutes(e *echo.Echo) {
 	content := contmeta.Group("", s.AuthRequired(util.PermLevelUser))
 	content.GET("/by-cid/:cid", s.handleGetContentByCid)
 	content.GET("/:cont_id", util.WithUser(s.handleGetContent))
+	content.PUT("/:cont_id/expiry", util.WithUser(s.handleSetContentExpiry))
 	content.GET("/stats", util.WithUser(s.handleStats))
 	content.GET("/contents", util.WithUser(s.handleGetUserContents))
 	content.GET("/ensure-replication/:datacid", s.handleEnsureReplication)
@@ -248,6 +253,11 @@ func (s *apiV1) RegisterRoutes(e *echo.Echo) {
 	admin.GET("/cm/offload/candidates", s.handleGetOffloadingCandidates)
 	admin.POST("/cm/offload/:content", s.handleOffloadContent)
 	admin.POST("/cm/offload/collect", s.handleRunOffloadingCollection)
+	admin.POST("/cm/deal-queue/reconcile", s.handleReconcileDealQueue)
+	admin.GET("/cm/deal-queue/target/:content", s.handleGetDealTarget)
+	admin.PUT("/cm/deal-queue/target/:content", s.handleSetDealTarget)
+	admin.POST("/cm/split-queue/reset", s.handleResetSplitQueueTracker)
+	admin.GET("/cm/queue-stats", s.handleQueueStats)
 	admin.GET("/cm/refresh/:content", s.handleRefreshContent)
 	admin.POST("/cm/gc", s.handleRunGc)
 	admin.POST("/cm/move", s.handleMoveContent)
@@ -284,10 +294,24 @@ func (s *apiV1) RegisterRoutes(e *echo.Echo) {
 	shuttle := admin.Group("/shuttle")
 	shuttle.POST("/init", s.handleShuttleInit)
 	shuttle.GET("/list", s.handleShuttleList)
+	shuttle.POST("/:handle/boost-queue", s.handleShuttleBoostQueue)
+	shuttle.GET("/:handle/queue", s.handleShuttlePeekQueue)
 
 	ar := admin.Group("/autoretrieve")
 	ar.POST("/init", s.handleAutoretrieveInit)
 	ar.GET("/list", s.handleAutoretrieveList)
+	ar.GET("/diff/:handle", s.handleAutoretrieveDiff)
+	ar.GET("/silent", s.handleAutoretrieveSilent)
+	ar.GET("/duplicates", s.handleAutoretrieveDuplicates)
+	ar.POST("/merge-duplicates", s.handleAutoretrieveMergeDuplicates)
+	ar.POST("/remove-advertisements/:handle", s.handleAutoretrieveRemoveAdvertisements)
+	ar.GET("/advertised/:handle/:content", s.handleAutoretrieveContentAdvertised)
+	ar.GET("/history/:handle/:first", s.handleAutoretrieveAdvertisementHistory)
+	ar.GET("/verify/:content", s.handleAutoretrieveVerify)
+	ar.GET("/registry", s.handleAutoretrieveExportRegistry)
+	ar.POST("/registry", s.handleAutoretrieveImportRegistry)
+	ar.POST("/pause/:handle", s.handleAutoretrievePause)
+	ar.POST("/resume/:handle", s.handleAutoretrieveResume)
 
 	e.POST("/autoretrieve/heartbeat", s.handleAutoretrieveHeartbeat, s.withAutoretrieveAuth())
 
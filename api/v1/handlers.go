@@ -34,7 +34,12 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 
 	"github.com/application-research/estuary/autoretrieve"
+	splitqueue "github.com/application-research/estuary/content/split/queue"
+	"github.com/application-research/estuary/deal/queue"
+	dealstatus "github.com/application-research/estuary/deal/status"
+	"github.com/application-research/estuary/deal/transfer"
 	pinningstatus "github.com/application-research/estuary/pinner/status"
+	websocketeng "github.com/application-research/estuary/shuttle/rpc/engines/websocket"
 	"github.com/application-research/estuary/util"
 	"github.com/application-research/estuary/util/gateway"
 	"github.com/application-research/filclient"
@@ -506,6 +511,7 @@ func (s *apiV1) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Read
 // @Param        overwrite	   query     string  false  "Overwrite files with the same path on same collection"
 // @Param        lazy-provide  query     string  false  "Lazy Provide true/false"
 // @Param        dir           query     string  false  "Directory"
+// @Param        shuttle       query     string  false  "Handle of the shuttle to add the content on (admins only)"
 // @Success      200           {object}  util.ContentAddResponse
 // @Failure      400           {object}  util.HttpError
 // @Failure      500           {object}  util.HttpError
@@ -524,6 +530,10 @@ func (s *apiV1) handleAdd(c echo.Context, u *util.User) error {
 		return err
 	}
 
+	if handle := c.QueryParam("shuttle"); handle != "" {
+		return s.routeContentAdding(c, u, handle)
+	}
+
 	if s.cfg.Content.DisableLocalAdding {
 		return s.redirectContentAdding(c, u)
 	}
@@ -688,7 +698,34 @@ func (s *apiV1) redirectContentAdding(c echo.Context, u *util.User) error {
 	}
 
 	//#nosec G404: ignore weak random number generator
-	shURL, err := url.Parse(uep[rand.Intn(len(uep))])
+	return proxyContentAdding(c, uep[rand.Intn(len(uep))])
+}
+
+// routeContentAdding adds the content in the shuttle the uploader asked for,
+// e.g. to benchmark a shuttle through the API. Only admins pick the shuttle,
+// others get the one GetLocationForStorage chooses.
+func (s *apiV1) routeContentAdding(c echo.Context, u *util.User, handle string) error {
+	if u.Perm < util.PermLevelAdmin {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "only admins can pick the shuttle to add content on",
+		}
+	}
+
+	ep, err := s.shuttleMgr.GetUploadEndpointForShuttle(handle)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("cannot add content to shuttle %s: %s", handle, err),
+		}
+	}
+	return proxyContentAdding(c, ep)
+}
+
+func proxyContentAdding(c echo.Context, endpoint string) error {
+	shURL, err := url.Parse(endpoint)
 	if err != nil {
 		return err
 	}
@@ -865,6 +902,59 @@ func (s *apiV1) handleGetContent(c echo.Context, u *util.User) error {
 	return c.JSON(http.StatusOK, content)
 }
 
+// handleSetContentExpiry godoc
+// @Summary      Set the expiry of a content
+// @Description  This endpoint sets when a content stops being advertised to the indexers, for temporary storage. A null expiresAt makes the content permanent again.
+// @Tags         content
+// @Accept       json
+// @Produce      json
+// @Param        cont_id  path      int     true  "Content ID"
+// @Param        expiry   body      string  true  "Expiry, {expiresAt: RFC 3339 time or null}"
+// @Success      200      {object}  util.Content
+// @Failure      400      {object}  util.HttpError
+// @Failure      404      {object}  util.HttpError
+// @Failure      500      {object}  util.HttpError
+// @Router       /content/{cont_id}/expiry [put]
+func (s *apiV1) handleSetContentExpiry(c echo.Context, u *util.User) error {
+	contID, err := strconv.ParseUint(c.Param("cont_id"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid expiry: %s", err),
+		}
+	}
+
+	var content util.Content
+	if err := s.db.First(&content, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content: %d was not found", contID),
+			}
+		}
+		return err
+	}
+
+	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+		return err
+	}
+
+	if err := util.SetContentExpiry(s.db, contID, body.ExpiresAt); err != nil {
+		return err
+	}
+	content.ExpiresAt = body.ExpiresAt
+	return c.JSON(http.StatusOK, content)
+}
+
 // handleContentStatus godoc
 // @Summary      Content Status
 // @Description  This endpoint returns the status of a content
@@ -1345,8 +1435,8 @@ func (s *apiV1) handleTransferStatus(c echo.Context) error {
 func (s *apiV1) handleTransferStatusByID(c echo.Context) error {
 	transferID := c.Param("id")
 
-	var deal model.ContentDeal
-	if err := s.db.First(&deal, "dt_chan = ?", transferID).Error; err != nil {
+	deal, err := transfer.DealByChannelID(s.db, transferID)
+	if err != nil {
 		if xerrors.Is(err, gorm.ErrRecordNotFound) {
 			return &util.HttpError{
 				Code:    http.StatusNotFound,
@@ -1362,7 +1452,7 @@ func (s *apiV1) handleTransferStatusByID(c echo.Context) error {
 		return err
 	}
 
-	status, err := s.transferMgr.GetTransferStatus(c.Request().Context(), &deal, cont.Cid.CID, cont.Location)
+	status, err := s.transferMgr.GetTransferStatus(c.Request().Context(), deal, cont.Cid.CID, cont.Location)
 	if err != nil {
 		return err
 	}
@@ -2376,7 +2466,7 @@ func (s *apiV1) handleGetAggregatedForContent(c echo.Context, u *util.User) erro
 
 // handleGetContentFailures godoc
 // @Summary      List all failures for a content
-// @Description  This endpoint returns all failures for a content
+// @Description  This endpoint returns all deal failures for a content, newest first
 // @Tags         content
 // @Produce      json
 // @Success      200  {object}  string
@@ -2390,8 +2480,8 @@ func (s *apiV1) handleGetContentFailures(c echo.Context, u *util.User) error {
 		return err
 	}
 
-	var errs []model.DfeRecord
-	if err := s.db.Find(&errs, "content = ?", cont).Error; err != nil {
+	errs, err := dealstatus.DealFailuresForContent(s.db, uint64(cont))
+	if err != nil {
 		return err
 	}
 
@@ -2426,6 +2516,127 @@ func (s *apiV1) handleRunOffloadingCollection(c echo.Context) error {
 	return c.JSON(http.StatusOK, res)
 }
 
+func (s *apiV1) handleReconcileDealQueue(c echo.Context) error {
+	rec, err := queue.ReconcileDealQueue(s.db, s.cfg.Content.MinSize)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, rec)
+}
+
+func (s *apiV1) handleGetDealTarget(c echo.Context) error {
+	contID, err := strconv.ParseUint(c.Param("content"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	dt, err := queue.GetDealTarget(s.db, s.cfg.Replication, contID)
+	if err != nil {
+		return dealTargetError(contID, err)
+	}
+	return c.JSON(http.StatusOK, dt)
+}
+
+// handleSetDealTarget raises (or lowers) the number of deals a content is replicated to, a target of 0 falls back
+// to the default replication
+func (s *apiV1) handleSetDealTarget(c echo.Context) error {
+	contID, err := strconv.ParseUint(c.Param("content"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Target int `json:"target"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if body.Target < 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid deal target %d", body.Target),
+		}
+	}
+
+	dt, err := queue.SetDealTarget(s.db, s.cfg.Replication, contID, body.Target)
+	if err != nil {
+		return dealTargetError(contID, err)
+	}
+	return c.JSON(http.StatusOK, dt)
+}
+
+func dealTargetError(contID uint64, err error) error {
+	if xerrors.Is(err, gorm.ErrRecordNotFound) {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content: %d was not found", contID),
+		}
+	}
+	return err
+}
+
+// handleQueueStats reports the health of the deal and split queues, and how many contents the deal queue cleared
+// per hour over the window given by the window query parameter (1h by default)
+func (s *apiV1) handleQueueStats(c echo.Context) error {
+	window := time.Hour
+	if w := c.QueryParam("window"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid window %q", w),
+			}
+		}
+		window = d
+	}
+
+	out := make(map[string]interface{})
+	for name, q := range map[string]model.StatsQueue{
+		"dealQueue":  model.DealQueue{},
+		"splitQueue": model.SplitQueue{},
+	} {
+		summary, err := model.QueueStats(s.db, q)
+		if err != nil {
+			return err
+		}
+		out[name] = summary
+	}
+
+	tp, err := queue.GetThroughput(s.db, window)
+	if err != nil {
+		return err
+	}
+	out["dealThroughput"] = tp
+	return c.JSON(http.StatusOK, out)
+}
+
+func (s *apiV1) handleResetSplitQueueTracker(c echo.Context) error {
+	var body struct {
+		Start  uint64 `json:"start"`
+		StopAt uint64 `json:"stopAt"`
+	}
+
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := splitqueue.ResetTracker(s.db, s.log, body.Start, body.StopAt); err != nil {
+		if xerrors.Is(err, splitqueue.ErrSweepRunning) {
+			return &util.HttpError{
+				Code:    http.StatusConflict,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
 func (s *apiV1) handleOffloadContent(c echo.Context) error {
 	cont, err := strconv.Atoi(c.Param("content"))
 	if err != nil {
@@ -2945,8 +3156,23 @@ func (s *apiV1) getMinersOwnedByUser(u *util.User) []string {
 }
 
 func (s *apiV1) handleHealth(c echo.Context) error {
-	return c.JSON(http.StatusOK, map[string]string{
-		"status": "ok",
+	// autoretrieve is nil when disabled
+	if s.arProvider == nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"status": "ok",
+		})
+	}
+
+	stats := s.arProvider.Stats()
+	if !stats.Healthy {
+		return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+			"status":       "unhealthy",
+			"autoretrieve": stats,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":       "ok",
+		"autoretrieve": stats,
 	})
 }
 
@@ -4221,6 +4447,16 @@ func (s *apiV1) handleShuttleList(c echo.Context) error {
 		return err
 	}
 
+	connected, err := s.shuttleMgr.ConnectedShuttles()
+	if err != nil {
+		return err
+	}
+
+	identified := make(map[string]*model.ShuttleConnection, len(connected))
+	for _, sc := range connected {
+		identified[sc.Handle] = sc
+	}
+
 	var out []util.ShuttleListResponse
 	for _, d := range shuttles {
 		isOnline, err := s.shuttleMgr.IsOnline(d.Handle)
@@ -4243,7 +4479,7 @@ func (s *apiV1) handleShuttleList(c echo.Context) error {
 			return err
 		}
 
-		out = append(out, util.ShuttleListResponse{
+		resp := util.ShuttleListResponse{
 			Handle:         d.Handle,
 			Token:          d.Token,
 			LastConnection: d.LastConnection,
@@ -4251,11 +4487,80 @@ func (s *apiV1) handleShuttleList(c echo.Context) error {
 			AddrInfo:       addInf,
 			Hostname:       hn,
 			StorageStats:   sts,
-		})
+		}
+		resp.ErrorRate, resp.ErrorRateSamples = s.shuttleMgr.ErrorRate(d.Handle)
+		if sc, ok := identified[d.Handle]; ok {
+			resp.AgentVersion = sc.AgentVersion
+			if sc.Protocols != "" {
+				resp.Protocols = strings.Split(sc.Protocols, ",")
+			}
+		}
+		out = append(out, resp)
 	}
 	return c.JSON(http.StatusOK, out)
 }
 
+// handleShuttlePeekQueue godoc
+// @Summary      Inspect the command queue of a shuttle
+// @Description  This endpoint returns the commands waiting to be sent to a connected shuttle, counted by op, without taking them off the queue
+// @Tags         admin
+// @Param        handle  path  string  true  "Shuttle handle"
+// @Produce      json
+// @Success      200  {object}  util.ShuttleQueueSnapshot
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/shuttle/{handle}/queue [get]
+func (s *apiV1) handleShuttlePeekQueue(c echo.Context) error {
+	snap, err := s.shuttleMgr.PeekCommandQueue(c.Param("handle"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, snap)
+}
+
+// handleShuttleBoostQueue godoc
+// @Summary      Boost the command queue of a shuttle
+// @Description  This endpoint grows the queue of commands to a connected shuttle for at least the given duration, so that bulk onboarding to the shuttle doesn't block on a full queue. Pending commands are kept, and the queue shrinks back once the duration has passed and the burst subsided.
+// @Tags         admin
+// @Param        handle  path  string                      true  "Shuttle handle"
+// @Param        body    body  util.ShuttleBoostQueueBody  true  "Queue size and duration"
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/shuttle/{handle}/boost-queue [post]
+func (s *apiV1) handleShuttleBoostQueue(c echo.Context) error {
+	var body util.ShuttleBoostQueueBody
+	if err := c.Bind(&body); err != nil {
+		return &util.HttpError{
+			Code:   http.StatusBadRequest,
+			Reason: util.ERR_INVALID_INPUT,
+		}
+	}
+
+	d, err := time.ParseDuration(body.Duration)
+	if err != nil || d <= 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid boost duration %q", body.Duration),
+		}
+	}
+
+	handle := c.Param("handle")
+	if err := s.shuttleMgr.BoostCommandQueue(handle, body.Size, d); err != nil {
+		if xerrors.Is(err, websocketeng.ErrInvalidQueueSize) {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
 func (s *apiV1) handleShuttleConnection(c echo.Context) error {
 	auth, err := util.ExtractAuth(c)
 	if err != nil {
@@ -4351,16 +4656,358 @@ func (s *apiV1) handleAutoretrieveList(c echo.Context) error {
 			return err
 		}
 
+		multihashes, uncounted, err := autoretrieve.AdvertisedMultihashes(s.db, ar.Handle)
+		if err != nil {
+			return err
+		}
+
 		out = append(out, autoretrieve.AutoretrieveListResponse{
-			Handle:            ar.Handle,
-			LastConnection:    ar.LastConnection,
-			LastAdvertisement: ar.LastAdvertisement,
-			AddrInfo:          addrInfo,
+			Handle:                ar.Handle,
+			LastConnection:        ar.LastConnection,
+			LastAdvertisement:     ar.LastAdvertisement,
+			AddrInfo:              addrInfo,
+			Paused:                ar.Paused,
+			AdvertisedMultihashes: multihashes,
+			UncountedBatches:      uncounted,
 		})
 	}
 	return c.JSON(http.StatusOK, out)
 }
 
+// handleAutoretrieveDiff godoc
+// @Summary      Diff advertised and actual contents of an autoretrieve server
+// @Description  This endpoint compares the batches advertised for an autoretrieve server with the contents in the database, returning the content ID ranges that are advertised but deleted, and those that exist but are not advertised
+// @Tags         autoretrieve
+// @Param        handle  path  string  true  "Autoretrieve handle"
+// @Produce      json
+// @Success      200  {object}  autoretrieve.AdvertisementDiff
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/diff/{handle} [get]
+func (s *apiV1) handleAutoretrieveDiff(c echo.Context) error {
+	diff, err := autoretrieve.DiffAdvertised(s.db, c.Param("handle"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, diff)
+}
+
+// handleAutoretrieveSilent godoc
+// @Summary      List autoretrieve servers that connect but aren't advertised
+// @Description  This endpoint lists the unpaused autoretrieve servers that connected within the window but have no batch advertised within it, e.g. because all their publications fail
+// @Tags         autoretrieve
+// @Param        window  query  string  false  "How far back to look for connections and advertisements, e.g. 48h (24h by default)"
+// @Produce      json
+// @Success      200  {object}  []autoretrieve.SilentAutoretrieve
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/silent [get]
+func (s *apiV1) handleAutoretrieveSilent(c echo.Context) error {
+	window := 24 * time.Hour
+	if w := c.QueryParam("window"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid window %q", w),
+			}
+		}
+		window = d
+	}
+
+	since := time.Now().Add(-window)
+	silent, err := autoretrieve.SilentAutoretrieves(s.db, since, since)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, silent)
+}
+
+// handleAutoretrieveDuplicates godoc
+// @Summary      List duplicate autoretrieve registrations
+// @Description  This endpoint lists the autoretrieve servers registered under several handles with the same peer ID, which are advertised redundantly, along with the registration a merge would keep
+// @Tags         autoretrieve
+// @Produce      json
+// @Success      200  {object}  []autoretrieve.DuplicateRegistration
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/duplicates [get]
+func (s *apiV1) handleAutoretrieveDuplicates(c echo.Context) error {
+	dups, err := autoretrieve.FindDuplicateRegistrations(s.db)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dups)
+}
+
+// handleAutoretrieveMergeDuplicates godoc
+// @Summary      Merge duplicate autoretrieve registrations
+// @Description  This endpoint merges the autoretrieve servers registered under several handles with the same peer ID into the registration that connected last, moving their published batches to it, and returns the merged registrations
+// @Tags         autoretrieve
+// @Produce      json
+// @Success      200  {object}  []autoretrieve.DuplicateRegistration
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/merge-duplicates [post]
+func (s *apiV1) handleAutoretrieveMergeDuplicates(c echo.Context) error {
+	dups, err := autoretrieve.MergeDuplicateRegistrations(s.db)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dups)
+}
+
+// handleAutoretrieveRemoveAdvertisements godoc
+// @Summary      Remove all advertisements of an autoretrieve server
+// @Description  This endpoint withdraws every batch advertised for an autoretrieve server, e.g. before decommissioning it, and reports how many were removed and how many failed. Batches that failed are kept, so the call can be repeated to retry them.
+// @Tags         autoretrieve
+// @Param        handle  path  string  true  "Autoretrieve handle"
+// @Produce      json
+// @Success      200  {object}  autoretrieve.AdvertisementRemoval
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/remove-advertisements/{handle} [post]
+func (s *apiV1) handleAutoretrieveRemoveAdvertisements(c echo.Context) error {
+	// autoretrieve is nil when disabled
+	if s.arProvider == nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "autoretrieve is disabled",
+		}
+	}
+
+	removal, err := s.arProvider.RemoveAllAdvertisements(c.Request().Context(), c.Param("handle"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, removal)
+}
+
+// handleAutoretrieveContentAdvertised godoc
+// @Summary      Check whether a content is advertised for an autoretrieve server
+// @Description  This endpoint reports whether the batch holding the content is currently advertised for the autoretrieve server, i.e. it was published since the content was added and isn't due for a refresh, along with the CID of the batch's latest advertisement
+// @Tags         autoretrieve
+// @Param        handle   path  string  true  "Autoretrieve handle"
+// @Param        content  path  int     true  "Content ID"
+// @Produce      json
+// @Success      200  {object}  autoretrieve.ContentAdvertisedResponse
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/advertised/{handle}/{content} [get]
+func (s *apiV1) handleAutoretrieveContentAdvertised(c echo.Context) error {
+	// autoretrieve is nil when disabled
+	if s.arProvider == nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "autoretrieve is disabled",
+		}
+	}
+
+	contID, err := strconv.ParseUint(c.Param("content"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	advertised, adCid, err := s.arProvider.IsContentAdvertised(c.Param("handle"), contID)
+	if err != nil {
+		return err
+	}
+
+	out := autoretrieve.ContentAdvertisedResponse{Advertised: advertised}
+	if adCid.Defined() {
+		out.AdCid = adCid.String()
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleAutoretrieveAdvertisementHistory godoc
+// @Summary      List the advertisements of a batch of an autoretrieve server
+// @Description  This endpoint lists the advertisements published or removed for the batch starting at the given content ID, oldest first, to correlate them with the indexer-side state
+// @Tags         autoretrieve
+// @Param        handle  path  string  true  "Autoretrieve handle"
+// @Param        first   path  int     true  "ID of the first content of the batch"
+// @Produce      json
+// @Success      200  {object}  []autoretrieve.AdvertisementHistory
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/history/{handle}/{first} [get]
+func (s *apiV1) handleAutoretrieveAdvertisementHistory(c echo.Context) error {
+	// autoretrieve is nil when disabled
+	if s.arProvider == nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "autoretrieve is disabled",
+		}
+	}
+
+	first, err := strconv.ParseUint(c.Param("first"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	history, err := s.arProvider.AdvertisementHistory(c.Param("handle"), first)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, history)
+}
+
+// handleAutoretrieveVerify godoc
+// @Summary      Verify that a content is findable on the indexers
+// @Description  This endpoint looks a multihash of the content up with the indexers' find API and reports, for each indexer, whether one of the registered autoretrieve servers is among its providers, i.e. whether the advertisement was actually ingested, and how long the lookup took
+// @Tags         autoretrieve
+// @Param        content  path   int     true   "Content ID"
+// @Param        indexer  query  string  false  "Indexer URL to query (the configured indexers by default)"
+// @Produce      json
+// @Success      200  {object}  []autoretrieve.IndexerVerification
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/verify/{content} [get]
+func (s *apiV1) handleAutoretrieveVerify(c echo.Context) error {
+	// autoretrieve is nil when disabled
+	if s.arProvider == nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "autoretrieve is disabled",
+		}
+	}
+
+	contID, err := strconv.ParseUint(c.Param("content"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	indexerURLs := s.cfg.Node.IndexerURLs
+	if indexer := c.QueryParam("indexer"); indexer != "" {
+		indexerURLs = []string{indexer}
+	}
+
+	// the iterator starts at the content, so the sample is one of its multihashes, or of the next contents of its
+	// batch if it has none
+	mh, err := s.arProvider.SampleMultihash(contID)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	out := make([]autoretrieve.IndexerVerification, 0, len(indexerURLs))
+	for _, indexerURL := range indexerURLs {
+		found, latency, err := s.arProvider.VerifyAdvertised(c.Request().Context(), indexerURL, mh)
+		v := autoretrieve.IndexerVerification{
+			IndexerURL: indexerURL,
+			Multihash:  mh.B58String(),
+			Found:      found,
+			Latency:    latency.String(),
+		}
+		if err != nil {
+			v.Error = err.Error()
+		}
+		out = append(out, v)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleAutoretrieveExportRegistry godoc
+// @Summary      Export the autoretrieve registry
+// @Description  This endpoint dumps the registered autoretrieve servers as JSON, for backup or migration. Tokens are left out.
+// @Tags         autoretrieve
+// @Produce      json
+// @Success      200  {object}  []autoretrieve.RegistryEntry
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/registry [get]
+func (s *apiV1) handleAutoretrieveExportRegistry(c echo.Context) error {
+	data, err := autoretrieve.ExportRegistry(s.db)
+	if err != nil {
+		return err
+	}
+	return c.JSONBlob(http.StatusOK, data)
+}
+
+// handleAutoretrieveImportRegistry godoc
+// @Summary      Import an autoretrieve registry
+// @Description  This endpoint registers the autoretrieve servers of a dump made by the export endpoint, skipping handles that are already registered. Imported servers get a new token and have to be re-initialized.
+// @Tags         autoretrieve
+// @Accept       json
+// @Produce      json
+// @Param        body  body  []autoretrieve.RegistryEntry  true  "Registry dump"
+// @Success      200  {object}  map[string]int
+// @Failure      400  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/registry [post]
+func (s *apiV1) handleAutoretrieveImportRegistry(c echo.Context) error {
+	data, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+
+	imported, err := autoretrieve.ImportRegistry(s.db, data)
+	if xerrors.Is(err, autoretrieve.ErrInvalidRegistry) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]int{"imported": imported})
+}
+
+// handleAutoretrievePause godoc
+// @Summary      Pause the advertisements of an autoretrieve server
+// @Description  This endpoint stops advertising the content of an autoretrieve server without deregistering it, e.g. while it misbehaves
+// @Tags         autoretrieve
+// @Param        handle  path  string  true  "Autoretrieve handle"
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      404  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/pause/{handle} [post]
+func (s *apiV1) handleAutoretrievePause(c echo.Context) error {
+	return s.setAutoretrievePaused(c, autoretrieve.PauseAutoretrieve)
+}
+
+// handleAutoretrieveResume godoc
+// @Summary      Resume the advertisements of an autoretrieve server
+// @Description  This endpoint advertises the content of a paused autoretrieve server again from the next tick
+// @Tags         autoretrieve
+// @Param        handle  path  string  true  "Autoretrieve handle"
+// @Produce      json
+// @Success      200  {object}  string
+// @Failure      400  {object}  util.HttpError
+// @Failure      404  {object}  util.HttpError
+// @Failure      500  {object}  util.HttpError
+// @Router       /admin/autoretrieve/resume/{handle} [post]
+func (s *apiV1) handleAutoretrieveResume(c echo.Context) error {
+	return s.setAutoretrievePaused(c, autoretrieve.ResumeAutoretrieve)
+}
+
+func (s *apiV1) setAutoretrievePaused(c echo.Context, set func(db *gorm.DB, handle string) error) error {
+	handle := c.Param("handle")
+	if err := set(s.db, handle); err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("autoretrieve: %s was not found", handle),
+			}
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
 // handleAutoretrieveHeartbeat godoc
 // @Summary      Marks autoretrieve server as up
 // @Description  This endpoint updates the lastConnection field for autoretrieve
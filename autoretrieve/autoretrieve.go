@@ -1,25 +1,32 @@
 package autoretrieve
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/metrics"
 	"github.com/application-research/estuary/util"
 	providerpkg "github.com/filecoin-project/index-provider"
 	"github.com/filecoin-project/index-provider/engine"
-	"github.com/filecoin-project/index-provider/metadata"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 	"gorm.io/gorm"
 )
 
@@ -34,20 +41,29 @@ type Autoretrieve struct {
 	LastAdvertisement time.Time
 	PubKey            string `gorm:"unique"`
 	Addresses         string
+	// Paused autoretrieves stay registered but are not advertised
+	Paused bool `gorm:"not null;default:false"`
+	// When the autoretrieve is next advertised, only used with WithScheduling
+	NextAdvertisement *time.Time
 }
 
-func (autoretrieve *Autoretrieve) AddrInfo() (*peer.AddrInfo, error) {
-	addrStrings := strings.Split(autoretrieve.Addresses, ",")
-
+// PeerID derives the peer ID of the autoretrieve from its public key
+func (autoretrieve *Autoretrieve) PeerID() (peer.ID, error) {
 	pubKeyBytes, err := crypto.ConfigDecodeKey(autoretrieve.PubKey)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	pubKey, err := crypto.UnmarshalPublicKey(pubKeyBytes)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	peerID, err := peer.IDFromPublicKey(pubKey)
+	return peer.IDFromPublicKey(pubKey)
+}
+
+func (autoretrieve *Autoretrieve) AddrInfo() (*peer.AddrInfo, error) {
+	addrStrings := strings.Split(autoretrieve.Addresses, ",")
+
+	peerID, err := autoretrieve.PeerID()
 	if err != nil {
 		return nil, err
 	}
@@ -78,13 +94,41 @@ func (autoretrieve *Autoretrieve) AddrInfo() (*peer.AddrInfo, error) {
 type PublishedBatch struct {
 	gorm.Model
 
-	FirstContentID     uint64
-	Count              uint64
+	FirstContentID uint64
+	// Index of the advertisement among those the batch's multihashes are
+	// split over, 0 if the batch fits in a single advertisement
+	SubBatch uint64
+	Count    uint64
+	// Amount of multihashes in the whole batch when it was last published,
+	// only recorded for batches within the lookback
+	Entries uint64 `gorm:"default:0"`
+	// Amount of multihashes the advertisement of the (sub-)batch lists, nil
+	// for batches published before it was recorded that haven't been
+	// counted since
+	MultihashCount     *uint64
 	AutoretrieveHandle string
+	LastAdvertisement  time.Time
+	// Peer ID the batch was advertised for, needed to remove the
+	// advertisement once the autoretrieve itself is gone
+	ProviderID string
 }
 
 func (PublishedBatch) TableName() string { return "published_batches" }
 
+// An advertisement that was published (or removed) for a batch, kept so that
+// the chain of advertisement CIDs can be correlated with indexer-side state
+type AdvertisementHistory struct {
+	gorm.Model
+
+	AutoretrieveHandle string `gorm:"index:idx_advertisement_histories_batch"`
+	FirstContentID     uint64 `gorm:"index:idx_advertisement_histories_batch"`
+	Count              uint64
+	AdCid              util.DbCID
+	Removal            bool
+}
+
+func (AdvertisementHistory) TableName() string { return "advertisement_histories" }
+
 type HeartbeatAutoretrieveResponse struct {
 	Handle            string         `json:"handle"`
 	LastConnection    time.Time      `json:"lastConnection"`
@@ -98,6 +142,19 @@ type AutoretrieveListResponse struct {
 	LastConnection    time.Time      `json:"lastConnection"`
 	LastAdvertisement time.Time      `json:"lastAdvertisement"`
 	AddrInfo          *peer.AddrInfo `json:"addrInfo"`
+	Paused            bool           `json:"paused"`
+	// multihashes advertised for the autoretrieve, batches that haven't
+	// been counted yet are left out
+	AdvertisedMultihashes uint64 `json:"advertisedMultihashes"`
+	UncountedBatches      int64  `json:"uncountedBatches"`
+}
+
+type ContentAdvertisedResponse struct {
+	Advertised bool `json:"advertised"`
+	// CID of the latest advertisement of the batch holding the content,
+	// empty when it isn't advertised or was published before the history
+	// was recorded
+	AdCid string `json:"adCid,omitempty"`
 }
 
 type AutoretrieveInitResponse struct {
@@ -108,12 +165,162 @@ type AutoretrieveInitResponse struct {
 	AdvertiseInterval string         `json:"advertiseInterval"`
 }
 
+// ObjRefStrategy selects how the CIDs of a batch are read from the objects
+// and obj_refs tables
+type ObjRefStrategy string
+
+const (
+	// ObjRefStrategyJoin reads CIDs with a single join of objects on obj_refs
+	ObjRefStrategyJoin ObjRefStrategy = "join"
+	// ObjRefStrategyTwoStep first collects the object IDs referenced by the
+	// content range, then fetches their CIDs by primary key in batches
+	ObjRefStrategyTwoStep ObjRefStrategy = "two-step"
+)
+
+// Amount of object IDs looked up per query by ObjRefStrategyTwoStep
+const objRefLookupBatchSize = 10000
+
+func ParseObjRefStrategy(s string) (ObjRefStrategy, error) {
+	switch strategy := ObjRefStrategy(s); strategy {
+	case "":
+		return ObjRefStrategyJoin, nil
+	case ObjRefStrategyJoin, ObjRefStrategyTwoStep:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown obj_refs strategy %q (expected %q or %q)", s, ObjRefStrategyJoin, ObjRefStrategyTwoStep)
+	}
+}
+
 type Provider struct {
-	engine                *engine.Engine
+	engine                Engine
+	engineDatastore       datastore.Batching
+	engineStartAttempts   int
+	engineStartBackoff    time.Duration
 	db                    *gorm.DB
 	advertisementInterval time.Duration
 	advertiseOffline      bool
+	offlineGrace          time.Duration
 	batchSize             uint64
+	objRefStrategy        ObjRefStrategy
+	refreshInterval       time.Duration
+	reapInterval          time.Duration
+	reapPace              time.Duration
+	pruneInterval         time.Duration
+	pruneNotifyRemove     bool
+	pauseNotifyRemove     bool
+	indexerURLs           []*url.URL
+	retrievalFeedback     RetrievalFeedback
+	maxEntriesPerAd       uint64
+	lookbackBatches       uint64
+	minBatchFill          float64
+	minBatchFillMaxAge    time.Duration
+	recentContentAge      time.Duration
+	coldBatchTicks        uint64
+	contentExpiry         bool
+	queryLimiter          *rate.Limiter
+	schedulePasses        uint64
+	scheduleJitter        float64
+	tick                  uint64
+	metadataExtension     MetadataExtension
+
+	iterCacheEnabled bool
+	iterCacheLk      sync.Mutex
+	iterCache        map[iterationKey][]multihash.Multihash
+
+	// multihash counts listed for the context IDs being published
+	listedLk              sync.Mutex
+	listed                map[string]*uint64
+	mhCountBackfillBudget int
+
+	// autoretrieve handles the metrics are labeled with
+	handleLabelsLk sync.Mutex
+	handleLabels   map[string]struct{}
+
+	statsLk      sync.Mutex
+	stats        ProviderStats
+	runningSince time.Time
+}
+
+type ProviderOption func(*Provider)
+
+// WithRefreshInterval makes the provider re-announce batches whose
+// advertisement is older than the interval even if they haven't changed, so
+// that they don't expire on the indexer side (0 disables refreshing)
+func WithRefreshInterval(interval time.Duration) ProviderOption {
+	return func(provider *Provider) {
+		provider.refreshInterval = interval
+	}
+}
+
+// WithPruneInterval makes the provider periodically delete the published
+// batches of autoretrieves that have been deregistered, removing their
+// advertisements first if notifyRemove is set (0 disables pruning)
+func WithPruneInterval(interval time.Duration, notifyRemove bool) ProviderOption {
+	return func(provider *Provider) {
+		provider.pruneInterval = interval
+		provider.pruneNotifyRemove = notifyRemove
+	}
+}
+
+// WithOfflineGrace makes the provider keep advertising autoretrieves for
+// grace past a missed heartbeat, so that a brief disconnect doesn't drop them
+// from advertisements (0 considers them offline as soon as a heartbeat is
+// missed)
+func WithOfflineGrace(grace time.Duration) ProviderOption {
+	return func(provider *Provider) {
+		provider.offlineGrace = grace
+	}
+}
+
+// WithMaxEntriesPerAd splits the multihashes of batches with more than max
+// of them over several advertisements (sub-batches) with distinct context
+// IDs (0 puts a whole batch in one advertisement)
+func WithMaxEntriesPerAd(max uint64) ProviderOption {
+	return func(provider *Provider) {
+		provider.maxEntriesPerAd = max
+	}
+}
+
+// WithLookback makes the provider recount the multihashes of the last batches
+// every tick and re-publish those whose count changed, catching obj_refs
+// written after their content was advertised. Each tick then costs an extra
+// count query per batch within the lookback, and batches still being written
+// may be re-published a few times (0 disables the lookback)
+func WithLookback(batches uint64) ProviderOption {
+	return func(provider *Provider) {
+		provider.lookbackBatches = batches
+	}
+}
+
+// WithMinBatchFill holds back the trailing, incomplete batch until it is at
+// least fill (a fraction of the batch size) full, so that a slowly filling
+// batch isn't re-published every time it grows. A batch whose first content
+// is older than maxAge is advertised regardless (a fill of 0 advertises
+// incomplete batches right away, a maxAge of 0 holds them until filled)
+func WithMinBatchFill(fill float64, maxAge time.Duration) ProviderOption {
+	return func(provider *Provider) {
+		provider.minBatchFill = fill
+		provider.minBatchFillMaxAge = maxAge
+	}
+}
+
+// WithAgePriority makes the provider check batches containing content added
+// within recentAge every tick, while batches of only older content are checked
+// every coldBatchTicks ticks (a recentAge or coldBatchTicks of 0 checks every
+// batch every tick)
+func WithAgePriority(recentAge time.Duration, coldBatchTicks uint64) ProviderOption {
+	return func(provider *Provider) {
+		provider.recentContentAge = recentAge
+		provider.coldBatchTicks = coldBatchTicks
+	}
+}
+
+// WithObjRefStrategy sets how the multihash lister reads CIDs for a batch
+// (defaults to ObjRefStrategyJoin)
+func WithObjRefStrategy(strategy ObjRefStrategy) ProviderOption {
+	return func(provider *Provider) {
+		provider.objRefStrategy = strategy
+	}
 }
 
 type Iterator struct {
@@ -123,15 +330,17 @@ type Iterator struct {
 	count          uint64
 }
 
-func NewIterator(db *gorm.DB, firstContentID uint64, count uint64) (*Iterator, error) {
+func NewIterator(db *gorm.DB, firstContentID uint64, count uint64, strategy ObjRefStrategy) (*Iterator, error) {
+	return newIteratorAt(db, firstContentID, count, strategy, time.Time{})
+}
+
+// newIteratorAt creates an iterator over the multihashes of the contents that
+// haven't expired by expiredBy, the zero time excludes none
+func newIteratorAt(db *gorm.DB, firstContentID uint64, count uint64, strategy ObjRefStrategy, expiredBy time.Time) (*Iterator, error) {
 
 	// Read CID strings for this content ID
-	var cidStrings []string
-	if err := db.Raw(
-		"SELECT objects.cid FROM objects LEFT JOIN obj_refs ON objects.id = obj_refs.object WHERE obj_refs.content BETWEEN ? AND ?",
-		firstContentID,
-		firstContentID+count,
-	).Scan(&cidStrings).Error; err != nil {
+	cidStrings, err := readCidStrings(db, firstContentID, count, strategy, expiredBy)
+	if err != nil {
 		return nil, err
 	}
 
@@ -146,8 +355,8 @@ func NewIterator(db *gorm.DB, firstContentID uint64, count uint64) (*Iterator, e
 		len(cidStrings),
 	)
 
-	// Parse CID strings and extract multihashes
-	var mhs []multihash.Multihash
+	// Parse CID strings
+	var cids []cid.Cid
 	// NOTE(@elijaharita 2022-12-11): CIDs are often empty in the database for
 	// some reason, so I just count the amount that are empty and put one print
 	// statement for them at the end to avoid thousands of lines of log spam.
@@ -164,18 +373,122 @@ func NewIterator(db *gorm.DB, firstContentID uint64, count uint64) (*Iterator, e
 			continue
 		}
 
-		mhs = append(mhs, cid.Hash())
+		cids = append(cids, cid)
 	}
 
 	if emptyCount != 0 {
 		log.Warnf("Skipped %d empty CIDs", emptyCount)
 	}
 
+	iter := NewIteratorFromCIDs(cids)
+	iter.firstContentID = firstContentID
+	iter.count = count
+	return iter, nil
+}
+
+// NewIteratorFromCIDs creates an iterator over the multihashes of an
+// in-memory list of CIDs, skipping undefined ones
+func NewIteratorFromCIDs(cids []cid.Cid) *Iterator {
+	mhs := make([]multihash.Multihash, 0, len(cids))
+	for _, c := range cids {
+		if !c.Defined() {
+			continue
+		}
+		mhs = append(mhs, c.Hash())
+	}
+
 	return &Iterator{
-		mhs:            mhs,
-		firstContentID: firstContentID,
-		count:          count,
-	}, nil
+		mhs: mhs,
+	}
+}
+
+func readCidStrings(db *gorm.DB, firstContentID uint64, count uint64, strategy ObjRefStrategy, expiredBy time.Time) ([]string, error) {
+	var cidStrings []string
+
+	where := "obj_refs.content BETWEEN ? AND ?"
+	args := []interface{}{firstContentID, firstContentID + count}
+	if !expiredBy.IsZero() {
+		where += " AND " + notExpired
+		args = append(args, expiredBy)
+	}
+
+	switch strategy {
+	case ObjRefStrategyJoin, "":
+		if err := db.Raw(
+			"SELECT objects.cid FROM objects LEFT JOIN obj_refs ON objects.id = obj_refs.object WHERE "+where,
+			args...,
+		).Scan(&cidStrings).Error; err != nil {
+			return nil, err
+		}
+	case ObjRefStrategyTwoStep:
+		var objectIDs []uint64
+		if err := db.Raw(
+			"SELECT object FROM obj_refs WHERE "+where,
+			args...,
+		).Scan(&objectIDs).Error; err != nil {
+			return nil, err
+		}
+
+		for start := 0; start < len(objectIDs); start += objRefLookupBatchSize {
+			end := start + objRefLookupBatchSize
+			if end > len(objectIDs) {
+				end = len(objectIDs)
+			}
+
+			var batch []string
+			if err := db.Raw("SELECT cid FROM objects WHERE id IN ?", objectIDs[start:end]).Scan(&batch).Error; err != nil {
+				return nil, err
+			}
+			cidStrings = append(cidStrings, batch...)
+		}
+	default:
+		return nil, fmt.Errorf("unknown obj_refs strategy %q", strategy)
+	}
+
+	return cidStrings, nil
+}
+
+// limitToSubBatch restricts the iterator to the multihashes of one of the
+// sub-batches of max multihashes. The multihashes are sorted first, so that
+// every sub-batch is the same however the database orders the rows.
+func (iter *Iterator) limitToSubBatch(subBatch uint64, max uint64) {
+	sort.Slice(iter.mhs, func(i, j int) bool {
+		return bytes.Compare(iter.mhs[i], iter.mhs[j]) < 0
+	})
+
+	start := subBatch * max
+	if start > uint64(len(iter.mhs)) {
+		start = uint64(len(iter.mhs))
+	}
+	end := start + max
+	if end > uint64(len(iter.mhs)) {
+		end = uint64(len(iter.mhs))
+	}
+	iter.mhs = iter.mhs[start:end]
+	iter.index = 0
+}
+
+// countEntries returns an upper bound of the multihashes of the batch, the
+// object references of its contents
+func countEntries(db *gorm.DB, firstContentID uint64, count uint64) (uint64, error) {
+	var entries uint64
+	if err := db.Raw(
+		"SELECT count(*) FROM obj_refs WHERE content BETWEEN ? AND ?",
+		firstContentID,
+		firstContentID+count,
+	).Scan(&entries).Error; err != nil {
+		return 0, err
+	}
+	return entries, nil
+}
+
+// subBatchCount returns how many advertisements the entries of a batch are
+// split over, at least one
+func subBatchCount(entries uint64, maxEntriesPerAd uint64) uint64 {
+	if maxEntriesPerAd == 0 || entries <= maxEntriesPerAd {
+		return 1
+	}
+	return (entries + maxEntriesPerAd - 1) / maxEntriesPerAd
 }
 
 func (iter *Iterator) Next() (multihash.Multihash, error) {
@@ -190,13 +503,61 @@ func (iter *Iterator) Next() (multihash.Multihash, error) {
 	return mh, nil
 }
 
-func NewProvider(db *gorm.DB, advertisementInterval time.Duration, indexerURL string, advertiseOffline bool) (*Provider, error) {
-	eng, err := engine.New(engine.WithPublisherKind(engine.DataTransferPublisher), engine.WithDirectAnnounce(indexerURL))
-	if err != nil {
-		return nil, fmt.Errorf("failed to init engine: %v", err)
+// Len returns how many multihashes the iterator yields in total, however many
+// were already read
+func (iter *Iterator) Len() int {
+	return len(iter.mhs)
+}
+
+// Reset rewinds the iterator, so that the same multihashes can be read again
+func (iter *Iterator) Reset() {
+	iter.index = 0
+}
+
+func NewProvider(db *gorm.DB, advertisementInterval time.Duration, indexerURLs []string, advertiseOffline bool, opts ...ProviderOption) (*Provider, error) {
+	provider := &Provider{
+		db:                    db,
+		advertisementInterval: advertisementInterval,
+		advertiseOffline:      advertiseOffline,
+		batchSize:             constants.AutoretrieveProviderBatchSize,
+		objRefStrategy:        ObjRefStrategyJoin,
+		engineStartAttempts:   engineStartAttempts,
+		engineStartBackoff:    engineStartBackoff,
+	}
+	for _, opt := range opts {
+		opt(provider)
+	}
+
+	// Refuse to start rather than publish advertisements whose context IDs
+	// don't read back as the range they were made for
+	if err := checkContextIDs(provider.batchSize); err != nil {
+		return nil, fmt.Errorf("context ID self-test failed: %v", err)
+	}
+
+	for _, indexerURL := range indexerURLs {
+		u, err := url.Parse(indexerURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid indexer url %q: %v", indexerURL, err)
+		}
+		provider.indexerURLs = append(provider.indexerURLs, u)
+	}
+
+	if provider.engine == nil {
+		// Direct announcements are sent by the provider itself rather than
+		// the engine, which would fail the whole publication if any one
+		// indexer is unreachable
+		opts := []engine.Option{engine.WithPublisherKind(engine.DataTransferPublisher)}
+		if provider.engineDatastore != nil {
+			opts = append(opts, engine.WithDatastore(provider.engineDatastore))
+		}
+		eng, err := engine.New(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init engine: %v", err)
+		}
+		provider.engine = eng
 	}
 
-	eng.RegisterMultihashLister(func(
+	provider.engine.RegisterMultihashLister(func(
 		ctx context.Context,
 		peer peer.ID,
 		contextID []byte,
@@ -220,33 +581,62 @@ func NewProvider(db *gorm.DB, advertisementInterval time.Duration, indexerURL st
 			params.firstContentID,
 			params.count,
 		)
-		iter, err := NewIterator(db, params.firstContentID, params.count)
+		if err := provider.throttle(ctx); err != nil {
+			return nil, err
+		}
+		iter, err := provider.newIterator(params.firstContentID, params.count)
 		if err != nil {
 			return nil, err
 		}
 
+		if provider.maxEntriesPerAd != 0 {
+			iter.limitToSubBatch(params.subBatch, provider.maxEntriesPerAd)
+		}
+		provider.recordListed(contextID, uint64(iter.Len()))
+
 		return iter, nil
 	})
 
-	return &Provider{
-		engine:                eng,
-		db:                    db,
-		advertisementInterval: advertisementInterval,
-		advertiseOffline:      advertiseOffline,
-		batchSize:             constants.AutoretrieveProviderBatchSize,
-	}, nil
+	return provider, nil
+}
+
+// isOffline reports whether an autoretrieve last seen at lastConnection has
+// missed its heartbeats for longer than the grace period
+func (provider *Provider) isOffline(lastConnection time.Time, now time.Time) bool {
+	return now.Sub(lastConnection) > provider.advertisementInterval+provider.offlineGrace
 }
 
 func (provider *Provider) Run(ctx context.Context) error {
 	log := log.Named("loop")
 
-	if err := provider.engine.Start(ctx); err != nil {
+	if err := provider.startEngine(ctx); err != nil {
 		return err
 	}
 
+	resumed, err := provider.resumeAdvertisements(ctx)
+	if err != nil {
+		log.Errorf("Failed to resume advertisements after engine start: %v", err)
+	} else if resumed.Republished != 0 || resumed.Failed != 0 {
+		log.Infof("Resumed advertisements after engine start: %d of %d published batches were missing from the engine, %d failed", resumed.Republished, resumed.Batches, resumed.Failed)
+	}
+
+	// duplicates are only reported, merging them is left to the admin API
+	dups, err := FindDuplicateRegistrations(provider.db)
+	if err != nil {
+		log.Errorf("Failed to find duplicate autoretrieve registrations: %v", err)
+	}
+	for _, dup := range dups {
+		log.Warnf("Autoretrieve %s is registered again as %v with the same peer ID %s and advertised redundantly, merge the registrations to stop it", dup.Canonical, dup.Duplicates, dup.PeerID)
+	}
+
 	// time.Tick will drop ticks to make up for slow advertisements
-	log.Infof("Starting autoretrieve advertisement loop every %s", provider.advertisementInterval)
-	ticker := time.NewTicker(provider.advertisementInterval)
+	log.Infof("Starting autoretrieve advertisement loop every %s", provider.tickInterval())
+	ticker := time.NewTicker(provider.tickInterval())
+	var lastPrune time.Time
+	var lastReap time.Time
+	// the reaper is paced, so it runs beside the loop rather than in a tick
+	reaping := false
+	reaped := make(chan struct{}, 1)
 	for ; true; <-ticker.C {
 		if ctx.Err() != nil {
 			ticker.Stop()
@@ -255,174 +645,690 @@ func (provider *Provider) Run(ctx context.Context) error {
 
 		log.Debugf("Starting autoretrieve advertisement tick")
 
-		// Find the highest current content ID for later
-		var lastContent util.Content
-		if err := provider.db.Last(&lastContent).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				log.Debugf("Failed to get last provider content ID: %v", err)
-				continue
+		if provider.pruneInterval != 0 && time.Since(lastPrune) >= provider.pruneInterval {
+			lastPrune = time.Now()
+			pruned, err := provider.PruneDeregistered(ctx, provider.pruneNotifyRemove)
+			if err != nil {
+				log.Errorf("Failed to prune published batches of deregistered autoretrieves: %v", err)
 			} else {
-				log.Warnf("No contents to advertise")
-				continue
+				log.Infof("Pruned %d published batches of deregistered autoretrieves", pruned)
 			}
 		}
 
-		var autoretrieves []Autoretrieve
-		if err := provider.db.Find(&autoretrieves).Error; err != nil {
-			log.Errorf("Failed to get autoretrieves: %v", err)
+		select {
+		case <-reaped:
+			reaping = false
+		default:
+		}
+
+		if provider.reapInterval != 0 && !reaping && time.Since(lastReap) >= provider.reapInterval {
+			lastReap = time.Now()
+			reaping = true
+			go func() {
+				defer func() { reaped <- struct{}{} }()
+				removed, err := provider.ReapEmptyBatches(ctx)
+				if err != nil {
+					log.Errorf("Failed to reap published batches of deleted content: %v", err)
+					return
+				}
+				log.Infof("Reaped %d published batches of deleted content", removed)
+			}()
+		}
+		provider.startTick()
+		provider.mhCountBackfillBudget = multihashCountBackfillPerTick
+		provider.beginIterationCache()
+		err := provider.advertise(ctx)
+		provider.endIterationCache()
+		if err != nil {
+			log.Errorf("Advertisement tick failed: %v", err)
+			provider.finishTick(err)
 			continue
 		}
+		provider.finishTick(nil)
+	}
 
-		// For each registered autoretrieve...
-		for _, autoretrieve := range autoretrieves {
-			log := log.With("autoretrieve_handle", autoretrieve.Handle)
+	provider.stopped()
+	return nil
+}
 
-			// Make sure it is online (if offline checking isn't disabled)
-			if !provider.advertiseOffline {
-				if time.Since(autoretrieve.LastConnection) > provider.advertisementInterval {
-					log.Debugf("Skipping offline autoretrieve")
-					continue
+// advertise runs a single tick of the advertisement loop, publishing each
+// batch that has not been advertised (or changed since) for each autoretrieve
+func (provider *Provider) advertise(ctx context.Context) error {
+	log := log.Named("loop")
+
+	// Find the highest current content ID for later
+	lastContentID, found, err := getLastContentID(provider.db)
+	if err != nil {
+		return fmt.Errorf("failed to get last provider content ID: %w", err)
+	}
+	if !found {
+		log.Debugf("No contents to advertise")
+		return nil
+	}
+
+	var autoretrieves []Autoretrieve
+	if err := provider.db.Find(&autoretrieves).Error; err != nil {
+		return fmt.Errorf("failed to get autoretrieves: %w", err)
+	}
+
+	checkCold, firstRecentContentID, err := provider.coldBatchPolicy(time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to get first recent content ID: %w", err)
+	}
+
+	// Skip the ranges left empty by deletions up front rather than checking
+	// each of their batches
+	populated, err := provider.populatedBatches(ctx, lastContentID)
+	if err != nil {
+		return fmt.Errorf("failed to find populated batches: %w", err)
+	}
+
+	// For each registered autoretrieve...
+	for _, autoretrieve := range autoretrieves {
+		log := log.With("autoretrieve_handle", autoretrieve.Handle)
+
+		if autoretrieve.Paused {
+			if provider.pauseNotifyRemove {
+				removed, err := provider.removePausedBatches(ctx, autoretrieve.Handle)
+				if err != nil {
+					log.Errorf("Failed to remove batches of paused autoretrieve: %v", err)
+				} else if removed != 0 {
+					log.Infof("Removed %d batches of paused autoretrieve", removed)
 				}
 			}
+			log.Debugf("Skipping paused autoretrieve")
+			continue
+		}
 
-			// Get address info for later
-			addrInfo, err := autoretrieve.AddrInfo()
+		// Only advertise the autoretrieve if it is due in this pass
+		due, err := provider.due(&autoretrieve, time.Now())
+		if err != nil {
+			log.Errorf("Failed to schedule autoretrieve: %v", err)
+			continue
+		}
+		if !due {
+			continue
+		}
+		if err := provider.reschedule(&autoretrieve, time.Now()); err != nil {
+			log.Errorf("Failed to reschedule autoretrieve: %v", err)
+		}
+
+		// Make sure it is online (if offline checking isn't disabled)
+		if !provider.advertiseOffline {
+			if provider.isOffline(autoretrieve.LastConnection, time.Now()) {
+				log.Debugf("Skipping offline autoretrieve")
+				continue
+			}
+		}
+
+		// Get address info for later
+		addrInfo, err := autoretrieve.AddrInfo()
+		if err != nil {
+			log.Errorf("Failed to get autoretrieve address info: %v", err)
+			continue
+		}
+
+		batches, err := batchesToAdvertise(provider.db, autoretrieve.Handle, populated, lastContentID, provider.batchSize)
+		if err != nil {
+			log.Errorf("Failed to get batches to advertise: %v", err)
+			continue
+		}
+
+		// For each batch that should be advertised...
+		for _, firstContentID := range batches {
+
+			// Find the amount of contents in this batch (likely less than
+			// the batch size if this is the last batch)
+			count := batchCount(firstContentID, lastContentID, provider.batchSize)
+
+			log := log.With("first_content_id", firstContentID, "count", count)
+
+			if !checkCold && firstContentID+count < firstRecentContentID {
+				continue
+			}
+
+			hold, err := provider.holdBatch(firstContentID, count, time.Now())
 			if err != nil {
-				log.Errorf("Failed to get autoretrieve address info: %v", err)
+				log.Errorf("Failed to check batch fill: %v", err)
+				continue
+			}
+			if hold {
+				log.Debugf("Holding back incomplete batch")
 				continue
 			}
 
-			// For each batch that should be advertised...
-			for firstContentID := uint64(0); firstContentID <= lastContent.ID; firstContentID += provider.batchSize {
+			provider.setCursor(autoretrieve.Handle, firstContentID)
 
-				// Find the amount of contents in this batch (likely less than
-				// the batch size if this is the last batch)
-				count := provider.batchSize
-				remaining := lastContent.ID - firstContentID
-				if remaining < count {
-					count = remaining
+			subBatches := uint64(1)
+			// Only set for batches within the lookback, whose entries are
+			// compared to the published ones
+			var lookbackEntries *uint64
+			inLookback := provider.inLookback(firstContentID, lastContentID)
+			if provider.maxEntriesPerAd != 0 || inLookback {
+				if err := provider.throttle(ctx); err != nil {
+					return err
 				}
-
-				log := log.With("first_content_id", firstContentID, "count", count)
-
-				// Search for an entry (this array will have either 0 or 1
-				// elements depending on whether an advertisement was found)
-				var publishedBatches []PublishedBatch
-				if err := provider.db.Where(
-					"autoretrieve_handle = ? AND first_content_id = ?",
-					autoretrieve.Handle,
-					firstContentID,
-				).Find(&publishedBatches).Error; err != nil {
-					log.Errorf("Failed to get published contents: %v", err)
+				entries, err := countEntries(provider.db, firstContentID, count)
+				if err != nil {
+					log.Errorf("Failed to count multihashes of batch: %v", err)
 					continue
 				}
+				subBatches = subBatchCount(entries, provider.maxEntriesPerAd)
+				if inLookback {
+					lookbackEntries = &entries
+				}
+			}
 
-				// And check if it's...
+			for subBatch := uint64(0); subBatch < subBatches; subBatch++ {
+				provider.publishBatch(ctx, log, autoretrieve.Handle, addrInfo, firstContentID, count, subBatch, lookbackEntries)
+			}
+			provider.removeStaleSubBatches(ctx, log, autoretrieve.Handle, firstContentID, subBatches)
+		}
 
-				// 1. fully advertised, or no changes: do nothing
-				if len(publishedBatches) != 0 && publishedBatches[0].Count == count {
-					log.Debugf("Skipping already advertised batch")
-					continue
+		provider.recordCoverage(autoretrieve.Handle, lastContentID)
+	}
+
+	return nil
+}
+
+// inLookback reports whether the batch starting at firstContentID is one of
+// the last lookbackBatches batches
+func (provider *Provider) inLookback(firstContentID uint64, lastContentID uint64) bool {
+	return provider.lookbackBatches != 0 && lastContentID-firstContentID < provider.lookbackBatches*provider.batchSize
+}
+
+// needsRepublish reports whether a published batch has changed since, or is
+// due for a refresh. entries is only set for batches within the lookback.
+func (provider *Provider) needsRepublish(batch PublishedBatch, count uint64, entries *uint64, now time.Time) bool {
+	if batch.Count != count || provider.needsRefresh(batch, now) {
+		return true
+	}
+	// obj_refs written after the batch was published don't change its count
+	return entries != nil && batch.Entries != *entries
+}
+
+// publishBatch publishes a batch (or one of its sub-batches, when its
+// multihashes are split over several advertisements) if it has not been
+// advertised, or has changed or expired since
+func (provider *Provider) publishBatch(ctx context.Context, log *zap.SugaredLogger, handle string, addrInfo *peer.AddrInfo, firstContentID uint64, count uint64, subBatch uint64, entries *uint64) {
+	if subBatch != 0 {
+		log = log.With("sub_batch", subBatch)
+	}
+
+	if err := provider.throttle(ctx); err != nil {
+		return
+	}
+
+	// Search for an entry (this array will have either 0 or 1
+	// elements depending on whether an advertisement was found)
+	var publishedBatches []PublishedBatch
+	if err := provider.db.Where(
+		"autoretrieve_handle = ? AND first_content_id = ? AND sub_batch = ?",
+		handle,
+		firstContentID,
+		subBatch,
+	).Find(&publishedBatches).Error; err != nil {
+		log.Errorf("Failed to get published contents: %v", err)
+		return
+	}
+
+	// Contents of the batch that expired since it was published
+	expired := false
+	if len(publishedBatches) != 0 && provider.contentExpiry {
+		var err error
+		expired, err = expiredSince(provider.db, firstContentID, provider.batchSize, publishedBatches[0].LastAdvertisement, time.Now())
+		if err != nil {
+			log.Errorf("Failed to check expired contents of batch: %v", err)
+			return
+		}
+		if expired && provider.removeExpiredBatch(ctx, log, publishedBatches[0]) {
+			return
+		}
+	}
+
+	// And check if it's...
+
+	// 1. fully advertised, or no changes, and advertised recently
+	// enough: do nothing
+	if len(publishedBatches) != 0 && !expired && !provider.needsRepublish(publishedBatches[0], count, entries, time.Now()) {
+		provider.backfillMultihashCount(log, &publishedBatches[0])
+		log.Debugf("Skipping already advertised batch")
+		return
+	}
+
+	// The batch size should always be the same unless the
+	// config changes
+	contextID, err := makeContextID(contextParams{
+		provider:       addrInfo.ID,
+		firstContentID: firstContentID,
+		count:          provider.batchSize,
+		subBatch:       subBatch,
+	})
+	if err != nil {
+		log.Errorf("Failed to make context ID: %v", err)
+		return
+	}
+
+	// 2. not advertised: notify put, create DB entry
+	if len(publishedBatches) == 0 {
+		// Ranges whose contents were all deleted are left unadvertised,
+		// the reaper would only remove them again
+		if err := provider.throttle(ctx); err != nil {
+			return
+		}
+		if entries, err := countLiveEntries(provider.db, firstContentID, provider.batchSize, provider.expiredBy(time.Now())); err == nil && entries == 0 {
+			log.Debugf("Skipping batch without contents")
+			return
+		}
+
+		adCid, mhCount, err := provider.notifyPut(ctx, addrInfo, contextID)
+		if err != nil {
+			// If there was an error, check whether already
+			// advertised
+			if errors.Is(err, providerpkg.ErrAlreadyAdvertised) {
+				// If so, try deleting it first...
+				log.Warnf("Batch was unexpectedly already advertised, removing old batch")
+				if removeAdCid, err := provider.engine.NotifyRemove(ctx, addrInfo.ID, contextID); err != nil {
+					log.Errorf("Failed to remove unexpected existing advertisement: %v", err)
+				} else {
+					provider.recordAdvertisement(handle, firstContentID, count, removeAdCid, true)
 				}
 
-				// The batch size should always be the same unless the
-				// config changes
-				contextID, err := makeContextID(contextParams{
-					provider:       addrInfo.ID,
-					firstContentID: firstContentID,
-					count:          provider.batchSize,
-				})
+				// ...and then re-advertise
+				_adCid, _mhCount, err := provider.notifyPut(ctx, addrInfo, contextID)
 				if err != nil {
-					log.Errorf("Failed to make context ID: %v", err)
-					continue
+					log.Errorf("Failed to publish batch after deleting unexpected existing advertisement: %v", err)
+					provider.recordBatchMetric(handle, metrics.AutoretrieveBatchesFailed)
+					return
 				}
 
-				// 2. not advertised: notify put, create DB entry, continue
-				if len(publishedBatches) == 0 {
-					adCid, err := provider.engine.NotifyPut(
-						ctx,
-						addrInfo,
-						contextID,
-						metadata.New(metadata.Bitswap{}),
-					)
-					if err != nil {
-						// If there was an error, check whether already
-						// advertised
-						if errors.Is(err, providerpkg.ErrAlreadyAdvertised) {
-							// If so, try deleting it first...
-							log.Warnf("Batch was unexpectedly already advertised, removing old batch")
-							if _, err := provider.engine.NotifyRemove(ctx, addrInfo.ID, contextID); err != nil {
-								log.Errorf("Failed to remove unexpected existing advertisement: %v", err)
-							}
-
-							// ...and then re-advertise
-							_adCid, err := provider.engine.NotifyPut(
-								ctx,
-								addrInfo,
-								contextID,
-								metadata.New(metadata.Bitswap{}),
-							)
-							if err != nil {
-								log.Errorf("Failed to publish batch after deleting unexpected existing advertisement: %v", err)
-								continue
-							}
-
-							adCid = _adCid
-						} else {
-							// Otherwise, fail out
-							log.Errorf("Failed to publish batch: %v", err)
-							continue
-						}
-					}
-
-					log.Infof("Published new batch with advertisement CID %s", adCid)
-					if err := provider.db.Create(&PublishedBatch{
-						FirstContentID:     firstContentID,
-						AutoretrieveHandle: autoretrieve.Handle,
-						Count:              count,
-					}).Error; err != nil {
-						log.Errorf("Failed to write batch to database: %v", err)
-					}
-					continue
-				}
+				adCid = _adCid
+				mhCount = _mhCount
+			} else {
+				// Otherwise, fail out
+				log.Errorf("Failed to publish batch: %v", err)
+				provider.recordBatchMetric(handle, metrics.AutoretrieveBatchesFailed)
+				return
+			}
+		}
 
-				// 3. incompletely advertised: delete and then notify put,
-				// update DB entry, continue
-				publishedBatch := publishedBatches[0]
-				if publishedBatch.Count != count {
-					oldAdCid, err := provider.engine.NotifyRemove(
-						ctx,
-						addrInfo.ID,
-						contextID,
-					)
-					if err != nil {
-						log.Warnf("Failed to remove batch (going to re-publish anyway): %v", err)
-					}
-					log.Infof("Removed old advertisement")
-
-					adCid, err := provider.engine.NotifyPut(
-						ctx,
-						addrInfo,
-						contextID,
-						metadata.New(metadata.Bitswap{}),
-					)
-					if err != nil {
-						log.Errorf("Failed to publish batch: %v", err)
-						continue
-					}
-
-					log.Infof("Updated incomplete batch with new ad CID %s (previously %s)", adCid, oldAdCid)
-					publishedBatch.Count = count
-					if err := provider.db.Save(&publishedBatch).Error; err != nil {
-						log.Errorf("Failed to update batch in database")
-					}
-					continue
-				}
+		log.Infof("Published new batch with advertisement CID %s", adCid)
+		provider.recordAdvertisement(handle, firstContentID, count, adCid, false)
+		provider.announce(ctx)
+		publishedBatch := PublishedBatch{
+			FirstContentID:     firstContentID,
+			SubBatch:           subBatch,
+			AutoretrieveHandle: handle,
+			Count:              count,
+			LastAdvertisement:  time.Now(),
+			ProviderID:         addrInfo.ID.String(),
+			MultihashCount:     mhCount,
+		}
+		if entries != nil {
+			publishedBatch.Entries = *entries
+		}
+		if err := provider.db.Create(&publishedBatch).Error; err != nil {
+			log.Errorf("Failed to write batch to database: %v", err)
+		}
+		return
+	}
+
+	// 3. incompletely advertised, advertised too long ago, or some
+	// of its contents expired: delete and then notify put, update DB
+	// entry
+	publishedBatch := publishedBatches[0]
+	if expired || provider.needsRepublish(publishedBatch, count, entries, time.Now()) {
+		if provider.retrievalFeedback != nil && provider.retrievalFeedback.Suppressed(handle, firstContentID, count) {
+			log.Infof("Skipping re-advertisement of batch with recent retrieval failures")
+			return
+		}
+
+		oldAdCid, err := provider.engine.NotifyRemove(
+			ctx,
+			addrInfo.ID,
+			contextID,
+		)
+		if err != nil {
+			log.Warnf("Failed to remove batch (going to re-publish anyway): %v", err)
+		} else {
+			log.Infof("Removed old advertisement")
+			provider.recordAdvertisement(handle, firstContentID, publishedBatch.Count, oldAdCid, true)
+		}
+
+		adCid, mhCount, err := provider.notifyPut(ctx, addrInfo, contextID)
+		if err != nil {
+			log.Errorf("Failed to publish batch: %v", err)
+			provider.recordBatchMetric(handle, metrics.AutoretrieveBatchesFailed)
+			return
+		}
+
+		log.Infof("Updated batch with new ad CID %s (previously %s)", adCid, oldAdCid)
+		provider.recordAdvertisement(handle, firstContentID, count, adCid, false)
+		provider.announce(ctx)
+		publishedBatch.Count = count
+		if entries != nil {
+			publishedBatch.Entries = *entries
+		}
+		publishedBatch.LastAdvertisement = time.Now()
+		publishedBatch.ProviderID = addrInfo.ID.String()
+		// a count of the previous advertisement would be stale
+		publishedBatch.MultihashCount = mhCount
+		if err := provider.db.Save(&publishedBatch).Error; err != nil {
+			log.Errorf("Failed to update batch in database")
+		}
+	}
+}
+
+// removeStaleSubBatches removes the advertisements of the sub-batches a batch
+// no longer has, once its entries shrank to fewer advertisements, and deletes
+// their rows
+func (provider *Provider) removeStaleSubBatches(ctx context.Context, log *zap.SugaredLogger, handle string, firstContentID uint64, subBatches uint64) {
+	var stale []PublishedBatch
+	if err := provider.db.Where(
+		"autoretrieve_handle = ? AND first_content_id = ? AND sub_batch >= ?",
+		handle,
+		firstContentID,
+		subBatches,
+	).Find(&stale).Error; err != nil {
+		log.Errorf("Failed to get stale sub-batches: %v", err)
+		return
+	}
+
+	for _, batch := range stale {
+		// kept for the next pass if the removal failed
+		if !provider.removeBatchAdvertisement(ctx, batch) {
+			continue
+		}
+		if err := provider.db.Unscoped().Delete(&PublishedBatch{}, batch.ID).Error; err != nil {
+			log.Errorf("Failed to delete stale sub-batch %d: %v", batch.SubBatch, err)
+			continue
+		}
+		log.Infof("Removed stale sub-batch %d", batch.SubBatch)
+	}
+}
+
+// PruneDeregistered deletes the published batches whose autoretrieve is no
+// longer registered, so the table doesn't grow forever. If notifyRemove is
+// set, the advertisements of the batches are removed from the indexer first.
+// It returns the amount of rows deleted.
+func (provider *Provider) PruneDeregistered(ctx context.Context, notifyRemove bool) (int64, error) {
+	var orphaned []PublishedBatch
+	if err := provider.db.Where(
+		"autoretrieve_handle NOT IN (?)",
+		provider.db.Model(&Autoretrieve{}).Select("handle"),
+	).Find(&orphaned).Error; err != nil {
+		return 0, err
+	}
+
+	if len(orphaned) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]uint, 0, len(orphaned))
+	for _, batch := range orphaned {
+		if notifyRemove {
+			provider.removeBatchAdvertisement(ctx, batch)
+		}
+		ids = append(ids, batch.ID)
+	}
+
+	res := provider.db.Unscoped().Delete(&PublishedBatch{}, ids)
+	return res.RowsAffected, res.Error
+}
+
+// removeBatchAdvertisement removes the advertisement of a published batch
+// from the indexer, it returns false if the removal failed and may be retried
+func (provider *Provider) removeBatchAdvertisement(ctx context.Context, batch PublishedBatch) bool {
+	log := log.With("autoretrieve_handle", batch.AutoretrieveHandle, "first_content_id", batch.FirstContentID)
+
+	// Batches published before the peer ID was recorded can't be removed,
+	// they will expire on the indexer side instead
+	if batch.ProviderID == "" {
+		log.Debugf("Not removing batch with unknown provider peer ID")
+		return true
+	}
+
+	providerID, err := peer.Decode(batch.ProviderID)
+	if err != nil {
+		log.Warnf("Failed to decode provider peer ID: %v", err)
+		return true
+	}
+
+	contextID, err := makeContextID(contextParams{
+		provider:       providerID,
+		firstContentID: batch.FirstContentID,
+		count:          provider.batchSize,
+		subBatch:       batch.SubBatch,
+	})
+	if err != nil {
+		log.Warnf("Failed to make context ID: %v", err)
+		return true
+	}
+
+	adCid, err := provider.engine.NotifyRemove(ctx, providerID, contextID)
+	if err != nil {
+		log.Warnf("Failed to remove advertisement: %v", err)
+		return false
+	}
+	provider.recordAdvertisement(batch.AutoretrieveHandle, batch.FirstContentID, batch.Count, adCid, true)
+	provider.announce(ctx)
+	return true
+}
+
+// announce sends the latest advertisement to each of the indexers directly,
+// a failure to reach one of them doesn't prevent announcing to the others.
+// Removals that are immediately followed by a put are not announced on their
+// own, since indexers sync the whole chain from the latest advertisement.
+func (provider *Provider) announce(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range provider.indexerURLs {
+		wg.Add(1)
+		go func(u *url.URL) {
+			defer wg.Done()
+
+			adCid, err := provider.engine.PublishLatestHTTP(ctx, u)
+			if err != nil {
+				log.With("indexer_url", u).Warnf("Failed to announce advertisement: %v", err)
+				return
 			}
+			log.With("indexer_url", u).Debugf("Announced advertisement %s", adCid)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// getLastContentID returns the highest content ID, found is false if there are
+// no contents yet
+func getLastContentID(db *gorm.DB) (id uint64, found bool, err error) {
+	var lastContent util.Content
+	if err := db.Last(&lastContent).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, false, nil
 		}
+		return 0, false, err
 	}
+	return lastContent.ID, true, nil
+}
 
-	return nil
+// coldBatchPolicy advances the tick counter and reports whether batches of
+// only old content are checked this tick. Batches ending before
+// firstRecentContentID contain only content older than the recent age.
+func (provider *Provider) coldBatchPolicy(now time.Time) (checkCold bool, firstRecentContentID uint64, err error) {
+	tick := provider.tick
+	provider.tick++
+
+	if provider.recentContentAge == 0 || provider.coldBatchTicks == 0 || tick%provider.coldBatchTicks == 0 {
+		return true, 0, nil
+	}
+
+	id, found, err := getFirstContentIDSince(provider.db, now.Add(-provider.recentContentAge))
+	if err != nil {
+		return false, 0, err
+	}
+	if !found {
+		// Everything is old, nothing is checked until the next cold tick
+		return false, ^uint64(0), nil
+	}
+	return false, id, nil
+}
+
+// getFirstContentIDSince returns the lowest ID of the contents created after
+// since, found is false if there are none
+func getFirstContentIDSince(db *gorm.DB, since time.Time) (id uint64, found bool, err error) {
+	var content util.Content
+	if err := db.Where("created_at > ?", since).Order("id asc").First(&content).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return content.ID, true, nil
+}
+
+// holdBatch reports whether an incomplete batch is held back from
+// advertisement until it fills up further
+func (provider *Provider) holdBatch(firstContentID uint64, count uint64, now time.Time) (bool, error) {
+	if provider.minBatchFill == 0 || count >= provider.batchSize {
+		return false, nil
+	}
+	if float64(count)/float64(provider.batchSize) >= provider.minBatchFill {
+		return false, nil
+	}
+	if provider.minBatchFillMaxAge == 0 {
+		return true, nil
+	}
+
+	var contents []util.Content
+	if err := provider.db.Where("id >= ? AND id < ?", firstContentID, firstContentID+provider.batchSize).Order("id asc").Limit(1).Find(&contents).Error; err != nil {
+		return false, err
+	}
+	if len(contents) == 0 {
+		return true, nil
+	}
+	return now.Sub(contents[0].CreatedAt) <= provider.minBatchFillMaxAge, nil
+}
+
+// batchCount returns the amount of contents in the batch starting at
+// firstContentID
+func batchCount(firstContentID uint64, lastContentID uint64, batchSize uint64) uint64 {
+	count := batchSize
+	remaining := lastContentID - firstContentID
+	if remaining < count {
+		count = remaining
+	}
+	return count
+}
+
+// CoverageGaps returns the first content IDs of the batches in
+// [0, lastContentID] that have not been completely advertised for the
+// autoretrieve, i.e. the batches the advertisement loop would still publish
+func CoverageGaps(db *gorm.DB, handle string, lastContentID uint64, batchSize uint64) ([]uint64, error) {
+	var publishedBatches []PublishedBatch
+	if err := db.Where("autoretrieve_handle = ?", handle).Find(&publishedBatches).Error; err != nil {
+		return nil, err
+	}
+
+	published := make(map[uint64]uint64, len(publishedBatches))
+	for _, batch := range publishedBatches {
+		published[batch.FirstContentID] = batch.Count
+	}
+
+	var gaps []uint64
+	for firstContentID := uint64(0); firstContentID <= lastContentID; firstContentID += batchSize {
+		count, ok := published[firstContentID]
+		if !ok || count != batchCount(firstContentID, lastContentID, batchSize) {
+			gaps = append(gaps, firstContentID)
+		}
+	}
+	return gaps, nil
+}
+
+// recordAdvertisement counts an advertisement produced for a batch in the
+// metrics and stores its CID in the batch's history, failures are only logged
+// as the history is informational
+func (provider *Provider) recordAdvertisement(handle string, firstContentID uint64, count uint64, adCid cid.Cid, removal bool) {
+	if removal {
+		provider.recordBatchMetric(handle, metrics.AutoretrieveBatchesRemoved)
+	} else {
+		provider.recordBatchMetric(handle, metrics.AutoretrieveBatchesPublished)
+	}
+
+	if err := provider.db.Create(&AdvertisementHistory{
+		AutoretrieveHandle: handle,
+		FirstContentID:     firstContentID,
+		Count:              count,
+		AdCid:              util.DbCID{CID: adCid},
+		Removal:            removal,
+	}).Error; err != nil {
+		log.Errorf("Failed to record advertisement %s in history: %v", adCid, err)
+	}
+}
+
+// AdvertisementHistory returns the advertisements published or removed for
+// the batch starting at firstContentID, oldest first
+func (provider *Provider) AdvertisementHistory(handle string, firstContentID uint64) ([]AdvertisementHistory, error) {
+	var history []AdvertisementHistory
+	if err := provider.db.Where(
+		"autoretrieve_handle = ? AND first_content_id = ?",
+		handle,
+		firstContentID,
+	).Order("created_at asc, id asc").Find(&history).Error; err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// IsContentAdvertised reports whether the content's multihashes are in a
+// currently published advertisement for the autoretrieve: the batch holding
+// the content was published for it since the content was added, and none of
+// the batch's advertisements is due for a refresh. It also returns the CID of
+// the batch's latest advertisement, undefined for batches published before the
+// history was recorded.
+func (provider *Provider) IsContentAdvertised(handle string, contID uint64) (bool, cid.Cid, error) {
+	firstContentID := contID - contID%provider.batchSize
+
+	var publishedBatches []PublishedBatch
+	if err := provider.db.Where(
+		"autoretrieve_handle = ? AND first_content_id = ?",
+		handle,
+		firstContentID,
+	).Find(&publishedBatches).Error; err != nil {
+		return false, cid.Undef, err
+	}
+	if len(publishedBatches) == 0 {
+		return false, cid.Undef, nil
+	}
+
+	now := time.Now()
+	for _, batch := range publishedBatches {
+		// The batch was last published before the content was added, or has
+		// expired on the indexer side
+		if batch.FirstContentID+batch.Count < contID || provider.needsRefresh(batch, now) {
+			return false, cid.Undef, nil
+		}
+	}
+
+	var history []AdvertisementHistory
+	if err := provider.db.Where(
+		"autoretrieve_handle = ? AND first_content_id = ?",
+		handle,
+		firstContentID,
+	).Order("created_at desc, id desc").Limit(1).Find(&history).Error; err != nil {
+		return false, cid.Undef, err
+	}
+	if len(history) == 0 {
+		return true, cid.Undef, nil
+	}
+	if history[0].Removal {
+		return false, cid.Undef, nil
+	}
+	return true, history[0].AdCid.CID, nil
+}
+
+// needsRefresh reports whether the batch's advertisement is old enough that it
+// should be re-announced before the indexer expires it
+func (provider *Provider) needsRefresh(batch PublishedBatch, now time.Time) bool {
+	return provider.refreshInterval != 0 && now.Sub(batch.LastAdvertisement) > provider.refreshInterval
 }
 
 func (provider *Provider) Stop() error {
@@ -433,14 +1339,33 @@ type contextParams struct {
 	provider       peer.ID
 	firstContentID uint64
 	count          uint64
+	subBatch       uint64
 }
 
+// Marks a context ID of a sub-batch other than the first, the byte it takes
+// is otherwise the first of the peer ID's multihash code, which is never 0xff
+const subBatchMarker = 0xff
+
 // Content ID to context ID
+//
+// Sub-batch 0 uses the same context ID as an unsplit batch, so batches keep
+// their advertisement when they start being split
 func makeContextID(params contextParams) ([]byte, error) {
+	if params.firstContentID > maxContextIDValue || params.count > maxContextIDValue || params.subBatch > maxContextIDValue {
+		return nil, fmt.Errorf("context params out of range (first content ID: %d, count: %d, sub-batch: %d)", params.firstContentID, params.count, params.subBatch)
+	}
+
 	contextID := make([]byte, 8)
 	binary.BigEndian.PutUint32(contextID[0:4], uint32(params.firstContentID))
 	binary.BigEndian.PutUint32(contextID[4:8], uint32(params.count))
 
+	if params.subBatch != 0 {
+		subBatch := make([]byte, 5)
+		subBatch[0] = subBatchMarker
+		binary.BigEndian.PutUint32(subBatch[1:5], uint32(params.subBatch))
+		contextID = append(contextID, subBatch...)
+	}
+
 	peerIDBytes, err := params.provider.MarshalBinary()
 	if err != nil {
 		return nil, fmt.Errorf("failed to write context peer ID: %v", err)
@@ -451,7 +1376,21 @@ func makeContextID(params contextParams) ([]byte, error) {
 
 // Context ID to content ID
 func readContextID(contextID []byte) (contextParams, error) {
-	peerID, err := peer.IDFromBytes(contextID[8:])
+	if len(contextID) < 9 {
+		return contextParams{}, fmt.Errorf("context ID too short (%d bytes)", len(contextID))
+	}
+
+	peerIDBytes := contextID[8:]
+	var subBatch uint64
+	if peerIDBytes[0] == subBatchMarker {
+		if len(peerIDBytes) < 6 {
+			return contextParams{}, fmt.Errorf("sub-batch context ID too short (%d bytes)", len(contextID))
+		}
+		subBatch = uint64(binary.BigEndian.Uint32(peerIDBytes[1:5]))
+		peerIDBytes = peerIDBytes[5:]
+	}
+
+	peerID, err := peer.IDFromBytes(peerIDBytes)
 	if err != nil {
 		return contextParams{}, fmt.Errorf("failed to read context peer ID: %v", err)
 	}
@@ -460,5 +1399,6 @@ func readContextID(contextID []byte) (contextParams, error) {
 		provider:       peerID,
 		firstContentID: uint64(uint(binary.BigEndian.Uint32(contextID[0:4]))),
 		count:          uint64(uint(binary.BigEndian.Uint32(contextID[4:8]))),
+		subBatch:       subBatch,
 	}, nil
 }
@@ -0,0 +1,1613 @@
+package autoretrieve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	providerpkg "github.com/filecoin-project/index-provider"
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t testing.TB) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// obj_refs indexes are created concurrently on postgres, which sqlite
+	// doesn't support, so the tables are created by hand
+	if err := db.Exec("CREATE TABLE objects (id integer primary key, cid blob, size integer, reads integer, last_access datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE TABLE obj_refs (id integer primary key, content integer, object integer, offloaded integer)").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE INDEX idx_obj_refs_content ON obj_refs (content)").Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// insertObjects creates objectsPerContent objects for each of the contents
+// in [1, contents], returning the multihashes in insertion order
+func insertObjects(t testing.TB, db *gorm.DB, contents int, objectsPerContent int) []multihash.Multihash {
+	var mhs []multihash.Multihash
+	for contID := 1; contID <= contents; contID++ {
+		objects := make([]*util.Object, 0, objectsPerContent)
+		for i := 0; i < objectsPerContent; i++ {
+			mh, err := multihash.Sum([]byte(fmt.Sprintf("%d-%d", contID, i)), multihash.SHA2_256, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mhs = append(mhs, mh)
+			objects = append(objects, &util.Object{Cid: util.DbCID{CID: cid.NewCidV1(cid.Raw, mh)}})
+		}
+
+		if err := db.CreateInBatches(objects, 500).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		refs := make([]util.ObjRef, 0, len(objects))
+		for _, o := range objects {
+			refs = append(refs, util.ObjRef{Content: uint64(contID), Object: o.ID})
+		}
+		if err := db.CreateInBatches(refs, 500).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mhs
+}
+
+func drain(t testing.TB, iter *Iterator) []multihash.Multihash {
+	var mhs []multihash.Multihash
+	for {
+		mh, err := iter.Next()
+		if err == io.EOF {
+			return mhs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		mhs = append(mhs, mh)
+	}
+}
+
+func TestIteratorStrategiesMatch(t *testing.T) {
+	db := setupTestDB(t)
+	mhs := insertObjects(t, db, 20, 10)
+
+	joined, err := NewIterator(db, 1, 20, ObjRefStrategyJoin)
+	assert.NoError(t, err)
+
+	twoStep, err := NewIterator(db, 1, 20, ObjRefStrategyTwoStep)
+	assert.NoError(t, err)
+
+	assert.ElementsMatch(t, mhs, drain(t, joined))
+	assert.ElementsMatch(t, mhs, drain(t, twoStep))
+}
+
+func TestParseObjRefStrategy(t *testing.T) {
+	strategy, err := ParseObjRefStrategy("")
+	assert.NoError(t, err)
+	assert.Equal(t, ObjRefStrategyJoin, strategy)
+
+	strategy, err = ParseObjRefStrategy("two-step")
+	assert.NoError(t, err)
+	assert.Equal(t, ObjRefStrategyTwoStep, strategy)
+
+	_, err = ParseObjRefStrategy("nested-loop")
+	assert.Error(t, err)
+}
+
+// Compare the strategies with e.g.
+//
+//	go test ./autoretrieve -run '^$' -bench BenchmarkIterator -benchmem
+//
+// sqlite only gives a rough idea, the difference that matters is the one
+// measured against the production postgres, where the planner may pick a
+// very different plan for the join
+func BenchmarkIterator(b *testing.B) {
+	for _, strategy := range []ObjRefStrategy{ObjRefStrategyJoin, ObjRefStrategyTwoStep} {
+		b.Run(string(strategy), func(b *testing.B) {
+			db := setupTestDB(b)
+			insertObjects(b, db, 100, 200)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := NewIterator(db, 1, 100, strategy); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNeedsRefresh(t *testing.T) {
+	now := time.Now()
+	provider := &Provider{refreshInterval: time.Hour}
+
+	stale := PublishedBatch{Count: 10, LastAdvertisement: now.Add(-2 * time.Hour)}
+	fresh := PublishedBatch{Count: 10, LastAdvertisement: now.Add(-time.Minute)}
+
+	assert.True(t, provider.needsRefresh(stale, now), "stale batch should be refreshed")
+	assert.False(t, provider.needsRefresh(fresh, now), "fresh batch should be skipped")
+
+	provider.refreshInterval = 0
+	assert.False(t, provider.needsRefresh(stale, now), "refreshing is disabled")
+}
+
+func TestRefreshStaleBatch(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}, &AdvertisementHistory{}))
+	insertObjects(t, db, 4, 2)
+
+	eng := &mockEngine{}
+	provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng), WithRefreshInterval(time.Hour))
+	assert.NoError(t, err)
+	provider.batchSize = 10
+
+	id, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	addrInfo := &peer.AddrInfo{ID: id}
+	ctx := context.Background()
+	log := zap.NewNop().Sugar()
+
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 1)
+
+	// advertised within the refresh interval: left alone
+	assert.NoError(t, db.Model(&PublishedBatch{}).Where("first_content_id = ?", 0).UpdateColumn("last_advertisement", time.Now().Add(-time.Minute)).Error)
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 1)
+	assert.Empty(t, eng.removes)
+
+	// unchanged but advertised too long ago: removed and put again under the same context ID
+	assert.NoError(t, db.Model(&PublishedBatch{}).Where("first_content_id = ?", 0).UpdateColumn("last_advertisement", time.Now().Add(-2*time.Hour)).Error)
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	if assert.Len(t, eng.puts, 2) && assert.Len(t, eng.removes, 1) {
+		assert.Equal(t, eng.puts[0], eng.removes[0])
+		assert.Equal(t, eng.puts[0], eng.puts[1])
+	}
+
+	var batch PublishedBatch
+	assert.NoError(t, db.First(&batch).Error)
+	assert.WithinDuration(t, time.Now(), batch.LastAdvertisement, time.Minute, "the refresh is recorded")
+}
+
+func TestLookbackCatchesLateObjRefs(t *testing.T) {
+	db := setupTestDB(t)
+	insertObjects(t, db, 25, 2)
+
+	now := time.Now()
+	provider := &Provider{batchSize: 10, lookbackBatches: 2, refreshInterval: time.Hour}
+
+	// last content is 25, so the batches starting at 20 and 10 are within the lookback
+	assert.True(t, provider.inLookback(20, 25))
+	assert.True(t, provider.inLookback(10, 25))
+	assert.False(t, provider.inLookback(0, 25))
+
+	entries, err := countEntries(db, 20, 5)
+	assert.NoError(t, err)
+	published := PublishedBatch{FirstContentID: 20, Count: 5, Entries: entries, LastAdvertisement: now}
+	assert.False(t, provider.needsRepublish(published, 5, &entries, now))
+
+	// an obj_ref of content 25 written after the batch was published
+	mh, err := multihash.Sum([]byte("late"), multihash.SHA2_256, -1)
+	assert.NoError(t, err)
+	late := &util.Object{Cid: util.DbCID{CID: cid.NewCidV1(cid.Raw, mh)}}
+	assert.NoError(t, db.Create(late).Error)
+	assert.NoError(t, db.Create(&util.ObjRef{Content: 25, Object: late.ID}).Error)
+
+	recounted, err := countEntries(db, 20, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, entries+1, recounted)
+	assert.True(t, provider.needsRepublish(published, 5, &recounted, now), "late obj_ref is re-published")
+
+	// outside of the lookback, only the content count is compared
+	assert.False(t, provider.needsRepublish(published, 5, nil, now))
+}
+
+func TestIsOffline(t *testing.T) {
+	now := time.Now()
+	provider := &Provider{advertisementInterval: time.Minute, offlineGrace: 5 * time.Minute}
+
+	assert.False(t, provider.isOffline(now.Add(-30*time.Second), now), "heartbeat within the interval")
+	assert.False(t, provider.isOffline(now.Add(-2*time.Minute), now), "missed heartbeat within the grace period")
+	assert.True(t, provider.isOffline(now.Add(-10*time.Minute), now), "missed heartbeats past the grace period")
+
+	provider.offlineGrace = 0
+	assert.True(t, provider.isOffline(now.Add(-2*time.Minute), now), "no grace period")
+}
+
+func TestAdvertisementHistory(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&AdvertisementHistory{}))
+
+	provider := &Provider{db: db}
+
+	var adCids []cid.Cid
+	for i := 0; i < 3; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("ad-%d", i)), multihash.SHA2_256, -1)
+		assert.NoError(t, err)
+		adCids = append(adCids, cid.NewCidV1(cid.DagJSON, mh))
+	}
+
+	provider.recordAdvertisement("ar-1", 0, 10, adCids[0], false)
+	provider.recordAdvertisement("ar-1", 0, 10, adCids[1], true)
+	provider.recordAdvertisement("ar-1", 25000, 3, adCids[2], false)
+
+	history, err := provider.AdvertisementHistory("ar-1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, adCids[0], history[0].AdCid.CID)
+	assert.False(t, history[0].Removal)
+	assert.Equal(t, adCids[1], history[1].AdCid.CID)
+	assert.True(t, history[1].Removal)
+
+	history, err = provider.AdvertisementHistory("ar-2", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestIsContentAdvertised(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}, &AdvertisementHistory{}))
+
+	provider := &Provider{db: db, batchSize: 10, refreshInterval: time.Hour}
+
+	var adCids []cid.Cid
+	for i := 0; i < 3; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("ad-%d", i)), multihash.SHA2_256, -1)
+		assert.NoError(t, err)
+		adCids = append(adCids, cid.NewCidV1(cid.DagJSON, mh))
+	}
+
+	now := time.Now()
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10, LastAdvertisement: now},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, Count: 4, LastAdvertisement: now},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 20, Count: 10, LastAdvertisement: now.Add(-2 * time.Hour)},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 30, Count: 10, LastAdvertisement: now},
+	}).Error)
+	provider.recordAdvertisement("ar-1", 0, 10, adCids[0], false)
+	provider.recordAdvertisement("ar-1", 0, 10, adCids[1], false)
+	provider.recordAdvertisement("ar-1", 30, 10, adCids[2], true)
+
+	advertised, adCid, err := provider.IsContentAdvertised("ar-1", 7)
+	assert.NoError(t, err)
+	assert.True(t, advertised)
+	assert.Equal(t, adCids[1], adCid)
+
+	// published before the history was recorded
+	advertised, adCid, err = provider.IsContentAdvertised("ar-1", 12)
+	assert.NoError(t, err)
+	assert.True(t, advertised)
+	assert.Equal(t, cid.Undef, adCid)
+
+	// added after the batch was published
+	advertised, _, err = provider.IsContentAdvertised("ar-1", 16)
+	assert.NoError(t, err)
+	assert.False(t, advertised)
+
+	// the advertisement is stale
+	advertised, _, err = provider.IsContentAdvertised("ar-1", 25)
+	assert.NoError(t, err)
+	assert.False(t, advertised)
+
+	// the advertisement was removed
+	advertised, _, err = provider.IsContentAdvertised("ar-1", 35)
+	assert.NoError(t, err)
+	assert.False(t, advertised)
+
+	advertised, _, err = provider.IsContentAdvertised("ar-2", 7)
+	assert.NoError(t, err)
+	assert.False(t, advertised)
+}
+
+func TestCoverageGaps(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}))
+
+	// batches start at 0, 10, 20 and 30; the last one holds 5 contents
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, Count: 4},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 30, Count: 5},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 20, Count: 10},
+	}).Error)
+
+	gaps, err := CoverageGaps(db, "ar-1", 35, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{10, 20}, gaps)
+
+	gaps, err = CoverageGaps(db, "ar-3", 35, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 10, 20, 30}, gaps)
+}
+
+func TestGetLastContentID(t *testing.T) {
+	db := setupTestDB(t)
+
+	// the contents table doesn't exist yet, which must be reported as an
+	// error rather than as nothing to advertise
+	_, found, err := getLastContentID(db)
+	assert.Error(t, err)
+	assert.False(t, found)
+
+	if err := db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, err = getLastContentID(db)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Exec("INSERT INTO contents (created_at, updated_at) VALUES (?, ?)", time.Now(), time.Now()).Error)
+	}
+
+	id, found, err := getLastContentID(db)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint64(3), id)
+}
+
+func TestNewIteratorFromCIDs(t *testing.T) {
+	var cids []cid.Cid
+	var mhs []multihash.Multihash
+	for i := 0; i < 5; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("cid-%d", i)), multihash.SHA2_256, -1)
+		assert.NoError(t, err)
+		mhs = append(mhs, mh)
+		cids = append(cids, cid.NewCidV1(cid.Raw, mh))
+	}
+	cids = append(cids, cid.Undef)
+
+	assert.Equal(t, mhs, drain(t, NewIteratorFromCIDs(cids)))
+	assert.Empty(t, drain(t, NewIteratorFromCIDs(nil)))
+}
+
+func TestIteratorLenReset(t *testing.T) {
+	var cids []cid.Cid
+	for i := 0; i < 3; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("cid-%d", i)), multihash.SHA2_256, -1)
+		assert.NoError(t, err)
+		cids = append(cids, cid.NewCidV1(cid.Raw, mh))
+	}
+
+	iter := NewIteratorFromCIDs(cids)
+	assert.Equal(t, 3, iter.Len())
+
+	first := drain(t, iter)
+	assert.Len(t, first, 3)
+	assert.Equal(t, 3, iter.Len())
+
+	// a drained iterator replays the same multihashes once reset
+	iter.Reset()
+	assert.Equal(t, first, drain(t, iter))
+
+	// and so does a partly read one
+	iter.Reset()
+	_, err := iter.Next()
+	assert.NoError(t, err)
+	iter.Reset()
+	assert.Equal(t, first, drain(t, iter))
+
+	assert.Equal(t, 0, NewIteratorFromCIDs(nil).Len())
+}
+
+func TestPruneDeregistered(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}, &PublishedBatch{}))
+
+	assert.NoError(t, db.Create(&Autoretrieve{Handle: "ar-1", Token: "token-1", PubKey: "key-1"}).Error)
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 10, Count: 3},
+	}).Error)
+
+	provider := &Provider{db: db, batchSize: 10}
+
+	pruned, err := provider.PruneDeregistered(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), pruned)
+
+	var remaining []PublishedBatch
+	assert.NoError(t, db.Unscoped().Find(&remaining).Error)
+	assert.Len(t, remaining, 1)
+	assert.Equal(t, "ar-1", remaining[0].AutoretrieveHandle)
+
+	pruned, err = provider.PruneDeregistered(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pruned)
+}
+
+func TestProviderStats(t *testing.T) {
+	provider := &Provider{advertisementInterval: time.Minute}
+	assert.False(t, provider.Stats().Healthy, "loop is not running")
+
+	provider.startTick()
+	assert.True(t, provider.Stats().Healthy, "first tick is still within the interval")
+
+	provider.setCursor("ar-1", 25000)
+	provider.finishTick(fmt.Errorf("db is down"))
+	stats := provider.Stats()
+	assert.Equal(t, "db is down", stats.LastError)
+	assert.Equal(t, "ar-1", stats.CursorHandle)
+	assert.Equal(t, uint64(25000), stats.CursorContentID)
+	assert.True(t, stats.LastTickCompleted.IsZero())
+
+	// no tick completed for more than twice the interval
+	provider.runningSince = time.Now().Add(-3 * time.Minute)
+	assert.False(t, provider.Stats().Healthy)
+
+	provider.startTick()
+	provider.finishTick(nil)
+	assert.True(t, provider.Stats().Healthy)
+
+	provider.stopped()
+	assert.False(t, provider.Stats().Healthy)
+}
+
+func TestColdBatchPolicy(t *testing.T) {
+	db := setupTestDB(t)
+	if err := db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, createdAt := range []time.Time{now.Add(-48 * time.Hour), now.Add(-48 * time.Hour), now.Add(-time.Hour)} {
+		assert.NoError(t, db.Exec("INSERT INTO contents (created_at, updated_at) VALUES (?, ?)", createdAt, createdAt).Error)
+	}
+
+	provider := &Provider{db: db, recentContentAge: 24 * time.Hour, coldBatchTicks: 3}
+
+	// the first tick checks everything
+	checkCold, _, err := provider.coldBatchPolicy(now)
+	assert.NoError(t, err)
+	assert.True(t, checkCold)
+
+	checkCold, firstRecent, err := provider.coldBatchPolicy(now)
+	assert.NoError(t, err)
+	assert.False(t, checkCold)
+	assert.Equal(t, uint64(3), firstRecent)
+
+	_, _, err = provider.coldBatchPolicy(now)
+	assert.NoError(t, err)
+
+	checkCold, _, err = provider.coldBatchPolicy(now)
+	assert.NoError(t, err)
+	assert.True(t, checkCold, "every third tick checks cold batches")
+
+	// without recent content, nothing but cold ticks check batches
+	checkCold, firstRecent, err = provider.coldBatchPolicy(now.Add(48 * time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, checkCold)
+	assert.Equal(t, ^uint64(0), firstRecent)
+
+	disabled := &Provider{db: db, coldBatchTicks: 3}
+	for i := 0; i < 3; i++ {
+		checkCold, _, err := disabled.coldBatchPolicy(now)
+		assert.NoError(t, err)
+		assert.True(t, checkCold)
+	}
+}
+
+func TestSubBatches(t *testing.T) {
+	db := setupTestDB(t)
+	mhs := insertObjects(t, db, 20, 10)
+
+	// 200 multihashes with a cap of 75 are split over 3 advertisements
+	entries, err := countEntries(db, 1, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200), entries)
+	subBatches := subBatchCount(entries, 75)
+	assert.Equal(t, uint64(3), subBatches)
+	assert.Equal(t, uint64(1), subBatchCount(entries, 0))
+	assert.Equal(t, uint64(1), subBatchCount(entries, 200))
+
+	pid, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+
+	var all []multihash.Multihash
+	contextIDs := make(map[string]bool)
+	for subBatch := uint64(0); subBatch < subBatches; subBatch++ {
+		params := contextParams{provider: pid, firstContentID: 1, count: 20, subBatch: subBatch}
+		contextID, err := makeContextID(params)
+		assert.NoError(t, err)
+		contextIDs[string(contextID)] = true
+
+		read, err := readContextID(contextID)
+		assert.NoError(t, err)
+		assert.Equal(t, params, read)
+
+		iter, err := NewIterator(db, read.firstContentID, read.count, ObjRefStrategyJoin)
+		assert.NoError(t, err)
+		iter.limitToSubBatch(read.subBatch, 75)
+		got := drain(t, iter)
+		assert.LessOrEqual(t, len(got), 75)
+		all = append(all, got...)
+	}
+
+	assert.Len(t, contextIDs, 3, "each sub-batch is advertised under its own context ID")
+	assert.ElementsMatch(t, mhs, all)
+
+	// the first sub-batch keeps the context ID of an unsplit batch
+	unsplit, err := makeContextID(contextParams{provider: pid, firstContentID: 1, count: 20})
+	assert.NoError(t, err)
+	assert.True(t, contextIDs[string(unsplit)])
+}
+
+func TestReapEmptyBatches(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}))
+	insertObjects(t, db, 20, 2)
+
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, Count: 10},
+		// the contents of this range were deleted
+		{AutoretrieveHandle: "ar-1", FirstContentID: 30, Count: 10},
+	}).Error)
+
+	provider := &Provider{db: db, batchSize: 10, reapPace: time.Millisecond}
+
+	reaped, err := provider.ReapEmptyBatches(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), reaped)
+
+	var remaining []PublishedBatch
+	assert.NoError(t, db.Unscoped().Order("first_content_id asc").Find(&remaining).Error)
+	if assert.Len(t, remaining, 2) {
+		assert.Equal(t, uint64(0), remaining[0].FirstContentID)
+		assert.Equal(t, uint64(10), remaining[1].FirstContentID)
+	}
+}
+
+func testPubKey(t testing.TB) string {
+	_, pub, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.ConfigEncodeKey(b)
+}
+
+func TestRegistryRoundTrip(t *testing.T) {
+	src := setupTestDB(t)
+	assert.NoError(t, src.AutoMigrate(&Autoretrieve{}))
+
+	lastConnection := time.Now().UTC().Truncate(time.Second)
+	assert.NoError(t, src.Create(&[]Autoretrieve{
+		{Handle: "ar-1", Token: "token-1", PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6746", LastConnection: lastConnection},
+		{Handle: "ar-2", Token: "token-2", PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6747,/ip6/::1/tcp/6747"},
+	}).Error)
+
+	dump, err := ExportRegistry(src)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(dump), "token-")
+
+	dst, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s-dst?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, dst.AutoMigrate(&Autoretrieve{}))
+	// already registered in the destination, kept as is
+	assert.NoError(t, dst.Create(&Autoretrieve{Handle: "ar-2", Token: "token-existing", PubKey: testPubKey(t)}).Error)
+
+	imported, err := ImportRegistry(dst, dump)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, imported)
+
+	var ar Autoretrieve
+	assert.NoError(t, dst.First(&ar, "handle = ?", "ar-1").Error)
+	assert.Equal(t, "/ip4/127.0.0.1/tcp/6746", ar.Addresses)
+	assert.True(t, lastConnection.Equal(ar.LastConnection))
+	assert.NotEmpty(t, ar.Token)
+	assert.NotEqual(t, "token-1", ar.Token)
+
+	var existing Autoretrieve
+	assert.NoError(t, dst.First(&existing, "handle = ?", "ar-2").Error)
+	assert.Equal(t, "token-existing", existing.Token)
+
+	// importing again is a no-op
+	imported, err = ImportRegistry(dst, dump)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+
+	invalid := []byte(fmt.Sprintf(`[{"handle":"ar-3","pubKey":%q,"addresses":"not-a-multiaddr"}]`, testPubKey(t)))
+	_, err = ImportRegistry(dst, invalid)
+	assert.ErrorIs(t, err, ErrInvalidRegistry)
+	assert.Error(t, dst.First(&Autoretrieve{}, "handle = ?", "ar-3").Error)
+}
+
+func TestPauseAutoretrieve(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}, &PublishedBatch{}))
+
+	assert.NoError(t, db.Create(&[]Autoretrieve{
+		{Handle: "ar-1", Token: "token-1", PubKey: "key-1"},
+		{Handle: "ar-2", Token: "token-2", PubKey: "key-2"},
+	}).Error)
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, Count: 10},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 0, Count: 10},
+	}).Error)
+
+	assert.NoError(t, PauseAutoretrieve(db, "ar-1"))
+	assert.ErrorIs(t, PauseAutoretrieve(db, "unknown"), gorm.ErrRecordNotFound)
+
+	var paused Autoretrieve
+	assert.NoError(t, db.First(&paused, "handle = ?", "ar-1").Error)
+	assert.True(t, paused.Paused)
+	var other Autoretrieve
+	assert.NoError(t, db.First(&other, "handle = ?", "ar-2").Error)
+	assert.False(t, other.Paused)
+
+	// batches without a recorded peer ID need no removal and are deleted right away
+	provider := &Provider{db: db, batchSize: 10}
+	removed, err := provider.removePausedBatches(context.Background(), "ar-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), removed)
+
+	var remaining []PublishedBatch
+	assert.NoError(t, db.Unscoped().Find(&remaining).Error)
+	if assert.Len(t, remaining, 1) {
+		assert.Equal(t, "ar-2", remaining[0].AutoretrieveHandle)
+	}
+
+	assert.NoError(t, ResumeAutoretrieve(db, "ar-1"))
+	assert.NoError(t, db.First(&paused, "handle = ?", "ar-1").Error)
+	assert.False(t, paused.Paused)
+}
+
+func TestVerifyAdvertised(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}))
+	mhs := insertObjects(t, db, 5, 2)
+
+	ar := Autoretrieve{Handle: "ar-1", Token: "token-1", PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6746"}
+	assert.NoError(t, db.Create(&ar).Error)
+	ours, err := ar.AddrInfo()
+	assert.NoError(t, err)
+	other, err := (&Autoretrieve{PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6747"}).AddrInfo()
+	assert.NoError(t, err)
+
+	providers := map[string]*peer.AddrInfo{
+		mhs[0].B58String(): ours,
+		mhs[1].B58String(): other,
+	}
+	indexer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ai, ok := providers[strings.TrimPrefix(r.URL.Path, "/multihash/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"MultihashResults": []interface{}{
+				map[string]interface{}{"ProviderResults": []interface{}{map[string]interface{}{"Provider": ai}}},
+			},
+		})
+	}))
+	defer indexer.Close()
+
+	provider := &Provider{db: db, batchSize: 10, objRefStrategy: ObjRefStrategyJoin}
+
+	sample, err := provider.SampleMultihash(1)
+	assert.NoError(t, err)
+	assert.Contains(t, mhs, sample)
+
+	found, latency, err := provider.VerifyAdvertised(context.Background(), indexer.URL, mhs[0])
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, latency > 0)
+
+	found, _, err = provider.VerifyAdvertised(context.Background(), indexer.URL, mhs[1])
+	assert.NoError(t, err)
+	assert.False(t, found, "only provided by another peer")
+
+	found, _, err = provider.VerifyAdvertised(context.Background(), indexer.URL, mhs[2])
+	assert.NoError(t, err)
+	assert.False(t, found, "unknown to the indexer")
+}
+
+func TestHoldBatch(t *testing.T) {
+	db := setupTestDB(t)
+	if err := db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for id, createdAt := range map[int]time.Time{21: now.Add(-2 * time.Hour), 31: now.Add(-time.Minute)} {
+		assert.NoError(t, db.Exec("INSERT INTO contents (id, created_at, updated_at) VALUES (?, ?, ?)", id, createdAt, createdAt).Error)
+	}
+
+	provider := &Provider{db: db, batchSize: 10, minBatchFill: 0.5, minBatchFillMaxAge: time.Hour}
+
+	hold, err := provider.holdBatch(0, 10, now)
+	assert.NoError(t, err)
+	assert.False(t, hold, "complete batch")
+
+	hold, err = provider.holdBatch(30, 6, now)
+	assert.NoError(t, err)
+	assert.False(t, hold, "filled past the minimum")
+
+	hold, err = provider.holdBatch(30, 2, now)
+	assert.NoError(t, err)
+	assert.True(t, hold, "incomplete and recent")
+
+	hold, err = provider.holdBatch(20, 2, now)
+	assert.NoError(t, err)
+	assert.False(t, hold, "incomplete for longer than the max age")
+
+	provider.minBatchFillMaxAge = 0
+	hold, err = provider.holdBatch(20, 2, now)
+	assert.NoError(t, err)
+	assert.True(t, hold, "held until filled")
+
+	provider.minBatchFill = 0
+	hold, err = provider.holdBatch(30, 2, now)
+	assert.NoError(t, err)
+	assert.False(t, hold, "holding disabled")
+}
+
+func TestIterationCache(t *testing.T) {
+	db := setupTestDB(t)
+	mhs := insertObjects(t, db, 2, 5)
+	provider := &Provider{db: db, objRefStrategy: ObjRefStrategyJoin, iterCacheEnabled: true}
+
+	provider.beginIterationCache()
+	iter, err := provider.newIterator(1, 2)
+	assert.NoError(t, err)
+	iter.limitToSubBatch(0, 3)
+	assert.Len(t, drain(t, iter), 3)
+
+	// the other autoretrieves get the whole batch from the cache, without
+	// reading the database again
+	if err := db.Exec("DELETE FROM obj_refs").Error; err != nil {
+		t.Fatal(err)
+	}
+	iter, err = provider.newIterator(1, 2)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, mhs, drain(t, iter))
+
+	// the next tick reads the database again
+	provider.endIterationCache()
+	_, err = provider.newIterator(1, 2)
+	assert.Error(t, err)
+}
+
+func TestEstimateAdSize(t *testing.T) {
+	db := setupTestDB(t)
+	insertObjects(t, db, 4, 10)
+
+	est, err := EstimateAdSize(db, 1, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(40), est.Entries)
+	assert.Equal(t, uint64(1), est.Advertisements)
+	assert.Equal(t, uint64(1), est.Chunks)
+	assert.Equal(t, uint64(estimatedAdOverhead+estimatedChunkOverhead+40*estimatedEntrySize), est.Bytes)
+
+	// split over advertisements, each with its own overhead and chunk
+	split, err := estimateAdSize(db, 1, 4, 15)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), split.Advertisements)
+	assert.Equal(t, uint64(3), split.Chunks)
+	assert.Greater(t, split.Bytes, est.Bytes)
+
+	empty, err := EstimateAdSize(db, 100, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), empty.Entries)
+	assert.Equal(t, uint64(0), empty.Chunks)
+}
+
+// mockEngine records the advertisements the provider publishes
+type mockEngine struct {
+	lister  providerpkg.MultihashLister
+	puts    [][]byte
+	removes [][]byte
+	// list the multihashes of each put, as the real engine does
+	listOnPut bool
+	// Start fails this many times before it succeeds
+	startFailures int
+	starts        int
+	// NotifyRemove fails this many times before it succeeds
+	removeFailures int
+	// refuse puts of context IDs that are already advertised, as the real
+	// engine does
+	dedupe     bool
+	advertised map[string]bool
+	// metadata of each put
+	mds []metadata.Metadata
+}
+
+func (e *mockEngine) Start(ctx context.Context) error {
+	e.starts++
+	if e.starts <= e.startFailures {
+		return fmt.Errorf("start failure %d", e.starts)
+	}
+	return nil
+}
+
+func (e *mockEngine) Shutdown() error { return nil }
+
+func (e *mockEngine) NotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata) (cid.Cid, error) {
+	if e.dedupe {
+		if e.advertised[string(contextID)] {
+			return cid.Undef, providerpkg.ErrAlreadyAdvertised
+		}
+		if e.advertised == nil {
+			e.advertised = make(map[string]bool)
+		}
+		e.advertised[string(contextID)] = true
+	}
+	e.puts = append(e.puts, contextID)
+	e.mds = append(e.mds, md)
+	if e.listOnPut {
+		if _, err := e.lister(ctx, provider.ID, contextID); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return e.adCid(len(e.puts) + len(e.removes))
+}
+
+func (e *mockEngine) NotifyRemove(ctx context.Context, provider peer.ID, contextID []byte) (cid.Cid, error) {
+	if e.removeFailures > 0 {
+		e.removeFailures--
+		return cid.Undef, fmt.Errorf("remove failure")
+	}
+	e.removes = append(e.removes, contextID)
+	delete(e.advertised, string(contextID))
+	return e.adCid(len(e.puts) + len(e.removes))
+}
+
+func (e *mockEngine) RegisterMultihashLister(mhl providerpkg.MultihashLister) {
+	e.lister = mhl
+}
+
+func (e *mockEngine) PublishLatestHTTP(ctx context.Context, announceURLs ...*url.URL) (cid.Cid, error) {
+	return e.adCid(len(e.puts) + len(e.removes))
+}
+
+func (e *mockEngine) adCid(n int) (cid.Cid, error) {
+	mh, err := multihash.Sum([]byte(fmt.Sprintf("ad-%d", n)), multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.DagJSON, mh), nil
+}
+
+func TestPublishBatchDecisions(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}, &AdvertisementHistory{}))
+	mhs := insertObjects(t, db, 4, 2)
+
+	eng := &mockEngine{}
+	provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng), WithRefreshInterval(time.Hour))
+	assert.NoError(t, err)
+	provider.batchSize = 10
+
+	id, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	addrInfo := &peer.AddrInfo{ID: id}
+	ctx := context.Background()
+	log := zap.NewNop().Sugar()
+
+	// not advertised yet: put
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 1)
+	assert.Empty(t, eng.removes)
+
+	// the engine lists the batch's multihashes through the provider
+	iter, err := eng.lister(ctx, id, eng.puts[0])
+	assert.NoError(t, err)
+	listed := drain(t, iter.(*Iterator))
+	assert.ElementsMatch(t, mhs, listed)
+
+	// unchanged and recent: nothing to do
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 1)
+	assert.Empty(t, eng.removes)
+
+	// grown since: remove and put again under the same context ID
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 5, 0, nil)
+	assert.Len(t, eng.puts, 2)
+	assert.Len(t, eng.removes, 1)
+	assert.Equal(t, eng.puts[0], eng.removes[0])
+
+	var batches []PublishedBatch
+	assert.NoError(t, db.Find(&batches).Error)
+	assert.Len(t, batches, 1)
+	assert.Equal(t, uint64(5), batches[0].Count)
+
+	history, err := provider.AdvertisementHistory("ar-1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+}
+
+func TestScheduling(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}))
+
+	unscheduled := &Provider{db: db, advertisementInterval: time.Hour}
+	assert.Equal(t, time.Hour, unscheduled.tickInterval())
+	due, err := unscheduled.due(&Autoretrieve{}, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, due)
+
+	provider := &Provider{db: db, advertisementInterval: time.Hour}
+	WithScheduling(6, 0.1)(provider)
+	assert.Equal(t, 10*time.Minute, provider.tickInterval())
+
+	ar := &Autoretrieve{Handle: "ar-1", Token: "token-1", PubKey: "key-1"}
+	assert.NoError(t, db.Create(ar).Error)
+
+	// a new autoretrieve is given a time within the interval
+	now := time.Now()
+	_, err = provider.due(ar, now)
+	assert.NoError(t, err)
+	if assert.NotNil(t, ar.NextAdvertisement) {
+		assert.False(t, ar.NextAdvertisement.Before(now))
+		assert.False(t, ar.NextAdvertisement.After(now.Add(time.Hour)))
+	}
+
+	due, err = provider.due(ar, ar.NextAdvertisement.Add(-time.Second))
+	assert.NoError(t, err)
+	assert.False(t, due)
+	due, err = provider.due(ar, *ar.NextAdvertisement)
+	assert.NoError(t, err)
+	assert.True(t, due)
+
+	// rescheduled an interval later, within the jitter, and stored
+	assert.NoError(t, provider.reschedule(ar, now))
+	assert.False(t, ar.NextAdvertisement.Before(now.Add(54*time.Minute)))
+	assert.False(t, ar.NextAdvertisement.After(now.Add(66*time.Minute)))
+
+	var stored Autoretrieve
+	assert.NoError(t, db.First(&stored, ar.ID).Error)
+	if assert.NotNil(t, stored.NextAdvertisement) {
+		assert.WithinDuration(t, *ar.NextAdvertisement, *stored.NextAdvertisement, time.Second)
+	}
+}
+
+func TestMultihashCount(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}, &AdvertisementHistory{}))
+	insertObjects(t, db, 4, 2)
+
+	eng := &mockEngine{listOnPut: true}
+	provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng), WithRefreshInterval(time.Hour))
+	assert.NoError(t, err)
+	provider.batchSize = 10
+
+	id, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	addrInfo := &peer.AddrInfo{ID: id}
+	ctx := context.Background()
+	log := zap.NewNop().Sugar()
+
+	// the count listed while publishing is recorded with the batch
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	var batch PublishedBatch
+	assert.NoError(t, db.First(&batch).Error)
+	if assert.NotNil(t, batch.MultihashCount) {
+		assert.Equal(t, uint64(8), *batch.MultihashCount)
+	}
+
+	// lists for indexer pulls aren't recorded
+	_, err = eng.lister(ctx, id, eng.puts[0])
+	assert.NoError(t, err)
+	assert.Empty(t, provider.listed)
+
+	multihashes, uncounted, err := AdvertisedMultihashes(db, "ar-1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8), multihashes)
+	assert.Equal(t, int64(0), uncounted)
+
+	// rows published before the count was recorded are backfilled lazily
+	assert.NoError(t, db.Model(&PublishedBatch{}).Where("id = ?", batch.ID).UpdateColumn("multihash_count", nil).Error)
+	_, uncounted, err = AdvertisedMultihashes(db, "ar-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), uncounted)
+
+	// not within the tick's budget
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	_, uncounted, err = AdvertisedMultihashes(db, "ar-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), uncounted)
+
+	provider.mhCountBackfillBudget = 1
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 1)
+	multihashes, uncounted, err = AdvertisedMultihashes(db, "ar-1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8), multihashes)
+	assert.Equal(t, int64(0), uncounted)
+	assert.Equal(t, 0, provider.mhCountBackfillBudget)
+}
+
+func TestStartEngineRetries(t *testing.T) {
+	db := setupTestDB(t)
+
+	eng := &mockEngine{startFailures: 2}
+	provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng))
+	assert.NoError(t, err)
+	provider.engineStartBackoff = time.Millisecond
+
+	// transient failures are retried
+	assert.NoError(t, provider.startEngine(context.Background()))
+	assert.Equal(t, 3, eng.starts)
+
+	// and given up on once the attempts are exhausted
+	eng = &mockEngine{startFailures: engineStartAttempts}
+	provider.engine = eng
+	err = provider.startEngine(context.Background())
+	assert.ErrorContains(t, err, fmt.Sprintf("start failure %d", engineStartAttempts))
+	assert.Equal(t, engineStartAttempts, eng.starts)
+
+	// without waiting out the backoff once the context is done
+	eng = &mockEngine{startFailures: engineStartAttempts}
+	provider.engine = eng
+	provider.engineStartBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, provider.startEngine(ctx), context.Canceled)
+	assert.Equal(t, 1, eng.starts)
+}
+
+func TestDiffAdvertised(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}))
+	if err := db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for id := 1; id <= 25; id++ {
+		var deletedAt *time.Time
+		if id == 3 || id == 4 || id == 22 {
+			now := time.Now()
+			deletedAt = &now
+		}
+		assert.NoError(t, db.Exec("INSERT INTO contents (id, created_at, updated_at, deleted_at) VALUES (?, ?, ?, ?)", id, time.Now(), time.Now(), deletedAt).Error)
+	}
+
+	// the batch at 0 is complete, the one at 10 was published with 4 contents
+	// only and the one at 20 not at all
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, Count: 4},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 20, Count: 5},
+	}).Error)
+
+	diff, err := diffAdvertised(db, "ar-1", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "ar-1", diff.Handle)
+	assert.Equal(t, []ContentRange{{First: 3, Last: 4}}, diff.AdvertisedDeleted)
+	assert.Equal(t, []ContentRange{{First: 14, Last: 21}, {First: 23, Last: 25}}, diff.Unadvertised)
+
+	// nothing is advertised for an unknown autoretrieve
+	diff, err = diffAdvertised(db, "ar-3", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, diff.AdvertisedDeleted)
+	assert.Equal(t, []ContentRange{{First: 1, Last: 2}, {First: 5, Last: 21}, {First: 23, Last: 25}}, diff.Unadvertised)
+}
+
+func TestHandleLabel(t *testing.T) {
+	provider := &Provider{}
+
+	for i := 0; i < maxHandleLabels; i++ {
+		handle := fmt.Sprintf("ar-%d", i)
+		assert.Equal(t, handle, provider.handleLabel(handle))
+	}
+
+	// handles seen once the labels are used up share a label, the ones seen
+	// before keep theirs
+	assert.Equal(t, otherHandleLabel, provider.handleLabel("ar-new"))
+	assert.Equal(t, otherHandleLabel, provider.handleLabel("ar-newer"))
+	assert.Equal(t, "ar-0", provider.handleLabel("ar-0"))
+}
+
+func TestPopulatedBatches(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}))
+	insertObjects(t, db, 45, 1)
+
+	provider := &Provider{db: db, batchSize: 10}
+
+	// the contents of 10 to 39 were deleted
+	assert.NoError(t, db.Exec("DELETE FROM obj_refs WHERE content BETWEEN 10 AND 39").Error)
+
+	populated, err := provider.populatedBatches(context.Background(), 45)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 40}, populated)
+
+	populated, err = provider.populatedBatches(context.Background(), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0}, populated)
+
+	// batches published before the deletion are still processed
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 20, Count: 10},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 40, Count: 5},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 25, Count: 5},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 30, Count: 10},
+	}).Error)
+
+	batches, err := batchesToAdvertise(db, "ar-1", []uint64{0, 40}, 45, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 20, 40}, batches)
+}
+
+func TestThrottle(t *testing.T) {
+	provider := &Provider{}
+	WithQueryRate(0)(provider)
+	assert.NoError(t, provider.throttle(context.Background()))
+
+	WithQueryRate(20)(provider)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, provider.throttle(context.Background()))
+	}
+	// the first query runs right away, the others are paced
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, provider.throttle(ctx))
+}
+
+func TestRemoveAllAdvertisements(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}, &AdvertisementHistory{}))
+
+	eng := &mockEngine{removeFailures: 1}
+	provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng))
+	assert.NoError(t, err)
+	provider.batchSize = 10
+
+	id := "12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv"
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10, ProviderID: id},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, Count: 10, ProviderID: id},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 20, Count: 10},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 0, Count: 10, ProviderID: id},
+	}).Error)
+
+	// the first removal fails, the others go through
+	removal, err := provider.RemoveAllAdvertisements(context.Background(), "ar-1")
+	assert.NoError(t, err)
+	assert.Equal(t, &AdvertisementRemoval{Handle: "ar-1", Batches: 3, Removed: 2, Failed: 1}, removal)
+	assert.Len(t, eng.removes, 1)
+
+	// running it again retries the batch left over
+	removal, err = provider.RemoveAllAdvertisements(context.Background(), "ar-1")
+	assert.NoError(t, err)
+	assert.Equal(t, &AdvertisementRemoval{Handle: "ar-1", Batches: 1, Removed: 1}, removal)
+	assert.Len(t, eng.removes, 2)
+
+	removal, err = provider.RemoveAllAdvertisements(context.Background(), "ar-1")
+	assert.NoError(t, err)
+	assert.Equal(t, &AdvertisementRemoval{Handle: "ar-1"}, removal)
+
+	var remaining []PublishedBatch
+	assert.NoError(t, db.Unscoped().Find(&remaining).Error)
+	if assert.Len(t, remaining, 1) {
+		assert.Equal(t, "ar-2", remaining[0].AutoretrieveHandle)
+	}
+}
+
+func TestContentExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&PublishedBatch{}, &AdvertisementHistory{}))
+	if err := db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime, expires_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 4; id++ {
+		assert.NoError(t, db.Exec("INSERT INTO contents (id, created_at, updated_at) VALUES (?, ?, ?)", id, time.Now(), time.Now()).Error)
+	}
+	mhs := insertObjects(t, db, 4, 2)
+	expire := func(id int, at time.Time) {
+		assert.NoError(t, db.Exec("UPDATE contents SET expires_at = ? WHERE id = ?", at, id).Error)
+	}
+
+	eng := &mockEngine{}
+	provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng), WithContentExpiry(true))
+	assert.NoError(t, err)
+	provider.batchSize = 10
+
+	id, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	addrInfo := &peer.AddrInfo{ID: id}
+	ctx := context.Background()
+	log := zap.NewNop().Sugar()
+	listed := func() []multihash.Multihash {
+		iter, err := eng.lister(ctx, id, eng.puts[len(eng.puts)-1])
+		assert.NoError(t, err)
+		return drain(t, iter.(*Iterator))
+	}
+
+	// content 2 already expired, the others are live
+	expire(2, time.Now().Add(-time.Hour))
+	expire(4, time.Now().Add(time.Hour))
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 1)
+	assert.ElementsMatch(t, []multihash.Multihash{mhs[0], mhs[1], mhs[4], mhs[5], mhs[6], mhs[7]}, listed())
+
+	// nothing expired since
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 1)
+
+	// content 3 expires after the batch was published: re-published without it
+	expire(3, time.Now())
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 2)
+	assert.Len(t, eng.removes, 1)
+	assert.ElementsMatch(t, []multihash.Multihash{mhs[0], mhs[1], mhs[6], mhs[7]}, listed())
+
+	// once all contents expired, the advertisement is removed
+	expire(1, time.Now())
+	expire(4, time.Now())
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 2)
+	assert.Len(t, eng.removes, 2)
+
+	var remaining []PublishedBatch
+	assert.NoError(t, db.Unscoped().Find(&remaining).Error)
+	assert.Empty(t, remaining)
+
+	// and a batch whose contents all expired isn't published again
+	provider.publishBatch(ctx, log, "ar-1", addrInfo, 0, 4, 0, nil)
+	assert.Len(t, eng.puts, 2)
+}
+
+func TestContentExpiryThroughLoop(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}, &PublishedBatch{}, &AdvertisementHistory{}))
+	if err := db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime, expires_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 4; id++ {
+		assert.NoError(t, db.Exec("INSERT INTO contents (id, created_at, updated_at) VALUES (?, ?, ?)", id, time.Now(), time.Now()).Error)
+	}
+	insertObjects(t, db, 4, 2)
+	assert.NoError(t, db.Create(&Autoretrieve{Handle: "ar-1", Token: "token-1", PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6746"}).Error)
+
+	eng := &mockEngine{}
+	provider, err := NewProvider(db, time.Minute, nil, true, WithEngine(eng), WithContentExpiry(true))
+	assert.NoError(t, err)
+	provider.batchSize = 10
+	ctx := context.Background()
+
+	assert.NoError(t, provider.advertise(ctx))
+	assert.Len(t, eng.puts, 1)
+
+	// the contents are made temporary the way the API does it, and expire
+	expiresAt := time.Now()
+	for id := uint64(1); id <= 4; id++ {
+		assert.NoError(t, util.SetContentExpiry(db, id, &expiresAt))
+	}
+	assert.ErrorIs(t, util.SetContentExpiry(db, 5, &expiresAt), gorm.ErrRecordNotFound)
+
+	// the next pass of the loop removes the advertisement
+	assert.NoError(t, provider.advertise(ctx))
+	assert.Len(t, eng.puts, 1)
+	if assert.Len(t, eng.removes, 1) {
+		assert.Equal(t, eng.puts[0], eng.removes[0])
+	}
+
+	var remaining []PublishedBatch
+	assert.NoError(t, db.Unscoped().Find(&remaining).Error)
+	assert.Empty(t, remaining)
+
+	// and doesn't publish it again
+	assert.NoError(t, provider.advertise(ctx))
+	assert.Len(t, eng.puts, 1)
+}
+
+func TestShrunkSubBatches(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}, &PublishedBatch{}, &AdvertisementHistory{}))
+	if err := db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime)").Error; err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 4; id++ {
+		assert.NoError(t, db.Exec("INSERT INTO contents (id, created_at, updated_at) VALUES (?, ?, ?)", id, time.Now(), time.Now()).Error)
+	}
+	insertObjects(t, db, 4, 2)
+	assert.NoError(t, db.Create(&Autoretrieve{Handle: "ar-1", Token: "token-1", PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6746"}).Error)
+
+	eng := &mockEngine{}
+	provider, err := NewProvider(db, time.Minute, nil, true, WithEngine(eng), WithMaxEntriesPerAd(3))
+	assert.NoError(t, err)
+	provider.batchSize = 10
+	ctx := context.Background()
+
+	// 8 multihashes are split over 3 advertisements
+	assert.NoError(t, provider.advertise(ctx))
+	assert.Len(t, eng.puts, 3)
+
+	// down to 4 multihashes, which fit in 2
+	assert.NoError(t, db.Exec("DELETE FROM obj_refs WHERE content IN (3, 4)").Error)
+	assert.NoError(t, provider.advertise(ctx))
+	assert.Len(t, eng.puts, 3)
+	if assert.Len(t, eng.removes, 1) {
+		assert.Equal(t, eng.puts[2], eng.removes[0])
+	}
+
+	var subBatches []uint64
+	assert.NoError(t, db.Unscoped().Model(&PublishedBatch{}).Order("sub_batch asc").Pluck("sub_batch", &subBatches).Error)
+	assert.Equal(t, []uint64{0, 1}, subBatches)
+
+	// nothing left to remove
+	assert.NoError(t, provider.advertise(ctx))
+	assert.Len(t, eng.removes, 1)
+}
+
+func TestCheckContextIDs(t *testing.T) {
+	assert.NoError(t, checkContextIDs(constants.AutoretrieveProviderBatchSize))
+	assert.NoError(t, checkContextIDs(1))
+
+	pid, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	_, err = makeContextID(contextParams{provider: pid, firstContentID: 1 << 32, count: 20})
+	assert.Error(t, err, "content IDs past 32 bits would wrap to another range")
+}
+
+func TestResumeAdvertisements(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}, &PublishedBatch{}, &AdvertisementHistory{}))
+
+	ar := Autoretrieve{Handle: "ar-1", Token: "token-1", PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6746"}
+	assert.NoError(t, db.Create(&ar).Error)
+	assert.NoError(t, db.Create(&Autoretrieve{Handle: "ar-2", Token: "token-2", PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6747", Paused: true}).Error)
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, Count: 10},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, SubBatch: 1, Count: 10},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "deregistered", FirstContentID: 0, Count: 10},
+	}).Error)
+
+	eng := &mockEngine{dedupe: true}
+	provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng))
+	assert.NoError(t, err)
+	provider.batchSize = 10
+
+	// the engine kept the advertisement of the first batch across the restart
+	addrInfo, err := ar.AddrInfo()
+	assert.NoError(t, err)
+	kept, err := makeContextID(contextParams{provider: addrInfo.ID, firstContentID: 0, count: 10})
+	assert.NoError(t, err)
+	eng.advertised = map[string]bool{string(kept): true}
+
+	resumed, err := provider.resumeAdvertisements(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &AdvertisementResumption{Batches: 3, Kept: 1, Republished: 2}, resumed)
+	assert.Len(t, eng.puts, 2, "only the advertisements missing from the engine are published again")
+
+	var history []AdvertisementHistory
+	assert.NoError(t, db.Find(&history).Error)
+	assert.Len(t, history, 2)
+
+	// nothing is missing anymore
+	resumed, err = provider.resumeAdvertisements(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &AdvertisementResumption{Batches: 3, Kept: 3}, resumed)
+	assert.Len(t, eng.puts, 2)
+}
+
+func TestResumeAdvertisementsAcrossRestart(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}, &PublishedBatch{}, &AdvertisementHistory{}))
+
+	assert.NoError(t, db.Create(&Autoretrieve{Handle: "ar-1", Token: "token-1", PubKey: testPubKey(t), Addresses: "/ip4/127.0.0.1/tcp/6746"}).Error)
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, Count: 10},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, Count: 10},
+	}).Error)
+
+	start := func(eng *mockEngine) *AdvertisementResumption {
+		provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng))
+		assert.NoError(t, err)
+		provider.batchSize = 10
+		resumed, err := provider.resumeAdvertisements(context.Background())
+		assert.NoError(t, err)
+		return resumed
+	}
+
+	// an engine whose datastore was lost publishes every batch again
+	first := &mockEngine{dedupe: true}
+	assert.Equal(t, &AdvertisementResumption{Batches: 2, Republished: 2}, start(first))
+	assert.Len(t, first.puts, 2)
+
+	// a fresh engine on the same persisted datastore knows all of them
+	restarted := &mockEngine{dedupe: true, advertised: first.advertised}
+	assert.Equal(t, &AdvertisementResumption{Batches: 2, Kept: 2}, start(restarted))
+	assert.Empty(t, restarted.puts)
+
+	// a batch published since is the only one missing from a datastore
+	// restored from an older backup
+	assert.NoError(t, db.Create(&PublishedBatch{AutoretrieveHandle: "ar-1", FirstContentID: 20, Count: 10}).Error)
+	restored := &mockEngine{dedupe: true, advertised: make(map[string]bool)}
+	for contextID := range first.advertised {
+		restored.advertised[contextID] = true
+	}
+	assert.Equal(t, &AdvertisementResumption{Batches: 3, Kept: 2, Republished: 1}, start(restored))
+	assert.Len(t, restored.puts, 1)
+}
+
+func TestMetadataExtension(t *testing.T) {
+	db := setupTestDB(t)
+	pid, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	addrInfo := &peer.AddrInfo{ID: pid}
+
+	var batches []AdvertisedBatch
+	extension := func(batch AdvertisedBatch) ([]metadata.Protocol, error) {
+		batches = append(batches, batch)
+		if batch.SubBatch == 2 {
+			return nil, fmt.Errorf("no metadata for sub-batch 2")
+		}
+		// bitswap is already advertised
+		return []metadata.Protocol{metadata.Bitswap{}, &metadata.GraphsyncFilecoinV1{FastRetrieval: true}}, nil
+	}
+
+	eng := &mockEngine{}
+	provider, err := NewProvider(db, time.Minute, nil, false, WithEngine(eng), WithMetadataExtension(extension))
+	assert.NoError(t, err)
+
+	contextID, err := makeContextID(contextParams{provider: pid, firstContentID: 10, count: 20, subBatch: 1})
+	assert.NoError(t, err)
+	_, _, err = provider.notifyPut(context.Background(), addrInfo, contextID)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []AdvertisedBatch{{Provider: pid, FirstContentID: 10, Count: 20, SubBatch: 1}}, batches)
+	if assert.Len(t, eng.mds, 1) {
+		md := eng.mds[0]
+		assert.Equal(t, 2, md.Len())
+		assert.NotNil(t, md.Get(metadata.Bitswap{}.ID()))
+		assert.Equal(t, &metadata.GraphsyncFilecoinV1{FastRetrieval: true}, md.Get((&metadata.GraphsyncFilecoinV1{}).ID()))
+	}
+
+	// a failing extension fails the publication
+	contextID, err = makeContextID(contextParams{provider: pid, firstContentID: 10, count: 20, subBatch: 2})
+	assert.NoError(t, err)
+	_, _, err = provider.notifyPut(context.Background(), addrInfo, contextID)
+	assert.Error(t, err)
+	assert.Len(t, eng.puts, 1)
+
+	// without an extension only bitswap is advertised
+	eng = &mockEngine{}
+	provider, err = NewProvider(db, time.Minute, nil, false, WithEngine(eng))
+	assert.NoError(t, err)
+	_, _, err = provider.notifyPut(context.Background(), addrInfo, contextID)
+	assert.NoError(t, err)
+	if assert.Len(t, eng.mds, 1) {
+		md := eng.mds[0]
+		assert.Equal(t, 1, md.Len())
+		assert.NotNil(t, md.Get(metadata.Bitswap{}.ID()))
+	}
+}
+
+func TestSilentAutoretrieves(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}, &PublishedBatch{}))
+
+	now := time.Now()
+	assert.NoError(t, db.Create(&[]Autoretrieve{
+		// online and advertised
+		{Handle: "ar-1", Token: "token-1", PubKey: "key-1", LastConnection: now},
+		// online, its batches were advertised long ago
+		{Handle: "ar-2", Token: "token-2", PubKey: "key-2", LastConnection: now, LastAdvertisement: now.Add(-72 * time.Hour)},
+		// online, never advertised
+		{Handle: "ar-3", Token: "token-3", PubKey: "key-3", LastConnection: now},
+		// offline
+		{Handle: "ar-4", Token: "token-4", PubKey: "key-4", LastConnection: now.Add(-72 * time.Hour)},
+		// paused on purpose
+		{Handle: "ar-5", Token: "token-5", PubKey: "key-5", LastConnection: now, Paused: true},
+	}).Error)
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-1", FirstContentID: 0, LastAdvertisement: now.Add(-72 * time.Hour)},
+		{AutoretrieveHandle: "ar-1", FirstContentID: 10, LastAdvertisement: now.Add(-time.Hour)},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 0, LastAdvertisement: now.Add(-72 * time.Hour)},
+		{AutoretrieveHandle: "ar-2", FirstContentID: 10, LastAdvertisement: now.Add(-72 * time.Hour)},
+	}).Error)
+
+	since := now.Add(-24 * time.Hour)
+	silent, err := SilentAutoretrieves(db, since, since)
+	assert.NoError(t, err)
+	var handles []string
+	for _, ar := range silent {
+		handles = append(handles, ar.Handle)
+	}
+	assert.Equal(t, []string{"ar-2", "ar-3"}, handles)
+	assert.Equal(t, int64(2), silent[0].PublishedBatches)
+	assert.Equal(t, int64(0), silent[1].PublishedBatches)
+
+	// a deleted fresh batch doesn't count
+	assert.NoError(t, db.Where("autoretrieve_handle = ? AND first_content_id = ?", "ar-1", 10).Delete(&PublishedBatch{}).Error)
+	silent, err = SilentAutoretrieves(db, since, since)
+	assert.NoError(t, err)
+	assert.Len(t, silent, 3)
+}
+
+func TestMergeDuplicateRegistrations(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&Autoretrieve{}, &PublishedBatch{}, &AdvertisementHistory{}))
+
+	// the same ed25519 key, once with its protobuf fields in the usual order
+	// and once swapped, has two encodings but a single peer ID
+	_, pub, err := crypto.GenerateEd25519Key(nil)
+	assert.NoError(t, err)
+	b, err := crypto.MarshalPublicKey(pub)
+	assert.NoError(t, err)
+	raw, err := pub.Raw()
+	assert.NoError(t, err)
+	swapped := append(append([]byte{0x12, byte(len(raw))}, raw...), 0x08, 0x01)
+
+	now := time.Now()
+	assert.NoError(t, db.Create(&[]Autoretrieve{
+		{Handle: "ar-old", Token: "token-1", PubKey: crypto.ConfigEncodeKey(swapped), LastConnection: now.Add(-time.Hour)},
+		{Handle: "ar-new", Token: "token-2", PubKey: crypto.ConfigEncodeKey(b), LastConnection: now},
+		{Handle: "ar-other", Token: "token-3", PubKey: testPubKey(t), LastConnection: now},
+	}).Error)
+	assert.NoError(t, db.Create(&[]PublishedBatch{
+		{AutoretrieveHandle: "ar-new", FirstContentID: 0},
+		{AutoretrieveHandle: "ar-old", FirstContentID: 0},
+		{AutoretrieveHandle: "ar-old", FirstContentID: 10},
+		{AutoretrieveHandle: "ar-old", FirstContentID: 10, SubBatch: 1},
+		{AutoretrieveHandle: "ar-other", FirstContentID: 0},
+	}).Error)
+	assert.NoError(t, db.Create(&AdvertisementHistory{AutoretrieveHandle: "ar-old", FirstContentID: 10}).Error)
+
+	peerID, err := peer.IDFromPublicKey(pub)
+	assert.NoError(t, err)
+
+	dups, err := FindDuplicateRegistrations(db)
+	assert.NoError(t, err)
+	assert.Equal(t, []DuplicateRegistration{{PeerID: peerID.String(), Canonical: "ar-new", Duplicates: []string{"ar-old"}}}, dups)
+
+	dups, err = MergeDuplicateRegistrations(db)
+	assert.NoError(t, err)
+	if assert.Len(t, dups, 1) {
+		assert.Equal(t, int64(2), dups[0].ReassignedBatches)
+		assert.Equal(t, int64(1), dups[0].DeletedBatches)
+	}
+
+	var handles []string
+	assert.NoError(t, db.Model(&Autoretrieve{}).Order("handle asc").Pluck("handle", &handles).Error)
+	assert.Equal(t, []string{"ar-new", "ar-other"}, handles)
+
+	var batches []PublishedBatch
+	assert.NoError(t, db.Where("autoretrieve_handle = ?", "ar-new").Order("first_content_id asc, sub_batch asc").Find(&batches).Error)
+	assert.Len(t, batches, 3)
+
+	var history AdvertisementHistory
+	assert.NoError(t, db.First(&history).Error)
+	assert.Equal(t, "ar-new", history.AutoretrieveHandle)
+
+	dups, err = FindDuplicateRegistrations(db)
+	assert.NoError(t, err)
+	assert.Empty(t, dups)
+}
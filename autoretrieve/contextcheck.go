@@ -0,0 +1,71 @@
+package autoretrieve
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// The context ID encodes the content IDs, count and sub-batch on 4 bytes each
+const maxContextIDValue = math.MaxUint32
+
+// checkContextIDs round-trips representative context params, around the batch
+// size and the limits of the encoding, through makeContextID and
+// readContextID. An encoding bug would otherwise only show as advertisements
+// serving the wrong content ranges.
+func checkContextIDs(batchSize uint64) error {
+	edPeer, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	if err != nil {
+		return err
+	}
+	// peer IDs of RSA keys are hashed rather than inlined, which changes the
+	// first byte the sub-batch marker is told apart from
+	shaMh, err := multihash.Sum([]byte("autoretrieve"), multihash.SHA2_256, -1)
+	if err != nil {
+		return err
+	}
+	shaPeer, err := peer.IDFromBytes(shaMh)
+	if err != nil {
+		return err
+	}
+
+	firstContentIDs := []uint64{0, 1, batchSize, batchSize + 1, maxContextIDValue - batchSize, maxContextIDValue}
+	counts := []uint64{1, batchSize, maxContextIDValue}
+	subBatches := []uint64{0, 1, subBatchMarker, maxContextIDValue}
+
+	for _, pid := range []peer.ID{edPeer, shaPeer} {
+		for _, first := range firstContentIDs {
+			for _, count := range counts {
+				for _, subBatch := range subBatches {
+					params := contextParams{provider: pid, firstContentID: first, count: count, subBatch: subBatch}
+					contextID, err := makeContextID(params)
+					if err != nil {
+						return fmt.Errorf("failed to make context ID of %+v: %v", params, err)
+					}
+					read, err := readContextID(contextID)
+					if err != nil {
+						return fmt.Errorf("failed to read context ID of %+v: %v", params, err)
+					}
+					if read != params {
+						return fmt.Errorf("context ID of %+v reads back as %+v", params, read)
+					}
+				}
+			}
+		}
+
+		// values the encoding can't hold must be refused rather than wrapped
+		// into another range
+		for _, params := range []contextParams{
+			{provider: pid, firstContentID: maxContextIDValue + 1, count: batchSize},
+			{provider: pid, firstContentID: 1, count: maxContextIDValue + 1},
+			{provider: pid, firstContentID: 1, count: batchSize, subBatch: maxContextIDValue + 1},
+		} {
+			if _, err := makeContextID(params); err == nil {
+				return fmt.Errorf("context ID of %+v was made despite not fitting", params)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package autoretrieve
+
+import (
+	"context"
+)
+
+// AdvertisementRemoval summarizes a RemoveAllAdvertisements run
+type AdvertisementRemoval struct {
+	Handle string `json:"handle"`
+	// published batches found for the autoretrieve
+	Batches int `json:"batches"`
+	// batches whose advertisement was removed and that were deleted
+	Removed int `json:"removed"`
+	// batches whose advertisement or row couldn't be removed, they are kept
+	// so that running the removal again retries them
+	Failed int `json:"failed"`
+}
+
+// RemoveAllAdvertisements withdraws everything advertised for the
+// autoretrieve, e.g. before decommissioning it: the advertisement of each of
+// its published batches is removed and the batch deleted. It keeps going
+// past batches that fail, and only the batches left over are looked at when
+// it runs again. Pause or deregister the autoretrieve first, or the
+// advertisement loop publishes its batches again.
+func (provider *Provider) RemoveAllAdvertisements(ctx context.Context, handle string) (*AdvertisementRemoval, error) {
+	log := log.With("autoretrieve_handle", handle)
+
+	var batches []PublishedBatch
+	if err := provider.db.Where("autoretrieve_handle = ?", handle).Order("id asc").Find(&batches).Error; err != nil {
+		return nil, err
+	}
+
+	removal := &AdvertisementRemoval{
+		Handle:  handle,
+		Batches: len(batches),
+	}
+	for _, batch := range batches {
+		if ctx.Err() != nil {
+			return removal, ctx.Err()
+		}
+
+		if !provider.removeBatchAdvertisement(ctx, batch) {
+			removal.Failed++
+			continue
+		}
+		if err := provider.db.Unscoped().Delete(&PublishedBatch{}, batch.ID).Error; err != nil {
+			log.Warnf("Failed to delete published batch %d: %v", batch.ID, err)
+			removal.Failed++
+			continue
+		}
+		removal.Removed++
+	}
+
+	log.Infof("Removed %d of %d published batches, %d failed", removal.Removed, removal.Batches, removal.Failed)
+	return removal, nil
+}
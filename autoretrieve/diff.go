@@ -0,0 +1,102 @@
+package autoretrieve
+
+import (
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"gorm.io/gorm"
+)
+
+// ContentRange is an inclusive range of content IDs
+type ContentRange struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// AdvertisementDiff compares what is advertised for an autoretrieve with the
+// contents in the database
+type AdvertisementDiff struct {
+	Handle string `json:"handle"`
+	// contents within the advertised batches that have been deleted since
+	AdvertisedDeleted []ContentRange `json:"advertisedDeleted"`
+	// contents that exist but aren't covered by an advertised batch
+	Unadvertised []ContentRange `json:"unadvertised"`
+}
+
+// DiffAdvertised compares the batches published for the autoretrieve with
+// the contents in the database, to find out why an indexer shows other
+// content than expected. It combines what CoverageGaps and the empty batch
+// reaper look at, down to the content IDs.
+func DiffAdvertised(db *gorm.DB, handle string) (*AdvertisementDiff, error) {
+	return diffAdvertised(db, handle, constants.AutoretrieveProviderBatchSize)
+}
+
+func diffAdvertised(db *gorm.DB, handle string, batchSize uint64) (*AdvertisementDiff, error) {
+	diff := &AdvertisementDiff{Handle: handle}
+
+	lastContentID, found, err := getLastContentID(db)
+	if err != nil || !found {
+		return diff, err
+	}
+
+	// sub-batches share the count of their batch
+	var publishedBatches []PublishedBatch
+	if err := db.Where("autoretrieve_handle = ? AND sub_batch = 0", handle).Find(&publishedBatches).Error; err != nil {
+		return nil, err
+	}
+
+	published := make(map[uint64]uint64, len(publishedBatches))
+	for _, batch := range publishedBatches {
+		published[batch.FirstContentID] = batch.Count
+	}
+
+	for firstContentID := uint64(0); firstContentID <= lastContentID; firstContentID += batchSize {
+		end := firstContentID + batchSize
+		if end > lastContentID+1 {
+			end = lastContentID + 1
+		}
+
+		// a batch published with the count it has now covers its whole
+		// range, one published with fewer contents only covers those
+		coveredEnd := firstContentID
+		if count, ok := published[firstContentID]; ok {
+			coveredEnd = end
+			if count != batchCount(firstContentID, lastContentID, batchSize) && firstContentID+count < end {
+				coveredEnd = firstContentID + count
+			}
+		}
+
+		if coveredEnd > firstContentID {
+			var deleted []uint64
+			if err := db.Unscoped().Model(&util.Content{}).
+				Where("id >= ? AND id < ? AND deleted_at IS NOT NULL", firstContentID, coveredEnd).
+				Order("id asc").Pluck("id", &deleted).Error; err != nil {
+				return nil, err
+			}
+			diff.AdvertisedDeleted = appendRanges(diff.AdvertisedDeleted, deleted)
+		}
+
+		if coveredEnd < end {
+			var unadvertised []uint64
+			if err := db.Model(&util.Content{}).
+				Where("id >= ? AND id < ?", coveredEnd, end).
+				Order("id asc").Pluck("id", &unadvertised).Error; err != nil {
+				return nil, err
+			}
+			diff.Unadvertised = appendRanges(diff.Unadvertised, unadvertised)
+		}
+	}
+	return diff, nil
+}
+
+// appendRanges adds the sorted IDs to the ranges, extending the last range
+// when the IDs continue it
+func appendRanges(ranges []ContentRange, ids []uint64) []ContentRange {
+	for _, id := range ids {
+		if n := len(ranges); n != 0 && ranges[n-1].Last+1 == id {
+			ranges[n-1].Last = id
+			continue
+		}
+		ranges = append(ranges, ContentRange{First: id, Last: id})
+	}
+	return ranges
+}
@@ -0,0 +1,113 @@
+package autoretrieve
+
+import (
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+// DuplicateRegistration is a set of autoretrieves registered under several
+// handles with the same peer ID, e.g. a node that registered its key again
+// encoded differently. Each of them is advertised, redundantly.
+type DuplicateRegistration struct {
+	PeerID string `json:"peerId"`
+	// the registration that is kept on merge, the one that connected last
+	Canonical string `json:"canonical"`
+	// the other registrations, removed on merge
+	Duplicates []string `json:"duplicates"`
+	// published batches of the duplicates moved to the canonical registration
+	// on merge, and those deleted because it already had them
+	ReassignedBatches int64 `json:"reassignedBatches"`
+	DeletedBatches    int64 `json:"deletedBatches"`
+}
+
+// FindDuplicateRegistrations groups the autoretrieves by the peer ID derived
+// from their public key, returning the groups of more than one registration.
+// Autoretrieves whose key can't be decoded are left out.
+func FindDuplicateRegistrations(db *gorm.DB) ([]DuplicateRegistration, error) {
+	var autoretrieves []Autoretrieve
+	if err := db.Order("last_connection desc, id asc").Find(&autoretrieves).Error; err != nil {
+		return nil, err
+	}
+
+	byPeer := make(map[string][]string)
+	for _, ar := range autoretrieves {
+		peerID, err := ar.PeerID()
+		if err != nil {
+			log.Warnf("Failed to get peer ID of autoretrieve %s: %v", ar.Handle, err)
+			continue
+		}
+		// the most recently connected registration comes first
+		byPeer[peerID.String()] = append(byPeer[peerID.String()], ar.Handle)
+	}
+
+	var dups []DuplicateRegistration
+	for peerID, handles := range byPeer {
+		if len(handles) < 2 {
+			continue
+		}
+		dups = append(dups, DuplicateRegistration{
+			PeerID:     peerID,
+			Canonical:  handles[0],
+			Duplicates: handles[1:],
+		})
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i].PeerID < dups[j].PeerID })
+	return dups, nil
+}
+
+// MergeDuplicateRegistrations merges each group of duplicate registrations
+// into its canonical one. The published batches of the duplicates are moved
+// to it, unless it already has the same (sub-)batch, in which case they are
+// deleted: the context IDs are derived from the peer ID, so it is the same
+// advertisement and nothing is removed from the indexers. Their advertisement
+// history is moved too, and the duplicates are deregistered. Each group is
+// merged in a transaction, the groups merged before an error stay merged.
+func MergeDuplicateRegistrations(db *gorm.DB) ([]DuplicateRegistration, error) {
+	dups, err := FindDuplicateRegistrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range dups {
+		dup := &dups[i]
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return mergeDuplicateRegistration(tx, dup)
+		}); err != nil {
+			return dups[:i], err
+		}
+		log.Infof("Merged autoretrieves %v into %s (peer ID %s), %d batches reassigned and %d deleted", dup.Duplicates, dup.Canonical, dup.PeerID, dup.ReassignedBatches, dup.DeletedBatches)
+	}
+	return dups, nil
+}
+
+func mergeDuplicateRegistration(tx *gorm.DB, dup *DuplicateRegistration) error {
+	// the same (sub-)batch published for the canonical registration
+	published := tx.Table("published_batches AS canonical").
+		Select("1").
+		Where("canonical.autoretrieve_handle = ? AND canonical.deleted_at IS NULL", dup.Canonical).
+		Where("canonical.first_content_id = published_batches.first_content_id AND canonical.sub_batch = published_batches.sub_batch")
+
+	for _, handle := range dup.Duplicates {
+		res := tx.Unscoped().Where("autoretrieve_handle = ? AND EXISTS (?)", handle, published).Delete(&PublishedBatch{})
+		if res.Error != nil {
+			return res.Error
+		}
+		dup.DeletedBatches += res.RowsAffected
+
+		res = tx.Unscoped().Model(&PublishedBatch{}).Where("autoretrieve_handle = ?", handle).UpdateColumn("autoretrieve_handle", dup.Canonical)
+		if res.Error != nil {
+			return res.Error
+		}
+		dup.ReassignedBatches += res.RowsAffected
+
+		if err := tx.Unscoped().Model(&AdvertisementHistory{}).Where("autoretrieve_handle = ?", handle).UpdateColumn("autoretrieve_handle", dup.Canonical).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().Delete(&Autoretrieve{}, "handle = ?", handle).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package autoretrieve
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	providerpkg "github.com/filecoin-project/index-provider"
+	"github.com/filecoin-project/index-provider/engine"
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Engine is the part of the index-provider engine the provider publishes
+// advertisements through
+type Engine interface {
+	Start(ctx context.Context) error
+	Shutdown() error
+	NotifyPut(ctx context.Context, provider *peer.AddrInfo, contextID []byte, md metadata.Metadata) (cid.Cid, error)
+	NotifyRemove(ctx context.Context, provider peer.ID, contextID []byte) (cid.Cid, error)
+	RegisterMultihashLister(mhl providerpkg.MultihashLister)
+	PublishLatestHTTP(ctx context.Context, announceURLs ...*url.URL) (cid.Cid, error)
+}
+
+var _ Engine = (*engine.Engine)(nil)
+
+// WithEngine makes the provider publish through eng rather than an engine of
+// its own, e.g. to check the provider's decisions against a mock
+func WithEngine(eng Engine) ProviderOption {
+	return func(provider *Provider) {
+		provider.engine = eng
+	}
+}
+
+// WithEngineDatastore makes the provider's own engine keep its advertisements
+// in ds rather than in memory, so that they survive restarts and only the
+// batches the engine lost are published again on resume
+func WithEngineDatastore(ds datastore.Batching) ProviderOption {
+	return func(provider *Provider) {
+		provider.engineDatastore = ds
+	}
+}
+
+const (
+	// attempts at starting the engine before the provider gives up
+	engineStartAttempts = 5
+	// wait before the second attempt, doubled for every further one
+	engineStartBackoff = 5 * time.Second
+)
+
+// startEngine starts the engine, retrying with backoff since the indexer and
+// data transfer it sets up can fail transiently at boot. The error of the
+// last attempt is returned once all of them failed.
+func (provider *Provider) startEngine(ctx context.Context) error {
+	attempts := provider.engineStartAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	backoff := provider.engineStartBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = provider.engine.Start(ctx); err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			return fmt.Errorf("failed to start engine after %d attempts: %w", attempts, err)
+		}
+
+		log.Warnf("Failed to start engine (attempt %d of %d), retrying in %s: %v", attempt, attempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
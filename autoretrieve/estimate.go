@@ -0,0 +1,90 @@
+package autoretrieve
+
+import (
+	"gorm.io/gorm"
+)
+
+const (
+	// serialized size of a sha2-256 multihash in an entry chunk, the
+	// multihash itself and its dag-cbor byte string header
+	estimatedEntrySize = 34 + 2
+	// the engine chains the entries in chunks of up to this many
+	entriesChunkSize = 16384
+	// serialized size of an entry chunk besides its entries, the link to the
+	// next chunk and the dag-cbor framing
+	estimatedChunkOverhead = 64
+	// serialized size of the advertisement itself, its context ID, metadata,
+	// addresses, provider and signature
+	estimatedAdOverhead = 1024
+)
+
+// AdSizeEstimate is the estimated size of the advertisements of a batch
+type AdSizeEstimate struct {
+	FirstContentID uint64 `json:"firstContentID"`
+	Count          uint64 `json:"count"`
+	// upper bound of the multihashes of the batch
+	Entries uint64 `json:"entries"`
+	// advertisements the multihashes are split over
+	Advertisements uint64 `json:"advertisements"`
+	// entry chunks the multihashes are chained over
+	Chunks uint64 `json:"chunks"`
+	// estimated serialized size of the advertisements and their entries
+	Bytes uint64 `json:"bytes"`
+}
+
+// EstimateAdSize estimates how large the advertisement of the batch starting
+// at firstContentID will be, without reading its multihashes. Multihashes are
+// assumed to be sha2-256, which is what Estuary adds content with.
+func EstimateAdSize(db *gorm.DB, firstContentID uint64, count uint64) (*AdSizeEstimate, error) {
+	return estimateAdSize(db, firstContentID, count, 0)
+}
+
+// estimateAdSize estimates the size of the advertisements of a batch whose
+// multihashes are split over advertisements of up to maxEntriesPerAd
+func estimateAdSize(db *gorm.DB, firstContentID uint64, count uint64, maxEntriesPerAd uint64) (*AdSizeEstimate, error) {
+	entries, err := countEntries(db, firstContentID, count)
+	if err != nil {
+		return nil, err
+	}
+
+	ads := subBatchCount(entries, maxEntriesPerAd)
+	var chunks uint64
+	for remaining := entries; remaining > 0; {
+		adEntries := remaining
+		if maxEntriesPerAd != 0 && adEntries > maxEntriesPerAd {
+			adEntries = maxEntriesPerAd
+		}
+		chunks += (adEntries + entriesChunkSize - 1) / entriesChunkSize
+		remaining -= adEntries
+	}
+
+	return &AdSizeEstimate{
+		FirstContentID: firstContentID,
+		Count:          count,
+		Entries:        entries,
+		Advertisements: ads,
+		Chunks:         chunks,
+		Bytes:          ads*estimatedAdOverhead + chunks*estimatedChunkOverhead + entries*estimatedEntrySize,
+	}, nil
+}
+
+// DryRunReport estimates the advertisement sizes of every batch of batchSize
+// contents as the advertisement loop would publish them, split over
+// advertisements of up to maxEntriesPerAd (0 doesn't split them), without
+// publishing anything
+func DryRunReport(db *gorm.DB, batchSize uint64, maxEntriesPerAd uint64) ([]*AdSizeEstimate, error) {
+	lastContentID, found, err := getLastContentID(db)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var estimates []*AdSizeEstimate
+	for firstContentID := uint64(0); firstContentID <= lastContentID; firstContentID += batchSize {
+		estimate, err := estimateAdSize(db, firstContentID, batchCount(firstContentID, lastContentID, batchSize), maxEntriesPerAd)
+		if err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, estimate)
+	}
+	return estimates, nil
+}
@@ -0,0 +1,93 @@
+package autoretrieve
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// notExpired filters obj_refs down to those of contents that haven't expired
+// by the time given as its argument
+const notExpired = "obj_refs.content NOT IN (SELECT id FROM contents WHERE expires_at <= ?)"
+
+// WithContentExpiry makes the provider stop advertising contents once their
+// expiry has passed: their multihashes are left out of the advertisements,
+// batches some of whose contents expired are re-published without them, and
+// the advertisements of batches whose contents all expired are removed
+func WithContentExpiry(enabled bool) ProviderOption {
+	return func(provider *Provider) {
+		provider.contentExpiry = enabled
+	}
+}
+
+// expiredBy returns the time contents must have expired by to be left out of
+// the advertisements, the zero time if expiry is disabled
+func (provider *Provider) expiredBy(now time.Time) time.Time {
+	if !provider.contentExpiry {
+		return time.Time{}
+	}
+	return now
+}
+
+// countLiveEntries is countEntries, leaving out the contents that expired by
+// expiredBy unless it is the zero time
+func countLiveEntries(db *gorm.DB, firstContentID uint64, count uint64, expiredBy time.Time) (uint64, error) {
+	if expiredBy.IsZero() {
+		return countEntries(db, firstContentID, count)
+	}
+
+	var entries uint64
+	if err := db.Raw(
+		"SELECT count(*) FROM obj_refs WHERE obj_refs.content BETWEEN ? AND ? AND "+notExpired,
+		firstContentID,
+		firstContentID+count,
+		expiredBy,
+	).Scan(&entries).Error; err != nil {
+		return 0, err
+	}
+	return entries, nil
+}
+
+// expiredSince reports whether any content of the batch starting at
+// firstContentID expired after since, up to now
+func expiredSince(db *gorm.DB, firstContentID uint64, count uint64, since time.Time, now time.Time) (bool, error) {
+	var expired int64
+	if err := db.Raw(
+		"SELECT count(*) FROM contents WHERE id BETWEEN ? AND ? AND expires_at > ? AND expires_at <= ?",
+		firstContentID,
+		firstContentID+count,
+		since,
+		now,
+	).Scan(&expired).Error; err != nil {
+		return false, err
+	}
+	return expired != 0, nil
+}
+
+// removeExpiredBatch removes the advertisement of a published batch whose
+// contents all expired and deletes the batch, a batch that couldn't be removed
+// is kept for the next tick. It returns false if the batch still has live
+// contents to re-publish.
+func (provider *Provider) removeExpiredBatch(ctx context.Context, log *zap.SugaredLogger, batch PublishedBatch) bool {
+	live, err := countLiveEntries(provider.db, batch.FirstContentID, provider.batchSize, time.Now())
+	if err != nil {
+		log.Errorf("Failed to count live multihashes of batch: %v", err)
+		// retried next tick rather than re-published without knowing
+		return true
+	}
+	if live != 0 {
+		return false
+	}
+
+	if !provider.removeBatchAdvertisement(ctx, batch) {
+		return true
+	}
+	if err := provider.db.Unscoped().Delete(&PublishedBatch{}, batch.ID).Error; err != nil {
+		log.Errorf("Failed to delete expired batch: %v", err)
+		return true
+	}
+	log.Infof("Removed batch whose contents all expired")
+	return true
+}
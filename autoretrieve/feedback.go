@@ -0,0 +1,80 @@
+package autoretrieve
+
+import (
+	"sync"
+	"time"
+)
+
+// RetrievalFeedback is consulted before a batch is re-advertised, so that
+// content which recently failed to be retrieved through an autoretrieve isn't
+// advertised again until it is known to work
+type RetrievalFeedback interface {
+	// Suppressed reports whether re-advertising the batch of count contents
+	// starting at firstContentID for the autoretrieve should be held back
+	Suppressed(handle string, firstContentID uint64, count uint64) bool
+}
+
+// WithRetrievalFeedback makes the provider skip re-advertising batches that
+// the feedback suppresses
+func WithRetrievalFeedback(feedback RetrievalFeedback) ProviderOption {
+	return func(provider *Provider) {
+		provider.retrievalFeedback = feedback
+	}
+}
+
+type retrievalKey struct {
+	handle    string
+	contentID uint64
+}
+
+// RetrievalTracker is a RetrievalFeedback fed by retrieval probes (e.g. the
+// benchest IPFS checks). A recorded failure suppresses its batch until a
+// success is recorded for the same content or the cooldown passes.
+type RetrievalTracker struct {
+	lk       sync.Mutex
+	cooldown time.Duration
+	failures map[retrievalKey]time.Time
+	now      func() time.Time
+}
+
+func NewRetrievalTracker(cooldown time.Duration) *RetrievalTracker {
+	return &RetrievalTracker{
+		cooldown: cooldown,
+		failures: make(map[retrievalKey]time.Time),
+		now:      time.Now,
+	}
+}
+
+func (rt *RetrievalTracker) RecordFailure(handle string, contentID uint64) {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+
+	rt.failures[retrievalKey{handle: handle, contentID: contentID}] = rt.now()
+}
+
+func (rt *RetrievalTracker) RecordSuccess(handle string, contentID uint64) {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+
+	delete(rt.failures, retrievalKey{handle: handle, contentID: contentID})
+}
+
+func (rt *RetrievalTracker) Suppressed(handle string, firstContentID uint64, count uint64) bool {
+	rt.lk.Lock()
+	defer rt.lk.Unlock()
+
+	now := rt.now()
+	suppressed := false
+	for key, failedAt := range rt.failures {
+		// Forget failures whose cooldown has passed
+		if now.Sub(failedAt) >= rt.cooldown {
+			delete(rt.failures, key)
+			continue
+		}
+
+		if key.handle == handle && key.contentID >= firstContentID && key.contentID < firstContentID+count {
+			suppressed = true
+		}
+	}
+	return suppressed
+}
@@ -0,0 +1,27 @@
+package autoretrieve
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrievalTracker(t *testing.T) {
+	now := time.Now()
+	rt := NewRetrievalTracker(time.Hour)
+	rt.now = func() time.Time { return now }
+
+	rt.RecordFailure("ar-1", 15)
+	assert.True(t, rt.Suppressed("ar-1", 10, 10))
+	assert.False(t, rt.Suppressed("ar-1", 0, 10), "failure is in another batch")
+	assert.False(t, rt.Suppressed("ar-2", 10, 10), "failure is for another autoretrieve")
+
+	rt.RecordSuccess("ar-1", 15)
+	assert.False(t, rt.Suppressed("ar-1", 10, 10), "success clears the failure")
+
+	rt.RecordFailure("ar-1", 15)
+	now = now.Add(2 * time.Hour)
+	assert.False(t, rt.Suppressed("ar-1", 10, 10), "cooldown has passed")
+	assert.Empty(t, rt.failures)
+}
@@ -0,0 +1,72 @@
+package autoretrieve
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+// populatedBatches returns the first content IDs of the batches in
+// [0, lastContentID] that reference any object, in ascending order. Instead
+// of counting every batch, it seeks the next referenced content ID from the
+// end of the last populated batch, so the holes deletions leave in the content
+// IDs cost a single query each.
+func (provider *Provider) populatedBatches(ctx context.Context, lastContentID uint64) ([]uint64, error) {
+	var batches []uint64
+	for next := uint64(0); next <= lastContentID; {
+		if err := provider.throttle(ctx); err != nil {
+			return nil, err
+		}
+
+		var contID sql.NullInt64
+		if err := provider.db.Raw(
+			"SELECT min(content) FROM obj_refs WHERE content >= ? AND content <= ?",
+			next,
+			lastContentID,
+		).Scan(&contID).Error; err != nil {
+			return nil, err
+		}
+		if !contID.Valid {
+			break
+		}
+
+		firstContentID := uint64(contID.Int64) - uint64(contID.Int64)%provider.batchSize
+		batches = append(batches, firstContentID)
+		next = firstContentID + provider.batchSize
+	}
+	return batches, nil
+}
+
+// batchesToAdvertise returns the first content IDs of the batches the
+// advertisement loop processes for the autoretrieve: the populated batches,
+// plus the batches published for it before, so that the advertisements of
+// ranges whose contents were all deleted are still reconciled
+func batchesToAdvertise(db *gorm.DB, handle string, populated []uint64, lastContentID uint64, batchSize uint64) ([]uint64, error) {
+	var published []uint64
+	if err := db.Model(&PublishedBatch{}).
+		Where("autoretrieve_handle = ? AND first_content_id <= ?", handle, lastContentID).
+		Distinct().
+		Pluck("first_content_id", &published).Error; err != nil {
+		return nil, err
+	}
+
+	seen := make(map[uint64]struct{}, len(populated)+len(published))
+	batches := make([]uint64, 0, len(populated)+len(published))
+	for _, ids := range [][]uint64{populated, published} {
+		for _, firstContentID := range ids {
+			// Batches published with another batch size are never visited
+			if firstContentID%batchSize != 0 {
+				continue
+			}
+			if _, ok := seen[firstContentID]; ok {
+				continue
+			}
+			seen[firstContentID] = struct{}{}
+			batches = append(batches, firstContentID)
+		}
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i] < batches[j] })
+	return batches, nil
+}
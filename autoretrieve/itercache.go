@@ -0,0 +1,77 @@
+package autoretrieve
+
+import (
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// iterationKey identifies the multihashes of a batch
+type iterationKey struct {
+	firstContentID uint64
+	count          uint64
+}
+
+// WithIterationCache makes the provider read the multihashes of a batch from
+// the database once per tick, and reuse them for every autoretrieve the batch
+// is advertised for in the same tick. The cache holds the multihashes of all
+// the batches published in a tick, so it trades memory for database scans.
+func WithIterationCache(enabled bool) ProviderOption {
+	return func(provider *Provider) {
+		provider.iterCacheEnabled = enabled
+	}
+}
+
+// beginIterationCache starts caching the multihash iteration for the tick
+func (provider *Provider) beginIterationCache() {
+	if !provider.iterCacheEnabled {
+		return
+	}
+
+	provider.iterCacheLk.Lock()
+	defer provider.iterCacheLk.Unlock()
+	provider.iterCache = make(map[iterationKey][]multihash.Multihash)
+}
+
+// endIterationCache drops the multihashes cached during the tick, obj_refs
+// written since are picked up by the next one
+func (provider *Provider) endIterationCache() {
+	provider.iterCacheLk.Lock()
+	defer provider.iterCacheLk.Unlock()
+	provider.iterCache = nil
+}
+
+// newIterator creates an iterator over the multihashes of a batch, from the
+// tick's cache if there is one
+func (provider *Provider) newIterator(firstContentID uint64, count uint64) (*Iterator, error) {
+	key := iterationKey{firstContentID: firstContentID, count: count}
+
+	provider.iterCacheLk.Lock()
+	mhs, cached := provider.iterCache[key]
+	caching := provider.iterCache != nil
+	provider.iterCacheLk.Unlock()
+
+	if cached {
+		// the iterator sorts and slices its multihashes, so each one gets
+		// its own copy
+		return &Iterator{
+			mhs:            append([]multihash.Multihash(nil), mhs...),
+			firstContentID: firstContentID,
+			count:          count,
+		}, nil
+	}
+
+	iter, err := newIteratorAt(provider.db, firstContentID, count, provider.objRefStrategy, provider.expiredBy(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	if caching {
+		provider.iterCacheLk.Lock()
+		if provider.iterCache != nil {
+			provider.iterCache[key] = append([]multihash.Multihash(nil), iter.mhs...)
+		}
+		provider.iterCacheLk.Unlock()
+	}
+	return iter, nil
+}
@@ -0,0 +1,73 @@
+package autoretrieve
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// AdvertisedBatch describes the (sub-)batch an advertisement is published for,
+// as encoded in its context ID
+type AdvertisedBatch struct {
+	Provider       peer.ID
+	FirstContentID uint64
+	Count          uint64
+	SubBatch       uint64
+}
+
+// MetadataExtension returns protocols to advertise for a batch alongside
+// bitswap, e.g. for experimental retrieval protocols
+type MetadataExtension func(batch AdvertisedBatch) ([]metadata.Protocol, error)
+
+// WithMetadataExtension merges the protocols the extension returns into the
+// metadata of every published advertisement. Protocols already in the
+// metadata (bitswap, or one the extension returns twice) are only advertised
+// once, and an extension error fails the publication so that it is retried.
+func WithMetadataExtension(extension MetadataExtension) ProviderOption {
+	return func(provider *Provider) {
+		provider.metadataExtension = extension
+	}
+}
+
+// advertisementMetadata builds the metadata published for a context ID
+func (provider *Provider) advertisementMetadata(contextID []byte) (metadata.Metadata, error) {
+	protocols := []metadata.Protocol{metadata.Bitswap{}}
+	if provider.metadataExtension == nil {
+		return metadata.New(protocols...), nil
+	}
+
+	params, err := readContextID(contextID)
+	if err != nil {
+		return metadata.Metadata{}, fmt.Errorf("failed to read context ID for metadata extension: %w", err)
+	}
+
+	extra, err := provider.metadataExtension(AdvertisedBatch{
+		Provider:       params.provider,
+		FirstContentID: params.firstContentID,
+		Count:          params.count,
+		SubBatch:       params.subBatch,
+	})
+	if err != nil {
+		return metadata.Metadata{}, fmt.Errorf("metadata extension failed: %w", err)
+	}
+
+	for _, protocol := range extra {
+		if protocol == nil {
+			continue
+		}
+		duplicate := false
+		for _, existing := range protocols {
+			if existing.ID() == protocol.ID() {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			log.Debugf("Ignoring duplicate protocol %s from metadata extension", protocol.ID())
+			continue
+		}
+		protocols = append(protocols, protocol)
+	}
+	return metadata.New(protocols...), nil
+}
@@ -0,0 +1,69 @@
+package autoretrieve
+
+import (
+	"context"
+
+	"github.com/application-research/estuary/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// distinct autoretrieve handles the metrics are labeled with, the handles
+// seen after those share otherHandleLabel so that registering many
+// autoretrieves can't blow up the number of series
+const maxHandleLabels = 50
+
+const otherHandleLabel = "other"
+
+// handleLabel returns the label for the handle in the metrics
+func (provider *Provider) handleLabel(handle string) string {
+	provider.handleLabelsLk.Lock()
+	defer provider.handleLabelsLk.Unlock()
+
+	if provider.handleLabels == nil {
+		provider.handleLabels = make(map[string]struct{})
+	}
+	if _, ok := provider.handleLabels[handle]; ok {
+		return handle
+	}
+	if len(provider.handleLabels) >= maxHandleLabels {
+		return otherHandleLabel
+	}
+	provider.handleLabels[handle] = struct{}{}
+	return handle
+}
+
+func (provider *Provider) recordBatchMetric(handle string, m *stats.Int64Measure) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(metrics.AutoretrieveHandle, provider.handleLabel(handle)))
+	if err != nil {
+		log.Warnf("Failed to tag autoretrieve metric: %v", err)
+		return
+	}
+	stats.Record(ctx, m.M(1))
+}
+
+// recordCoverage records the percentage of batches completely advertised for
+// the autoretrieve. Handles sharing otherHandleLabel are left out, the last
+// of them would overwrite the coverage of the others.
+func (provider *Provider) recordCoverage(handle string, lastContentID uint64) {
+	label := provider.handleLabel(handle)
+	if label == otherHandleLabel {
+		return
+	}
+
+	gaps, err := CoverageGaps(provider.db, handle, lastContentID, provider.batchSize)
+	if err != nil {
+		log.With("autoretrieve_handle", handle).Warnf("Failed to get coverage gaps: %v", err)
+		return
+	}
+
+	batches := lastContentID/provider.batchSize + 1
+	coverage := float64(batches-uint64(len(gaps))) / float64(batches) * 100
+
+	ctx, err := tag.New(context.Background(), tag.Upsert(metrics.AutoretrieveHandle, label))
+	if err != nil {
+		log.Warnf("Failed to tag autoretrieve metric: %v", err)
+		return
+	}
+	stats.Record(ctx, metrics.AutoretrieveCoverage.M(coverage))
+}
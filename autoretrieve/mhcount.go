@@ -0,0 +1,107 @@
+package autoretrieve
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// published batches without a multihash count that are counted per tick, so
+// that backfilling rows published before the count was recorded doesn't hold
+// up the advertisement loop
+const multihashCountBackfillPerTick = 100
+
+// notifyPut publishes the advertisement of a batch, also returning how many
+// multihashes the engine listed for it, nil if it didn't list them
+func (provider *Provider) notifyPut(ctx context.Context, addrInfo *peer.AddrInfo, contextID []byte) (cid.Cid, *uint64, error) {
+	md, err := provider.advertisementMetadata(contextID)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	key := string(contextID)
+
+	provider.listedLk.Lock()
+	if provider.listed == nil {
+		provider.listed = make(map[string]*uint64)
+	}
+	provider.listed[key] = nil
+	provider.listedLk.Unlock()
+
+	adCid, err := provider.engine.NotifyPut(ctx, addrInfo, contextID, md)
+
+	provider.listedLk.Lock()
+	count := provider.listed[key]
+	delete(provider.listed, key)
+	provider.listedLk.Unlock()
+
+	return adCid, count, err
+}
+
+// recordListed records how many multihashes the lister returned for a
+// context ID that is being published, lists for indexer pulls are ignored
+func (provider *Provider) recordListed(contextID []byte, count uint64) {
+	provider.listedLk.Lock()
+	defer provider.listedLk.Unlock()
+
+	if _, publishing := provider.listed[string(contextID)]; publishing {
+		provider.listed[string(contextID)] = &count
+	}
+}
+
+// countMultihashes counts the multihashes advertised for a (sub-)batch by
+// running its iterator
+func (provider *Provider) countMultihashes(firstContentID uint64, subBatch uint64) (uint64, error) {
+	iter, err := provider.newIterator(firstContentID, provider.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	if provider.maxEntriesPerAd != 0 {
+		iter.limitToSubBatch(subBatch, provider.maxEntriesPerAd)
+	}
+	return uint64(iter.Len()), nil
+}
+
+// backfillMultihashCount counts the multihashes of a batch published before
+// the count was recorded, within the tick's backfill budget
+func (provider *Provider) backfillMultihashCount(log *zap.SugaredLogger, batch *PublishedBatch) {
+	if batch.MultihashCount != nil || provider.mhCountBackfillBudget == 0 {
+		return
+	}
+	provider.mhCountBackfillBudget--
+
+	count, err := provider.countMultihashes(batch.FirstContentID, batch.SubBatch)
+	if err != nil {
+		log.Warnf("Failed to count multihashes of published batch: %v", err)
+		return
+	}
+
+	if err := provider.db.Model(&PublishedBatch{}).Where("id = ?", batch.ID).UpdateColumn("multihash_count", count).Error; err != nil {
+		log.Warnf("Failed to record multihash count of published batch: %v", err)
+		return
+	}
+	batch.MultihashCount = &count
+}
+
+// AdvertisedMultihashes returns how many multihashes are advertised for the
+// autoretrieve, and how many of its published batches haven't been counted
+// yet and are left out of that total
+func AdvertisedMultihashes(db *gorm.DB, handle string) (multihashes uint64, uncounted int64, err error) {
+	if err := db.Model(&PublishedBatch{}).
+		Select("COALESCE(SUM(multihash_count), 0)").
+		Where("autoretrieve_handle = ?", handle).
+		Scan(&multihashes).Error; err != nil {
+		return 0, 0, err
+	}
+
+	if err := db.Model(&PublishedBatch{}).
+		Where("autoretrieve_handle = ? AND multihash_count IS NULL", handle).
+		Count(&uncounted).Error; err != nil {
+		return 0, 0, err
+	}
+	return multihashes, uncounted, nil
+}
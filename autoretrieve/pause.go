@@ -0,0 +1,65 @@
+package autoretrieve
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// WithPauseRemoval makes the provider remove the advertisements of paused
+// autoretrieves and delete their published batches, so that their content
+// stops being findable until they are resumed. Otherwise the advertisements
+// of paused autoretrieves are left to expire on the indexer side
+func WithPauseRemoval(notifyRemove bool) ProviderOption {
+	return func(provider *Provider) {
+		provider.pauseNotifyRemove = notifyRemove
+	}
+}
+
+// PauseAutoretrieve stops the advertisement of an autoretrieve's content
+// without deregistering it
+func PauseAutoretrieve(db *gorm.DB, handle string) error {
+	return setPaused(db, handle, true)
+}
+
+// ResumeAutoretrieve advertises a paused autoretrieve's content again from
+// the next tick, batches whose advertisements were removed while paused are
+// re-published
+func ResumeAutoretrieve(db *gorm.DB, handle string) error {
+	return setPaused(db, handle, false)
+}
+
+func setPaused(db *gorm.DB, handle string, paused bool) error {
+	res := db.Model(&Autoretrieve{}).Where("handle = ?", handle).UpdateColumn("paused", paused)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no autoretrieve with handle %s: %w", handle, gorm.ErrRecordNotFound)
+	}
+	return nil
+}
+
+// removePausedBatches removes the advertisements of the published batches of
+// a paused autoretrieve and deletes the batches. A batch whose advertisement
+// could not be removed is kept for the next tick. It returns the amount of
+// batches deleted.
+func (provider *Provider) removePausedBatches(ctx context.Context, handle string) (int64, error) {
+	var batches []PublishedBatch
+	if err := provider.db.Where("autoretrieve_handle = ?", handle).Find(&batches).Error; err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	for _, batch := range batches {
+		if !provider.removeBatchAdvertisement(ctx, batch) {
+			continue
+		}
+		if err := provider.db.Unscoped().Delete(&PublishedBatch{}, batch.ID).Error; err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,66 @@
+package autoretrieve
+
+import (
+	"context"
+	"time"
+)
+
+// Published batches checked between two pauses of the reaper
+const reapPageSize = 100
+
+// WithEmptyBatchReaper makes the provider periodically remove the
+// advertisements and delete the published batches whose contents have all
+// been deleted, pausing for pace after each page of batches checked so that
+// the scan doesn't hammer the database (an interval of 0 disables reaping)
+func WithEmptyBatchReaper(interval time.Duration, pace time.Duration) ProviderOption {
+	return func(provider *Provider) {
+		provider.reapInterval = interval
+		provider.reapPace = pace
+	}
+}
+
+// ReapEmptyBatches removes the advertisements of the published batches whose
+// content range no longer references any object, and deletes the batches. A
+// batch whose advertisement could not be removed is kept for the next run.
+// It returns the amount of batches deleted.
+func (provider *Provider) ReapEmptyBatches(ctx context.Context) (int64, error) {
+	var reaped int64
+	var lastID uint
+	for {
+		var batches []PublishedBatch
+		if err := provider.db.Where("id > ?", lastID).Order("id asc").Limit(reapPageSize).Find(&batches).Error; err != nil {
+			return reaped, err
+		}
+		if len(batches) == 0 {
+			return reaped, nil
+		}
+
+		for _, batch := range batches {
+			lastID = batch.ID
+
+			// The advertisement resolves the whole batch size from its
+			// first content ID, not just the contents it was published with
+			entries, err := countEntries(provider.db, batch.FirstContentID, provider.batchSize)
+			if err != nil {
+				return reaped, err
+			}
+			if entries != 0 {
+				continue
+			}
+
+			if !provider.removeBatchAdvertisement(ctx, batch) {
+				continue
+			}
+			if err := provider.db.Unscoped().Delete(&PublishedBatch{}, batch.ID).Error; err != nil {
+				return reaped, err
+			}
+			reaped++
+		}
+
+		select {
+		case <-ctx.Done():
+			return reaped, ctx.Err()
+		case <-time.After(provider.reapPace):
+		}
+	}
+}
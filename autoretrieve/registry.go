@@ -0,0 +1,100 @@
+package autoretrieve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidRegistry is returned when a dump can't be imported as is, nothing
+// is imported then
+var ErrInvalidRegistry = errors.New("invalid registry")
+
+// RegistryEntry is an autoretrieve server as exported from the registry,
+// tokens are left out so a dump can't be used to impersonate a server
+type RegistryEntry struct {
+	Handle            string    `json:"handle"`
+	PubKey            string    `json:"pubKey"`
+	Addresses         string    `json:"addresses"`
+	LastConnection    time.Time `json:"lastConnection"`
+	LastAdvertisement time.Time `json:"lastAdvertisement"`
+	Paused            bool      `json:"paused"`
+}
+
+// ExportRegistry dumps the registered autoretrieve servers as JSON
+func ExportRegistry(db *gorm.DB) ([]byte, error) {
+	var autoretrieves []Autoretrieve
+	if err := db.Order("id asc").Find(&autoretrieves).Error; err != nil {
+		return nil, err
+	}
+
+	entries := make([]RegistryEntry, 0, len(autoretrieves))
+	for _, ar := range autoretrieves {
+		entries = append(entries, RegistryEntry{
+			Handle:            ar.Handle,
+			PubKey:            ar.PubKey,
+			Addresses:         ar.Addresses,
+			LastConnection:    ar.LastConnection,
+			LastAdvertisement: ar.LastAdvertisement,
+			Paused:            ar.Paused,
+		})
+	}
+	return json.Marshal(entries)
+}
+
+// ImportRegistry registers the autoretrieve servers of a dump made by
+// ExportRegistry, skipping handles that are already registered. Imported
+// servers get a new token and have to be re-initialized to learn it. It
+// returns how many servers were imported.
+func ImportRegistry(db *gorm.DB, data []byte) (int, error) {
+	var entries []RegistryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("%w: failed to parse: %v", ErrInvalidRegistry, err)
+	}
+
+	// validate the whole dump before importing anything
+	for _, entry := range entries {
+		if entry.Handle == "" {
+			return 0, fmt.Errorf("%w: entry with pub key %s has no handle", ErrInvalidRegistry, entry.PubKey)
+		}
+		ar := Autoretrieve{PubKey: entry.PubKey, Addresses: entry.Addresses}
+		if _, err := ar.AddrInfo(); err != nil {
+			return 0, fmt.Errorf("%w: entry %s: %v", ErrInvalidRegistry, entry.Handle, err)
+		}
+	}
+
+	var imported int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, entry := range entries {
+			var count int64
+			if err := tx.Model(&Autoretrieve{}).Where("handle = ?", entry.Handle).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+
+			if err := tx.Create(&Autoretrieve{
+				Handle:            entry.Handle,
+				Token:             "SECRET" + uuid.New().String() + "SECRET",
+				LastConnection:    entry.LastConnection,
+				LastAdvertisement: entry.LastAdvertisement,
+				PubKey:            entry.PubKey,
+				Addresses:         entry.Addresses,
+				Paused:            entry.Paused,
+			}).Error; err != nil {
+				return fmt.Errorf("failed to import %s: %w", entry.Handle, err)
+			}
+			imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
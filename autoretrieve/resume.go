@@ -0,0 +1,114 @@
+package autoretrieve
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	providerpkg "github.com/filecoin-project/index-provider"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"gorm.io/gorm"
+)
+
+// AdvertisementResumption summarizes a resumeAdvertisements run
+type AdvertisementResumption struct {
+	// published batches of the registered, unpaused autoretrieves
+	Batches int
+	// batches whose advertisement the engine still had
+	Kept int
+	// batches whose advertisement the engine had lost and that were published
+	// again
+	Republished int
+	Failed      int
+}
+
+// resumeAdvertisements reconciles the engine with the published batches once
+// it started. Its advertisements may not have survived the restart (its
+// datastore is in memory unless WithEngineDatastore is given, or was lost),
+// while the published batches say they are advertised, so the loop wouldn't
+// publish them again until they need a refresh. The engine is asked by
+// context ID through NotifyPut, which it refuses with ErrAlreadyAdvertised for
+// the advertisements its datastore still has, so only the lost ones are
+// published again.
+func (provider *Provider) resumeAdvertisements(ctx context.Context) (*AdvertisementResumption, error) {
+	log := log.Named("resume")
+
+	var autoretrieves []Autoretrieve
+	if err := provider.db.Find(&autoretrieves).Error; err != nil {
+		return nil, err
+	}
+
+	addrInfos := make(map[string]*peer.AddrInfo)
+	for _, autoretrieve := range autoretrieves {
+		// Batches of paused autoretrieves are left to the loop, which may
+		// remove them
+		if autoretrieve.Paused {
+			continue
+		}
+		addrInfo, err := autoretrieve.AddrInfo()
+		if err != nil {
+			log.Errorf("Failed to get address info of autoretrieve %s: %v", autoretrieve.Handle, err)
+			continue
+		}
+		addrInfos[autoretrieve.Handle] = addrInfo
+	}
+
+	res := &AdvertisementResumption{}
+	var batches []PublishedBatch
+	if err := provider.db.Order("id asc").FindInBatches(&batches, 1000, func(tx *gorm.DB, _ int) error {
+		for _, batch := range batches {
+			addrInfo, ok := addrInfos[batch.AutoretrieveHandle]
+			if !ok {
+				continue
+			}
+			res.Batches++
+
+			log := log.With("autoretrieve_handle", batch.AutoretrieveHandle, "first_content_id", batch.FirstContentID, "sub_batch", batch.SubBatch)
+
+			contextID, err := makeContextID(contextParams{
+				provider:       addrInfo.ID,
+				firstContentID: batch.FirstContentID,
+				count:          provider.batchSize,
+				subBatch:       batch.SubBatch,
+			})
+			if err != nil {
+				log.Errorf("Failed to make context ID: %v", err)
+				res.Failed++
+				continue
+			}
+
+			if err := provider.throttle(ctx); err != nil {
+				return err
+			}
+			adCid, mhCount, err := provider.notifyPut(ctx, addrInfo, contextID)
+			if errors.Is(err, providerpkg.ErrAlreadyAdvertised) {
+				res.Kept++
+				continue
+			}
+			if err != nil {
+				log.Errorf("Failed to publish batch missing from the engine: %v", err)
+				res.Failed++
+				continue
+			}
+
+			log.Infof("Published batch missing from the engine with advertisement CID %s", adCid)
+			provider.recordAdvertisement(batch.AutoretrieveHandle, batch.FirstContentID, batch.Count, adCid, false)
+			res.Republished++
+
+			if err := provider.db.Model(&PublishedBatch{}).Where("id = ?", batch.ID).Updates(map[string]interface{}{
+				"last_advertisement": time.Now(),
+				"multihash_count":    mhCount,
+			}).Error; err != nil {
+				log.Errorf("Failed to update batch in database: %v", err)
+			}
+		}
+		return nil
+	}).Error; err != nil {
+		return res, err
+	}
+
+	if res.Republished != 0 {
+		provider.announce(ctx)
+	}
+	return res, nil
+}
@@ -0,0 +1,71 @@
+package autoretrieve
+
+import (
+	"math/rand"
+	"time"
+)
+
+// WithScheduling gives each autoretrieve its own advertisement time instead of
+// advertising all of them on every tick, so that the load of advertising many
+// autoretrieves is spread over the interval. The loop then runs passes times
+// per interval, each pass advertising the autoretrieves that are due, which
+// are scheduled again an interval later, shifted by up to jitter (a fraction
+// of the interval) either way. Batch policies counted in ticks, like
+// WithAgePriority's cold batch ticks, count passes. 0 passes disables
+// scheduling.
+func WithScheduling(passes uint64, jitter float64) ProviderOption {
+	return func(provider *Provider) {
+		provider.schedulePasses = passes
+		provider.scheduleJitter = jitter
+	}
+}
+
+// tickInterval is how often the advertisement loop runs
+func (provider *Provider) tickInterval() time.Duration {
+	if provider.schedulePasses == 0 {
+		return provider.advertisementInterval
+	}
+	if tick := provider.advertisementInterval / time.Duration(provider.schedulePasses); tick > 0 {
+		return tick
+	}
+	return provider.advertisementInterval
+}
+
+// due reports whether the autoretrieve is to be advertised in the pass at
+// now. Autoretrieves that were never scheduled are given a random time within
+// the interval, so that they don't all start at once.
+func (provider *Provider) due(autoretrieve *Autoretrieve, now time.Time) (bool, error) {
+	if provider.schedulePasses == 0 {
+		return true, nil
+	}
+
+	if autoretrieve.NextAdvertisement == nil {
+		next := now.Add(time.Duration(rand.Int63n(int64(provider.advertisementInterval) + 1)))
+		if err := provider.setNextAdvertisement(autoretrieve, next); err != nil {
+			return false, err
+		}
+	}
+	return !autoretrieve.NextAdvertisement.After(now), nil
+}
+
+// reschedule schedules the next advertisement of the autoretrieve an interval
+// after now, with jitter
+func (provider *Provider) reschedule(autoretrieve *Autoretrieve, now time.Time) error {
+	if provider.schedulePasses == 0 {
+		return nil
+	}
+	return provider.setNextAdvertisement(autoretrieve, provider.nextAdvertisement(now))
+}
+
+func (provider *Provider) nextAdvertisement(now time.Time) time.Time {
+	offset := (rand.Float64()*2 - 1) * provider.scheduleJitter
+	return now.Add(provider.advertisementInterval + time.Duration(offset*float64(provider.advertisementInterval)))
+}
+
+func (provider *Provider) setNextAdvertisement(autoretrieve *Autoretrieve, next time.Time) error {
+	if err := provider.db.Model(&Autoretrieve{}).Where("id = ?", autoretrieve.ID).UpdateColumn("next_advertisement", next).Error; err != nil {
+		return err
+	}
+	autoretrieve.NextAdvertisement = &next
+	return nil
+}
@@ -0,0 +1,51 @@
+package autoretrieve
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SilentAutoretrieve is an autoretrieve that keeps connecting but none of
+// whose batches was advertised lately, e.g. because all its publications fail
+type SilentAutoretrieve struct {
+	Handle            string    `json:"handle"`
+	LastConnection    time.Time `json:"lastConnection"`
+	LastAdvertisement time.Time `json:"lastAdvertisement"`
+	// published batches of the autoretrieve, however old, 0 if it was never
+	// advertised at all
+	PublishedBatches int64 `json:"publishedBatches"`
+}
+
+// SilentAutoretrieves lists the unpaused autoretrieves that connected since
+// onlineSince but have no batch advertised since advertisedSince. Batches are
+// only republished when they change or need a refresh, so advertisedSince
+// should be well before the refresh interval ago.
+func SilentAutoretrieves(db *gorm.DB, onlineSince time.Time, advertisedSince time.Time) ([]SilentAutoretrieve, error) {
+	fresh := db.Model(&PublishedBatch{}).
+		Select("1").
+		Where("published_batches.autoretrieve_handle = autoretrieves.handle AND published_batches.last_advertisement >= ?", advertisedSince)
+
+	var autoretrieves []Autoretrieve
+	if err := db.Where("last_connection >= ? AND NOT paused AND NOT EXISTS (?)", onlineSince, fresh).
+		Order("handle asc").
+		Find(&autoretrieves).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]SilentAutoretrieve, 0, len(autoretrieves))
+	for _, ar := range autoretrieves {
+		var published int64
+		if err := db.Model(&PublishedBatch{}).Where("autoretrieve_handle = ?", ar.Handle).Count(&published).Error; err != nil {
+			return nil, err
+		}
+
+		out = append(out, SilentAutoretrieve{
+			Handle:            ar.Handle,
+			LastConnection:    ar.LastConnection,
+			LastAdvertisement: ar.LastAdvertisement,
+			PublishedBatches:  published,
+		})
+	}
+	return out, nil
+}
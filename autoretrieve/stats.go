@@ -0,0 +1,87 @@
+package autoretrieve
+
+import (
+	"time"
+)
+
+// A tick that hasn't completed within this many advertisement intervals
+// marks the provider as unhealthy
+const unhealthyTickIntervals = 2
+
+type ProviderStats struct {
+	Running           bool      `json:"running"`
+	Healthy           bool      `json:"healthy"`
+	AdvertiseInterval string    `json:"advertiseInterval"`
+	LastTickStarted   time.Time `json:"lastTickStarted"`
+	// last tick that completed without error
+	LastTickCompleted time.Time `json:"lastTickCompleted"`
+	LastError         string    `json:"lastError,omitempty"`
+	LastErrorAt       time.Time `json:"lastErrorAt,omitempty"`
+	// batch the loop is at (or stopped at) in the current (or last) tick
+	CursorHandle    string `json:"cursorHandle"`
+	CursorContentID uint64 `json:"cursorContentId"`
+}
+
+// Stats reports the state of the advertisement loop
+func (provider *Provider) Stats() ProviderStats {
+	provider.statsLk.Lock()
+	defer provider.statsLk.Unlock()
+
+	stats := provider.stats
+	stats.AdvertiseInterval = provider.advertisementInterval.String()
+	stats.Healthy = provider.healthy(time.Now())
+	return stats
+}
+
+// healthy reports whether a tick has completed within the last few intervals,
+// must be called with statsLk held
+func (provider *Provider) healthy(now time.Time) bool {
+	if !provider.stats.Running {
+		return false
+	}
+
+	last := provider.stats.LastTickCompleted
+	if last.IsZero() {
+		last = provider.runningSince
+	}
+	return now.Sub(last) <= unhealthyTickIntervals*provider.advertisementInterval
+}
+
+func (provider *Provider) startTick() {
+	provider.statsLk.Lock()
+	defer provider.statsLk.Unlock()
+
+	now := time.Now()
+	if !provider.stats.Running {
+		provider.stats.Running = true
+		provider.runningSince = now
+	}
+	provider.stats.LastTickStarted = now
+}
+
+func (provider *Provider) finishTick(err error) {
+	provider.statsLk.Lock()
+	defer provider.statsLk.Unlock()
+
+	if err != nil {
+		provider.stats.LastError = err.Error()
+		provider.stats.LastErrorAt = time.Now()
+		return
+	}
+	provider.stats.LastTickCompleted = time.Now()
+}
+
+func (provider *Provider) setCursor(handle string, firstContentID uint64) {
+	provider.statsLk.Lock()
+	defer provider.statsLk.Unlock()
+
+	provider.stats.CursorHandle = handle
+	provider.stats.CursorContentID = firstContentID
+}
+
+func (provider *Provider) stopped() {
+	provider.statsLk.Lock()
+	defer provider.statsLk.Unlock()
+
+	provider.stats.Running = false
+}
@@ -0,0 +1,30 @@
+package autoretrieve
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// WithQueryRate paces the queries the advertisement loop runs for each batch,
+// its published batch lookups, multihash counts and iterator reads, to at most
+// queriesPerSecond, so that a tick over many batches doesn't starve the
+// queries serving requests. 0 disables the pacing.
+func WithQueryRate(queriesPerSecond float64) ProviderOption {
+	return func(provider *Provider) {
+		if queriesPerSecond <= 0 {
+			provider.queryLimiter = nil
+			return
+		}
+		provider.queryLimiter = rate.NewLimiter(rate.Limit(queriesPerSecond), 1)
+	}
+}
+
+// throttle waits until the next query may run, it only fails if ctx is done
+// first
+func (provider *Provider) throttle(ctx context.Context) error {
+	if provider.queryLimiter == nil {
+		return nil
+	}
+	return provider.queryLimiter.Wait(ctx)
+}
@@ -0,0 +1,108 @@
+package autoretrieve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// findResponse is the part of the indexer's find API response the verification needs
+type findResponse struct {
+	MultihashResults []struct {
+		ProviderResults []struct {
+			Provider peer.AddrInfo
+		}
+	}
+}
+
+// IndexerVerification is the outcome of looking a multihash up with an
+// indexer
+type IndexerVerification struct {
+	IndexerURL string `json:"indexerUrl"`
+	Multihash  string `json:"multihash"`
+	Found      bool   `json:"found"`
+	Latency    string `json:"latency"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SampleMultihash returns a multihash of the batch starting at
+// firstContentID, to look up on the indexer once the batch is advertised
+func (provider *Provider) SampleMultihash(firstContentID uint64) (multihash.Multihash, error) {
+	iter, err := NewIterator(provider.db, firstContentID, provider.batchSize, provider.objRefStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	mh, err := iter.Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("batch starting at content %d has no multihashes", firstContentID)
+	}
+	return mh, err
+}
+
+// VerifyAdvertised looks the multihash up with the indexer's find API and
+// reports whether one of the registered autoretrieves is among its providers,
+// i.e. whether an advertisement containing it was actually ingested, along
+// with how long the lookup took
+func (provider *Provider) VerifyAdvertised(ctx context.Context, indexerURL string, mh multihash.Multihash) (bool, time.Duration, error) {
+	var autoretrieves []Autoretrieve
+	if err := provider.db.Find(&autoretrieves).Error; err != nil {
+		return false, 0, fmt.Errorf("failed to get autoretrieves: %w", err)
+	}
+
+	ours := make(map[peer.ID]bool, len(autoretrieves))
+	for _, autoretrieve := range autoretrieves {
+		addrInfo, err := autoretrieve.AddrInfo()
+		if err != nil {
+			continue
+		}
+		ours[addrInfo.ID] = true
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(indexerURL, "/")+"/multihash/"+mh.B58String(), nil)
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, time.Since(start), err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close indexer find response body: %v", err)
+		}
+	}()
+
+	// The indexer doesn't know the multihash at all
+	if resp.StatusCode == http.StatusNotFound {
+		return false, time.Since(start), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, time.Since(start), fmt.Errorf("indexer find returned status code %d", resp.StatusCode)
+	}
+
+	var found findResponse
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		return false, time.Since(start), fmt.Errorf("failed to decode indexer find response: %w", err)
+	}
+	latency := time.Since(start)
+
+	for _, result := range found.MultihashResults {
+		for _, providerResult := range result.ProviderResults {
+			if ours[providerResult.Provider.ID] {
+				return true, latency, nil
+			}
+		}
+	}
+	return false, latency, nil
+}
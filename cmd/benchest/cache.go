@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var cacheTestFlag = &cli.BoolFlag{
+	Name:  "cache-test",
+	Usage: "fetch the freshly added content a second time right after the first fetch, to compare a cold and a warm gateway cache",
+}
+
+type cacheStats struct {
+	// the first fetch of the content, which no cache can have served
+	Cold *fetchStats
+	// the fetch right after it, through the same gateway
+	Warm *fetchStats
+	// warm TTFB over cold TTFB, well below 1 when the cache works, 0 unless
+	// both fetches succeeded
+	WarmColdTTFBRatio float64 `json:",omitempty"`
+	// whether both fetches were answered by the same gateway host, a warm
+	// fetch answered by another one may have missed the cache
+	SameGatewayHost bool
+}
+
+// cacheTest fetches the content again right after the cold fetch and compares
+// the two
+func cacheTest(ctx context.Context, c string, cold *fetchStats) *cacheStats {
+	ctx, span := tracer.Start(ctx, "cacheTest")
+	defer span.End()
+
+	warm, err := benchFetch(ctx, c)
+	if err != nil {
+		warm = &fetchStats{
+			RequestError: err.Error(),
+		}
+	}
+
+	cst := &cacheStats{
+		Cold:            cold,
+		Warm:            warm,
+		SameGatewayHost: cold.GatewayHost != "" && cold.GatewayHost == warm.GatewayHost,
+	}
+	if retrieved(cold) && retrieved(warm) && cold.TimeToFirstByte > 0 {
+		cst.WarmColdTTFBRatio = float64(warm.TimeToFirstByte) / float64(cold.TimeToFirstByte)
+		span.SetAttributes(attribute.Float64("warmColdTTFBRatio", cst.WarmColdTTFBRatio))
+	}
+	return cst
+}
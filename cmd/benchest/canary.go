@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+var benchCanaryCmd = &cli.Command{
+	Name:      "canary",
+	Usage:     "continuously check that a fixed set of CIDs stays retrievable",
+	ArgsUsage: "<cids file>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "runner",
+			Value: "",
+		},
+		&cli.DurationFlag{
+			Name:  "every",
+			Usage: "how often to check the whole set of CIDs, 0 checks it once",
+			Value: 10 * time.Minute,
+		},
+		&cli.StringFlag{
+			Name:  "check-addr",
+			Usage: "multiaddr of the provider to also check the CIDs on with ipfs-check",
+		},
+		&cli.IntFlag{
+			Name:  "window",
+			Usage: "number of most recent checks of each CID the success ratio is computed over",
+			Value: 20,
+		},
+		insecureSkipVerifyFlag,
+		acceptEncodingFlag,
+		httpVersionFlag,
+		verifyFlag,
+		captureHeadersFlag,
+		headerFlag,
+		otelEndpointFlag,
+		metricsFileFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		if !cctx.Args().Present() {
+			return fmt.Errorf("must pass a file of CIDs")
+		}
+
+		cids, err := readCanaryCIDs(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		window := cctx.Int("window")
+		if window <= 0 {
+			return fmt.Errorf("invalid window %d", window)
+		}
+
+		if err := configureHTTPClient(cctx); err != nil {
+			return err
+		}
+
+		flushTraces, err := setupTracing(cctx)
+		if err != nil {
+			return err
+		}
+		defer flushTraces()
+
+		interval := cctx.Duration("every")
+		runner := cctx.String("runner")
+		checkAddr := cctx.String("check-addr")
+		history := newCanaryHistory(cids, window)
+
+		for {
+			start := time.Now()
+
+			for _, c := range cids {
+				res := runCanaryCheck(cctx.Context, c, checkAddr)
+				res.Runner = runner
+				res.SuccessRatio = history.record(res)
+
+				b, err := json.Marshal(res)
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(b))
+			}
+
+			if mf := cctx.String("metrics-file"); mf != "" {
+				if err := writeFileAtomic(mf, history.formatMetrics()); err != nil {
+					return fmt.Errorf("failed to write metrics file: %w", err)
+				}
+			}
+
+			if interval == 0 {
+				return nil
+			}
+			took := time.Since(start)
+			if took < interval {
+				select {
+				case <-cctx.Context.Done():
+					return cctx.Context.Err()
+				case <-time.After(interval - took):
+				}
+			}
+		}
+	},
+}
+
+// readCanaryCIDs reads one CID per line, skipping blank lines and # comments
+func readCanaryCIDs(path string) ([]string, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			logger.Warnf("failed to close cids file: %s", err)
+		}
+	}()
+
+	var cids []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := cid.Decode(line); err != nil {
+			return nil, fmt.Errorf("invalid cid %q: %w", line, err)
+		}
+		if !seen[line] {
+			seen[line] = true
+			cids = append(cids, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cids) == 0 {
+		return nil, fmt.Errorf("no cids in %s", path)
+	}
+	return cids, nil
+}
+
+type canaryResult struct {
+	Runner    string
+	CID       string
+	CheckedAt time.Time
+	// the fetch succeeded and, if the CID was also checked with ipfs-check, the provider served it over bitswap
+	Available bool
+	Latency   time.Duration
+	// ratio of available checks of the CID within the window, this one included
+	SuccessRatio float64
+
+	FetchStats *fetchStats
+	IpfsCheck  *checkResp `json:",omitempty"`
+}
+
+func runCanaryCheck(ctx context.Context, c string, checkAddr string) *canaryResult {
+	ctx, span := tracer.Start(ctx, "canaryCheck")
+	defer span.End()
+
+	res := &canaryResult{
+		CID:       c,
+		CheckedAt: time.Now(),
+	}
+
+	chk := make(chan *checkResp, 1)
+	if checkAddr != "" {
+		go func() {
+			chk <- ipfsCheck(ctx, c, checkAddr)
+		}()
+	} else {
+		chk <- nil
+	}
+
+	st, err := benchFetch(ctx, c)
+	if err != nil {
+		st = &fetchStats{
+			RequestStart: res.CheckedAt,
+			TotalElapsed: time.Since(res.CheckedAt),
+			RequestError: err.Error(),
+		}
+	}
+	res.FetchStats = st
+	res.Latency = st.TotalElapsed
+	res.IpfsCheck = <-chk
+
+	res.Available = retrieved(st)
+	if res.IpfsCheck != nil && res.IpfsCheck.Outcome != checkRetrievable {
+		res.Available = false
+	}
+	return res
+}
+
+// canaryHistory keeps the outcomes of the last checks of each CID
+type canaryHistory struct {
+	cids     []string
+	window   int
+	outcomes map[string][]bool
+	last     map[string]*canaryResult
+}
+
+func newCanaryHistory(cids []string, window int) *canaryHistory {
+	return &canaryHistory{
+		cids:     cids,
+		window:   window,
+		outcomes: make(map[string][]bool),
+		last:     make(map[string]*canaryResult),
+	}
+}
+
+// record adds the check to the CID's window and returns the CID's success ratio
+func (h *canaryHistory) record(res *canaryResult) float64 {
+	outcomes := append(h.outcomes[res.CID], res.Available)
+	if len(outcomes) > h.window {
+		outcomes = outcomes[len(outcomes)-h.window:]
+	}
+	h.outcomes[res.CID] = outcomes
+	h.last[res.CID] = res
+	return successRatio(outcomes)
+}
+
+func successRatio(outcomes []bool) float64 {
+	if len(outcomes) == 0 {
+		return 0
+	}
+	var ok int
+	for _, o := range outcomes {
+		if o {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(outcomes))
+}
+
+// formatMetrics renders the canary state in the Prometheus text exposition format
+func (h *canaryHistory) formatMetrics() []byte {
+	buf := new(bytes.Buffer)
+
+	var all []bool
+	var available int
+	for _, c := range h.cids {
+		all = append(all, h.outcomes[c]...)
+		if res := h.last[c]; res != nil && res.Available {
+			available++
+		}
+	}
+
+	fmt.Fprintln(buf, "# HELP benchest_canary_cids Number of CIDs in the canary set.")
+	fmt.Fprintln(buf, "# TYPE benchest_canary_cids gauge")
+	fmt.Fprintf(buf, "benchest_canary_cids %d\n", len(h.cids))
+
+	fmt.Fprintln(buf, "# HELP benchest_canary_available_cids Number of CIDs available on their last check.")
+	fmt.Fprintln(buf, "# TYPE benchest_canary_available_cids gauge")
+	fmt.Fprintf(buf, "benchest_canary_available_cids %d\n", available)
+
+	fmt.Fprintln(buf, "# HELP benchest_canary_success_ratio Ratio of available checks across the recent checks of all CIDs.")
+	fmt.Fprintln(buf, "# TYPE benchest_canary_success_ratio gauge")
+	fmt.Fprintf(buf, "benchest_canary_success_ratio %g\n", successRatio(all))
+
+	fmt.Fprintln(buf, "# HELP benchest_canary_cid_available Whether the CID was available on its last check.")
+	fmt.Fprintln(buf, "# TYPE benchest_canary_cid_available gauge")
+	for _, c := range h.cids {
+		if res := h.last[c]; res != nil {
+			v := 0
+			if res.Available {
+				v = 1
+			}
+			fmt.Fprintf(buf, "benchest_canary_cid_available{cid=%q} %d\n", c, v)
+		}
+	}
+
+	fmt.Fprintln(buf, "# HELP benchest_canary_cid_latency_seconds Time the last fetch of the CID took.")
+	fmt.Fprintln(buf, "# TYPE benchest_canary_cid_latency_seconds gauge")
+	for _, c := range h.cids {
+		if res := h.last[c]; res != nil {
+			fmt.Fprintf(buf, "benchest_canary_cid_latency_seconds{cid=%q} %g\n", c, res.Latency.Seconds())
+		}
+	}
+
+	fmt.Fprintln(buf, "# HELP benchest_canary_cid_success_ratio Ratio of available checks across the recent checks of the CID.")
+	fmt.Fprintln(buf, "# TYPE benchest_canary_cid_success_ratio gauge")
+	for _, c := range h.cids {
+		if outcomes := h.outcomes[c]; len(outcomes) > 0 {
+			fmt.Fprintf(buf, "benchest_canary_cid_success_ratio{cid=%q} %g\n", c, successRatio(outcomes))
+		}
+	}
+	return buf.Bytes()
+}
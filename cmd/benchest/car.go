@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	"github.com/urfave/cli/v2"
+)
+
+var carFlag = &cli.BoolFlag{
+	Name:  "car",
+	Usage: "upload the file as a CAR to /content/add-car instead of /content/add",
+}
+
+var carGzipFlag = &cli.BoolFlag{
+	Name:  "car-gzip",
+	Usage: "upload the CAR with gzip content-encoding, falling back to uncompressed if the server rejects it",
+}
+
+const carContentType = "application/vnd.ipld.car"
+
+type carStats struct {
+	RawSize        int64
+	CompressedSize int64 `json:",omitempty"`
+	Compressed     bool
+	// why the upload was retried uncompressed, if it was
+	CompressionFallback string `json:",omitempty"`
+	// bytes sent per second, until the add response was received
+	UploadThroughput float64
+}
+
+type carUpload struct {
+	root     cid.Cid
+	raw      []byte
+	gzipped  []byte
+	compress bool
+	fallback string
+}
+
+// newCarUpload imports the file into an in-memory blockstore and writes it out as a CAR
+func newCarUpload(ctx context.Context, fi io.Reader, compress bool) (*carUpload, error) {
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	nd, err := util.ImportFile(dserv, fi)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import file: %w", err)
+	}
+	return writeCarUpload(ctx, dserv, nd.Cid(), compress)
+}
+
+// writeCarUpload writes out the DAG under root as a CAR
+func writeCarUpload(ctx context.Context, dserv ipld.DAGService, root cid.Cid, compress bool) (*carUpload, error) {
+	raw := new(bytes.Buffer)
+	if err := car.WriteCar(ctx, dserv, []cid.Cid{root}, raw); err != nil {
+		return nil, fmt.Errorf("failed to write car: %w", err)
+	}
+
+	cu := &carUpload{
+		root:     root,
+		raw:      raw.Bytes(),
+		compress: compress,
+	}
+
+	if compress {
+		gzipped := new(bytes.Buffer)
+		zw := gzip.NewWriter(gzipped)
+		if _, err := zw.Write(cu.raw); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		cu.gzipped = gzipped.Bytes()
+	}
+	return cu, nil
+}
+
+func (cu *carUpload) body() []byte {
+	if cu.compress {
+		return cu.gzipped
+	}
+	return cu.raw
+}
+
+func (cu *carUpload) newRequest(ctx context.Context, host string, estToken string, name string) (*http.Request, error) {
+	addURL := fmt.Sprintf("https://%s/content/add-car?filename=%s", host, url.QueryEscape(name))
+
+	// a bytes.Reader body sets the Content-Length the endpoint requires
+	req, err := http.NewRequestWithContext(ctx, "POST", addURL, bytes.NewReader(cu.body()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", carContentType)
+	if cu.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	return req, nil
+}
+
+// fallBack switches to uncompressed uploads after the server rejected a compressed one
+func (cu *carUpload) fallBack(reason string) {
+	cu.compress = false
+	cu.fallback = reason
+}
+
+func (cu *carUpload) stats(uploadTime time.Duration) *carStats {
+	st := &carStats{
+		RawSize:             int64(len(cu.raw)),
+		Compressed:          cu.compress,
+		CompressionFallback: cu.fallback,
+	}
+	if cu.gzipped != nil {
+		st.CompressedSize = int64(len(cu.gzipped))
+	}
+	if uploadTime > 0 {
+		st.UploadThroughput = float64(len(cu.body())) / uploadTime.Seconds()
+	}
+	return st
+}
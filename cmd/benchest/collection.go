@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var collectionFlag = &cli.StringFlag{
+	Name:  "collection",
+	Usage: "UUID of the collection to add the benchmark content to, or 'new' to create a throwaway collection",
+}
+
+var labelFlag = &cli.StringFlag{
+	Name:  "label",
+	Usage: "name prefix of the uploaded benchmark files",
+	Value: "goodfile",
+}
+
+var autoCleanupFlag = &cli.BoolFlag{
+	Name:  "auto-cleanup",
+	Usage: "delete the collection once the benchmark runs are done",
+}
+
+type collectionResp struct {
+	UUID string `json:"uuid"`
+}
+
+// setupCollection resolves the --collection flag, creating a collection if requested. The returned func
+// deletes the collection when --auto-cleanup is set.
+func setupCollection(cctx *cli.Context, host string, estToken string) (string, func(), error) {
+	coluuid := cctx.String("collection")
+	if coluuid == "" {
+		if cctx.Bool("auto-cleanup") {
+			return "", nil, fmt.Errorf("--auto-cleanup requires --collection")
+		}
+		return "", func() {}, nil
+	}
+
+	if coluuid == "new" {
+		name := fmt.Sprintf("benchest-%s-%d", cctx.String("label"), time.Now().Unix())
+		created, err := createCollection(cctx.Context, host, estToken, name)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create benchmark collection: %w", err)
+		}
+		coluuid = created
+		fmt.Fprintln(os.Stderr, "created collection: ", coluuid)
+	}
+
+	cleanup := func() {}
+	if cctx.Bool("auto-cleanup") {
+		cleanup = func() {
+			if err := deleteCollection(context.Background(), host, estToken, coluuid); err != nil {
+				fmt.Fprintln(os.Stderr, "failed to delete collection: ", err)
+				return
+			}
+			fmt.Fprintln(os.Stderr, "deleted collection: ", coluuid)
+		}
+	}
+	return coluuid, cleanup, nil
+}
+
+func createCollection(ctx context.Context, host string, estToken string, name string) (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"name":        name,
+		"description": "benchest throwaway collection",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("https://%s/collections/", host), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+estToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close request body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("got invalid status code: %d, body: %s", resp.StatusCode, b)
+	}
+
+	var col collectionResp
+	if err := json.NewDecoder(resp.Body).Decode(&col); err != nil {
+		return "", err
+	}
+	return col.UUID, nil
+}
+
+func deleteCollection(ctx context.Context, host string, estToken string, coluuid string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("https://%s/collections/%s", host, coluuid), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close request body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("got invalid status code: %d, body: %s", resp.StatusCode, b)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var waitForDealFlag = &cli.BoolFlag{
+	Name:  "wait-for-deal",
+	Usage: "after adding, poll the content's deal status until a deal reaches --deal-state and record the time to deal",
+}
+
+var dealStateFlag = &cli.StringFlag{
+	Name:  "deal-state",
+	Usage: "state a deal has to reach: proposed, published or active",
+	Value: string(dealStateActive),
+}
+
+var dealTimeoutFlag = &cli.DurationFlag{
+	Name:  "deal-timeout",
+	Usage: "how long after the add to keep polling before recording that no deal was made",
+	Value: 48 * time.Hour,
+}
+
+var dealPollIntervalFlag = &cli.DurationFlag{
+	Name:  "deal-poll-interval",
+	Usage: "how often the deal status is polled",
+	Value: time.Minute,
+}
+
+// dealState is how far along a deal of the content is
+type dealState string
+
+const (
+	// a deal was proposed to a miner and hasn't failed
+	dealStateProposed dealState = "proposed"
+	// the deal was published on chain
+	dealStatePublished dealState = "published"
+	// the deal's sector was activated
+	dealStateActive dealState = "active"
+)
+
+func parseDealState(s string) (dealState, error) {
+	switch st := dealState(s); st {
+	case dealStateProposed, dealStatePublished, dealStateActive:
+		return st, nil
+	default:
+		return "", fmt.Errorf("unknown deal state %q (expected %q, %q or %q)", s, dealStateProposed, dealStatePublished, dealStateActive)
+	}
+}
+
+const (
+	// the deal reached the state
+	dealOutcomeReached = "reached"
+	// no deal reached the state before the timeout
+	dealOutcomeNoDeal = "no-deal-within-deadline"
+	// polling the deal status failed
+	dealOutcomeError = "error"
+)
+
+type waitForDealOpts struct {
+	State        dealState
+	Timeout      time.Duration
+	PollInterval time.Duration
+}
+
+func waitForDealOptsFromFlags(cctx *cli.Context) (*waitForDealOpts, error) {
+	if !cctx.Bool("wait-for-deal") {
+		return nil, nil
+	}
+
+	state, err := parseDealState(cctx.String("deal-state"))
+	if err != nil {
+		return nil, err
+	}
+	interval := cctx.Duration("deal-poll-interval")
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid deal poll interval %s", interval)
+	}
+	return &waitForDealOpts{
+		State:        state,
+		Timeout:      cctx.Duration("deal-timeout"),
+		PollInterval: interval,
+	}, nil
+}
+
+type dealStats struct {
+	State   dealState
+	Outcome string
+	Polls   int
+	// time from the add to the first deal reaching the state
+	TimeToDeal time.Duration `json:",omitempty"`
+	Miner      string        `json:",omitempty"`
+	DealID     int64         `json:",omitempty"`
+	// the last error polling the deal status, the error outcome if it
+	// stopped the wait
+	Error string `json:",omitempty"`
+}
+
+// contentStatus is the part of the content status response the wait looks at
+type contentStatus struct {
+	Deals []struct {
+		Deal struct {
+			Miner  string `json:"miner"`
+			DealID int64  `json:"dealId"`
+			Failed bool   `json:"failed"`
+		} `json:"deal"`
+		OnChainState *struct {
+			SectorStartEpoch int64 `json:"sectorStartEpoch"`
+		} `json:"onChainState"`
+	} `json:"deals"`
+}
+
+// waitForDeal polls the deal status of the content until one of its deals
+// reaches the state or the timeout (counted from addedAt) passes
+func waitForDeal(ctx context.Context, host string, estToken string, contID uint64, addedAt time.Time, opts *waitForDealOpts) (st *dealStats) {
+	ctx, span := tracer.Start(ctx, "waitForDeal")
+	defer func() {
+		span.SetAttributes(
+			attribute.String("outcome", st.Outcome),
+			attribute.Int("polls", st.Polls),
+			attribute.Int64("timeToDealMs", st.TimeToDeal.Milliseconds()),
+		)
+		span.End()
+	}()
+
+	st = &dealStats{State: opts.State}
+	deadline := addedAt.Add(opts.Timeout)
+	for {
+		st.Polls++
+		status, err := getContentStatus(ctx, host, estToken, contID)
+		if err != nil {
+			// the status is polled again, a deadline without deal remains
+			// the outcome if it keeps failing
+			st.Error = err.Error()
+			logger.Warnf("failed to get deal status of content %d: %s", contID, err)
+		} else if miner, dealID, ok := dealReached(status, opts.State); ok {
+			st.Outcome = dealOutcomeReached
+			st.TimeToDeal = time.Since(addedAt)
+			st.Miner = miner
+			st.DealID = dealID
+			st.Error = ""
+			return st
+		}
+
+		if time.Now().Add(opts.PollInterval).After(deadline) {
+			st.Outcome = dealOutcomeNoDeal
+			return st
+		}
+
+		select {
+		case <-ctx.Done():
+			st.Outcome = dealOutcomeError
+			st.Error = ctx.Err().Error()
+			return st
+		case <-time.After(opts.PollInterval):
+		}
+	}
+}
+
+// dealReached returns the first deal of the content that reached the state
+func dealReached(status *contentStatus, state dealState) (string, int64, bool) {
+	for _, d := range status.Deals {
+		if d.Deal.Failed {
+			continue
+		}
+
+		switch state {
+		case dealStateProposed:
+		case dealStatePublished:
+			if d.Deal.DealID == 0 {
+				continue
+			}
+		case dealStateActive:
+			if d.OnChainState == nil || d.OnChainState.SectorStartEpoch <= 0 {
+				continue
+			}
+		}
+		return d.Deal.Miner, d.Deal.DealID, true
+	}
+	return "", 0, false
+}
+
+func getContentStatus(ctx context.Context, host string, estToken string, contID uint64) (*contentStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/content/status/%d", host, contID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	injectTraceHeaders(ctx, req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("content status returned status code %d: %s", resp.StatusCode, b)
+	}
+
+	var status contentStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode content status: %w", err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/urfave/cli/v2"
+)
+
+// acceptEncoding is sent with gateway fetches when set, empty leaves content
+// negotiation to the http client
+var acceptEncoding string
+
+var acceptEncodingFlag = &cli.StringFlag{
+	Name:  "accept-encoding",
+	Usage: "Accept-Encoding header to send with gateway fetches (e.g. 'gzip, deflate'), compressed responses are decompressed while both the on-wire and decompressed sizes are reported",
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// decodeBody wraps the response body in a decompressor for the content encoding
+func decodeBody(encoding string, body io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
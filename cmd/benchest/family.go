@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/multiformats/go-multiaddr"
+	"github.com/urfave/cli/v2"
+)
+
+// addrFamily restricts the provider addresses ipfs-check is run against
+type addrFamily string
+
+const (
+	familyAny addrFamily = "any"
+	familyV4  addrFamily = "v4"
+	familyV6  addrFamily = "v6"
+)
+
+var checkFamilyFlag = &cli.StringFlag{
+	Name:  "check-family",
+	Usage: "only check provider addresses of this family: v4, v6 or any",
+	Value: string(familyAny),
+}
+
+func parseAddrFamily(s string) (addrFamily, error) {
+	switch f := addrFamily(s); f {
+	case "":
+		return familyAny, nil
+	case familyAny, familyV4, familyV6:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown address family %q (expected %q, %q or %q)", s, familyV4, familyV6, familyAny)
+	}
+}
+
+// family reports the family of a provider multiaddr from its first component, /dns addresses can resolve to
+// either and only match any
+func family(addr string) (addrFamily, error) {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return "", err
+	}
+
+	var f addrFamily = familyAny
+	multiaddr.ForEach(ma, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_IP4, multiaddr.P_DNS4:
+			f = familyV4
+		case multiaddr.P_IP6, multiaddr.P_DNS6:
+			f = familyV6
+		}
+		return false
+	})
+	return f, nil
+}
+
+// filterFamily keeps the providers of the requested family, failing if there are none
+func filterFamily(providers []string, want addrFamily) ([]string, error) {
+	if want == familyAny || want == "" {
+		return providers, nil
+	}
+
+	var out []string
+	for _, p := range providers {
+		f, err := family(p)
+		if err != nil {
+			continue
+		}
+		if f == want {
+			out = append(out, p)
+		}
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no %s provider address in %v", want, providers)
+	}
+	return out, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/http/httpguts"
+)
+
+// captureHeaders are the response headers recorded from add and fetch
+// responses, in canonical form
+var captureHeaders []string
+
+var captureHeadersFlag = &cli.StringSliceFlag{
+	Name:  "capture-headers",
+	Usage: "response headers to record from the add and fetch responses (e.g. 'x-cache-status,x-served-by'), can be repeated",
+}
+
+func setCaptureHeaders(names []string) {
+	captureHeaders = nil
+	for _, name := range names {
+		for _, n := range strings.Split(name, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				captureHeaders = append(captureHeaders, http.CanonicalHeaderKey(n))
+			}
+		}
+	}
+}
+
+// capturedHeaders returns the allowlisted headers present in the response,
+// values of repeated headers are joined with commas
+func capturedHeaders(h http.Header) map[string]string {
+	var out map[string]string
+	for _, name := range captureHeaders {
+		values := h.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string)
+		}
+		out[name] = strings.Join(values, ", ")
+	}
+	return out
+}
+
+var headerFlag = &cli.StringSliceFlag{
+	Name:  "header",
+	Usage: "header to send with every request, as 'Key: Value' (e.g. for auth proxies or feature flags), can be repeated",
+}
+
+// requestHeaders are the custom headers sent with every request
+var requestHeaders http.Header
+
+// parseHeaders parses 'Key: Value' headers, values of repeated keys are all
+// sent
+func parseHeaders(headers []string) (http.Header, error) {
+	var out http.Header
+	for _, h := range headers {
+		key, value, ok := strings.Cut(h, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid header %q, expected 'Key: Value'", h)
+		}
+		if !httpguts.ValidHeaderFieldName(key) {
+			return nil, fmt.Errorf("invalid header name %q in %q", key, h)
+		}
+		value = strings.TrimSpace(value)
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fmt.Errorf("invalid value for header %q", key)
+		}
+
+		if out == nil {
+			out = make(http.Header)
+		}
+		out.Add(key, value)
+	}
+	return out, nil
+}
+
+// sentHeaders returns the custom headers for the result, values of repeated
+// headers are joined with commas
+func sentHeaders() map[string]string {
+	var out map[string]string
+	for name, values := range requestHeaders {
+		if out == nil {
+			out = make(map[string]string)
+		}
+		out[name] = strings.Join(values, ", ")
+	}
+	return out
+}
+
+// headerTransport adds the custom headers to every request, replacing
+// headers of the same name set by benchest itself
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// round trippers must not modify the request they are given
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	return t.base.RoundTrip(req)
+}
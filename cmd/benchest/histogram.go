@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var histogramBucketsFlag = &cli.StringFlag{
+	Name:  "histogram-buckets",
+	Usage: "comma separated upper bounds of latency buckets (e.g. 100ms,500ms,1s,5s), prints a histogram of each latency across the runs once they finished",
+}
+
+// parseHistogramBuckets parses the bucket upper bounds, which have to be increasing
+func parseHistogramBuckets(s string) ([]time.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var buckets []time.Duration
+	for _, b := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram bucket %q: %w", b, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid histogram bucket %s, must be positive", d)
+		}
+		if len(buckets) > 0 && d <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("histogram buckets must be increasing, %s follows %s", d, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, d)
+	}
+	return buckets, nil
+}
+
+// histogramCounts counts the samples in each bucket, the last count is of the samples above the last bucket
+func histogramCounts(samples []time.Duration, buckets []time.Duration) []int {
+	counts := make([]int, len(buckets)+1)
+	for _, s := range samples {
+		i := 0
+		for i < len(buckets) && s > buckets[i] {
+			i++
+		}
+		counts[i]++
+	}
+	return counts
+}
+
+// histogramBarWidth is the width of the bar of the fullest bucket
+const histogramBarWidth = 40
+
+// printHistograms prints a histogram of each latency the SLOs can be checked on, so that a distribution
+// with several modes (e.g. cache hits and misses) shows up where the percentiles would hide it
+func printHistograms(w io.Writer, results []*benchResult, buckets []time.Duration) {
+	for _, s := range samplers {
+		samples := s.samples(results)
+		fmt.Fprintf(w, "%s latency histogram (%d samples):\n", s.name, len(samples))
+		if len(samples) == 0 {
+			continue
+		}
+
+		counts := histogramCounts(samples, buckets)
+		max := 0
+		for _, c := range counts {
+			if c > max {
+				max = c
+			}
+		}
+
+		for i, c := range counts {
+			label := fmt.Sprintf("> %s", buckets[len(buckets)-1])
+			if i < len(buckets) {
+				label = fmt.Sprintf("<= %s", buckets[i])
+			}
+			bar := strings.Repeat("#", c*histogramBarWidth/max)
+			fmt.Fprintf(w, "  %-12s %6d %s\n", label, c, bar)
+		}
+	}
+}
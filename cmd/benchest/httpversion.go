@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// fetchClient makes the gateway fetches, it is httpClient unless
+// --http-version restricts the fetches to another protocol
+var fetchClient = httpClient
+
+var httpVersionFlag = &cli.StringFlag{
+	Name:  "http-version",
+	Usage: "HTTP version of the gateway fetches: auto (HTTP/2 if the gateway supports it) or 1.1 (HTTP/1.1 only, without multiplexing)",
+	Value: "auto",
+}
+
+// configureFetchClient makes fetchClient use HTTP/1.1 only when asked to, on
+// the transport httpClient was configured with
+func configureFetchClient(version string) error {
+	switch version {
+	case "", "auto":
+		fetchClient = httpClient
+		return nil
+	case "1.1":
+	default:
+		return fmt.Errorf("unknown http version %q (expected auto or 1.1)", version)
+	}
+
+	base := http.DefaultTransport.(*http.Transport)
+	if tr, ok := unwrapTransport(httpClient.Transport).(*http.Transport); ok {
+		base = tr
+	}
+	h1 := base.Clone()
+	h1.ForceAttemptHTTP2 = false
+	// a non-nil empty map keeps the transport from upgrading to HTTP/2
+	h1.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+
+	var transport http.RoundTripper = h1
+	if len(requestHeaders) != 0 {
+		transport = &headerTransport{base: transport, headers: requestHeaders}
+	}
+	fetchClient = &http.Client{Transport: transport}
+	return nil
+}
+
+func unwrapTransport(rt http.RoundTripper) http.RoundTripper {
+	if ht, ok := rt.(*headerTransport); ok {
+		return ht.base
+	}
+	return rt
+}
+
+// connCounter counts the TCP connections a request opens, redirects
+// included, through its client trace
+type connCounter struct {
+	lk     sync.Mutex
+	opened int
+	reused int
+}
+
+func (cc *connCounter) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		// dials racing for the same connection (e.g. IPv4 and IPv6) each
+		// report a connect, only those that succeeded opened one
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				return
+			}
+			cc.lk.Lock()
+			defer cc.lk.Unlock()
+			cc.opened++
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				return
+			}
+			cc.lk.Lock()
+			defer cc.lk.Unlock()
+			cc.reused++
+		},
+	}
+}
+
+func (cc *connCounter) counts() (opened int, reused int) {
+	cc.lk.Lock()
+	defer cc.lk.Unlock()
+	return cc.opened, cc.reused
+}
@@ -3,13 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -18,12 +26,49 @@ import (
 	"github.com/application-research/estuary/util"
 	pgd "github.com/jinzhu/gorm/dialects/postgres"
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var logger = logging.Logger("benchtest")
 
+// httpClient is shared by the add, fetch and check requests
+var httpClient = &http.Client{}
+
+var insecureSkipVerifyFlag = &cli.BoolFlag{
+	Name:  "insecure-skip-verify",
+	Usage: "skip TLS certificate verification (for gateways and hosts with self-signed certificates)",
+}
+
+func configureHTTPClient(cctx *cli.Context) error {
+	acceptEncoding = cctx.String("accept-encoding")
+	verifyFetches = cctx.Bool("verify")
+	setCaptureHeaders(cctx.StringSlice("capture-headers"))
+
+	headers, err := parseHeaders(cctx.StringSlice("header"))
+	if err != nil {
+		return err
+	}
+	requestHeaders = headers
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if cctx.Bool("insecure-skip-verify") {
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is disabled for all requests")
+
+		insecure := http.DefaultTransport.(*http.Transport).Clone()
+		insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		transport = insecure
+	}
+	if len(requestHeaders) != 0 {
+		transport = &headerTransport{base: transport, headers: requestHeaders}
+	}
+	if transport != http.DefaultTransport {
+		httpClient.Transport = transport
+	}
+	return configureFetchClient(cctx.String("http-version"))
+}
+
 func main() {
 	app := getApp()
 
@@ -42,6 +87,9 @@ func getApp() *cli.App {
 		benchAddFileCmd,
 		benchFetchFileCmd,
 		benchAddResultCmd,
+		benchCanaryCmd,
+		benchWhoamiCmd,
+		benchReadScaleCmd,
 	}
 
 	return app
@@ -54,19 +102,79 @@ func getFile(cctx *cli.Context) (io.Reader, string, error) {
 		return nil, "", err
 	}
 
-	return bytes.NewReader(buf), fmt.Sprintf("goodfile-%x", buf[:4]), nil
+	return bytes.NewReader(buf), fmt.Sprintf("%s-%x", cctx.String("label"), buf[:4]), nil
 }
 
 type benchResult struct {
 	Runner          string
+	Collection      string
 	BenchStart      time.Time
 	FileCID         string
+	ContentType     string `json:",omitempty"`
 	AddFileRespTime time.Duration
 	AddFileTime     time.Duration
 	AddFileError    string
+	// allowlisted response headers of the add request, see --capture-headers
+	AddFileHeaders map[string]string `json:",omitempty"`
+	// custom headers sent with every request, see --header
+	RequestHeaders map[string]string `json:",omitempty"`
+
+	FetchStats  *fetchStats
+	IpfsCheck   *checkResp
+	Retrievable *retrievableStats `json:",omitempty"`
+	Car         *carStats         `json:",omitempty"`
+	Resumable   *resumableStats   `json:",omitempty"`
+	Presigned   *presignedStats   `json:",omitempty"`
+	UploadRate  *uploadRateStats  `json:",omitempty"`
+	Deal        *dealStats        `json:",omitempty"`
+	Pin         *pinStats         `json:",omitempty"`
+	// the shuttle the upload was routed to, see --route-to-shuttle
+	ShuttleRoute *shuttleRouteStats `json:",omitempty"`
+	// cold and warm fetches of the content, see --cache-test
+	Cache *cacheStats `json:",omitempty"`
+	// set with --upload-only, which skips the fetch and the checks
+	Upload *uploadStats `json:",omitempty"`
+	// the directory uploaded with --many-files
+	ManyFiles *manyFilesStats `json:",omitempty"`
+
+	// every provider's check, see --provider-strategy all
+	ProviderChecks *providerChecks `json:",omitempty"`
+}
 
-	FetchStats *fetchStats
-	IpfsCheck  *checkResp
+type addFileOpts struct {
+	// UUID of the collection to add the content to, if any
+	Collection string
+	// how long to poll for the content to become retrievable, 0 fetches once
+	RetrievableTimeout time.Duration
+	// if set, only provider addresses matching it are checked
+	ProviderMatch *regexp.Regexp
+	// how the provider addresses to check are picked
+	ProviderStrategy providerStrategy
+	// if set, only provider addresses of this family are checked
+	CheckFamily addrFamily
+	// path of the endpoint the multipart file is POSTed to
+	Endpoint string
+	// MIME type of the uploaded multipart file
+	ContentType string
+	// if set, the file is uploaded through the resumable upload endpoint when the server supports it
+	Resumable *resumableOpts
+	// if set, the file is uploaded through a pre-signed URL issued by the server
+	Presigned *presignedOpts
+	// upload the file as a CAR, optionally gzipped
+	Car     bool
+	CarGzip bool
+	// bytes per second the upload is throttled to, 0 doesn't throttle it
+	UploadRate int64
+	// if set, wait for a deal of the content after the add
+	WaitForDeal *waitForDealOpts
+	// if set, the API adds the file on this shuttle
+	ShuttleRoute *shuttleRoute
+	// fetch the content a second time to compare cold and warm fetches
+	CacheTest bool
+	// only time the add, skipping the fetch and the checks
+	UploadOnly bool
+	// if set, a directory of generated files is uploaded as a CAR instead of the file
+	ManyFiles *manyFilesOpts
 }
 
 var benchAddFileCmd = &cli.Command{
@@ -88,6 +196,63 @@ var benchAddFileCmd = &cli.Command{
 			Name:  "every",
 			Usage: "run benchmark in a loop on the specified interval",
 		},
+		&cli.StringFlag{
+			Name:  "endpoint",
+			Usage: "path of the API endpoint the file is POSTed to, for deployments serving it elsewhere",
+			Value: "/content/add",
+		},
+		&cli.StringFlag{
+			Name:  "content-type",
+			Usage: "MIME type the file is uploaded with, to benchmark type-based routing and caching",
+			Value: "application/octet-stream",
+		},
+		&cli.StringFlag{
+			Name:  "provider-match",
+			Usage: "regular expression (or substring) the provider address checked with ipfs-check must match, e.g. a shuttle's host",
+		},
+		providerStrategyFlag,
+		checkFamilyFlag,
+		insecureSkipVerifyFlag,
+		acceptEncodingFlag,
+		httpVersionFlag,
+		verifyFlag,
+		captureHeadersFlag,
+		headerFlag,
+		otelEndpointFlag,
+		metricsFileFlag,
+		metricsWindowFlag,
+		rawOutputFlag,
+		uploadRateFlag,
+		routeToShuttleFlag,
+		cacheTestFlag,
+		uploadOnlyFlag,
+		runsFlag,
+		sloPercentileFlag,
+		sloTtfbFlag,
+		sloTotalFlag,
+		sloAddFlag,
+		histogramBucketsFlag,
+		collectionFlag,
+		labelFlag,
+		autoCleanupFlag,
+		pollUntilRetrievableFlag,
+		retrievableTimeoutFlag,
+		carFlag,
+		carGzipFlag,
+		manyFilesFlag,
+		fileSizeFlag,
+		resumableFlag,
+		resumablePathFlag,
+		resumableChunkSizeFlag,
+		resumableRetriesFlag,
+		presignedFlag,
+		presignedPathFlag,
+		waitForDealFlag,
+		dealStateFlag,
+		dealTimeoutFlag,
+		dealPollIntervalFlag,
+		pinCidFlag,
+		pinTimeoutFlag,
 	},
 	Action: func(cctx *cli.Context) error {
 		estToken := os.Getenv("ESTUARY_TOKEN")
@@ -95,10 +260,95 @@ var benchAddFileCmd = &cli.Command{
 			return fmt.Errorf("no estuary token found")
 		}
 
+		if err := configureHTTPClient(cctx); err != nil {
+			return err
+		}
+
+		flushTraces, err := setupTracing(cctx)
+		if err != nil {
+			return err
+		}
+		defer flushTraces()
+
 		host := cctx.String("host")
 		interval := cctx.Duration("every")
 		runner := cctx.String("runner")
 
+		endpoint := cctx.String("endpoint")
+		if !strings.HasPrefix(endpoint, "/") {
+			return fmt.Errorf("invalid endpoint %q: must start with /", endpoint)
+		}
+		if cctx.IsSet("endpoint") && cctx.Bool("car") {
+			return fmt.Errorf("--endpoint can't be combined with --car")
+		}
+
+		var providerMatch *regexp.Regexp
+		if pm := cctx.String("provider-match"); pm != "" {
+			providerMatch, err = regexp.Compile(pm)
+			if err != nil {
+				return fmt.Errorf("invalid provider match: %w", err)
+			}
+		}
+
+		histogramBuckets, err := parseHistogramBuckets(cctx.String("histogram-buckets"))
+		if err != nil {
+			return err
+		}
+		if err := checkRunFlags(cctx); err != nil {
+			return err
+		}
+
+		providerStrategy, err := parseProviderStrategy(cctx.String("provider-strategy"))
+		if err != nil {
+			return err
+		}
+
+		checkFamily, err := parseAddrFamily(cctx.String("check-family"))
+		if err != nil {
+			return err
+		}
+
+		resumable, err := resumableOptsFromFlags(cctx)
+		if err != nil {
+			return err
+		}
+
+		presigned, err := presignedOptsFromFlags(cctx)
+		if err != nil {
+			return err
+		}
+
+		dealWait, err := waitForDealOptsFromFlags(cctx)
+		if err != nil {
+			return err
+		}
+
+		pin, err := pinOptsFromFlags(cctx)
+		if err != nil {
+			return err
+		}
+
+		route, err := shuttleRouteFromFlags(cctx, host, estToken)
+		if err != nil {
+			return err
+		}
+
+		uploadOnly, err := uploadOnlyFromFlags(cctx)
+		if err != nil {
+			return err
+		}
+
+		manyFiles, err := manyFilesOptsFromFlags(cctx)
+		if err != nil {
+			return err
+		}
+
+		coluuid, cleanupCollection, err := setupCollection(cctx, host, estToken)
+		if err != nil {
+			return err
+		}
+		defer cleanupCollection()
+
 		var resdb *gorm.DB
 		if pg := cctx.String("postgres"); pg != "" {
 			db, err := openDB(pg)
@@ -108,14 +358,47 @@ var benchAddFileCmd = &cli.Command{
 			resdb = db
 		}
 
-		for {
-			start := time.Now()
-			fi, name, err := getFile(cctx)
+		var raw *rawOutput
+		if ro := cctx.String("raw-output"); ro != "" {
+			raw, err = openRawOutput(ro)
 			if err != nil {
 				return err
 			}
+			defer raw.Close()
+		}
 
-			outstats, err := RunBenchAddFile(name, fi, host, estToken)
+		var results []*benchResult
+		for {
+			start := time.Now()
+			var outstats *benchResult
+			if pin != nil {
+				outstats, err = RunBenchPinCID(cctx.Context, host, estToken, pin)
+			} else {
+				fi, name, ferr := getFile(cctx)
+				if ferr != nil {
+					return ferr
+				}
+
+				outstats, err = RunBenchAddFile(cctx.Context, name, fi, host, estToken, addFileOpts{
+					Collection:         coluuid,
+					RetrievableTimeout: retrievableTimeout(cctx),
+					ProviderMatch:      providerMatch,
+					ProviderStrategy:   providerStrategy,
+					CheckFamily:        checkFamily,
+					Endpoint:           endpoint,
+					ContentType:        cctx.String("content-type"),
+					Resumable:          resumable,
+					Presigned:          presigned,
+					Car:                cctx.Bool("car"),
+					CarGzip:            cctx.Bool("car-gzip"),
+					UploadRate:         cctx.Int64("upload-rate"),
+					WaitForDeal:        dealWait,
+					ShuttleRoute:       route,
+					CacheTest:          cctx.Bool("cache-test"),
+					UploadOnly:         uploadOnly,
+					ManyFiles:          manyFiles,
+				})
+			}
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "failed to run bench: ", err)
 				time.Sleep(time.Second * 15)
@@ -123,11 +406,18 @@ var benchAddFileCmd = &cli.Command{
 			}
 
 			outstats.Runner = runner
+			outstats.Collection = coluuid
+			outstats.RequestHeaders = sentHeaders()
 
-			b, err := json.MarshalIndent(outstats, "", "  ")
-			if err != nil {
-				return err
+			if raw != nil {
+				if err := raw.write(outstats); err != nil {
+					return err
+				}
 			} else {
+				b, err := json.MarshalIndent(outstats, "", "  ")
+				if err != nil {
+					return err
+				}
 				fmt.Println(string(b))
 			}
 
@@ -137,8 +427,22 @@ var benchAddFileCmd = &cli.Command{
 				}
 			}
 
-			if interval == 0 {
-				return nil
+			results = recordResult(cctx, results, outstats)
+			if mf := cctx.String("metrics-file"); mf != "" {
+				if err := writeMetricsFile(mf, "add-file", results); err != nil {
+					return fmt.Errorf("failed to write metrics file: %w", err)
+				}
+			}
+			if finished(cctx, len(results)) {
+				if len(histogramBuckets) > 0 {
+					printHistograms(os.Stderr, results, histogramBuckets)
+				}
+				if raw != nil {
+					if err := printSummary(runner, results); err != nil {
+						return err
+					}
+				}
+				return checkSLOs(cctx, results)
 			}
 			took := time.Since(start)
 			if took < interval {
@@ -214,6 +518,24 @@ var benchFetchFileCmd = &cli.Command{
 			Name:  "every",
 			Usage: "run benchmark in a loop on the specified interval",
 		},
+		insecureSkipVerifyFlag,
+		acceptEncodingFlag,
+		httpVersionFlag,
+		verifyFlag,
+		captureHeadersFlag,
+		headerFlag,
+		otelEndpointFlag,
+		metricsFileFlag,
+		metricsWindowFlag,
+		rawOutputFlag,
+		runsFlag,
+		sloPercentileFlag,
+		sloTtfbFlag,
+		sloTotalFlag,
+		sloAddFlag,
+		histogramBucketsFlag,
+		fetchUntilFailureFlag,
+		maxFetchesFlag,
 	},
 	Action: func(cctx *cli.Context) error {
 		estToken := os.Getenv("ESTUARY_TOKEN")
@@ -221,11 +543,45 @@ var benchFetchFileCmd = &cli.Command{
 			return fmt.Errorf("no estuary token found")
 		}
 
+		if err := configureHTTPClient(cctx); err != nil {
+			return err
+		}
+
+		flushTraces, err := setupTracing(cctx)
+		if err != nil {
+			return err
+		}
+		defer flushTraces()
+
 		host := cctx.String("host")
 		interval := cctx.Duration("every")
 		runner := cctx.String("runner")
 		cid := cctx.String("file")
 
+		histogramBuckets, err := parseHistogramBuckets(cctx.String("histogram-buckets"))
+		if err != nil {
+			return err
+		}
+		if err := checkRunFlags(cctx); err != nil {
+			return err
+		}
+
+		if cctx.Bool("fetch-until-failure") {
+			res := fetchUntilFailure(cctx.Context, cid, cctx.Int("max-fetches"), interval)
+			res.Runner = runner
+
+			b, err := json.MarshalIndent(res, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+
+			if res.Failed {
+				return fmt.Errorf("fetch failed after %d successful fetches", res.Successes)
+			}
+			return nil
+		}
+
 		var resdb *gorm.DB
 		if pg := cctx.String("postgres"); pg != "" {
 			db, err := openDB(pg)
@@ -235,10 +591,20 @@ var benchFetchFileCmd = &cli.Command{
 			resdb = db
 		}
 
+		var raw *rawOutput
+		if ro := cctx.String("raw-output"); ro != "" {
+			raw, err = openRawOutput(ro)
+			if err != nil {
+				return err
+			}
+			defer raw.Close()
+		}
+
+		var results []*benchResult
 		for {
 			start := time.Now()
 
-			outstats, err := RunBenchFetchFile(cid, host, estToken)
+			outstats, err := RunBenchFetchFile(cctx.Context, cid, host, estToken)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "failed to run bench: ", err)
 				time.Sleep(time.Second * 15)
@@ -246,12 +612,19 @@ var benchFetchFileCmd = &cli.Command{
 			}
 
 			outstats.Runner = runner
+			outstats.RequestHeaders = sentHeaders()
 
-			b, err := json.MarshalIndent(outstats, "", "  ")
-			if err != nil {
-				return err
+			if raw != nil {
+				if err := raw.write(outstats); err != nil {
+					return err
+				}
+			} else {
+				b, err := json.MarshalIndent(outstats, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(b))
 			}
-			fmt.Println(string(b))
 
 			if resdb != nil {
 				if err := addResultsToDatabase(resdb, outstats); err != nil {
@@ -259,51 +632,192 @@ var benchFetchFileCmd = &cli.Command{
 				}
 			}
 
-			if interval == 0 {
-				return nil
+			results = recordResult(cctx, results, outstats)
+			if mf := cctx.String("metrics-file"); mf != "" {
+				if err := writeMetricsFile(mf, "fetch-file", results); err != nil {
+					return fmt.Errorf("failed to write metrics file: %w", err)
+				}
+			}
+			if finished(cctx, len(results)) {
+				if len(histogramBuckets) > 0 {
+					printHistograms(os.Stderr, results, histogramBuckets)
+				}
+				if raw != nil {
+					if err := printSummary(runner, results); err != nil {
+						return err
+					}
+				}
+				return checkSLOs(cctx, results)
 			}
 			took := time.Since(start)
 			if took < interval {
 				time.Sleep(interval - took)
 			}
 		}
-
-		return nil
 	},
 }
 
-func RunBenchAddFile(name string, fi io.Reader, host string, estToken string) (*benchResult, error) {
-	buf := new(bytes.Buffer)
-	mw := multipart.NewWriter(buf)
-	part, err := mw.CreateFormFile("data", name)
-	if err != nil {
-		return nil, err
-	}
-	if _, err = io.Copy(part, fi); err != nil {
-		return nil, err
-	}
-	err = mw.Close()
-	if err != nil {
-		return nil, err
-	}
+func RunBenchAddFile(ctx context.Context, name string, fi io.Reader, host string, estToken string, opts addFileOpts) (*benchResult, error) {
+	ctx, span := tracer.Start(ctx, "benchAddFile")
+	defer span.End()
+
+	var req *http.Request
+	var cu *carUpload
+	var mfst *manyFilesStats
+	var resumableData []byte
+	var presignedData []byte
+	contentType := opts.ContentType
+	addCtx, addSpan := tracer.Start(ctx, "add")
+	defer addSpan.End()
+
+	if opts.Car || opts.ManyFiles != nil {
+		var err error
+		if opts.ManyFiles != nil {
+			cu, mfst, err = newManyFilesUpload(ctx, opts.ManyFiles, opts.CarGzip)
+		} else {
+			cu, err = newCarUpload(ctx, fi, opts.CarGzip)
+		}
+		if err != nil {
+			return nil, err
+		}
+		contentType = carContentType
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/content/add", host), buf)
-	if err != nil {
-		return nil, err
+		req, err = cu.newRequest(addCtx, host, estToken, name)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if opts.Resumable != nil {
+			// kept for the resumable upload, the multipart body is the fallback
+			data, err := io.ReadAll(fi)
+			if err != nil {
+				return nil, err
+			}
+			resumableData = data
+			fi = bytes.NewReader(data)
+		}
+		if opts.Presigned != nil {
+			data, err := io.ReadAll(fi)
+			if err != nil {
+				return nil, err
+			}
+			presignedData = data
+			fi = bytes.NewReader(data)
+		}
+
+		buf := new(bytes.Buffer)
+		mw := multipart.NewWriter(buf)
+		part, err := createFilePart(mw, name, opts.ContentType)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.New()
+		if _, err = io.Copy(part, io.TeeReader(fi, digest)); err != nil {
+			return nil, err
+		}
+		// estuary imports these bytes with its defaults, fetches can be checked against them
+		ctx = withUploadedPayload(ctx, hex.EncodeToString(digest.Sum(nil)))
+		err = mw.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		addURL := fmt.Sprintf("https://%s%s", host, opts.Endpoint)
+		q := url.Values{}
+		if opts.Collection != "" {
+			q.Set("coluuid", opts.Collection)
+		}
+		if opts.ShuttleRoute != nil {
+			q.Set("shuttle", opts.ShuttleRoute.Handle)
+		}
+		if len(q) > 0 {
+			addURL += "?" + q.Encode()
+		}
+
+		req, err = http.NewRequestWithContext(addCtx, "POST", addURL, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Add("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+estToken)
 	}
+	injectTraceHeaders(addCtx, req)
 
-	req.Header.Add("Content-Type", mw.FormDataContentType())
-	req.Header.Set("Authorization", "Bearer "+estToken)
+	var rl *rateLimitedReader
+	if opts.UploadRate > 0 {
+		rl = throttleRequest(req, opts.UploadRate)
+	}
 
 	// Start of HTTP request for a file
 	addReqStart := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	var resp *http.Response
+	var rsst *resumableStats
+	var psst *presignedStats
+	var uploadSize int64
+	var err error
+	if presignedData != nil {
+		resp, psst, err = uploadPresigned(addCtx, host, estToken, name, opts.Collection, presignedData, opts.Presigned)
+		if err != nil {
+			addSpan.RecordError(err)
+			return nil, err
+		}
+		uploadSize = int64(len(presignedData))
+	}
+	if resumableData != nil {
+		resp, rsst, err = resumableUpload(addCtx, host, estToken, name, opts.Collection, resumableData, opts.Resumable)
+		if err != nil {
+			addSpan.RecordError(err)
+			return nil, err
+		}
+		if resp == nil {
+			fmt.Fprintln(os.Stderr, "falling back to a single upload: ", rsst.Fallback)
+		} else {
+			uploadSize = int64(len(resumableData))
+		}
+	}
+	if resp == nil {
+		uploadSize = req.ContentLength
+		resp, err = httpClient.Do(req)
+		if err != nil {
+			addSpan.RecordError(err)
+			return nil, err
+		}
+	}
+
+	// the server rejects content encodings it can't decode, retry the CAR uncompressed
+	if resp.StatusCode != 200 && cu != nil && cu.compress {
+		b, _ := io.ReadAll(resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close request body: %s", err)
+		}
+		cu.fallBack(fmt.Sprintf("gzip upload rejected with status code %d: %s", resp.StatusCode, b))
+		fmt.Fprintln(os.Stderr, "retrying uncompressed: ", cu.fallback)
+
+		req, err = cu.newRequest(addCtx, host, estToken, name)
+		if err != nil {
+			return nil, err
+		}
+		injectTraceHeaders(addCtx, req)
+		if opts.UploadRate > 0 {
+			rl = throttleRequest(req, opts.UploadRate)
+		}
+
+		addReqStart = time.Now()
+		uploadSize = req.ContentLength
+		resp, err = httpClient.Do(req)
+		if err != nil {
+			addSpan.RecordError(err)
+			return nil, err
+		}
 	}
 
 	// End of HTTP request for a file
 	addRespAt := time.Now()
+	addSpan.SetAttributes(
+		attribute.Int("statusCode", resp.StatusCode),
+		attribute.Int64("addFileRespTimeMs", addRespAt.Sub(addReqStart).Milliseconds()),
+	)
 
 	if resp.StatusCode != 200 {
 		var m map[string]interface{}
@@ -312,7 +826,8 @@ func RunBenchAddFile(name string, fi io.Reader, host string, estToken string) (*
 		}
 		fmt.Fprintln(os.Stderr, "error body: ", m)
 		return &benchResult{
-			AddFileError: fmt.Sprintf("got invalid status code: %d", resp.StatusCode),
+			AddFileError:   fmt.Sprintf("got invalid status code: %d", resp.StatusCode),
+			AddFileHeaders: capturedHeaders(resp.Header),
 		}, nil
 	}
 
@@ -321,51 +836,134 @@ func RunBenchAddFile(name string, fi io.Reader, host string, estToken string) (*
 		return nil, err
 	}
 	readBodyTime := time.Now()
+	addSpan.SetAttributes(
+		attribute.String("cid", rbody.Cid),
+		attribute.Int64("addFileTimeMs", readBodyTime.Sub(addReqStart).Milliseconds()),
+	)
+	addSpan.End()
 
 	fmt.Fprintln(os.Stderr, "file added, cid: ", rbody.Cid)
 
-	chk := make(chan *checkResp)
-	go func() {
-		if len(rbody.Providers) == 0 {
-			chk <- &checkResp{
-				CheckRequestError: "no addresses back from add response",
-			}
-			return
+	var srst *shuttleRouteStats
+	if opts.ShuttleRoute != nil {
+		srst = checkShuttleRoute(opts.ShuttleRoute, rbody.Providers)
+		if !srst.Served {
+			fmt.Fprintf(os.Stderr, "WARNING: shuttle %s isn't among the providers of %s: %v\n", srst.Handle, rbody.Cid, rbody.Providers)
 		}
+	}
 
-		addr := rbody.Providers[0]
-		for _, a := range rbody.Providers {
-			if !strings.Contains(a, "127.0.0.1") {
-				addr = a
-			}
+	var cst *carStats
+	if cu != nil {
+		cst = cu.stats(addRespAt.Sub(addReqStart))
+		if rbody.Cid != cu.root.String() {
+			return nil, fmt.Errorf("add-car returned cid %s, expected the car root %s", rbody.Cid, cu.root)
 		}
+	}
 
-		chk <- ipfsCheck(rbody.Cid, addr)
+	var urst *uploadRateStats
+	if rl != nil {
+		urst = rl.stats()
+	}
+
+	if mfst != nil {
+		mfst.AddTimePerFile = readBodyTime.Sub(addReqStart) / time.Duration(mfst.Files)
+	}
+
+	if opts.UploadOnly {
+		return &benchResult{
+			BenchStart:      addReqStart,
+			FileCID:         rbody.Cid,
+			ContentType:     contentType,
+			AddFileRespTime: addRespAt.Sub(addReqStart),
+			AddFileTime:     readBodyTime.Sub(addReqStart),
+			AddFileHeaders:  capturedHeaders(resp.Header),
+
+			Car:        cst,
+			Resumable:  rsst,
+			Presigned:  psst,
+			UploadRate: urst,
+			Upload:     newUploadStats(uploadSize, addRespAt.Sub(addReqStart)),
+			ManyFiles:  mfst,
+		}, nil
+	}
+
+	var chkresp *checkResp
+	var pchks *providerChecks
+	chkDone := make(chan struct{})
+	go func() {
+		defer close(chkDone)
+		chkresp, pchks = checkProviders(ctx, rbody.Cid, rbody.Providers, opts)
 	}()
 
-	st, err := benchFetch(rbody.Cid)
-	if err != nil {
-		return nil, err
+	var st *fetchStats
+	var rst *retrievableStats
+	if opts.RetrievableTimeout > 0 {
+		st, rst = pollUntilRetrievable(ctx, rbody.Cid, readBodyTime, opts.RetrievableTimeout)
+	} else {
+		st, err = benchFetch(ctx, rbody.Cid)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	chkresp := <-chk
+	var cache *cacheStats
+	if opts.CacheTest && st != nil {
+		cache = cacheTest(ctx, rbody.Cid, st)
+	}
+
+	<-chkDone
+
+	var dst *dealStats
+	if opts.WaitForDeal != nil {
+		dst = waitForDeal(ctx, host, estToken, rbody.EstuaryId, readBodyTime, opts.WaitForDeal)
+	}
 
 	return &benchResult{
 		BenchStart:      addReqStart,
 		FileCID:         rbody.Cid,
+		ContentType:     contentType,
 		AddFileRespTime: addRespAt.Sub(addReqStart),
 		AddFileTime:     readBodyTime.Sub(addReqStart),
-
-		FetchStats: st,
-		IpfsCheck:  chkresp,
+		AddFileHeaders:  capturedHeaders(resp.Header),
+
+		FetchStats:  st,
+		IpfsCheck:   chkresp,
+		Retrievable: rst,
+		Car:         cst,
+		Resumable:   rsst,
+		Presigned:   psst,
+		UploadRate:  urst,
+		Deal:        dst,
+
+		ShuttleRoute:   srst,
+		Cache:          cache,
+		ManyFiles:      mfst,
+		ProviderChecks: pchks,
 	}, nil
 }
 
-func RunBenchFetchFile(cid string, host string, estToken string) (*benchResult, error) {
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// createFilePart is multipart.Writer.CreateFormFile with a custom content type
+func createFilePart(mw *multipart.Writer, name string, contentType string) (io.Writer, error) {
+	if contentType == "" {
+		return mw.CreateFormFile("data", name)
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="data"; filename="%s"`, quoteEscaper.Replace(name)))
+	h.Set("Content-Type", contentType)
+	return mw.CreatePart(h)
+}
+
+func RunBenchFetchFile(ctx context.Context, cid string, host string, estToken string) (*benchResult, error) {
+	ctx, span := tracer.Start(ctx, "benchFetchFile")
+	defer span.End()
+
 	// Start of HTTP request for a file
 	addReqStart := time.Now()
 
-	st, err := benchFetch(cid)
+	st, err := benchFetch(ctx, cid)
 	if err != nil {
 		return nil, err
 	}
@@ -396,24 +994,55 @@ type fetchStats struct {
 	TimeToFirstByte   time.Duration
 	TotalTransferTime time.Duration
 	TotalElapsed      time.Duration
+
+	// protocol of the response, e.g. HTTP/2.0, see --http-version
+	Proto string `json:",omitempty"`
+	// TCP connections opened for the fetch (redirects included), and pooled
+	// connections it reused
+	ConnectionsOpened int
+	ConnectionsReused int
+
+	// WireBytes is the response body size as transferred, DecodedBytes its
+	// size after decompressing it according to ContentEncoding
+	ContentEncoding string `json:",omitempty"`
+	WireBytes       int64
+	DecodedBytes    int64
+
+	// set with --verify when the fetch succeeded
+	Verify *verifyStats `json:",omitempty"`
+	// allowlisted response headers, see --capture-headers
+	Headers map[string]string `json:",omitempty"`
 }
 
-func benchFetch(c string) (*fetchStats, error) {
+func benchFetch(ctx context.Context, c string) (*fetchStats, error) {
+	ctx, span := tracer.Start(ctx, "fetch")
+	defer span.End()
+
 	url := "https://dweb.link/ipfs/" + c
-	req, err := http.NewRequest("GET", url, nil)
+	conns := &connCounter{}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, conns.trace()), "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	injectTraceHeaders(ctx, req)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
 
 	start := time.Now()
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := fetchClient.Do(req)
 	afterDo := time.Now()
 	if err != nil {
-		return &fetchStats{
-			RequestStart: start,
-			TotalElapsed: time.Since(start),
-			RequestError: err.Error(),
-		}, nil
+		opened, reused := conns.counts()
+		st := &fetchStats{
+			RequestStart:      start,
+			TotalElapsed:      time.Since(start),
+			RequestError:      err.Error(),
+			ConnectionsOpened: opened,
+			ConnectionsReused: reused,
+		}
+		setFetchAttributes(span, st)
+		return st, nil
 	}
 
 	gwayhost := resp.Header.Get("x-ipfs-gateway-host")
@@ -438,24 +1067,60 @@ func benchFetch(c string) (*fetchStats, error) {
 	}
 	firstByteAt := time.Now()
 
-	_, err = io.Copy(io.Discard, br)
+	encoding := resp.Header.Get("Content-Encoding")
+	wire := &countingReader{r: br}
+	body, err := decodeBody(encoding, wire)
 	if err != nil {
+		return nil, err
+	}
+
+	var sink io.Writer = io.Discard
+	var fv *fetchVerifier
+	if verifyFetches && status == 200 {
+		fv = newFetchVerifier(c, uploadedPayload(ctx))
+		sink = fv
+	}
+
+	decoded, err := io.Copy(sink, body)
+	if err != nil {
+		if fv != nil {
+			fv.finish(err)
+		}
 		return nil, fmt.Errorf("copying bytes failed: %w ", err)
 	}
 	endTime := time.Now()
 
-	return &fetchStats{
+	var vst *verifyStats
+	if fv != nil {
+		vst = fv.finish(nil)
+	}
+	opened, reused := conns.counts()
+
+	st := &fetchStats{
 		RequestStart: start,
 		GatewayURL:   url,
 		StatusCode:   status,
 
 		GatewayHost: gwayhost,
 
+		Proto:             resp.Proto,
+		ConnectionsOpened: opened,
+		ConnectionsReused: reused,
+
 		ResponseTime:      afterDo.Sub(start),
 		TimeToFirstByte:   firstByteAt.Sub(start),
 		TotalTransferTime: endTime.Sub(firstByteAt),
 		TotalElapsed:      endTime.Sub(start),
-	}, nil
+
+		ContentEncoding: encoding,
+		WireBytes:       wire.n,
+		DecodedBytes:    decoded,
+
+		Verify:  vst,
+		Headers: capturedHeaders(resp.Header),
+	}
+	setFetchAttributes(span, st)
+	return st, nil
 }
 
 type checkResp struct {
@@ -469,11 +1134,56 @@ type checkResp struct {
 		Responded bool
 		Error     string
 	}
+	// classification of the fields above, see checkOutcome
+	Outcome string
 }
 
-func ipfsCheck(c string, maddr string) *checkResp {
+const (
+	// the provider served the content over bitswap
+	checkRetrievable = "retrievable"
+	// the content is announced in the DHT, but the provider didn't serve it
+	checkIndexedNotRetrievable = "indexed-not-retrievable"
+	// the content is neither announced in the DHT nor served by the provider
+	checkNotFound = "not-found"
+	// the check couldn't be made, or the provider could neither be reached nor found in the DHT
+	checkError = "error"
+)
+
+// checkOutcome classifies an ipfs-check response
+func checkOutcome(chk *checkResp) string {
+	switch {
+	case chk.CheckRequestError != "":
+		return checkError
+	case chk.DataAvailableOverBitswap.Found:
+		return checkRetrievable
+	case chk.CidInDHT:
+		return checkIndexedNotRetrievable
+	case chk.ConnectionError != "" && len(chk.PeerFoundInDHT) == 0:
+		return checkError
+	default:
+		return checkNotFound
+	}
+}
+
+func ipfsCheck(ctx context.Context, c string, maddr string) (out *checkResp) {
+	ctx, span := tracer.Start(ctx, "check")
+	defer func() {
+		out.Outcome = checkOutcome(out)
+		setCheckAttributes(span, out)
+		span.End()
+	}()
+
 	start := time.Now()
-	resp, err := http.DefaultClient.Get(fmt.Sprintf("https://ipfs-check-backend.ipfs.io/?cid=%s&multiaddr=%s", c, maddr))
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://ipfs-check-backend.ipfs.io/?cid=%s&multiaddr=%s", c, maddr), nil)
+	if err != nil {
+		return &checkResp{
+			CheckTook:         time.Since(start),
+			CheckRequestError: err.Error(),
+		}
+	}
+	injectTraceHeaders(ctx, req)
+
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return &checkResp{
 			CheckTook:         time.Since(start),
@@ -487,16 +1197,16 @@ func ipfsCheck(c string, maddr string) *checkResp {
 		}
 	}()
 
-	var out checkResp
-	out.CheckTook = time.Since(start)
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+	var chk checkResp
+	chk.CheckTook = time.Since(start)
+	if err := json.NewDecoder(resp.Body).Decode(&chk); err != nil {
 		return &checkResp{
 			CheckTook:         time.Since(start),
 			CheckRequestError: err.Error(),
 		}
 	}
 
-	return &out
+	return &chk
 }
 
 type DBBenchResult struct {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/docker/go-units"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/urfave/cli/v2"
+)
+
+var manyFilesFlag = &cli.IntFlag{
+	Name:  "many-files",
+	Usage: "upload a directory of this many small random files as a CAR, instead of a single file, to measure small-object overhead",
+}
+
+var fileSizeFlag = &cli.StringFlag{
+	Name:  "file-size",
+	Usage: "size of each file uploaded with --many-files, e.g. 512, 4KiB",
+	Value: "1KiB",
+}
+
+type manyFilesOpts struct {
+	Count    int
+	FileSize int64
+}
+
+type manyFilesStats struct {
+	Files    int
+	FileSize int64
+	// blocks of the directory DAG, the files' and the directory nodes'
+	Blocks int
+	// AddFileTime spread over the files
+	AddTimePerFile time.Duration
+}
+
+// manyFilesOptsFromFlags returns the directory to upload, if any, refusing
+// the flags that upload or check a single file
+func manyFilesOptsFromFlags(cctx *cli.Context) (*manyFilesOpts, error) {
+	count := cctx.Int("many-files")
+	if count == 0 {
+		if cctx.IsSet("file-size") {
+			return nil, fmt.Errorf("--file-size requires --many-files")
+		}
+		return nil, nil
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("invalid --many-files %d: must be positive", count)
+	}
+
+	size, err := units.RAMInBytes(cctx.String("file-size"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --file-size: %w", err)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid --file-size %q: must be positive", cctx.String("file-size"))
+	}
+
+	for _, name := range []string{"car", "endpoint", "content-type", "resumable", "presigned", "pin-cid", "route-to-shuttle", "verify"} {
+		if cctx.IsSet(name) {
+			return nil, fmt.Errorf("--many-files can't be combined with --%s", name)
+		}
+	}
+	return &manyFilesOpts{
+		Count:    count,
+		FileSize: size,
+	}, nil
+}
+
+// newManyFilesUpload generates the random files into a UnixFS directory in an
+// in-memory blockstore and writes it out as a CAR, whose root is the directory
+func newManyFilesUpload(ctx context.Context, opts *manyFilesOpts, compress bool) (*carUpload, *manyFilesStats, error) {
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	dir := uio.NewDirectory(dserv)
+	buf := make([]byte, opts.FileSize)
+	for i := 0; i < opts.Count; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+
+		nd, err := util.ImportFile(dserv, bytes.NewReader(buf))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to import file: %w", err)
+		}
+		if err := dir.AddChild(ctx, fmt.Sprintf("file-%06d", i), nd); err != nil {
+			return nil, nil, fmt.Errorf("failed to add file to directory: %w", err)
+		}
+	}
+
+	root, err := dir.GetNode()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get directory node: %w", err)
+	}
+	if err := dserv.Add(ctx, root); err != nil {
+		return nil, nil, fmt.Errorf("failed to add directory node: %w", err)
+	}
+
+	cu, err := writeCarUpload(ctx, dserv, root.Cid(), compress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	st := &manyFilesStats{
+		Files:    opts.Count,
+		FileSize: opts.FileSize,
+	}
+	for range keys {
+		st.Blocks++
+	}
+	return cu, st, nil
+}
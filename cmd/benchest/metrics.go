@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+var metricsFileFlag = &cli.StringFlag{
+	Name:  "metrics-file",
+	Usage: "after each run, write the aggregated metrics in Prometheus text format to this path (e.g. for node_exporter's textfile collector)",
+}
+
+var metricsWindowFlag = &cli.IntFlag{
+	Name:  "metrics-window",
+	Usage: "when running forever (--every without --runs), number of most recent runs the metrics file aggregates",
+	Value: 1000,
+}
+
+var metricsQuantiles = []float64{50, 90, 95, 99}
+
+// recordResult adds the result to those aggregated once the loop finishes or
+// in the metrics file. A loop running forever never finishes, so it only keeps
+// the most recent results the metrics file aggregates, if any.
+func recordResult(cctx *cli.Context, results []*benchResult, res *benchResult) []*benchResult {
+	results = append(results, res)
+	if cctx.Int("runs") > 0 || cctx.Duration("every") == 0 {
+		return results
+	}
+	if cctx.String("metrics-file") == "" {
+		return results[:0]
+	}
+
+	if window := cctx.Int("metrics-window"); window > 0 && len(results) > window {
+		// shifted in place, so the oldest result can be collected
+		n := copy(results, results[len(results)-window:])
+		results = results[:n]
+	}
+	return results
+}
+
+// succeeded reports whether every step of the run that was attempted worked
+func succeeded(res *benchResult) bool {
+	if res.AddFileError != "" {
+		return false
+	}
+	// upload-only runs make no fetch
+	if res.Upload != nil {
+		return true
+	}
+	return res.FetchStats != nil && retrieved(res.FetchStats)
+}
+
+// formatMetrics renders the aggregated results in the Prometheus text exposition format
+func formatMetrics(command string, results []*benchResult) []byte {
+	buf := new(bytes.Buffer)
+	labels := fmt.Sprintf("command=%q", command)
+
+	var successes int
+	for _, res := range results {
+		if succeeded(res) {
+			successes++
+		}
+	}
+
+	fmt.Fprintln(buf, "# HELP benchest_runs Number of benchmark runs aggregated.")
+	fmt.Fprintln(buf, "# TYPE benchest_runs gauge")
+	fmt.Fprintf(buf, "benchest_runs{%s} %d\n", labels, len(results))
+
+	fmt.Fprintln(buf, "# HELP benchest_successful_runs Number of runs whose add and fetch both succeeded.")
+	fmt.Fprintln(buf, "# TYPE benchest_successful_runs gauge")
+	fmt.Fprintf(buf, "benchest_successful_runs{%s} %d\n", labels, successes)
+
+	ratio := 0.0
+	if len(results) > 0 {
+		ratio = float64(successes) / float64(len(results))
+	}
+	fmt.Fprintln(buf, "# HELP benchest_success_ratio Ratio of successful runs.")
+	fmt.Fprintln(buf, "# TYPE benchest_success_ratio gauge")
+	fmt.Fprintf(buf, "benchest_success_ratio{%s} %g\n", labels, ratio)
+
+	outcomes := make(map[string]int)
+	for _, res := range results {
+		if res.IpfsCheck != nil {
+			outcomes[res.IpfsCheck.Outcome]++
+		}
+	}
+	fmt.Fprintln(buf, "# HELP benchest_check_outcomes Number of runs by the outcome of their ipfs-check.")
+	fmt.Fprintln(buf, "# TYPE benchest_check_outcomes gauge")
+	for _, outcome := range []string{checkRetrievable, checkIndexedNotRetrievable, checkNotFound, checkError} {
+		fmt.Fprintf(buf, "benchest_check_outcomes{%s,outcome=%q} %d\n", labels, outcome, outcomes[outcome])
+	}
+
+	for _, s := range samplers {
+		samples := s.samples(results)
+		name := fmt.Sprintf("benchest_%s_seconds", s.name)
+
+		fmt.Fprintf(buf, "# HELP %s Percentiles of the %s latency across successful runs.\n", name, s.name)
+		fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+		for _, q := range metricsQuantiles {
+			if len(samples) == 0 {
+				break
+			}
+			fmt.Fprintf(buf, "%s{%s,quantile=\"%g\"} %g\n", name, labels, q/100, percentile(samples, q).Seconds())
+		}
+
+		fmt.Fprintf(buf, "# HELP %s_samples Number of successful runs with a %s latency.\n", name, s.name)
+		fmt.Fprintf(buf, "# TYPE %s_samples gauge\n", name)
+		fmt.Fprintf(buf, "%s_samples{%s} %d\n", name, labels, len(samples))
+	}
+	return buf.Bytes()
+}
+
+func writeMetricsFile(path string, command string, results []*benchResult) error {
+	return writeFileAtomic(path, formatMetrics(command, results))
+}
+
+// writeFileAtomic replaces the metrics file atomically, so a collector never reads a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// a no-op once the file has been renamed into place
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes the file readable only by its owner
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var pinCidFlag = &cli.StringFlag{
+	Name:  "pin-cid",
+	Usage: "instead of uploading a file, ask estuary to pin this CID from the network and time how long until it is pinned",
+}
+
+var pinTimeoutFlag = &cli.DurationFlag{
+	Name:  "pin-timeout",
+	Usage: "how long after the pin request to keep polling before giving up on the CID being pinned",
+	Value: 30 * time.Minute,
+}
+
+type pinOpts struct {
+	CID     string
+	Timeout time.Duration
+}
+
+func pinOptsFromFlags(cctx *cli.Context) (*pinOpts, error) {
+	c := cctx.String("pin-cid")
+	if c == "" {
+		return nil, nil
+	}
+
+	if _, err := cid.Decode(c); err != nil {
+		return nil, fmt.Errorf("invalid pin cid %q: %w", c, err)
+	}
+	if cctx.Bool("car") || cctx.Bool("resumable") || cctx.Bool("presigned") {
+		return nil, fmt.Errorf("--pin-cid can't be combined with --car, --resumable or --presigned")
+	}
+	return &pinOpts{
+		CID:     c,
+		Timeout: cctx.Duration("pin-timeout"),
+	}, nil
+}
+
+type pinStats struct {
+	RequestID string
+	// status of the pin at the last poll
+	Status string
+	Polls  int
+	// time from the pin request to the pin reaching the pinned status
+	TimeToPinned time.Duration `json:",omitempty"`
+	// set when the pin failed or didn't complete before the timeout
+	Failed   bool `json:",omitempty"`
+	TimedOut bool `json:",omitempty"`
+	// the last error polling the pin status
+	Error string `json:",omitempty"`
+}
+
+type pinStatus struct {
+	RequestID string `json:"requestid"`
+	Status    string `json:"status"`
+}
+
+// RunBenchPinCID benchmarks the pin-by-CID path: estuary fetches the content from the network instead of
+// receiving it. The pin status is polled with the backoff of --poll-until-retrievable, and once pinned the
+// content is fetched from the gateway.
+func RunBenchPinCID(ctx context.Context, host string, estToken string, opts *pinOpts) (*benchResult, error) {
+	ctx, span := tracer.Start(ctx, "benchPinCID")
+	defer span.End()
+
+	reqStart := time.Now()
+	ps, err := requestPin(ctx, host, estToken, opts.CID)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	respAt := time.Now()
+
+	pst := pollUntilPinned(ctx, host, estToken, ps, reqStart, opts.Timeout)
+	res := &benchResult{
+		BenchStart:      reqStart,
+		FileCID:         opts.CID,
+		AddFileRespTime: respAt.Sub(reqStart),
+		Pin:             pst,
+	}
+	if pst.Status != "pinned" {
+		res.AddFileError = fmt.Sprintf("pin did not complete, last status: %s", pst.Status)
+		return res, nil
+	}
+	res.AddFileTime = pst.TimeToPinned
+
+	st, err := benchFetch(ctx, opts.CID)
+	if err != nil {
+		return nil, err
+	}
+	res.FetchStats = st
+	return res, nil
+}
+
+func requestPin(ctx context.Context, host string, estToken string, c string) (*pinStatus, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"cid":  c,
+		"name": "benchest-" + c,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("https://%s/pinning/pins", host), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceHeaders(ctx, req)
+
+	return doPinRequest(req)
+}
+
+func getPinStatus(ctx context.Context, host string, estToken string, requestID string) (*pinStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/pinning/pins/%s", host, url.PathEscape(requestID)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	injectTraceHeaders(ctx, req)
+
+	return doPinRequest(req)
+}
+
+func doPinRequest(req *http.Request) (*pinStatus, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("pinning returned status code %d: %s", resp.StatusCode, b)
+	}
+
+	var ps pinStatus
+	if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+		return nil, fmt.Errorf("failed to decode pin status: %w", err)
+	}
+	return &ps, nil
+}
+
+// pollUntilPinned polls the pin status until it is pinned or failed, or the timeout (counted from
+// requestedAt) passes
+func pollUntilPinned(ctx context.Context, host string, estToken string, ps *pinStatus, requestedAt time.Time, timeout time.Duration) (pst *pinStats) {
+	ctx, span := tracer.Start(ctx, "pollUntilPinned")
+	defer func() {
+		span.SetAttributes(
+			attribute.String("status", pst.Status),
+			attribute.Int("polls", pst.Polls),
+			attribute.Int64("timeToPinnedMs", pst.TimeToPinned.Milliseconds()),
+		)
+		span.End()
+	}()
+
+	pst = &pinStats{
+		RequestID: ps.RequestID,
+		Status:    ps.Status,
+	}
+	deadline := requestedAt.Add(timeout)
+	backoff := retrievableInitialBackoff
+	for {
+		switch pst.Status {
+		case "pinned":
+			pst.TimeToPinned = time.Since(requestedAt)
+			return pst
+		case "failed":
+			pst.Failed = true
+			return pst
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			pst.TimedOut = true
+			return pst
+		}
+
+		select {
+		case <-ctx.Done():
+			pst.TimedOut = true
+			return pst
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > retrievableMaxBackoff {
+			backoff = retrievableMaxBackoff
+		}
+
+		pst.Polls++
+		ps, err := getPinStatus(ctx, host, estToken, pst.RequestID)
+		if err != nil {
+			// polled again, a timeout remains the outcome if it keeps failing
+			pst.Error = err.Error()
+			logger.Warnf("failed to get status of pin %s: %s", pst.RequestID, err)
+			continue
+		}
+		pst.Status = ps.Status
+		pst.Error = ""
+	}
+}
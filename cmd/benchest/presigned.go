@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var presignedFlag = &cli.BoolFlag{
+	Name:  "presigned",
+	Usage: "upload through a pre-signed URL issued by the server: request the URL, PUT the file to it, then notify the server of completion; fails if the server doesn't issue pre-signed URLs",
+}
+
+var presignedPathFlag = &cli.StringFlag{
+	Name:  "presigned-path",
+	Usage: "path of the endpoint issuing pre-signed upload URLs",
+	Value: "/content/presigned-uploads",
+}
+
+type presignedOpts struct {
+	Path string
+}
+
+func presignedOptsFromFlags(cctx *cli.Context) (*presignedOpts, error) {
+	if !cctx.Bool("presigned") {
+		return nil, nil
+	}
+
+	if cctx.Bool("car") || cctx.Bool("resumable") {
+		return nil, fmt.Errorf("--presigned can't be combined with --car or --resumable")
+	}
+	return &presignedOpts{
+		Path: cctx.String("presigned-path"),
+	}, nil
+}
+
+type presignedStats struct {
+	// time to get the pre-signed URL from the server
+	RequestTime time.Duration
+	// time to PUT the file to the pre-signed URL
+	PutTime time.Duration
+	// time for the server to answer the completion notice
+	CompleteTime time.Duration
+	// host the file was PUT to
+	UploadHost string
+}
+
+type presignedUpload struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// uploadPresigned uploads data through a pre-signed URL. On success, the response of the completion notice
+// carries the content add response.
+func uploadPresigned(ctx context.Context, host string, estToken string, name string, coluuid string, data []byte, opts *presignedOpts) (*http.Response, *presignedStats, error) {
+	ctx, span := tracer.Start(ctx, "presignedUpload")
+	defer span.End()
+
+	st := &presignedStats{}
+	endpoint := fmt.Sprintf("https://%s%s", host, opts.Path)
+
+	start := time.Now()
+	upload, err := requestPresignedURL(ctx, endpoint, estToken, name, coluuid, int64(len(data)))
+	if err != nil {
+		return nil, st, err
+	}
+	st.RequestTime = time.Since(start)
+
+	u, err := url.Parse(upload.URL)
+	if err != nil {
+		return nil, st, fmt.Errorf("server issued an invalid pre-signed upload url: %w", err)
+	}
+	st.UploadHost = u.Host
+
+	start = time.Now()
+	if err := putPresigned(ctx, upload.URL, data); err != nil {
+		return nil, st, err
+	}
+	st.PutTime = time.Since(start)
+
+	start = time.Now()
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/%s/complete", endpoint, url.PathEscape(upload.ID)), nil)
+	if err != nil {
+		return nil, st, err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	injectTraceHeaders(ctx, req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, st, err
+	}
+	st.CompleteTime = time.Since(start)
+	return resp, st, nil
+}
+
+// requestPresignedURL asks the server for a URL to upload the file to, servers that don't issue pre-signed
+// URLs are reported as such rather than as a failed upload
+func requestPresignedURL(ctx context.Context, endpoint string, estToken string, name string, coluuid string, size int64) (*presignedUpload, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"filename": name,
+		"size":     size,
+		"coluuid":  coluuid,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceHeaders(ctx, req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, fmt.Errorf("server doesn't issue pre-signed upload urls at %s (status code %d)", endpoint, resp.StatusCode)
+	default:
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get a pre-signed upload url, status code %d: %s", resp.StatusCode, b)
+	}
+
+	var upload presignedUpload
+	if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return nil, fmt.Errorf("failed to decode pre-signed upload response: %w", err)
+	}
+	if upload.ID == "" || upload.URL == "" {
+		return nil, fmt.Errorf("pre-signed upload response is missing the upload id or url")
+	}
+	return &upload, nil
+}
+
+// putPresigned uploads the file to the pre-signed URL, which carries its own authorization
+func putPresigned(ctx context.Context, uploadURL string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(data))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("pre-signed upload rejected with status code %d: %s", resp.StatusCode, b)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sync"
+
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/urfave/cli/v2"
+)
+
+// providerStrategy picks the provider addresses ipfs-check is run against
+type providerStrategy string
+
+const (
+	// the first public address, falling back to the first non-loopback one
+	strategyFirstPublic providerStrategy = "first-public"
+	// any of the addresses
+	strategyRandom providerStrategy = "random"
+	// every address, to find providers that don't serve the content
+	strategyAll providerStrategy = "all"
+	// the first /dns address, falling back to first-public
+	strategyPreferDNS providerStrategy = "prefer-dns"
+)
+
+var providerStrategyFlag = &cli.StringFlag{
+	Name:  "provider-strategy",
+	Usage: "how the provider addresses to check with ipfs-check are picked: first-public, random, all or prefer-dns",
+	Value: string(strategyFirstPublic),
+}
+
+func parseProviderStrategy(s string) (providerStrategy, error) {
+	switch st := providerStrategy(s); st {
+	case "":
+		return strategyFirstPublic, nil
+	case strategyFirstPublic, strategyRandom, strategyAll, strategyPreferDNS:
+		return st, nil
+	default:
+		return "", fmt.Errorf("unknown provider strategy %q (expected %q, %q, %q or %q)", s, strategyFirstPublic, strategyRandom, strategyAll, strategyPreferDNS)
+	}
+}
+
+type providerCheck struct {
+	Addr  string
+	Check *checkResp
+}
+
+type providerChecks struct {
+	Checked int
+	// providers that served the content over bitswap
+	Serving int
+	Results []providerCheck
+}
+
+// checkProviders runs ipfs-check against the providers picked from the add response. With the all strategy,
+// every provider is checked and the returned check is that of the first provider serving the content, or of
+// the first provider if none does.
+func checkProviders(ctx context.Context, c string, providers []string, opts addFileOpts) (*checkResp, *providerChecks) {
+	providers, err := filterFamily(providers, opts.CheckFamily)
+	if err != nil {
+		return &checkResp{
+			CheckRequestError: err.Error(),
+			Outcome:           checkError,
+		}, nil
+	}
+
+	addrs, err := selectProviders(providers, opts.ProviderMatch, opts.ProviderStrategy)
+	if err != nil {
+		return &checkResp{
+			CheckRequestError: err.Error(),
+			Outcome:           checkError,
+		}, nil
+	}
+
+	if opts.ProviderStrategy != strategyAll {
+		return ipfsCheck(ctx, c, addrs[0]), nil
+	}
+
+	pchks := &providerChecks{
+		Checked: len(addrs),
+		Results: make([]providerCheck, len(addrs)),
+	}
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			pchks.Results[i] = providerCheck{Addr: addr, Check: ipfsCheck(ctx, c, addr)}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	chk := pchks.Results[0].Check
+	for i := len(pchks.Results) - 1; i >= 0; i-- {
+		if r := pchks.Results[i]; r.Check.Outcome == checkRetrievable {
+			pchks.Serving++
+			chk = r.Check
+		}
+	}
+	return chk, pchks
+}
+
+// selectProviders picks the addresses to check the content on, among those matching match if it is set
+func selectProviders(providers []string, match *regexp.Regexp, strategy providerStrategy) ([]string, error) {
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no addresses back from add response")
+	}
+
+	if match != nil {
+		var matching []string
+		for _, a := range providers {
+			if match.MatchString(a) {
+				matching = append(matching, a)
+			}
+		}
+		if len(matching) == 0 {
+			return nil, fmt.Errorf("no provider address matches %q: %v", match, providers)
+		}
+		providers = matching
+	}
+
+	switch strategy {
+	case strategyAll:
+		return providers, nil
+	case strategyRandom:
+		return []string{providers[rand.Intn(len(providers))]}, nil
+	case strategyPreferDNS:
+		for _, a := range providers {
+			if ma, err := multiaddr.NewMultiaddr(a); err == nil && isDNS(ma) {
+				return []string{a}, nil
+			}
+		}
+	}
+	return []string{firstPublic(providers)}, nil
+}
+
+// firstPublic returns the first public address, or the first non-loopback one if none is public
+func firstPublic(providers []string) string {
+	var nonLoopback string
+	for _, a := range providers {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			continue
+		}
+		if manet.IsPublicAddr(ma) {
+			return a
+		}
+		if nonLoopback == "" && !manet.IsIPLoopback(ma) {
+			nonLoopback = a
+		}
+	}
+	if nonLoopback != "" {
+		return nonLoopback
+	}
+	return providers[0]
+}
+
+func isDNS(ma multiaddr.Multiaddr) bool {
+	dns := false
+	multiaddr.ForEach(ma, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6, multiaddr.P_DNSADDR:
+			dns = true
+		}
+		return false
+	})
+	return dns
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var rawOutputFlag = &cli.StringFlag{
+	Name:  "raw-output",
+	Usage: "append the result of every run to this file as JSON lines, and print a summary of the runs to stdout once they finished instead",
+}
+
+// rawOutput appends each run's result to a JSON lines file, which add-result can load
+type rawOutput struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func openRawOutput(path string) (*rawOutput, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raw output: %w", err)
+	}
+	return &rawOutput{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (ro *rawOutput) write(res *benchResult) error {
+	if err := ro.enc.Encode(res); err != nil {
+		return fmt.Errorf("failed to write raw output: %w", err)
+	}
+	return nil
+}
+
+func (ro *rawOutput) Close() error {
+	return ro.f.Close()
+}
+
+type latencySummary struct {
+	Samples int
+	P50     time.Duration `json:",omitempty"`
+	P90     time.Duration `json:",omitempty"`
+	P95     time.Duration `json:",omitempty"`
+	P99     time.Duration `json:",omitempty"`
+	Max     time.Duration `json:",omitempty"`
+}
+
+type runSummary struct {
+	Runner    string
+	Runs      int
+	Successes int
+	// keyed by the sampler's name, e.g. ttfb
+	Latencies map[string]*latencySummary
+}
+
+// summarize aggregates the results to the percentiles of each latency
+func summarize(runner string, results []*benchResult) *runSummary {
+	sum := &runSummary{
+		Runner:    runner,
+		Runs:      len(results),
+		Latencies: make(map[string]*latencySummary),
+	}
+	for _, res := range results {
+		if succeeded(res) {
+			sum.Successes++
+		}
+	}
+
+	for _, s := range samplers {
+		samples := s.samples(results)
+		ls := &latencySummary{Samples: len(samples)}
+		if len(samples) > 0 {
+			ls.P50 = percentile(samples, 50)
+			ls.P90 = percentile(samples, 90)
+			ls.P95 = percentile(samples, 95)
+			ls.P99 = percentile(samples, 99)
+			ls.Max = percentile(samples, 100)
+		}
+		sum.Latencies[s.name] = ls
+	}
+	return sum
+}
+
+func printSummary(runner string, results []*benchResult) error {
+	b, err := json.MarshalIndent(summarize(runner, results), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
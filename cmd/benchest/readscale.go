@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var benchReadScaleCmd = &cli.Command{
+	Name:  "read-scale",
+	Usage: "fetch one CID with increasing concurrency (1, 2, 4, ...) to find where the gateway's read throughput stops scaling",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Value: "QmducxoYHKULWXeq5wtKoeMzie2QggYphNCVwuFuou9eWE",
+			Usage: "CID for file - defaults to NYC Public Data: QmducxoYHKULWXeq5wtKoeMzie2QggYphNCVwuFuou9eWE",
+		},
+		&cli.StringFlag{
+			Name:  "runner",
+			Value: "",
+		},
+		&cli.IntFlag{
+			Name:  "max-concurrency",
+			Usage: "highest number of parallel fetches to try",
+			Value: 64,
+		},
+		&cli.IntFlag{
+			Name:  "fetches-per-worker",
+			Usage: "number of fetches each parallel worker makes at every concurrency level",
+			Value: 3,
+		},
+		&cli.Float64Flag{
+			Name:  "plateau",
+			Usage: "stop once doubling the concurrency raises the throughput by less than this fraction (e.g. 0.1 for 10%)",
+			Value: 0.1,
+		},
+		insecureSkipVerifyFlag,
+		acceptEncodingFlag,
+		httpVersionFlag,
+		verifyFlag,
+		captureHeadersFlag,
+		headerFlag,
+		otelEndpointFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		opts := readScaleOpts{
+			MaxConcurrency:   cctx.Int("max-concurrency"),
+			FetchesPerWorker: cctx.Int("fetches-per-worker"),
+			Plateau:          cctx.Float64("plateau"),
+		}
+		if opts.MaxConcurrency < 1 {
+			return fmt.Errorf("invalid max concurrency %d", opts.MaxConcurrency)
+		}
+		if opts.FetchesPerWorker < 1 {
+			return fmt.Errorf("invalid fetches per worker %d", opts.FetchesPerWorker)
+		}
+
+		if err := configureHTTPClient(cctx); err != nil {
+			return err
+		}
+
+		flushTraces, err := setupTracing(cctx)
+		if err != nil {
+			return err
+		}
+		defer flushTraces()
+
+		res := readScale(cctx.Context, cctx.String("file"), opts)
+		res.Runner = cctx.String("runner")
+
+		b, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+const (
+	// a level had failed fetches
+	readScaleStopErrors = "errors"
+	// doubling the concurrency didn't raise the throughput enough
+	readScaleStopPlateau = "plateau"
+	// the max concurrency was reached while the throughput still scaled
+	readScaleStopMaxConcurrency = "max-concurrency"
+	// the run was interrupted
+	readScaleStopInterrupted = "interrupted"
+)
+
+type readScaleOpts struct {
+	MaxConcurrency   int
+	FetchesPerWorker int
+	Plateau          float64
+}
+
+type readScaleResult struct {
+	Runner     string
+	CID        string
+	Start      time.Time
+	Levels     []*readScaleLevel
+	StopReason string
+	// the level with the highest throughput without failed fetches
+	PeakConcurrency int `json:",omitempty"`
+}
+
+type readScaleLevel struct {
+	Concurrency int
+	Fetches     int
+	Errors      int
+	// wall time of the whole level
+	Elapsed time.Duration
+	// aggregate throughput of the successful fetches
+	BytesPerSecond   float64
+	FetchesPerSecond float64
+	// latency of the successful fetches
+	LatencyP50 time.Duration `json:",omitempty"`
+	LatencyP95 time.Duration `json:",omitempty"`
+	LatencyMax time.Duration `json:",omitempty"`
+	// the first failed fetch of the level
+	FirstError string `json:",omitempty"`
+}
+
+// readScale fetches the content at doubling concurrency levels until a level
+// has failed fetches, the throughput plateaus or the max concurrency is reached
+func readScale(ctx context.Context, c string, opts readScaleOpts) *readScaleResult {
+	ctx, span := tracer.Start(ctx, "readScale")
+	defer span.End()
+
+	res := &readScaleResult{
+		CID:   c,
+		Start: time.Now(),
+	}
+	defer func() {
+		span.SetAttributes(
+			attribute.String("stopReason", res.StopReason),
+			attribute.Int("peakConcurrency", res.PeakConcurrency),
+		)
+	}()
+
+	var peak *readScaleLevel
+	for concurrency := 1; ; concurrency *= 2 {
+		if concurrency > opts.MaxConcurrency {
+			res.StopReason = readScaleStopMaxConcurrency
+			return res
+		}
+
+		level := runReadScaleLevel(ctx, c, concurrency, opts.FetchesPerWorker)
+		if ctx.Err() != nil {
+			res.StopReason = readScaleStopInterrupted
+			return res
+		}
+		res.Levels = append(res.Levels, level)
+
+		if level.Errors > 0 {
+			res.StopReason = readScaleStopErrors
+			return res
+		}
+
+		prev := peak
+		if peak == nil || level.BytesPerSecond > peak.BytesPerSecond {
+			peak = level
+			res.PeakConcurrency = level.Concurrency
+		}
+		if prev != nil && level.BytesPerSecond < prev.BytesPerSecond*(1+opts.Plateau) {
+			res.StopReason = readScaleStopPlateau
+			return res
+		}
+	}
+}
+
+// runReadScaleLevel runs concurrency workers that each fetch the content
+// fetches times
+func runReadScaleLevel(ctx context.Context, c string, concurrency int, fetches int) *readScaleLevel {
+	ctx, span := tracer.Start(ctx, "readScaleLevel")
+	defer span.End()
+	span.SetAttributes(attribute.Int("concurrency", concurrency))
+
+	var lk sync.Mutex
+	var latencies []time.Duration
+	var bytes int64
+	level := &readScaleLevel{Concurrency: concurrency}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < fetches && ctx.Err() == nil; i++ {
+				st, err := benchFetch(ctx, c)
+
+				lk.Lock()
+				level.Fetches++
+				switch {
+				case err != nil:
+					level.Errors++
+					if level.FirstError == "" {
+						level.FirstError = err.Error()
+					}
+				case !retrieved(st):
+					level.Errors++
+					if level.FirstError == "" {
+						level.FirstError = fetchFailure(st)
+					}
+				default:
+					latencies = append(latencies, st.TotalElapsed)
+					bytes += st.DecodedBytes
+				}
+				lk.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	level.Elapsed = time.Since(start)
+
+	if len(latencies) > 0 {
+		level.BytesPerSecond = float64(bytes) / level.Elapsed.Seconds()
+		level.FetchesPerSecond = float64(len(latencies)) / level.Elapsed.Seconds()
+		level.LatencyP50 = percentile(latencies, 50)
+		level.LatencyP95 = percentile(latencies, 95)
+		level.LatencyMax = percentile(latencies, 100)
+	}
+	return level
+}
+
+// fetchFailure describes why a fetch that was made didn't succeed
+func fetchFailure(st *fetchStats) string {
+	switch {
+	case st.RequestError != "":
+		return st.RequestError
+	case st.StatusCode != 200:
+		return fmt.Sprintf("status code %d", st.StatusCode)
+	default:
+		return "fetched data is corrupt"
+	}
+}
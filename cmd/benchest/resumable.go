@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// resumable uploads speak the tus protocol (https://tus.io/protocols/resumable-upload)
+const tusVersion = "1.0.0"
+
+var resumableFlag = &cli.BoolFlag{
+	Name:  "resumable",
+	Usage: "upload in chunks through the server's resumable (tus) upload endpoint, resuming from the last acknowledged offset after transient failures; falls back to a single POST if the server doesn't support it",
+}
+
+var resumablePathFlag = &cli.StringFlag{
+	Name:  "resumable-path",
+	Usage: "path of the resumable upload endpoint",
+	Value: "/content/uploads",
+}
+
+var resumableChunkSizeFlag = &cli.Int64Flag{
+	Name:  "resumable-chunk-size",
+	Usage: "size in bytes of each chunk of a resumable upload",
+	Value: 8 << 20,
+}
+
+var resumableRetriesFlag = &cli.IntFlag{
+	Name:  "resumable-retries",
+	Usage: "how many times a resumable upload is resumed after transient failures before giving up",
+	Value: 5,
+}
+
+type resumableOpts struct {
+	Path      string
+	ChunkSize int64
+	Retries   int
+}
+
+func resumableOptsFromFlags(cctx *cli.Context) (*resumableOpts, error) {
+	if !cctx.Bool("resumable") {
+		return nil, nil
+	}
+
+	chunkSize := cctx.Int64("resumable-chunk-size")
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid resumable chunk size %d", chunkSize)
+	}
+	return &resumableOpts{
+		Path:      cctx.String("resumable-path"),
+		ChunkSize: chunkSize,
+		Retries:   cctx.Int("resumable-retries"),
+	}, nil
+}
+
+type resumableStats struct {
+	Supported bool
+	// why the upload fell back to a single POST, if it did
+	Fallback string `json:",omitempty"`
+	Chunks   int
+	Resumes  int
+	// wall-clock time of the whole upload, including resumes
+	TotalTime time.Duration
+}
+
+// resumableUpload uploads data through the resumable upload endpoint. It returns a nil response (and no
+// error) if the server doesn't support resumable uploads, the stats then tell why. On success, the
+// response of the last chunk carries the content add response.
+func resumableUpload(ctx context.Context, host string, estToken string, name string, coluuid string, data []byte, opts *resumableOpts) (*http.Response, *resumableStats, error) {
+	ctx, span := tracer.Start(ctx, "resumableUpload")
+	defer span.End()
+
+	start := time.Now()
+	st := &resumableStats{}
+	endpoint := fmt.Sprintf("https://%s%s", host, opts.Path)
+
+	if reason := tusSupported(ctx, endpoint, estToken); reason != "" {
+		st.Fallback = reason
+		return nil, st, nil
+	}
+	st.Supported = true
+
+	uploadURL, err := tusCreate(ctx, endpoint, estToken, name, coluuid, int64(len(data)))
+	if err != nil {
+		return nil, st, err
+	}
+
+	var offset int64
+	for {
+		end := offset + opts.ChunkSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		resp, err := tusPatch(ctx, uploadURL, estToken, offset, data[offset:end])
+		st.Chunks++
+		if err == nil && end == int64(len(data)) {
+			st.TotalTime = time.Since(start)
+			if resp.StatusCode != http.StatusOK {
+				return nil, st, fmt.Errorf("resumable upload completed without a content add response (status code %d)", resp.StatusCode)
+			}
+			return resp, st, nil
+		}
+		if err == nil {
+			offset = end
+			continue
+		}
+
+		// resume from whatever the server acknowledged
+		if st.Resumes >= opts.Retries {
+			return nil, st, fmt.Errorf("resumable upload failed at offset %d after %d resumes: %w", offset, st.Resumes, err)
+		}
+		st.Resumes++
+		fmt.Fprintf(os.Stderr, "resumable upload chunk at offset %d failed, resuming: %s\n", offset, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, st, ctx.Err()
+		case <-time.After(time.Duration(st.Resumes) * time.Second):
+		}
+
+		acked, err := tusOffset(ctx, uploadURL, estToken)
+		if err != nil {
+			// the next attempt resends the chunk from the last known offset
+			logger.Warnf("failed to get resumable upload offset: %s", err)
+			continue
+		}
+		offset = acked
+	}
+}
+
+// tusSupported returns why the endpoint can't be used for resumable uploads, or an empty string if it can
+func tusSupported(ctx context.Context, endpoint string, estToken string) string {
+	req, err := http.NewRequestWithContext(ctx, "OPTIONS", endpoint, nil)
+	if err != nil {
+		return err.Error()
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Sprintf("resumable upload endpoint unreachable: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Sprintf("resumable upload endpoint returned status code %d", resp.StatusCode)
+	}
+	for _, v := range strings.Split(resp.Header.Get("Tus-Version"), ",") {
+		if strings.TrimSpace(v) == tusVersion {
+			return ""
+		}
+	}
+	return fmt.Sprintf("server doesn't support tus %s resumable uploads", tusVersion)
+}
+
+func tusCreate(ctx context.Context, endpoint string, estToken string, name string, coluuid string, length int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
+
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(name))
+	if coluuid != "" {
+		metadata += ",coluuid " + base64.StdEncoding.EncodeToString([]byte(coluuid))
+	}
+	req.Header.Set("Upload-Metadata", metadata)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to create resumable upload, status code %d: %s", resp.StatusCode, b)
+	}
+
+	loc, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("resumable upload created without a location: %w", err)
+	}
+	return loc.String(), nil
+}
+
+// tusPatch sends one chunk, the response is only returned (open) for the last one
+func tusPatch(ctx context.Context, uploadURL string, estToken string, offset int64, chunk []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "PATCH", uploadURL, bytes.NewReader(chunk))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	injectTraceHeaders(ctx, req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the last chunk is answered with the content add response
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusNoContent {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("chunk rejected with status code %d: %s", resp.StatusCode, b)
+	}
+	return resp, nil
+}
+
+// tusOffset asks the server how much of the upload it has received
+func tusOffset(ctx context.Context, uploadURL string, estToken string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", uploadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+	req.Header.Set("Tus-Resumable", tusVersion)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("offset request returned status code %d", resp.StatusCode)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var pollUntilRetrievableFlag = &cli.BoolFlag{
+	Name:  "poll-until-retrievable",
+	Usage: "after adding, retry the fetch with backoff until it succeeds and record the time to retrievable",
+}
+
+var retrievableTimeoutFlag = &cli.DurationFlag{
+	Name:  "retrievable-timeout",
+	Usage: "how long after the add to keep polling before giving up on the content becoming retrievable",
+	Value: 10 * time.Minute,
+}
+
+const (
+	retrievableInitialBackoff = time.Second
+	retrievableMaxBackoff     = 30 * time.Second
+)
+
+type retrievableStats struct {
+	Attempts          int
+	TimeToRetrievable time.Duration
+	// set when the content never became retrievable before the timeout
+	TimedOut bool
+}
+
+func retrievableTimeout(cctx *cli.Context) time.Duration {
+	if !cctx.Bool("poll-until-retrievable") {
+		return 0
+	}
+	return cctx.Duration("retrievable-timeout")
+}
+
+func retrieved(st *fetchStats) bool {
+	return st.RequestError == "" && st.StatusCode == 200 && (st.Verify == nil || !st.Verify.Corrupt)
+}
+
+// pollUntilRetrievable fetches the content until a fetch succeeds or the
+// timeout (counted from addedAt) passes, returning the stats of the last fetch
+func pollUntilRetrievable(ctx context.Context, c string, addedAt time.Time, timeout time.Duration) (*fetchStats, *retrievableStats) {
+	ctx, span := tracer.Start(ctx, "pollUntilRetrievable")
+	defer span.End()
+
+	deadline := addedAt.Add(timeout)
+	backoff := retrievableInitialBackoff
+	rst := &retrievableStats{}
+	for {
+		rst.Attempts++
+		st, err := benchFetch(ctx, c)
+		if err != nil {
+			st = &fetchStats{
+				RequestStart: time.Now(),
+				RequestError: err.Error(),
+			}
+		}
+
+		if retrieved(st) {
+			rst.TimeToRetrievable = time.Since(addedAt)
+			span.SetAttributes(
+				attribute.Int("attempts", rst.Attempts),
+				attribute.Int64("timeToRetrievableMs", rst.TimeToRetrievable.Milliseconds()),
+			)
+			return st, rst
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			rst.TimedOut = true
+			span.SetAttributes(
+				attribute.Int("attempts", rst.Attempts),
+				attribute.Bool("timedOut", true),
+			)
+			return st, rst
+		}
+
+		select {
+		case <-ctx.Done():
+			rst.TimedOut = true
+			return st, rst
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > retrievableMaxBackoff {
+			backoff = retrievableMaxBackoff
+		}
+	}
+}
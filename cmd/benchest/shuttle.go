@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/application-research/estuary/util"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/urfave/cli/v2"
+)
+
+var routeToShuttleFlag = &cli.StringFlag{
+	Name:  "route-to-shuttle",
+	Usage: "handle of the shuttle the API adds the file on, to benchmark a single shuttle through the API (the token must be an admin's to look the shuttle up)",
+}
+
+// shuttleRoute is the shuttle uploads are routed to
+type shuttleRoute struct {
+	Handle string
+	PeerID string
+}
+
+type shuttleRouteStats struct {
+	Handle string
+	PeerID string
+	// whether the add response listed the shuttle as a provider of the content
+	Served bool
+	// peer IDs of the providers the add response listed
+	Providers []string `json:",omitempty"`
+}
+
+func shuttleRouteFromFlags(cctx *cli.Context, host string, estToken string) (*shuttleRoute, error) {
+	handle := cctx.String("route-to-shuttle")
+	if handle == "" {
+		return nil, nil
+	}
+
+	if cctx.Bool("car") || cctx.Bool("resumable") || cctx.Bool("presigned") || cctx.String("pin-cid") != "" {
+		return nil, fmt.Errorf("--route-to-shuttle can't be combined with --car, --resumable, --presigned or --pin-cid")
+	}
+
+	peerID, err := shuttlePeerID(host, estToken, handle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up shuttle %s: %w", handle, err)
+	}
+	return &shuttleRoute{
+		Handle: handle,
+		PeerID: peerID,
+	}, nil
+}
+
+// shuttlePeerID looks up the peer ID of a shuttle in the admin shuttle list,
+// to recognize it among the providers of the content added on it
+func shuttlePeerID(host string, estToken string, handle string) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/admin/shuttle/list", host), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("shuttle list returned status code %d: %s", resp.StatusCode, b)
+	}
+
+	var shuttles []util.ShuttleListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&shuttles); err != nil {
+		return "", fmt.Errorf("failed to decode shuttle list: %w", err)
+	}
+
+	for _, sh := range shuttles {
+		if sh.Handle != handle {
+			continue
+		}
+		if sh.AddrInfo == nil || sh.AddrInfo.ID == "" {
+			return "", fmt.Errorf("shuttle has no known peer ID, is it connected?")
+		}
+		return sh.AddrInfo.ID.String(), nil
+	}
+	return "", fmt.Errorf("no such shuttle")
+}
+
+// checkShuttleRoute checks that the shuttle the upload was routed to is
+// among the providers of the content
+func checkShuttleRoute(route *shuttleRoute, providers []string) *shuttleRouteStats {
+	st := &shuttleRouteStats{
+		Handle: route.Handle,
+		PeerID: route.PeerID,
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range providers {
+		ma, err := multiaddr.NewMultiaddr(p)
+		if err != nil {
+			continue
+		}
+		id, err := ma.ValueForProtocol(multiaddr.P_P2P)
+		if err != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		st.Providers = append(st.Providers, id)
+		if id == route.PeerID {
+			st.Served = true
+		}
+	}
+	return st
+}
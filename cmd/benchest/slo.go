@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var runsFlag = &cli.IntFlag{
+	Name:  "runs",
+	Usage: "number of benchmark runs to aggregate before exiting (0 runs once, or forever with --every)",
+}
+
+var sloPercentileFlag = &cli.Float64Flag{
+	Name:  "slo-percentile",
+	Usage: "percentile of the aggregated runs checked against the SLOs",
+	Value: 95,
+}
+
+var sloTtfbFlag = &cli.DurationFlag{
+	Name:  "slo-ttfb",
+	Usage: "fail if the fetch time to first byte exceeds this duration",
+}
+
+var sloTotalFlag = &cli.DurationFlag{
+	Name:  "slo-total",
+	Usage: "fail if the total fetch time exceeds this duration",
+}
+
+var sloAddFlag = &cli.DurationFlag{
+	Name:  "slo-add",
+	Usage: "fail if the add request takes longer than this duration",
+}
+
+// checkRunFlags refuses the combinations of --every and --runs whose results would never be aggregated: a loop
+// running forever never reaches its SLO check or histograms, and only keeps the results the metrics file needs
+func checkRunFlags(cctx *cli.Context) error {
+	runs := cctx.Int("runs")
+	if runs < 0 {
+		return fmt.Errorf("invalid --runs %d, must not be negative", runs)
+	}
+	if cctx.IsSet("metrics-window") && cctx.String("metrics-file") == "" {
+		return fmt.Errorf("--metrics-window requires --metrics-file")
+	}
+	if cctx.Duration("every") == 0 || runs > 0 {
+		return nil
+	}
+
+	if cctx.IsSet("runs") {
+		return fmt.Errorf("--runs=0 can't be combined with --every, the loop would never end")
+	}
+	for _, name := range []string{"slo-ttfb", "slo-total", "slo-add", "histogram-buckets"} {
+		if cctx.IsSet(name) {
+			return fmt.Errorf("--%s requires --runs when combined with --every, a loop running forever never checks it", name)
+		}
+	}
+	return nil
+}
+
+// finished reports whether a benchmark loop has completed all of its runs
+func finished(cctx *cli.Context, completed int) bool {
+	if runs := cctx.Int("runs"); runs > 0 {
+		return completed >= runs
+	}
+	return cctx.Duration("every") == 0
+}
+
+// sampler extracts one latency sample from a result, if the result has one
+type sampler struct {
+	name   string
+	sample func(res *benchResult) (time.Duration, bool)
+}
+
+func fetchSample(get func(st *fetchStats) time.Duration) func(res *benchResult) (time.Duration, bool) {
+	return func(res *benchResult) (time.Duration, bool) {
+		if res.FetchStats == nil || res.FetchStats.RequestError != "" {
+			return 0, false
+		}
+		return get(res.FetchStats), true
+	}
+}
+
+// samplers are the latencies aggregated across runs, each can be bounded by an slo-<name> flag
+var samplers = []sampler{
+	{
+		name:   "ttfb",
+		sample: fetchSample(func(st *fetchStats) time.Duration { return st.TimeToFirstByte }),
+	},
+	{
+		name:   "total",
+		sample: fetchSample(func(st *fetchStats) time.Duration { return st.TotalElapsed }),
+	},
+	{
+		name: "add",
+		sample: func(res *benchResult) (time.Duration, bool) {
+			return res.AddFileTime, res.AddFileError == "" && res.AddFileTime > 0
+		},
+	},
+}
+
+func (s sampler) samples(results []*benchResult) []time.Duration {
+	var samples []time.Duration
+	for _, res := range results {
+		if d, ok := s.sample(res); ok {
+			samples = append(samples, d)
+		}
+	}
+	return samples
+}
+
+// checkSLOs aggregates the results and returns an error naming every SLO whose percentile was exceeded
+func checkSLOs(cctx *cli.Context, results []*benchResult) error {
+	p := cctx.Float64("slo-percentile")
+	if p <= 0 || p > 100 {
+		return fmt.Errorf("invalid SLO percentile %v, must be in (0, 100]", p)
+	}
+
+	var violations []string
+	for _, s := range samplers {
+		limit := cctx.Duration("slo-" + s.name)
+		if limit == 0 {
+			continue
+		}
+
+		samples := s.samples(results)
+		if len(samples) == 0 {
+			violations = append(violations, fmt.Sprintf("%s: no successful samples to check against %s", s.name, limit))
+			continue
+		}
+
+		if got := percentile(samples, p); got > limit {
+			violations = append(violations, fmt.Sprintf("%s: p%v %s exceeds %s by %s", s.name, p, got, limit, got-limit))
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("SLO violated (%d runs): %s", len(results), strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// percentile returns the nearest-rank percentile p (in (0, 100]) of the samples
+func percentile(samples []time.Duration, p float64) time.Duration {
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
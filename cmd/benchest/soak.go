@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var fetchUntilFailureFlag = &cli.BoolFlag{
+	Name:  "fetch-until-failure",
+	Usage: "fetch the file over and over (pausing --every between fetches) until a fetch fails, and report how many succeeded before it",
+}
+
+var maxFetchesFlag = &cli.IntFlag{
+	Name:  "max-fetches",
+	Usage: "with --fetch-until-failure, stop after this many successful fetches, 0 fetches until a failure",
+}
+
+type soakResult struct {
+	Runner    string
+	CID       string
+	Start     time.Time
+	Elapsed   time.Duration
+	Successes int
+	// set when a fetch failed, rather than the max fetches being reached or the run being interrupted
+	Failed bool
+	// the failed fetch, or why the fetch could not be made
+	FirstFailure      *fetchStats `json:",omitempty"`
+	FirstFailureError string      `json:",omitempty"`
+	// the last successful fetch, to compare the failure against
+	LastSuccess *fetchStats `json:",omitempty"`
+}
+
+// fetchUntilFailure fetches the content until a fetch fails, max fetches
+// succeeded (if max is not 0) or ctx is done
+func fetchUntilFailure(ctx context.Context, c string, max int, pause time.Duration) *soakResult {
+	ctx, span := tracer.Start(ctx, "fetchUntilFailure")
+	defer span.End()
+
+	res := &soakResult{
+		CID:   c,
+		Start: time.Now(),
+	}
+	defer func() {
+		res.Elapsed = time.Since(res.Start)
+		span.SetAttributes(
+			attribute.Int("successes", res.Successes),
+			attribute.Bool("failed", res.Failed),
+		)
+	}()
+
+	for max == 0 || res.Successes < max {
+		st, err := benchFetch(ctx, c)
+		if ctx.Err() != nil {
+			return res
+		}
+		if err != nil {
+			res.Failed = true
+			res.FirstFailureError = err.Error()
+			return res
+		}
+		if !retrieved(st) {
+			res.Failed = true
+			res.FirstFailure = st
+			return res
+		}
+		res.Successes++
+		res.LastSuccess = st
+
+		if pause > 0 {
+			select {
+			case <-ctx.Done():
+				return res
+			case <-time.After(pause):
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var uploadRateFlag = &cli.Int64Flag{
+	Name:  "upload-rate",
+	Usage: "throttle the upload to this many bytes per second, to check the server doesn't time out slow but valid uploads (0 uploads at full speed)",
+}
+
+type uploadRateStats struct {
+	// bytes per second the upload was throttled to
+	Configured int64
+	// bytes per second the body was actually sent at
+	Achieved float64
+}
+
+// rateLimitedReader trickles the reads of the underlying reader at rate bytes per second
+type rateLimitedReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	last  time.Time
+	n     int64
+}
+
+func newRateLimitedReader(r io.Reader, rate int64) *rateLimitedReader {
+	return &rateLimitedReader{r: r, rate: rate}
+}
+
+func (rl *rateLimitedReader) Read(p []byte) (int, error) {
+	if rl.start.IsZero() {
+		rl.start = time.Now()
+	}
+
+	// small reads keep the rate smooth rather than sending bursts
+	chunk := rl.rate / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	if int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := rl.r.Read(p)
+	rl.n += int64(n)
+
+	due := time.Duration(float64(rl.n) / float64(rl.rate) * float64(time.Second))
+	if wait := due - time.Since(rl.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	rl.last = time.Now()
+	return n, err
+}
+
+func (rl *rateLimitedReader) stats() *uploadRateStats {
+	st := &uploadRateStats{Configured: rl.rate}
+	if took := rl.last.Sub(rl.start); took > 0 {
+		st.Achieved = float64(rl.n) / took.Seconds()
+	}
+	return st
+}
+
+// throttleRequest replaces the request body with a rate limited one, the content length is kept
+func throttleRequest(req *http.Request, rate int64) *rateLimitedReader {
+	rl := newRateLimitedReader(req.Body, rate)
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{rl, req.Body}
+	return rl
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/application-research/estuary/metrics"
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op unless --otel-endpoint is set
+var tracer = otel.Tracer("benchest")
+
+var otelEndpointFlag = &cli.StringFlag{
+	Name:  "otel-endpoint",
+	Usage: "collector endpoint to export a trace span for each benchmark phase to",
+}
+
+// setupTracing installs the trace exporter if one was requested, the returned func flushes pending spans
+func setupTracing(cctx *cli.Context) (func(), error) {
+	endpoint := cctx.String("otel-endpoint")
+	if endpoint == "" {
+		return func() {}, nil
+	}
+
+	tp, err := metrics.NewJaegerTraceProvider("benchest", endpoint, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up trace exporter: %w", err)
+	}
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = tp.Tracer("benchest")
+
+	return func() {
+		if err := tp.Shutdown(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to flush trace spans: ", err)
+		}
+	}, nil
+}
+
+// injectTraceHeaders propagates the span in ctx to the request so it can be correlated with server-side traces
+func injectTraceHeaders(ctx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+func setFetchAttributes(span trace.Span, st *fetchStats) {
+	span.SetAttributes(
+		attribute.String("gatewayURL", st.GatewayURL),
+		attribute.String("gatewayHost", st.GatewayHost),
+		attribute.Int("statusCode", st.StatusCode),
+		attribute.String("requestError", st.RequestError),
+		attribute.Int64("responseTimeMs", st.ResponseTime.Milliseconds()),
+		attribute.Int64("timeToFirstByteMs", st.TimeToFirstByte.Milliseconds()),
+		attribute.Int64("totalTransferTimeMs", st.TotalTransferTime.Milliseconds()),
+		attribute.Int64("totalElapsedMs", st.TotalElapsed.Milliseconds()),
+		attribute.String("contentEncoding", st.ContentEncoding),
+		attribute.Int64("wireBytes", st.WireBytes),
+		attribute.Int64("decodedBytes", st.DecodedBytes),
+		attribute.String("proto", st.Proto),
+		attribute.Int("connectionsOpened", st.ConnectionsOpened),
+		attribute.Int("connectionsReused", st.ConnectionsReused),
+	)
+	if st.Verify != nil {
+		span.SetAttributes(
+			attribute.String("sha256", st.Verify.SHA256),
+			attribute.Bool("corrupt", st.Verify.Corrupt),
+		)
+	}
+}
+
+func setCheckAttributes(span trace.Span, chk *checkResp) {
+	span.SetAttributes(
+		attribute.Int64("checkTookMs", chk.CheckTook.Milliseconds()),
+		attribute.String("checkRequestError", chk.CheckRequestError),
+		attribute.String("connectionError", chk.ConnectionError),
+		attribute.Bool("cidInDHT", chk.CidInDHT),
+		attribute.Bool("bitswapFound", chk.DataAvailableOverBitswap.Found),
+		attribute.Bool("bitswapResponded", chk.DataAvailableOverBitswap.Responded),
+		attribute.String("outcome", chk.Outcome),
+	)
+}
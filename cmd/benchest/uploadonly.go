@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var uploadOnlyFlag = &cli.BoolFlag{
+	Name:  "upload-only",
+	Usage: "only time the add, skipping the fetch and the provider checks, to measure server-side ingest alone",
+}
+
+type uploadStats struct {
+	// size of the uploaded body
+	Bytes int64
+	// bytes per second the body was uploaded at, up to the add response
+	Throughput float64
+}
+
+// uploadOnlyFromFlags returns whether only the add is benchmarked, refusing
+// the flags that need the skipped phases
+func uploadOnlyFromFlags(cctx *cli.Context) (bool, error) {
+	if !cctx.Bool("upload-only") {
+		return false, nil
+	}
+
+	for _, name := range []string{"poll-until-retrievable", "cache-test", "route-to-shuttle", "provider-match", "wait-for-deal", "pin-cid", "slo-ttfb", "slo-total"} {
+		if cctx.IsSet(name) {
+			return false, fmt.Errorf("--upload-only can't be combined with --%s", name)
+		}
+	}
+	return true, nil
+}
+
+func newUploadStats(size int64, took time.Duration) *uploadStats {
+	st := &uploadStats{Bytes: size}
+	if took > 0 && size > 0 {
+		st.Throughput = float64(size) / took.Seconds()
+	}
+	return st
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/urfave/cli/v2"
+)
+
+// verifyFetches makes gateway fetches hash the body and recompute its CID
+var verifyFetches bool
+
+var verifyFlag = &cli.BoolFlag{
+	Name:  "verify",
+	Usage: "hash fetched bodies and recompute their UnixFS CID to check it matches the requested one, flagging corrupted responses",
+}
+
+type verifyStats struct {
+	SHA256 string
+	// CID of the body imported with estuary's defaults, empty if it couldn't be computed
+	ComputedCID string `json:",omitempty"`
+	CIDMatch    bool
+	// set when the body doesn't match the payload this run uploaded, only known for plain uploads
+	Corrupt bool
+	// why the body couldn't be checked, if it couldn't
+	Error string `json:",omitempty"`
+}
+
+type uploadedPayloadKey struct{}
+
+// withUploadedPayload records the SHA256 of the bytes uploaded for the content fetched with ctx
+func withUploadedPayload(ctx context.Context, sha string) context.Context {
+	return context.WithValue(ctx, uploadedPayloadKey{}, sha)
+}
+
+// uploadedPayload is the SHA256 recorded by withUploadedPayload, empty if this run didn't upload the content
+func uploadedPayload(ctx context.Context) string {
+	sha, _ := ctx.Value(uploadedPayloadKey{}).(string)
+	return sha
+}
+
+// fetchVerifier hashes the body written to it and imports it as a UnixFS file as it streams
+type fetchVerifier struct {
+	requested string
+	// SHA256 of the uploaded payload, empty if unknown
+	uploaded string
+	hasher   hash.Hash
+	pw       *io.PipeWriter
+	// set once the import stopped reading the body
+	importStopped bool
+	imported      chan importResult
+}
+
+type importResult struct {
+	c   cid.Cid
+	err error
+}
+
+func newFetchVerifier(requested, uploaded string) *fetchVerifier {
+	pr, pw := io.Pipe()
+	fv := &fetchVerifier{
+		requested: requested,
+		uploaded:  uploaded,
+		hasher:    sha256.New(),
+		pw:        pw,
+		imported:  make(chan importResult, 1),
+	}
+
+	go func() {
+		bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+		dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+		nd, err := util.ImportFile(dserv, pr)
+		// unblocks the writer if the import failed before reading the whole body
+		pr.CloseWithError(fmt.Errorf("import stopped"))
+		if err != nil {
+			fv.imported <- importResult{err: err}
+			return
+		}
+		fv.imported <- importResult{c: nd.Cid()}
+	}()
+	return fv
+}
+
+// Write never fails, a failed import is reported by finish rather than failing the fetch
+func (fv *fetchVerifier) Write(p []byte) (int, error) {
+	fv.hasher.Write(p)
+	if !fv.importStopped {
+		if _, err := fv.pw.Write(p); err != nil {
+			fv.importStopped = true
+		}
+	}
+	return len(p), nil
+}
+
+// finish ends the import once the body has been read (or failed with err) and checks it. The body is only
+// flagged corrupt against the payload this run uploaded: content added as a CAR, as a directory or pinned
+// may not have been imported with estuary's defaults, so a CID mismatch can't tell it's corrupt
+func (fv *fetchVerifier) finish(err error) *verifyStats {
+	if err != nil {
+		fv.pw.CloseWithError(err)
+	} else {
+		fv.pw.Close()
+	}
+	res := <-fv.imported
+
+	vst := &verifyStats{
+		SHA256: hex.EncodeToString(fv.hasher.Sum(nil)),
+	}
+	if err != nil {
+		vst.Error = fmt.Sprintf("body not fully read: %s", err)
+		return vst
+	}
+	if fv.uploaded != "" {
+		vst.Corrupt = vst.SHA256 != fv.uploaded
+	}
+	if res.err != nil {
+		vst.Error = fmt.Sprintf("failed to import body: %s", res.err)
+		return vst
+	}
+	vst.ComputedCID = res.c.String()
+
+	requested, err := cid.Decode(fv.requested)
+	if err != nil {
+		vst.Error = fmt.Sprintf("invalid requested cid: %s", err)
+		return vst
+	}
+	// the body can only be reimported into the same DAG if it was added with estuary's defaults
+	if requested.Version() == 0 {
+		vst.Error = "CIDv0 content can't be reimported with estuary's defaults"
+		return vst
+	}
+
+	vst.CIDMatch = requested.Equals(res.c)
+	if !vst.CIDMatch && fv.uploaded == "" {
+		vst.Error = "not comparable: the content may not have been imported with estuary's defaults"
+	}
+	return vst
+}
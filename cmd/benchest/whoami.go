@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/urfave/cli/v2"
+)
+
+var benchWhoamiCmd = &cli.Command{
+	Name:  "whoami",
+	Usage: "check that ESTUARY_TOKEN is valid and allowed to upload before a benchmark run",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "host",
+			Value: "api.estuary.tech",
+		},
+		insecureSkipVerifyFlag,
+		headerFlag,
+	},
+	Action: func(cctx *cli.Context) error {
+		estToken := os.Getenv("ESTUARY_TOKEN")
+		if estToken == "" {
+			return fmt.Errorf("no estuary token found")
+		}
+
+		if err := configureHTTPClient(cctx); err != nil {
+			return err
+		}
+
+		res, err := whoami(cctx.String("host"), estToken)
+		if res != nil {
+			b, err := json.MarshalIndent(res, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		}
+		return err
+	},
+}
+
+type whoamiResult struct {
+	Username   string
+	ID         uint
+	Perms      int
+	PermLevel  string
+	AuthExpiry time.Time `json:",omitempty"`
+	// rate limit headers of the response, if the host sets any
+	RateLimitHeaders map[string]string `json:",omitempty"`
+}
+
+// whoami looks up the account of the token. It fails if the token is invalid
+// or expired, or can't upload content, in which case the result is still
+// returned if the account could be looked up.
+func whoami(host string, estToken string) (*whoamiResult, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/viewer", host), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+estToken)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logger.Warnf("failed to close response body: %s", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		// the viewer endpoint requires upload permission, so a valid token
+		// without it is rejected as well
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("token is invalid, expired or lacks upload permission (status code %d): %s", resp.StatusCode, b)
+	default:
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("viewer returned status code %d: %s", resp.StatusCode, b)
+	}
+
+	var viewer util.ViewerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&viewer); err != nil {
+		return nil, fmt.Errorf("failed to decode viewer response: %w", err)
+	}
+
+	res := &whoamiResult{
+		Username:         viewer.Username,
+		ID:               viewer.ID,
+		Perms:            viewer.Perms,
+		PermLevel:        permLevelName(viewer.Perms),
+		AuthExpiry:       viewer.AuthExpiry,
+		RateLimitHeaders: rateLimitHeaders(resp.Header),
+	}
+	if viewer.Perms < util.PermLevelUpload {
+		return res, fmt.Errorf("token of %s lacks upload permission", viewer.Username)
+	}
+	if !viewer.AuthExpiry.IsZero() && time.Until(viewer.AuthExpiry) < 24*time.Hour {
+		fmt.Fprintln(os.Stderr, "WARNING: token expires at", viewer.AuthExpiry)
+	}
+	return res, nil
+}
+
+func permLevelName(perms int) string {
+	switch {
+	case perms >= util.PermLevelAdmin:
+		return "admin"
+	case perms >= util.PermLevelUser:
+		return "user"
+	case perms >= util.PermLevelUpload:
+		return "upload"
+	default:
+		return "none"
+	}
+}
+
+// rateLimitHeaders returns the headers describing rate limits, like
+// X-RateLimit-Remaining or Retry-After
+func rateLimitHeaders(h http.Header) map[string]string {
+	out := make(map[string]string)
+	for k, v := range h {
+		if strings.Contains(strings.ToLower(k), "ratelimit") || k == "Retry-After" {
+			out[k] = strings.Join(v, ", ")
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
@@ -185,6 +185,8 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.RpcEngine.Websocket.IncomingQueueSize = cctx.Int("rpc-incoming-queue-size")
 		case "rpc-outgoing-queue-size":
 			cfg.RpcEngine.Websocket.OutgoingQueueSize = cctx.Int("rpc-outgoing-queue-size")
+		case "rpc-command-queue-size":
+			cfg.RpcEngine.Websocket.CommandQueueSize = cctx.Int("rpc-command-queue-size")
 		case "queue-eng-driver":
 			cfg.RpcEngine.Queue.Driver = cctx.String("queue-eng-driver")
 		case "queue-eng-host":
@@ -372,6 +374,11 @@ func main() {
 			Usage: "sets outgoing rpc message queue size",
 			Value: cfg.RpcEngine.Websocket.OutgoingQueueSize,
 		},
+		&cli.IntFlag{
+			Name:  "rpc-command-queue-size",
+			Usage: "asks estuary for a larger queue of commands to this shuttle, e.g. for bulk onboarding (0 uses estuary's default)",
+			Value: cfg.RpcEngine.Websocket.CommandQueueSize,
+		},
 
 		&cli.BoolFlag{
 			Name:  "queue-eng-enabled",
@@ -612,6 +619,8 @@ func main() {
 						Params: params,
 					}); err != nil {
 						log.Errorf("failed to notify estuary primary node about transfer state: %s", err)
+					} else {
+						s.transferReported(&fst.ChannelID, fst)
 					}
 				case datatransfer.TransferFinished, datatransfer.Completed:
 					op := rpcevent.OP_TransferFinished
@@ -627,17 +636,21 @@ func main() {
 						Params: params,
 					}); err != nil {
 						log.Errorf("failed to notify estuary primary node about transfer state: %s", err)
+					} else {
+						s.transferReported(&fst.ChannelID, fst)
 					}
 				default:
 					// send transfer update for every other events
 					trsFailed, msg := util.TransferFailed(fst)
-					s.sendTransferStatusUpdate(context.TODO(), &rpcevent.TransferStatus{
+					if err := s.sendTransferStatusUpdate(context.TODO(), &rpcevent.TransferStatus{
 						Chanid:   fst.TransferID,
 						DealDBID: trk.Dbid,
 						State:    fst,
 						Failed:   trsFailed,
 						Message:  fmt.Sprintf("status: %d(%s), message: %s", fst.Status, msg, fst.Message),
-					})
+					}); err == nil {
+						s.transferReported(&fst.ChannelID, fst)
+					}
 				}
 			}()
 		})
@@ -670,6 +683,8 @@ func main() {
 						Params: params,
 					}); err != nil {
 						log.Errorf("failed to notify estuary primary node about transfer state: %s", err)
+					} else {
+						s.transferReported(&fst.ChannelID, &fst)
 					}
 
 				case datatransfer.TransferFinished, datatransfer.Completed:
@@ -686,17 +701,21 @@ func main() {
 						Params: params,
 					}); err != nil {
 						log.Errorf("failed to notify estuary primary node about transfer state: %s", err)
+					} else {
+						s.transferReported(&fst.ChannelID, &fst)
 					}
 				default:
 					// send transfer update for every other events
 					trsFailed, msg := util.TransferFailed(&fst)
-					s.sendTransferStatusUpdate(context.TODO(), &rpcevent.TransferStatus{
+					if err := s.sendTransferStatusUpdate(context.TODO(), &rpcevent.TransferStatus{
 						Chanid:   fst.TransferID,
 						DealDBID: dbid,
 						State:    &fst,
 						Failed:   trsFailed,
 						Message:  fmt.Sprintf("status: %d(%s), message: %s", fst.Status, msg, fst.Message),
-					})
+					}); err == nil {
+						s.transferReported(&fst.ChannelID, &fst)
+					}
 				}
 			}()
 		})
@@ -875,6 +894,11 @@ type Shuttle struct {
 	inflightCids   map[cid.Cid]uint
 	inflightCidsLk sync.Mutex
 
+	// total size of the active pins, summed at most once every pinnedBytesMaxAge
+	pinnedLk      sync.Mutex
+	pinnedBytes   int64
+	pinnedBytesAt time.Time
+
 	shuttleConfig *config.Shuttle
 
 	queueEng queueng.IShuttleRpcEngine
@@ -945,6 +969,9 @@ func (d *Shuttle) runRpc(conn *websocket.Conn) (err error) {
 		}
 	}()
 
+	// catch estuary up on transfers whose status changed while disconnected
+	go d.sendTrackedTransferStatuses(context.TODO())
+
 	for {
 		select {
 		case <-readDone:
@@ -987,6 +1014,7 @@ func (d *Shuttle) getHelloMessage() (*rpcevent.Hello, error) {
 		},
 		ContentAddingDisabled: d.disableLocalAdding,
 		QueueEngEnabled:       d.shuttleConfig.RpcEngine.Queue.Enabled,
+		CommandQueueSize:      d.shuttleConfig.RpcEngine.Websocket.CommandQueueSize,
 	}, nil
 }
 
@@ -1808,9 +1836,37 @@ func (s *Shuttle) getUpdatePacket() (*rpcevent.ShuttleUpdate, error) {
 		return nil, err
 	}
 
+	pinned, err := s.activePinnedBytes()
+	if err != nil {
+		return nil, err
+	}
+	upd.PinnedBytes = uint64(pinned)
+
 	return &upd, nil
 }
 
+// how stale the pinned size in update packets may get, summing it scans every active pin
+const pinnedBytesMaxAge = 10 * time.Minute
+
+// activePinnedBytes returns the total size of the active pins, only summing them again once the last sum is older
+// than pinnedBytesMaxAge
+func (s *Shuttle) activePinnedBytes() (int64, error) {
+	s.pinnedLk.Lock()
+	defer s.pinnedLk.Unlock()
+
+	if !s.pinnedBytesAt.IsZero() && time.Since(s.pinnedBytesAt) < pinnedBytesMaxAge {
+		return s.pinnedBytes, nil
+	}
+
+	var pinned int64
+	if err := s.DB.Model(Pin{}).Where("active").Select("coalesce(sum(size), 0)").Scan(&pinned).Error; err != nil {
+		return 0, err
+	}
+	s.pinnedBytes = pinned
+	s.pinnedBytesAt = time.Now()
+	return pinned, nil
+}
+
 func (s *Shuttle) handleHealth(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{
 		"status": "ok",
@@ -69,6 +69,14 @@ func (d *Shuttle) handleRpcCmd(cmd *rpcevent.Command, source string) error {
 		return err
 	case rpcevent.CMD_RestartTransfer:
 		return d.handleRpcRestartTransfer(ctx, cmd.Params.RestartTransfer)
+	case rpcevent.CMD_CancelTransfer:
+		return d.handleRpcCancelTransfer(ctx, cmd.Params.CancelTransfer)
+	case rpcevent.CMD_RetryPin:
+		return d.handleRpcRetryPin(ctx, cmd.Params.RetryPin)
+	case rpcevent.CMD_RequestStorageStats:
+		return d.handleRpcRequestStorageStats(ctx, cmd.Params.RequestStorageStats)
+	case rpcevent.CMD_RequestContentStats:
+		return d.handleRpcRequestContentStats(ctx, cmd.Params.RequestContentStats)
 	default:
 		return fmt.Errorf("unrecognized command op: %q", cmd.Op)
 	}
@@ -205,6 +213,148 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint64, data cid.Cid, user
 	return nil
 }
 
+func (d *Shuttle) handleRpcRetryPin(ctx context.Context, req *rpcevent.RetryPin) error {
+	if req == nil {
+		return fmt.Errorf("retry pin command had nil params")
+	}
+
+	ctx, span := d.Tracer.Start(ctx, "handleRetryPin", trace.WithAttributes(
+		attribute.Int64("contID", int64(req.DBID)),
+	))
+	defer span.End()
+
+	d.addPinLk.Lock()
+	defer d.addPinLk.Unlock()
+
+	var pin Pin
+	if err := d.DB.First(&pin, "content = ?", req.DBID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("no pin to retry for content %d", req.DBID)
+		}
+		return err
+	}
+
+	if pin.Active {
+		// the pin complete message must have been lost, resend it
+		go func() {
+			if err := d.resendPinComplete(ctx, pin); err != nil {
+				log.Error(err)
+			}
+		}()
+		return nil
+	}
+
+	if !pin.Failed {
+		// still queued or pinning, its outcome will be reported when done
+		return nil
+	}
+
+	if err := d.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
+		"failed":  false,
+		"pinning": false,
+	}).Error; err != nil {
+		return err
+	}
+
+	d.PinMgr.Add(&operation.PinningOperation{
+		Obj:    pin.Cid.CID,
+		ContId: pin.Content,
+		UserId: pin.UserID,
+		Status: pinningstatus.PinningStatusQueued,
+		Peers:  operation.SerializePeers(req.Peers),
+	})
+	return nil
+}
+
+func (d *Shuttle) handleRpcRequestStorageStats(ctx context.Context, req *rpcevent.RequestStorageStats) error {
+	if req == nil {
+		return fmt.Errorf("request storage stats command had nil params")
+	}
+
+	upd, err := d.getUpdatePacket()
+	if err != nil {
+		return fmt.Errorf("failed to get update packet: %w", err)
+	}
+
+	// answer off the command loop, sending may block on the outgoing queue
+	go func() {
+		if err := d.sendRpcMessage(ctx, &rpcevent.Message{
+			Op: rpcevent.OP_ShuttleUpdate,
+			Params: rpcevent.MsgParams{
+				ShuttleUpdate: upd,
+			},
+		}); err != nil {
+			log.Errorf("failed to send shuttle update: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (d *Shuttle) handleRpcRequestContentStats(ctx context.Context, req *rpcevent.RequestContentStats) error {
+	if req == nil {
+		return fmt.Errorf("request content stats command had nil params")
+	}
+
+	// walking the blocks of a large content takes a while, answer off the command loop
+	go func() {
+		stats, err := d.contentStats(ctx, req.Content)
+		if err != nil {
+			stats = &rpcevent.ContentStats{
+				Content: req.Content,
+				ErrMsg:  err.Error(),
+			}
+		}
+
+		if err := d.sendRpcMessage(ctx, &rpcevent.Message{
+			Op: rpcevent.OP_ContentStats,
+			Params: rpcevent.MsgParams{
+				ContentStats: stats,
+			},
+		}); err != nil {
+			log.Errorf("failed to send content stats: %s", err)
+		}
+	}()
+	return nil
+}
+
+// contentStats counts the blocks of the content's pin that are in the blockstore, and those that are missing
+func (d *Shuttle) contentStats(ctx context.Context, contid uint64) (*rpcevent.ContentStats, error) {
+	ctx, span := d.Tracer.Start(ctx, "contentStats", trace.WithAttributes(
+		attribute.Int64("content", int64(contid)),
+	))
+	defer span.End()
+
+	var pin Pin
+	if err := d.DB.First(&pin, "content = ?", contid).Error; err != nil {
+		return nil, fmt.Errorf("failed to look up pin for content %d: %w", contid, err)
+	}
+
+	objects, err := d.objectsForPin(ctx, pin.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get objects for pin: %w", err)
+	}
+
+	stats := &rpcevent.ContentStats{Content: contid}
+	for _, o := range objects {
+		has, err := d.Node.Blockstore.Has(ctx, o.Cid.CID)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			stats.MissingBlocks++
+			continue
+		}
+
+		size, err := d.Node.Blockstore.GetSize(ctx, o.Cid.CID)
+		if err != nil {
+			return nil, err
+		}
+		stats.Blocks++
+		stats.Size += int64(size)
+	}
+	return stats, nil
+}
+
 func (s *Shuttle) resendPinComplete(ctx context.Context, pin Pin) error {
 	objects, err := s.objectsForPin(ctx, pin.ID)
 	if err != nil {
@@ -492,6 +642,17 @@ func (s *Shuttle) trackTransfer(chanid *datatransfer.ChannelID, dealdbid uint, s
 	}
 }
 
+// transferReported records that estuary was sent st, unless the transfer moved
+// on to a newer state meanwhile
+func (s *Shuttle) transferReported(chanid *datatransfer.ChannelID, st *filclient.ChannelState) {
+	s.tcLk.Lock()
+	defer s.tcLk.Unlock()
+
+	if trk, ok := s.trackingChannels[chanid.String()]; ok && trk.Last == st {
+		trk.Reported = true
+	}
+}
+
 func (s *Shuttle) handleRpcPrepareForDataRequest(ctx context.Context, cmd *rpcevent.PrepareForDataRequest) error {
 	ctx, span := s.Tracer.Start(ctx, "handleRpcPrepareForDataRequest", trace.WithAttributes(
 		attribute.Int64("dealDbID", int64(cmd.DealDBID)),
@@ -546,7 +707,7 @@ func (s *Shuttle) handleRpcStartTransfer(ctx context.Context, cmd *rpcevent.Star
 	return nil
 }
 
-func (d *Shuttle) sendTransferStatusUpdate(ctx context.Context, st *rpcevent.TransferStatus) {
+func (d *Shuttle) sendTransferStatusUpdate(ctx context.Context, st *rpcevent.TransferStatus) error {
 	ctx, span := d.Tracer.Start(ctx, "sendTransferStatusUpdate")
 	defer span.End()
 
@@ -563,6 +724,70 @@ func (d *Shuttle) sendTransferStatusUpdate(ctx context.Context, st *rpcevent.Tra
 		},
 	}); err != nil {
 		log.Errorf("failed to send transfer status update: %s", err)
+		return err
+	}
+	return nil
+}
+
+// sendTrackedTransferStatuses reports the last known status of the tracked
+// transfers in a single message, so estuary can catch up after a reconnect.
+// Transfers in progress are always reported, those that ended only until
+// estuary was sent their final state, then they are no longer tracked: their
+// failures would be recorded again on every reconnect.
+func (d *Shuttle) sendTrackedTransferStatuses(ctx context.Context) {
+	ctx, span := d.Tracer.Start(ctx, "sendTrackedTransferStatuses")
+	defer span.End()
+
+	d.tcLk.Lock()
+	var statuses []*rpcevent.TransferStatus
+	sent := make(map[string]*filclient.ChannelState)
+	for chanid, trk := range d.trackingChannels {
+		if trk.Last == nil {
+			continue
+		}
+
+		if !util.CanRestartTransfer(trk.Last) {
+			if trk.Reported {
+				delete(d.trackingChannels, chanid)
+				continue
+			}
+			sent[chanid] = trk.Last
+		}
+
+		trsFailed, msg := util.TransferFailed(trk.Last)
+		statuses = append(statuses, &rpcevent.TransferStatus{
+			Chanid:   chanid,
+			DealDBID: trk.Dbid,
+			State:    trk.Last,
+			Failed:   trsFailed,
+			Message:  fmt.Sprintf("status: %d(%s), message: %s", trk.Last.Status, msg, trk.Last.Message),
+		})
+	}
+	d.tcLk.Unlock()
+
+	if len(statuses) == 0 {
+		return
+	}
+
+	log.Debugf("sending transfer status batch update for %d transfers", len(statuses))
+	if err := d.sendRpcMessage(ctx, &rpcevent.Message{
+		Op: rpcevent.OP_TransferStatusBatch,
+		Params: rpcevent.MsgParams{
+			TransferStatusBatch: &rpcevent.TransferStatusBatch{
+				Statuses: statuses,
+			},
+		},
+	}); err != nil {
+		log.Errorf("failed to send transfer status batch update: %s", err)
+		return
+	}
+
+	d.tcLk.Lock()
+	defer d.tcLk.Unlock()
+	for chanid, st := range sent {
+		if trk, ok := d.trackingChannels[chanid]; ok && trk.Last == st {
+			delete(d.trackingChannels, chanid)
+		}
 	}
 }
 
@@ -799,3 +1024,48 @@ func (s *Shuttle) handleRpcRestartTransfer(ctx context.Context, req *rpcevent.Re
 	s.trackTransfer(&req.ChanID, req.DealDBID, st)
 	return nil
 }
+
+func (s *Shuttle) handleRpcCancelTransfer(ctx context.Context, req *rpcevent.CancelTransfer) error {
+	if req == nil {
+		return fmt.Errorf("cancel transfer command had nil params")
+	}
+
+	ctx, span := s.Tracer.Start(ctx, "handleCancelTransfer", trace.WithAttributes(
+		attribute.Int64("dealDbID", int64(req.DealDBID)),
+	))
+	defer span.End()
+
+	log.Debugf("cancelling data transfer: %s (deal: %d)", req.ChanID, req.DealDBID)
+
+	// a transfer that was never started only needs to be acknowledged
+	if req.ChanID != "" {
+		// boost transfers are driven by the provider and are cleaned up through CleanupPreparedRequest
+		chanid, err := filclient.ChannelIDFromString(req.ChanID)
+		if err != nil {
+			return fmt.Errorf("cannot cancel transfer %s, only legacy data transfers can be cancelled: %w", req.ChanID, err)
+		}
+
+		st, err := s.Filc.TransferStatus(ctx, chanid)
+		if err != nil && err != filclient.ErrNoTransferFound {
+			return err
+		}
+
+		if st != nil && util.CanRestartTransfer(st) {
+			if err := s.Filc.GetDtMgr().CloseDataTransferChannel(ctx, *chanid); err != nil {
+				return fmt.Errorf("failed to cancel data transfer %s: %w", req.ChanID, err)
+			}
+		}
+
+		s.tcLk.Lock()
+		delete(s.trackingChannels, chanid.String())
+		s.tcLk.Unlock()
+	}
+
+	s.sendTransferStatusUpdate(ctx, &rpcevent.TransferStatus{
+		DealDBID:  req.DealDBID,
+		Chanid:    req.ChanID,
+		Cancelled: true,
+		Message:   "transfer cancelled by estuary",
+	})
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
@@ -119,3 +120,59 @@ func TestShuttleJSONRoundtrip(t *testing.T) {
 	load(&config2, path)
 	assert.Equal(config, &config2)
 }
+
+func TestLegacyIndexerURL(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	assert.NoError(os.WriteFile(path, []byte(`{"node": {"indexer_url": "https://indexer.example.com"}}`), 0600))
+	config := NewEstuary("test-version")
+	assert.NoError(config.Load(path))
+	assert.Equal([]string{"https://indexer.example.com"}, config.Node.IndexerURLs)
+
+	// indexer_urls wins over the legacy key
+	assert.NoError(os.WriteFile(path, []byte(`{"node": {"indexer_url": "https://indexer.example.com", "indexer_urls": ["https://a.example.com", "https://b.example.com"]}}`), 0600))
+	config = NewEstuary("test-version")
+	assert.NoError(config.Load(path))
+	assert.Equal([]string{"https://a.example.com", "https://b.example.com"}, config.Node.IndexerURLs)
+
+	// without either key the default is kept
+	assert.NoError(os.WriteFile(path, []byte(`{"node": {}}`), 0600))
+	config = NewEstuary("test-version")
+	assert.NoError(config.Load(path))
+	assert.Equal(NewEstuary("test-version").Node.IndexerURLs, config.Node.IndexerURLs)
+}
+
+func TestTransferTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	var tiers []TransferTimeoutTier
+	for _, s := range []string{"*=48h", "16GiB=24h", "4GiB=12h"} {
+		tier, err := ParseTransferTimeoutTier(s)
+		assert.NoError(err)
+		tiers = append(tiers, tier)
+	}
+	deal := Deal{TransferTimeouts: tiers}
+
+	assert.Equal(12*time.Hour, deal.TransferTimeout(1<<30))
+	assert.Equal(12*time.Hour, deal.TransferTimeout(4<<30))
+	assert.Equal(24*time.Hour, deal.TransferTimeout(8<<30))
+	assert.Equal(48*time.Hour, deal.TransferTimeout(32<<30))
+
+	// without a catch-all tier, larger deals never time out
+	deal.TransferTimeouts = tiers[1:]
+	assert.Equal(time.Duration(0), deal.TransferTimeout(32<<30))
+
+	for _, tier := range tiers {
+		parsed, err := ParseTransferTimeoutTier(tier.String())
+		assert.NoError(err)
+		assert.Equal(tier, parsed)
+	}
+
+	_, err := ParseTransferTimeoutTier("4GiB")
+	assert.Error(err)
+	_, err = ParseTransferTimeoutTier("lots=12h")
+	assert.Error(err)
+	_, err = ParseTransferTimeoutTier("4GiB=soon")
+	assert.Error(err)
+}
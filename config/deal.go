@@ -1,7 +1,13 @@
 package config
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/application-research/filclient"
+	"github.com/docker/go-units"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -18,12 +24,75 @@ var DealProtocolsVersionsMap = map[string]protocol.ID{
 }
 
 type Deal struct {
-	FailOnTransferFailure        bool                 `json:"fail_on_transfer_failure"`
-	IsDisabled                   bool                 `json:"disabled"`
-	IsVerified                   bool                 `json:"verified"`
-	RemoveUnsealed               bool                 `json:"remove_unsealed"`
-	Duration                     abi.ChainEpoch       `json:"duration"`
-	EnabledDealProtocolsVersions map[protocol.ID]bool `json:"enabled_deal_protocol_versions"`
-	MaxVerifiedPrice             big.Int              `json:"max_verified_price"`
-	MaxPrice                     big.Int              `json:"max_price"`
+	FailOnTransferFailure        bool                  `json:"fail_on_transfer_failure"`
+	IsDisabled                   bool                  `json:"disabled"`
+	IsVerified                   bool                  `json:"verified"`
+	RemoveUnsealed               bool                  `json:"remove_unsealed"`
+	Duration                     abi.ChainEpoch        `json:"duration"`
+	EnabledDealProtocolsVersions map[protocol.ID]bool  `json:"enabled_deal_protocol_versions"`
+	MaxVerifiedPrice             big.Int               `json:"max_verified_price"`
+	MaxPrice                     big.Int               `json:"max_price"`
+	TransferTimeouts             []TransferTimeoutTier `json:"transfer_timeouts"`
+}
+
+// TransferTimeoutTier is how long the data transfer of deals of up to MaxSize
+// bytes may run before the deal is failed, a MaxSize of 0 matches any size
+type TransferTimeoutTier struct {
+	MaxSize int64         `json:"max_size"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+// ParseTransferTimeoutTier parses a tier written as size=timeout, e.g.
+// '4GiB=12h', with a size of '*' matching any size
+func ParseTransferTimeoutTier(s string) (TransferTimeoutTier, error) {
+	size, timeout, ok := strings.Cut(s, "=")
+	if !ok {
+		return TransferTimeoutTier{}, fmt.Errorf("invalid transfer timeout tier %q, expected size=timeout", s)
+	}
+
+	var tier TransferTimeoutTier
+	if size != "*" {
+		maxSize, err := units.RAMInBytes(size)
+		if err != nil {
+			return TransferTimeoutTier{}, fmt.Errorf("invalid size in transfer timeout tier %q: %w", s, err)
+		}
+		if maxSize <= 0 {
+			return TransferTimeoutTier{}, fmt.Errorf("invalid size in transfer timeout tier %q", s)
+		}
+		tier.MaxSize = maxSize
+	}
+
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return TransferTimeoutTier{}, fmt.Errorf("invalid timeout in transfer timeout tier %q: %w", s, err)
+	}
+	tier.Timeout = d
+	return tier, nil
+}
+
+func (tier TransferTimeoutTier) String() string {
+	if tier.MaxSize == 0 {
+		return "*=" + tier.Timeout.String()
+	}
+	return units.BytesSize(float64(tier.MaxSize)) + "=" + tier.Timeout.String()
+}
+
+// TransferTimeout returns the transfer timeout of a deal of size bytes, that
+// of the smallest tier it fits in, or 0 if it fits in none
+func (d Deal) TransferTimeout(size int64) time.Duration {
+	tiers := make([]TransferTimeoutTier, len(d.TransferTimeouts))
+	copy(tiers, d.TransferTimeouts)
+	sort.SliceStable(tiers, func(i, j int) bool {
+		if tiers[i].MaxSize == 0 || tiers[j].MaxSize == 0 {
+			return tiers[j].MaxSize == 0 && tiers[i].MaxSize != 0
+		}
+		return tiers[i].MaxSize < tiers[j].MaxSize
+	})
+
+	for _, tier := range tiers {
+		if tier.MaxSize == 0 || size <= tier.MaxSize {
+			return tier.Timeout
+		}
+	}
+	return 0
 }
@@ -102,6 +102,11 @@ func NewEstuary(appVersion string) *Estuary {
 			},
 			MaxVerifiedPrice: constants.VerifiedDealMaxPrice,
 			MaxPrice:         constants.DealMaxPrice,
+			TransferTimeouts: []TransferTimeoutTier{
+				{MaxSize: 4 << 30, Timeout: 12 * time.Hour},
+				{MaxSize: 16 << 30, Timeout: 24 * time.Hour},
+				{MaxSize: 0, Timeout: 48 * time.Hour},
+			},
 		},
 
 		Content: Content{
@@ -144,8 +149,18 @@ func NewEstuary(appVersion string) *Estuary {
 			WriteLogTruncate:  false,
 			NoBlockstoreCache: false,
 
-			IndexerURL:                   constants.DefaultIndexerURL,
+			IndexerURLs:                  []string{constants.DefaultIndexerURL},
 			IndexerAdvertisementInterval: time.Minute,
+			IndexerRefreshInterval:       24 * time.Hour,
+			IndexerPruneInterval:         24 * time.Hour,
+			IndexerReapInterval:          24 * time.Hour,
+			IndexerReapPace:              time.Second,
+			IndexerColdBatchTicks:        10,
+			IndexerLookbackBatches:       2,
+			IndexerMinBatchFillMaxAge:    time.Hour,
+			IndexerOfflineGrace:          5 * time.Minute,
+			IndexerScheduleJitter:        0.1,
+			IndexerObjRefStrategy:        "join",
 
 			ApiURL: "wss://api.chain.love",
 
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/application-research/estuary/node/modules/peering"
@@ -12,13 +13,32 @@ type Node struct {
 	AnnounceAddrs                 []string                 `json:"announce_addrs"`
 	PeeringPeers                  []peering.PeeringPeer    `json:"peering_peers"`
 	IndexerAdvertisementInterval  time.Duration            `json:"indexer_advertisement_interval"`
+	IndexerRefreshInterval        time.Duration            `json:"indexer_refresh_interval"`
+	IndexerPruneInterval          time.Duration            `json:"indexer_prune_interval"`
+	IndexerPruneNotifyRemove      bool                     `json:"indexer_prune_notify_remove"`
+	IndexerPauseNotifyRemove      bool                     `json:"indexer_pause_notify_remove"`
+	IndexerReapInterval           time.Duration            `json:"indexer_reap_interval"`
+	IndexerReapPace               time.Duration            `json:"indexer_reap_pace"`
+	IndexerRecentContentAge       time.Duration            `json:"indexer_recent_content_age"`
+	IndexerMaxEntriesPerAd        uint64                   `json:"indexer_max_entries_per_ad"`
+	IndexerColdBatchTicks         uint64                   `json:"indexer_cold_batch_ticks"`
+	IndexerLookbackBatches        uint64                   `json:"indexer_lookback_batches"`
+	IndexerMinBatchFill           float64                  `json:"indexer_min_batch_fill"`
+	IndexerMinBatchFillMaxAge     time.Duration            `json:"indexer_min_batch_fill_max_age"`
+	IndexerOfflineGrace           time.Duration            `json:"indexer_offline_grace"`
+	IndexerIterationCache         bool                     `json:"indexer_iteration_cache"`
+	IndexerSchedulePasses         uint64                   `json:"indexer_schedule_passes"`
+	IndexerScheduleJitter         float64                  `json:"indexer_schedule_jitter"`
+	IndexerQueryRate              float64                  `json:"indexer_query_rate"`
+	IndexerContentExpiry          bool                     `json:"indexer_content_expiry"`
 	AdvertiseOfflineAutoretrieves bool                     `json:"advertise_offline_autoretrieve"`
 	EnableWebsocketListenAddr     bool                     `json:"enable_websocket_listen_addr"`
 	HardFlushWriteLog             bool                     `json:"hard_flush_write_log"`
 	WriteLogTruncate              bool                     `json:"write_log_truncate"`
 	NoBlockstoreCache             bool                     `json:"no_blockstore_cache"`
 	NoLimiter                     bool                     `json:"no_limiter"`
-	IndexerURL                    string                   `json:"indexer_url"`
+	IndexerURLs                   []string                 `json:"indexer_urls"`
+	IndexerObjRefStrategy         string                   `json:"indexer_obj_ref_strategy"`
 	Blockstore                    string                   `json:"blockstore"`
 	WriteLogDir                   string                   `json:"write_log_dir"`
 	Libp2pKeyFile                 string                   `json:"libp2p_key_file"`
@@ -30,3 +50,24 @@ type Node struct {
 	Limits                        rcmgr.ScalingLimitConfig `json:"limits"`
 	ConnectionManager             ConnectionManager        `json:"connection_manager"`
 }
+
+// UnmarshalJSON reads configs written before indexer_url became indexer_urls,
+// their indexer_url is used unless indexer_urls is set too
+func (n *Node) UnmarshalJSON(b []byte) error {
+	type node Node
+	if err := json.Unmarshal(b, (*node)(n)); err != nil {
+		return err
+	}
+
+	var legacy struct {
+		IndexerURL  string   `json:"indexer_url"`
+		IndexerURLs []string `json:"indexer_urls"`
+	}
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return err
+	}
+	if legacy.IndexerURL != "" && legacy.IndexerURLs == nil {
+		n.IndexerURLs = []string{legacy.IndexerURL}
+	}
+	return nil
+}
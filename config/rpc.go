@@ -16,4 +16,7 @@ type WebsocketEngine struct {
 	IncomingQueueSize int `json:"incoming_queue_size"`
 	OutgoingQueueSize int `json:"outgoing_queue_size"`
 	QueueHandlers     int `json:"queue_handlers"`
+	// shuttle only, size of the command queue estuary is asked to keep for
+	// the shuttle, 0 leaves it to estuary
+	CommandQueueSize int `json:"command_queue_size"`
 }
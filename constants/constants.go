@@ -30,6 +30,12 @@ const MinDealContentSize = int64(1_100_000_000)
 // MaxDealContentSize 31.66 GB
 const MaxDealContentSize = int64(34_000_000_000)
 
+// attempts after which the commp worker gives up on a deal queue entry
+const DealQueueCommpMaxAttempts = 3
+
+// attempts after which a split queue entry is flagged as failing, and no longer claimed
+const SplitQueueMaxAttempts = 3
+
 // how many contents to include per advertisement for autoretrieve
 const AutoretrieveProviderBatchSize = uint64(25000)
 
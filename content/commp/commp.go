@@ -7,6 +7,7 @@ import (
 	"github.com/application-research/estuary/config"
 	"github.com/application-research/estuary/constants"
 	commpstatus "github.com/application-research/estuary/content/commp/status"
+	"github.com/application-research/estuary/deal/queue"
 	"github.com/application-research/estuary/model"
 
 	"github.com/application-research/estuary/node"
@@ -48,7 +49,7 @@ func NewManager(ctx context.Context, db *gorm.DB, cfg *config.Estuary, log *zap.
 		shuttleMgr:         shuttleMgr,
 		tracer:             otel.Tracer("commp"),
 		blockstore:         tbs.Under().(node.EstuaryBlockstore),
-		commpStatusUpdater: commpstatus.NewUpdater(db, log),
+		commpStatusUpdater: commpstatus.NewUpdater(db, log, queue.NewManager(cfg, log)),
 	}
 
 	m.runWorker(ctx)
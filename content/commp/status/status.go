@@ -3,6 +3,7 @@ package status
 import (
 	"time"
 
+	dealqueuemgr "github.com/application-research/estuary/deal/queue"
 	"github.com/application-research/estuary/model"
 	"github.com/application-research/estuary/util"
 	"github.com/filecoin-project/go-state-types/abi"
@@ -20,14 +21,16 @@ type IUpdater interface {
 }
 
 type updater struct {
-	db  *gorm.DB
-	log *zap.SugaredLogger
+	db           *gorm.DB
+	log          *zap.SugaredLogger
+	dealQueueMgr dealqueuemgr.IManager
 }
 
-func NewUpdater(db *gorm.DB, log *zap.SugaredLogger) IUpdater {
+func NewUpdater(db *gorm.DB, log *zap.SugaredLogger, dealQueueMgr dealqueuemgr.IManager) IUpdater {
 	return &updater{
-		db:  db,
-		log: log,
+		db:           db,
+		log:          log,
+		dealQueueMgr: dealQueueMgr,
 	}
 }
 
@@ -42,7 +45,7 @@ func (up *updater) ComputeCompleted(data cid.Cid, piece cid.Cid, size abi.Unpadd
 		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&opcr).Error; err != nil {
 			return err
 		}
-		return tx.Exec("UPDATE deal_queues SET commp_attempted = commp_attempted + 1, commp_done = ? WHERE cont_cid = ?", true, data.Bytes()).Error
+		return up.markCommpDone(data, tx)
 	}); err != nil {
 		up.log.Errorf("failed to update deal queue (ComputeCompleted) for cid %s - %s", data, err)
 	}
@@ -61,7 +64,17 @@ func (up *updater) ComputeRequested(data cid.Cid) {
 }
 
 func (up *updater) CommpExist(data cid.Cid) {
-	if err := up.db.Exec("UPDATE deal_queues SET commp_attempted = commp_attempted + 1, commp_done = ? WHERE cont_cid = ?", true, data.Bytes()).Error; err != nil {
+	if err := up.markCommpDone(data, up.db); err != nil {
 		up.log.Errorf("failed to update deal queue (CommpExist) for cid %s - %s", data, err)
 	}
 }
+
+// markCommpDone marks the commp of all the contents with cid data as done in one statement
+func (up *updater) markCommpDone(data cid.Cid, tx *gorm.DB) error {
+	var contIDs []uint64
+	if err := tx.Model(model.DealQueue{}).Where("cont_cid = ?", data.Bytes()).Pluck("cont_id", &contIDs).Error; err != nil {
+		return err
+	}
+	_, err := up.dealQueueMgr.MarkCommpDone(contIDs, tx)
+	return err
+}
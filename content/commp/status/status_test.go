@@ -0,0 +1,70 @@
+package status
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	dealqueuemgr "github.com/application-research/estuary/deal/queue"
+	"github.com/application-research/estuary/model"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testCid(t *testing.T, s string) cid.Cid {
+	mh, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	assert.NoError(t, err)
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+func TestComputeCompleted(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.AutoMigrate(&model.DealQueue{}, &model.PieceCommRecord{}))
+
+	data := testCid(t, "data")
+	other := testCid(t, "other")
+	later := time.Now().Add(time.Hour).UTC()
+	// contents 1 and 2 share their cid
+	for contID, c := range map[uint64]cid.Cid{1: data, 2: data, 3: other} {
+		assert.NoError(t, db.Create(&model.DealQueue{
+			UserID:                 1,
+			ContID:                 contID,
+			ContCid:                util.DbCID{CID: c},
+			CommpNextAttemptAt:     time.Now().UTC(),
+			DealCheckNextAttemptAt: later,
+			DealNextAttemptAt:      later,
+		}).Error)
+	}
+
+	log := zap.NewNop().Sugar()
+	up := NewUpdater(db, log, dealqueuemgr.NewManager(config.NewEstuary("test"), log))
+	up.ComputeCompleted(data, testCid(t, "piece"), 1024, 2048)
+
+	var tasks []*model.DealQueue
+	assert.NoError(t, db.Order("cont_id asc").Find(&tasks).Error)
+	if assert.Len(t, tasks, 3) {
+		for _, task := range tasks[:2] {
+			assert.True(t, task.CommpDone, "cont %d commp_done", task.ContID)
+			assert.True(t, task.DealCheckNextAttemptAt.Before(time.Now()), "cont %d is due for a deal check", task.ContID)
+		}
+		assert.False(t, tasks[2].CommpDone)
+	}
+
+	var records []model.PieceCommRecord
+	assert.NoError(t, db.Find(&records).Error)
+	assert.Len(t, records, 1)
+
+	up.CommpExist(other)
+	var task model.DealQueue
+	assert.NoError(t, db.First(&task, "cont_id = ?", 3).Error)
+	assert.True(t, task.CommpDone)
+}
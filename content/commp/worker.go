@@ -4,6 +4,8 @@ import (
 	"context"
 	"time"
 
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/deal/queue"
 	"github.com/application-research/estuary/model"
 	"github.com/ipfs/go-cid"
 	"gorm.io/gorm"
@@ -17,7 +19,16 @@ func (m *manager) runWorker(ctx context.Context) {
 	m.log.Infof("spun up commp worker")
 }
 
+// failed attempts are retried after an hour, a next attempt further out than this was left behind by a crashed worker
+const stalledCommpThreshold = 24 * time.Hour
+
 func (m *manager) runCommpForContents(ctx context.Context) {
+	if reset, err := queue.ResetStalledCommp(m.db, stalledCommpThreshold); err != nil {
+		m.log.Warnf("failed to reset stalled commp attempts - %s", err)
+	} else if reset > 0 {
+		m.log.Infof("reset %d stalled commp attempt(s)", reset)
+	}
+
 	timer := time.NewTicker(m.cfg.WorkerIntervals.CommpInterval)
 	for {
 		select {
@@ -29,7 +40,7 @@ func (m *manager) runCommpForContents(ctx context.Context) {
 
 			// get contents grouped by cid, so one commp can work for all contents with same cid
 			var tasks []*model.DealQueue
-			if err := m.db.Where("not commp_done and commp_attempted < 3 and commp_next_attempt_at < ?", time.Now().UTC()).Distinct("cont_cid, id").Order("id asc").Limit(10).Find(&tasks).Error; err != nil {
+			if err := m.db.Where("not commp_done and commp_attempted < ? and commp_next_attempt_at < ?", constants.DealQueueCommpMaxAttempts, time.Now().UTC()).Distinct("cont_cid, id").Order("id asc").Limit(10).Find(&tasks).Error; err != nil {
 				m.log.Warnf("failed to get contents to commp - %s", err)
 				continue
 			}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/application-research/estuary/constants"
 	"github.com/application-research/estuary/model"
 	"github.com/application-research/estuary/util"
 	"go.opentelemetry.io/otel"
@@ -17,8 +18,16 @@ type IManager interface {
 	QueueContent(contID uint64, userID uint, tx *gorm.DB) error
 	SplitComplete(contID uint64, tx *gorm.DB)
 	SplitFailed(contID uint64, tx *gorm.DB)
+	ClaimNextSplit(tx *gorm.DB) (*model.SplitQueue, error)
+	CompleteSplit(contID uint64, tx *gorm.DB) error
+	FailSplit(task *model.SplitQueue, tx *gorm.DB) error
 }
 
+const (
+	// how long a claimed entry is held by its worker before it can be claimed again
+	splitClaimLease = 1 * time.Hour
+)
+
 type manager struct {
 	log    *zap.SugaredLogger
 	tracer trace.Tracer
@@ -47,7 +56,14 @@ func (m *manager) QueueContent(contID uint64, userID uint, tx *gorm.DB) error {
 func (m *manager) SplitComplete(contID uint64, tx *gorm.DB) {
 	m.log.Debugf("cont: %d split complete", contID)
 
-	if err := tx.Transaction(func(tx *gorm.DB) error {
+	if err := m.CompleteSplit(contID, tx); err != nil {
+		m.log.Errorf("failed to update split queue (SplitComplete) for cont %d - %s", contID, err)
+	}
+}
+
+// CompleteSplit marks the content as split and removes it from the queue
+func (m *manager) CompleteSplit(contID uint64, tx *gorm.DB) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
 		if err := tx.Model(util.Content{}).Where("id = ?", contID).UpdateColumns(map[string]interface{}{
 			"dag_split": true,
 			"active":    false,
@@ -61,9 +77,7 @@ func (m *manager) SplitComplete(contID uint64, tx *gorm.DB) {
 			return fmt.Errorf("failed to delete object references for newly split object: %w", err)
 		}
 		return tx.Unscoped().Delete(&model.SplitQueue{}, "cont_id = ?", contID).Error // delete permanently
-	}); err != nil {
-		m.log.Errorf("failed to update split queue (SplitComplete) for cont %d - %s", contID, err)
-	}
+	})
 }
 
 func (m *manager) SplitFailed(contID uint64, tx *gorm.DB) {
@@ -73,3 +87,63 @@ func (m *manager) SplitFailed(contID uint64, tx *gorm.DB) {
 		m.log.Errorf("failed to update split queue (SplitFaileds) for cont %d - %s", contID, err)
 	}
 }
+
+// ClaimNextSplit picks the next content to split and leases it by counting the attempt and pushing its
+// next_attempt_at forward, so that concurrent workers never get the same entry. It returns nil when there is
+// nothing to claim, the claim must be finalized with CompleteSplit or FailSplit.
+func (m *manager) ClaimNextSplit(tx *gorm.DB) (*model.SplitQueue, error) {
+	var claimed *model.SplitQueue
+	if err := tx.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+
+		q := tx.Where("not failing and attempted < ? and next_attempt_at <= ?", constants.SplitQueueMaxAttempts, now).Order("id asc").Limit(1)
+		if tx.Dialector.Name() == "postgres" {
+			q = q.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+
+		var tasks []*model.SplitQueue
+		if err := q.Find(&tasks).Error; err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			return nil
+		}
+		task := tasks[0]
+
+		// the attempt count is compared so that the claim is lost, rather than doubled, if another worker
+		// claimed the entry in between (databases without row locks)
+		leaseEnd := now.Add(splitClaimLease)
+		res := tx.Model(model.SplitQueue{}).Where("id = ? and attempted = ?", task.ID, task.Attempted).UpdateColumns(map[string]interface{}{
+			"attempted":       task.Attempted + 1,
+			"next_attempt_at": leaseEnd,
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+
+		task.Attempted++
+		task.NextAttemptAt = leaseEnd
+		claimed = task
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if claimed != nil {
+		m.log.Debugf("claimed cont: %d for splitting (attempt %d)", claimed.ContID, claimed.Attempted)
+	}
+	return claimed, nil
+}
+
+// FailSplit schedules a claimed entry for a retry, flagging it as failing once it ran out of attempts
+func (m *manager) FailSplit(task *model.SplitQueue, tx *gorm.DB) error {
+	m.log.Warnf("cont: %d split failed (attempt %d)", task.ContID, task.Attempted)
+
+	return tx.Model(model.SplitQueue{}).Where("id = ?", task.ID).UpdateColumns(map[string]interface{}{
+		"failing":         task.Attempted >= constants.SplitQueueMaxAttempts,
+		"next_attempt_at": time.Now().Add(1 * time.Hour).UTC(),
+	}).Error
+}
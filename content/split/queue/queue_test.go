@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.AutoMigrate(&model.SplitQueue{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestClaimNextSplit(t *testing.T) {
+	db := setupTestDB(t)
+	mgr := NewManager(zap.NewNop().Sugar())
+
+	for _, contID := range []uint64{1, 2} {
+		assert.NoError(t, mgr.QueueContent(contID, 1, db))
+	}
+	// not eligible yet
+	assert.NoError(t, db.Create(&model.SplitQueue{UserID: 1, ContID: 3, NextAttemptAt: time.Now().Add(time.Hour).UTC()}).Error)
+
+	first, err := mgr.ClaimNextSplit(db)
+	assert.NoError(t, err)
+	if assert.NotNil(t, first) {
+		assert.Equal(t, uint64(1), first.ContID)
+		assert.Equal(t, uint(1), first.Attempted)
+	}
+
+	second, err := mgr.ClaimNextSplit(db)
+	assert.NoError(t, err)
+	if assert.NotNil(t, second) {
+		assert.Equal(t, uint64(2), second.ContID)
+	}
+
+	none, err := mgr.ClaimNextSplit(db)
+	assert.NoError(t, err)
+	assert.Nil(t, none, "claimed entries are leased and the last one is scheduled for later")
+
+	// a failure on the last attempt stops the entry from being claimed again
+	first.Attempted = constants.SplitQueueMaxAttempts
+	assert.NoError(t, mgr.FailSplit(first, db))
+
+	var task model.SplitQueue
+	assert.NoError(t, db.First(&task, "cont_id = ?", first.ContID).Error)
+	assert.True(t, task.Failing)
+	assert.True(t, task.NextAttemptAt.After(time.Now()))
+
+	assert.NoError(t, mgr.FailSplit(second, db))
+	var retried model.SplitQueue
+	assert.NoError(t, db.First(&retried, "cont_id = ?", second.ContID).Error)
+	assert.False(t, retried.Failing)
+}
+
+func TestResetTracker(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&model.SplitQueueTracker{}))
+
+	// content indexes are created concurrently on postgres, which sqlite doesn't support, so the table is
+	// created by hand
+	assert.NoError(t, db.Exec("CREATE TABLE contents (id integer primary key, size integer, dag_split boolean, deleted_at datetime)").Error)
+	for id, size := range map[int]int64{1: 10, 2: 1000, 3: 10, 4: 1000, 5: 1000} {
+		assert.NoError(t, db.Exec("INSERT INTO contents (id, size, dag_split) VALUES (?, ?, false)", id, size).Error)
+	}
+
+	window := func() []uint64 {
+		var trk model.SplitQueueTracker
+		assert.NoError(t, db.First(&trk).Error)
+
+		contents, err := NextWindow(db, &trk, 100)
+		assert.NoError(t, err)
+
+		var ids []uint64
+		for _, c := range contents {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+
+	log := zap.NewNop().Sugar()
+	assert.NoError(t, db.Create(&model.SplitQueueTracker{LastContID: 4, StopAt: 5, BackfillDone: true}).Error)
+	assert.Equal(t, []uint64{5}, window())
+
+	assert.NoError(t, ResetTracker(db, log, 0, 5))
+	var trk model.SplitQueueTracker
+	assert.NoError(t, db.First(&trk).Error)
+	assert.False(t, trk.BackfillDone)
+	assert.Equal(t, []uint64{2, 4, 5}, window())
+
+	assert.NoError(t, ResetTracker(db, log, 3, 4))
+	assert.Equal(t, []uint64{4}, window())
+
+	assert.Error(t, ResetTracker(db, log, 5, 4))
+
+	// a window being swept can't be reset under it
+	assert.NoError(t, Sweep(func() error {
+		assert.ErrorIs(t, ResetTracker(db, log, 0, 5), ErrSweepRunning)
+		return nil
+	}))
+	assert.Equal(t, []uint64{4}, window())
+}
+
+func TestAdvanceTracker(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&model.SplitQueueTracker{}))
+	assert.NoError(t, db.Create(&model.SplitQueueTracker{LastContID: 2, StopAt: 10}).Error)
+
+	advanced, err := AdvanceTracker(db, 2, 4)
+	assert.NoError(t, err)
+	assert.True(t, advanced)
+
+	// a worker that read the tracker before the advance loses
+	advanced, err = AdvanceTracker(db, 2, 3)
+	assert.NoError(t, err)
+	assert.False(t, advanced)
+
+	var trk model.SplitQueueTracker
+	assert.NoError(t, db.First(&trk).Error)
+	assert.Equal(t, uint64(4), trk.LastContID)
+
+	// and retries from the new value
+	advanced, err = AdvanceTracker(db, trk.LastContID, 5)
+	assert.NoError(t, err)
+	assert.True(t, advanced)
+}
@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/application-research/estuary/model"
+	"github.com/application-research/estuary/util"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var ErrSweepRunning = fmt.Errorf("split queue backfill is sweeping")
+
+// contents the split queue backfill queues per window
+const backfillWindowSize = 2000
+
+// held while the backfill sweeps a window, so that the tracker can't be reset under it
+var sweepLk sync.Mutex
+
+// Sweep runs a window of the split queue backfill, which excludes resetting the tracker
+func Sweep(fn func() error) error {
+	sweepLk.Lock()
+	defer sweepLk.Unlock()
+	return fn()
+}
+
+// NextWindow returns the next contents for the split queue backfill to queue: those larger than maxSize that
+// weren't split yet, after the last content the tracker reached up to its stop
+func NextWindow(db *gorm.DB, tracker *model.SplitQueueTracker, maxSize int64) ([]*util.Content, error) {
+	var contents []*util.Content
+	if err := db.Where("id > ? and id <= ? and size > ? and not dag_split", tracker.LastContID, tracker.StopAt, maxSize).
+		Order("id asc").Limit(backfillWindowSize).Find(&contents).Error; err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// AdvanceTracker moves the split queue backfill's last content from from to to, only if no other worker moved
+// it since it was read. It returns false if another worker got there first, which then has to continue from
+// the tracker's new last content, so that no range is skipped or swept twice.
+func AdvanceTracker(db *gorm.DB, from uint64, to uint64) (bool, error) {
+	res := db.Model(model.SplitQueueTracker{}).Where("last_cont_id = ?", from).UpdateColumn("last_cont_id", to)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// ResetTracker rewinds the split queue backfill, e.g. after fixing a splitting bug, so that it sweeps the
+// contents after start up to stopAt again. It fails with ErrSweepRunning instead of waiting for a window
+// being swept.
+func ResetTracker(db *gorm.DB, log *zap.SugaredLogger, start uint64, stopAt uint64) error {
+	if start > stopAt {
+		return fmt.Errorf("split queue tracker reset start %d is past its stop %d", start, stopAt)
+	}
+
+	if !sweepLk.TryLock() {
+		return ErrSweepRunning
+	}
+	defer sweepLk.Unlock()
+
+	var trks []*model.SplitQueueTracker
+	if err := db.Find(&trks).Error; err != nil {
+		return err
+	}
+
+	if len(trks) == 0 {
+		if err := db.Create(&model.SplitQueueTracker{LastContID: start, StopAt: stopAt}).Error; err != nil {
+			return err
+		}
+		log.Infof("created split queue tracker to sweep contents %d to %d", start, stopAt)
+		return nil
+	}
+
+	trk := trks[0]
+	if err := db.Model(model.SplitQueueTracker{}).Where("id = ?", trk.ID).UpdateColumns(map[string]interface{}{
+		"last_cont_id":  start,
+		"stop_at":       stopAt,
+		"backfill_done": false,
+	}).Error; err != nil {
+		return err
+	}
+	log.Infof("reset split queue tracker to sweep contents %d to %d (was at %d of %d, done: %t)", start, stopAt, trk.LastContID, trk.StopAt, trk.BackfillDone)
+	return nil
+}
@@ -2,8 +2,11 @@ package split
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"github.com/application-research/estuary/constants"
+	splitqueuemgr "github.com/application-research/estuary/content/split/queue"
 	"github.com/application-research/estuary/model"
 	"github.com/application-research/estuary/util"
 
@@ -64,15 +67,11 @@ func (m *manager) getQueueTracker() (*model.SplitQueueTracker, error) {
 
 func (m *manager) runSplitBackFillWorker(ctx context.Context) {
 	// init tracker before work starts
-	tracker, err := m.getQueueTracker()
-	if err != nil {
+	if _, err := m.getQueueTracker(); err != nil {
 		m.log.Warnf("failed to get split queue tracker - %s", err)
 	}
 
-	if tracker.BackfillDone {
-		return
-	}
-
+	// keeps running once the backfill is done, in case the tracker is reset to sweep again
 	timer := time.NewTicker(m.cfg.WorkerIntervals.SplitInterval)
 	for {
 		select {
@@ -80,52 +79,69 @@ func (m *manager) runSplitBackFillWorker(ctx context.Context) {
 			m.log.Info("shutting down split backfill worker")
 			return
 		case <-timer.C:
-			m.log.Debug("running split backfill worker")
-
-			tracker, err = m.getQueueTracker()
-			if err != nil {
-				m.log.Warnf("failed to get split queue tracker - %s", err)
-				continue
+			if err := splitqueuemgr.Sweep(func() error {
+				return m.sweepSplitBackfill(ctx)
+			}); err != nil {
+				m.log.Warnf("failed to backfill split queue - %s", err)
 			}
+		}
+	}
+}
 
-			if tracker.BackfillDone {
-				m.log.Info("split queue backfill is done")
-				return
-			}
+func (m *manager) sweepSplitBackfill(ctx context.Context) error {
+	tracker, err := m.getQueueTracker()
+	if err != nil {
+		return fmt.Errorf("failed to get split queue tracker - %w", err)
+	}
 
-			m.log.Debugf("trying to start split queue backfill, starting from content: %d", tracker.LastContID)
+	if tracker.BackfillDone {
+		return nil
+	}
 
-			var largeContents []*util.Content
-			if err := m.db.Where("size > ? and not dag_split", m.cfg.Content.MaxSize).Order("id asc").Limit(2000).Find(&largeContents).Error; err != nil {
-				m.log.Warnf("failed to get contents for split queue backfill - %s", err)
-				continue
-			}
+	m.log.Debugf("trying to start split queue backfill, starting from content: %d", tracker.LastContID)
 
-			m.log.Debugf("trying to backfill split queue for total of %d contents", len(largeContents))
-			for _, c := range largeContents {
-				if err := m.backfill(ctx, c, tracker); err != nil {
-					m.log.Warnf("failed to backfill split queue for cont: %d - %s", c.ID, err)
-					break
-				}
-			}
+	largeContents, err := splitqueuemgr.NextWindow(m.db, tracker, m.cfg.Content.MaxSize)
+	if err != nil {
+		return fmt.Errorf("failed to get contents for split queue backfill - %w", err)
+	}
 
-			// if there are no more to backfill set stop
-			if len(largeContents) == 0 {
-				if err = m.db.Model(model.SplitQueueTracker{}).Where("id = ?", tracker.ID).UpdateColumn("stop_at", tracker.LastContID).Error; err != nil {
-					m.log.Warnf("failed to set stop_at for split queue tracker - %s", err)
-				}
-			}
+	m.log.Debugf("trying to backfill split queue for total of %d contents", len(largeContents))
+	for _, c := range largeContents {
+		advanced, err := m.backfill(ctx, c, tracker)
+		if err != nil {
+			m.log.Warnf("failed to backfill split queue for cont: %d - %s", c.ID, err)
+			break
+		}
+		if !advanced {
+			m.log.Debugf("split queue tracker was advanced past %d by another worker, continuing from it on the next sweep", tracker.LastContID)
+			break
+		}
+	}
+
+	// if there are no more to backfill set stop
+	if len(largeContents) == 0 {
+		if err = m.db.Model(model.SplitQueueTracker{}).Where("id = ?", tracker.ID).UpdateColumn("stop_at", tracker.LastContID).Error; err != nil {
+			return fmt.Errorf("failed to set stop_at for split queue tracker - %w", err)
 		}
 	}
+	return nil
 }
 
-func (m *manager) backfill(ctx context.Context, cont *util.Content, tracker *model.SplitQueueTracker) error {
+// backfill queues the content and advances the tracker past it, queueing is idempotent so a content queued by a
+// worker that then loses the advance to another one is harmless
+func (m *manager) backfill(ctx context.Context, cont *util.Content, tracker *model.SplitQueueTracker) (bool, error) {
 	m.log.Debugf("trying to backfill split queue for content: %d", cont.ID)
 
 	if err := m.splitQueueMgr.QueueContent(cont.ID, cont.UserID, m.db); err != nil {
-		return err
+		return false, err
+	}
+
+	advanced, err := splitqueuemgr.AdvanceTracker(m.db, tracker.LastContID, cont.ID)
+	if err != nil || !advanced {
+		return false, err
 	}
-	return m.db.Model(model.SplitQueueTracker{}).Where("id = ?", tracker.ID).UpdateColumn("last_cont_id", cont.ID).Error
+	tracker.LastContID = cont.ID
+	return true, nil
 }
 
 func (m *manager) runSplitWorker(ctx context.Context) {
@@ -146,7 +162,7 @@ func (m *manager) runSplitWorker(ctx context.Context) {
 
 func (m *manager) FindAndSplitLargeContents(ctx context.Context) error {
 	var tasks []*model.SplitQueue
-	return m.db.Where("attempted < 3 and next_attempt_at < ?", time.Now().UTC()).Order("id asc").FindInBatches(&tasks, 2000, func(tx *gorm.DB, batch int) error {
+	return m.db.Where("attempted < ? and next_attempt_at < ?", constants.SplitQueueMaxAttempts, time.Now().UTC()).Order("id asc").FindInBatches(&tasks, 2000, func(tx *gorm.DB, batch int) error {
 		m.log.Debugf("trying to split total of %d contents", len(tasks))
 		for _, tsk := range tasks {
 			var cont util.Content
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/application-research/estuary/constants"
+	dealqueuemgr "github.com/application-research/estuary/deal/queue"
 	dealstatus "github.com/application-research/estuary/deal/status"
 	"github.com/application-research/estuary/model"
 	"github.com/application-research/estuary/util"
@@ -43,10 +44,7 @@ func (m *manager) checkContentDeals(ctx context.Context, contID uint64) (int, er
 		}
 	}
 
-	replicationFactor := m.cfg.Replication
-	if content.Replication > 0 {
-		replicationFactor = content.Replication
-	}
+	replicationFactor := dealqueuemgr.TargetReplication(m.cfg.Replication, content)
 
 	// for new contents, there will be no deals
 	if len(deals) == 0 {
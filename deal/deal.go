@@ -281,6 +281,12 @@ func (m *manager) CheckContentReadyForDealMaking(ctx context.Context, content *u
 	return nil
 }
 
+// how long a miner that failed a content's deal for good is left out of the content's new deals
+const terminalFailureExclusion = 7 * 24 * time.Hour
+
+// how many of those miners are left out at most, the most recent ones
+const maxTerminalFailureExclusions = 20
+
 func (m *manager) makeDealsForContent(ctx context.Context, contID uint64, dealsToBeMade int) error {
 	ctx, span := m.tracer.Start(ctx, "makeDealsForContent", trace.WithAttributes(
 		attribute.Int64("content", int64(contID)),
@@ -320,6 +326,19 @@ func (m *manager) makeDealsForContent(ctx context.Context, contID uint64, dealsT
 		excludedMiners[maddr] = true
 	}
 
+	// miners that recently failed the content's deals for good would only fail them again
+	terminalMiners, err := dealstatus.TerminalFailureMiners(m.db, content.ID, time.Now().Add(-terminalFailureExclusion), maxTerminalFailureExclusions)
+	if err != nil {
+		return err
+	}
+	for _, miner := range terminalMiners {
+		maddr, err := address.NewFromString(miner)
+		if err != nil {
+			return err
+		}
+		excludedMiners[maddr] = true
+	}
+
 	minerCount := 10000 // pick enough miners so we can try to make the most deal
 	miners, err := m.minerManager.PickMiners(ctx, minerCount, pieceSize.Padded(), excludedMiners, true)
 	if err != nil {
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/model"
+	"gorm.io/gorm"
+)
+
+// QueueDepths counts the deal queue entries by the phase they wait in
+type QueueDepths struct {
+	// commp never attempted
+	AwaitingCommp int64 `json:"awaitingCommp"`
+	// commp failed, with attempts left
+	RetryingCommp int64 `json:"retryingCommp"`
+	// commp done, due for the deal check that counts the deals to be made
+	AwaitingDealCheck int64 `json:"awaitingDealCheck"`
+	// commp done and deals to be made, due now
+	AwaitingDeal int64 `json:"awaitingDeal"`
+	// commp done and deals to be made, held until later: backing off after a
+	// failed deal or claimed by a worker, the queue doesn't tell them apart
+	RetryingDeal int64 `json:"retryingDeal"`
+}
+
+// DealQueueDepths snapshots the backlog of the deal pipeline. Each count
+// filters on the leading columns of the composite indexes of the queue, the
+// commp ones on (commp_done, commp_attempted) and the deal check and deal
+// ones on (can_deal, commp_done).
+func DealQueueDepths(db *gorm.DB) (*QueueDepths, error) {
+	now := time.Now().UTC()
+
+	var depths QueueDepths
+	if err := db.Model(model.DealQueue{}).Where("not commp_done and commp_attempted = 0").Count(&depths.AwaitingCommp).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(model.DealQueue{}).Where("not commp_done and commp_attempted > 0 and commp_attempted < ?", constants.DealQueueCommpMaxAttempts).Count(&depths.RetryingCommp).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(model.DealQueue{}).Where("not can_deal and commp_done and deal_check_next_attempt_at < ?", now).Count(&depths.AwaitingDealCheck).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(model.DealQueue{}).Where("can_deal and commp_done and deal_count > 0 and deal_next_attempt_at < ?", now).Count(&depths.AwaitingDeal).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(model.DealQueue{}).Where("can_deal and commp_done and deal_count > 0 and deal_next_attempt_at >= ?", now).Count(&depths.RetryingDeal).Error; err != nil {
+		return nil, err
+	}
+	return &depths, nil
+}
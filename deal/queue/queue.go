@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/constants"
 	"github.com/application-research/estuary/model"
 	"github.com/application-research/estuary/util"
 	"go.opentelemetry.io/otel"
@@ -20,8 +21,14 @@ type IManager interface {
 	DealFailed(contID uint64, tx *gorm.DB)
 	DealCheckComplete(contID uint64, dealsToBeMade int, tx *gorm.DB)
 	DealCheckFailed(contID uint64, tx *gorm.DB)
+	RecheckDeals(contID uint64, tx *gorm.DB) error
+	MarkCommpDone(contIDs []uint64, tx *gorm.DB) (int64, error)
+	ClaimNext(workerID string, tx *gorm.DB) (*model.DealQueue, error)
 }
 
+// how long a claimed entry is held by its worker before others can claim it again
+const dealClaimLease = 1 * time.Hour
+
 type manager struct {
 	db     *gorm.DB
 	cfg    *config.Estuary
@@ -67,7 +74,12 @@ func (m *manager) QueueContent(contID uint64, tx *gorm.DB) error {
 		return nil
 	}
 
-	task := &model.DealQueue{
+	task := newTask(cont)
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&task).Error
+}
+
+func newTask(cont *util.Content) *model.DealQueue {
+	return &model.DealQueue{
 		UserID:                 cont.UserID,
 		ContID:                 cont.ID,
 		ContCid:                cont.Cid,
@@ -79,7 +91,6 @@ func (m *manager) QueueContent(contID uint64, tx *gorm.DB) error {
 		DealCheckNextAttemptAt: time.Now().UTC(),
 		DealNextAttemptAt:      time.Now().UTC(),
 	}
-	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&task).Error
 }
 
 func (m *manager) DealComplete(contID uint64, tx *gorm.DB) {
@@ -89,6 +100,7 @@ func (m *manager) DealComplete(contID uint64, tx *gorm.DB) {
 		"can_deal":                   false,
 		"deal_count":                 0,
 		"deal_check_next_attempt_at": time.Now().Add(10 * time.Hour).UTC(),
+		"deal_completed_at":          time.Now().UTC(),
 	}).Error; err != nil {
 		m.log.Errorf("failed to update deal queue (DealComplete) for cont %d - %s", contID, err)
 		return
@@ -133,3 +145,161 @@ func (m *manager) DealCheckFailed(contID uint64, tx *gorm.DB) {
 		m.log.Errorf("failed to update deal queue (DealCheckFailed) for cont %d - %s", contID, err)
 	}
 }
+
+// RecheckDeals makes the content due for a deal check right away, so that a deal lost to a transient failure is
+// replaced without waiting for the next scheduled check
+func (m *manager) RecheckDeals(contID uint64, tx *gorm.DB) error {
+	return tx.Model(model.DealQueue{}).Where("cont_id = ? and not can_deal", contID).UpdateColumns(map[string]interface{}{
+		"deal_check_next_attempt_at": time.Now().UTC(),
+	}).Error
+}
+
+// MarkCommpDone flags the queue entries of contents whose commp has been computed in one statement, it returns
+// the number of entries updated. The entries are due for a deal check right away, which counts the deals to be
+// made and sets can_deal, as deal making only picks entries with deals to be made.
+func (m *manager) MarkCommpDone(contIDs []uint64, tx *gorm.DB) (int64, error) {
+	if len(contIDs) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	res := tx.Model(model.DealQueue{}).Where("cont_id IN ?", contIDs).UpdateColumns(map[string]interface{}{
+		"commp_done":                 true,
+		"can_deal":                   false,
+		"deal_check_next_attempt_at": now,
+		"deal_next_attempt_at":       now,
+	})
+	if res.Error != nil {
+		return 0, res.Error
+	}
+
+	m.log.Debugf("marked commp done for %d content(s)", res.RowsAffected)
+	return res.RowsAffected, nil
+}
+
+// ClaimNext picks the next content ready for deal making, that has fewer deals than its target, and leases it to the worker by pushing its
+// deal_next_attempt_at forward, so that concurrent workers never get the same entry. It returns nil
+// when there is nothing to claim.
+func (m *manager) ClaimNext(workerID string, tx *gorm.DB) (*model.DealQueue, error) {
+	var claimed *model.DealQueue
+	if err := tx.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+
+		q := tx.Where("commp_done and can_deal and deal_count > 0 and deal_next_attempt_at < ?", now).Order("id asc").Limit(1)
+		if tx.Dialector.Name() == "postgres" {
+			q = q.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+
+		var tasks []*model.DealQueue
+		if err := q.Find(&tasks).Error; err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			return nil
+		}
+		task := tasks[0]
+
+		// the eligibility check is repeated so that the claim is lost, rather than doubled, if another worker
+		// claimed the entry in between (databases without row locks)
+		leaseEnd := now.Add(dealClaimLease)
+		res := tx.Model(model.DealQueue{}).Where("id = ? and deal_next_attempt_at < ?", task.ID, now).UpdateColumns(map[string]interface{}{
+			"claimed_by":           workerID,
+			"deal_next_attempt_at": leaseEnd,
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+
+		task.ClaimedBy = workerID
+		task.DealNextAttemptAt = leaseEnd
+		claimed = task
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if claimed != nil {
+		m.log.Debugf("worker %s claimed content: %d for deal making", workerID, claimed.ContID)
+	}
+	return claimed, nil
+}
+
+// ResetStalledCommp makes entries whose commp was attempted but never completed, and whose next attempt was pushed
+// further out than olderThan (e.g. by a worker that crashed mid-attempt), eligible for commp again. Entries that
+// used up their attempts are left alone. It returns the number of entries reset.
+func ResetStalledCommp(db *gorm.DB, olderThan time.Duration) (int64, error) {
+	now := time.Now().UTC()
+	res := db.Model(model.DealQueue{}).
+		Where("not commp_done and commp_attempted > 0 and commp_attempted < ? and commp_next_attempt_at > ?", constants.DealQueueCommpMaxAttempts, now.Add(olderThan)).
+		UpdateColumn("commp_next_attempt_at", now)
+	return res.RowsAffected, res.Error
+}
+
+type Throughput struct {
+	Window time.Duration `json:"window"`
+	// contents whose deal making completed within the window
+	Completed int64   `json:"completed"`
+	PerHour   float64 `json:"perHour"`
+}
+
+// GetThroughput estimates how many contents the deal pipeline clears per hour, from the contents whose deal making
+// completed within the window. A content completing several times within the window is only counted once.
+func GetThroughput(db *gorm.DB, window time.Duration) (*Throughput, error) {
+	var completed int64
+	if err := db.Model(model.DealQueue{}).Where("deal_completed_at > ?", time.Now().Add(-window).UTC()).Count(&completed).Error; err != nil {
+		return nil, err
+	}
+
+	tp := &Throughput{
+		Window:    window,
+		Completed: completed,
+	}
+	if window > 0 {
+		tp.PerHour = float64(completed) / window.Hours()
+	}
+	return tp, nil
+}
+
+type Reconciliation struct {
+	// entries removed because their content no longer exists
+	Removed int64 `json:"removed"`
+	// eligible contents that had no entry and were queued
+	Queued int64 `json:"queued"`
+}
+
+// ReconcileDealQueue brings the queue back in line with the contents table: it removes the entries of contents that
+// were deleted (or soft-deleted) and queues the contents eligible for deal making, by the same rules as QueueContent,
+// that have no entry.
+func ReconcileDealQueue(db *gorm.DB, minSize int64) (*Reconciliation, error) {
+	var rec Reconciliation
+
+	// entries are removed for good, so that the content's unique entry can be created again if it comes back
+	res := db.Unscoped().Where("cont_id NOT IN (?)", db.Model(util.Content{}).Select("id")).Delete(&model.DealQueue{})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	rec.Removed = res.RowsAffected
+
+	var contents []*util.Content
+	if err := db.Where("active and aggregated_in = 0 and not (dag_split and split_from = 0) and size >= ?", minSize).
+		Where("id NOT IN (?)", db.Unscoped().Model(model.DealQueue{}).Select("cont_id")).
+		Order("id asc").FindInBatches(&contents, 2000, func(tx *gorm.DB, batch int) error {
+		tasks := make([]*model.DealQueue, 0, len(contents))
+		for _, cont := range contents {
+			tasks = append(tasks, newTask(cont))
+		}
+
+		res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&tasks)
+		if res.Error != nil {
+			return res.Error
+		}
+		rec.Queued += res.RowsAffected
+		return nil
+	}).Error; err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
@@ -0,0 +1,428 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/model"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.AutoMigrate(&model.DealQueue{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func queueContents(t *testing.T, db *gorm.DB, contIDs ...uint64) {
+	for _, contID := range contIDs {
+		if err := db.Create(&model.DealQueue{
+			UserID:                 1,
+			ContID:                 contID,
+			CommpNextAttemptAt:     time.Now().UTC(),
+			DealCount:              1,
+			DealCheckNextAttemptAt: time.Now().UTC(),
+			DealNextAttemptAt:      time.Now().Add(time.Hour).UTC(),
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMarkCommpDone(t *testing.T) {
+	db := setupTestDB(t)
+	queueContents(t, db, 1, 2, 3, 4)
+
+	mgr := NewManager(config.NewEstuary("test"), zap.NewNop().Sugar())
+
+	updated, err := mgr.MarkCommpDone([]uint64{2, 4}, db)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), updated)
+
+	var tasks []*model.DealQueue
+	assert.NoError(t, db.Order("cont_id asc").Find(&tasks).Error)
+	assert.Len(t, tasks, 4)
+
+	for _, task := range tasks {
+		marked := task.ContID == 2 || task.ContID == 4
+		assert.Equal(t, marked, task.CommpDone, "cont %d commp_done", task.ContID)
+		assert.False(t, task.CanDeal, "cont %d can_deal is left to the deal check", task.ContID)
+		assert.Equal(t, marked, task.DealNextAttemptAt.Before(time.Now()), "cont %d deal_next_attempt_at", task.ContID)
+	}
+
+	updated, err = mgr.MarkCommpDone(nil, db)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), updated)
+}
+
+func TestMarkCommpDoneThenClaimNext(t *testing.T) {
+	db := setupTestDB(t)
+	queueContents(t, db, 1)
+
+	mgr := NewManager(config.NewEstuary("test"), zap.NewNop().Sugar())
+
+	_, err := mgr.MarkCommpDone([]uint64{1}, db)
+	assert.NoError(t, err)
+
+	claimed, err := mgr.ClaimNext("worker", db)
+	assert.NoError(t, err)
+	assert.Nil(t, claimed, "the deals to be made aren't counted yet")
+
+	// the deal check worker picks the entry up
+	var tasks []*model.DealQueue
+	assert.NoError(t, db.Where("commp_done and not can_deal and deal_check_next_attempt_at < ?", time.Now().UTC()).Find(&tasks).Error)
+	if assert.Len(t, tasks, 1) {
+		assert.Equal(t, uint64(1), tasks[0].ContID)
+	}
+	mgr.DealCheckComplete(1, 2, db)
+
+	claimed, err = mgr.ClaimNext("worker", db)
+	assert.NoError(t, err)
+	if assert.NotNil(t, claimed) {
+		assert.Equal(t, uint64(1), claimed.ContID)
+		assert.Equal(t, 2, claimed.DealCount)
+	}
+}
+
+func TestRecheckDeals(t *testing.T) {
+	db := setupTestDB(t)
+	queueContents(t, db, 1, 2)
+
+	mgr := NewManager(config.NewEstuary("test"), zap.NewNop().Sugar())
+
+	// content 1 has all its deals, content 2 is waiting for deals to be made
+	mgr.DealComplete(1, db)
+	mgr.DealCheckComplete(2, 1, db)
+
+	assert.NoError(t, mgr.RecheckDeals(1, db))
+	assert.NoError(t, mgr.RecheckDeals(2, db))
+
+	var tasks []*model.DealQueue
+	assert.NoError(t, db.Order("cont_id asc").Find(&tasks).Error)
+	if assert.Len(t, tasks, 2) {
+		assert.True(t, tasks[0].DealCheckNextAttemptAt.Before(time.Now()), "content 1 is due for a deal check")
+		assert.True(t, tasks[1].DealCheckNextAttemptAt.After(time.Now()), "content 2 already has deals to be made")
+	}
+}
+
+func TestClaimNextNoDoubleClaim(t *testing.T) {
+	db := setupTestDB(t)
+
+	// sqlite only allows one writer at a time
+	sqlDB, err := db.DB()
+	assert.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+
+	contIDs := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	queueContents(t, db, contIDs...)
+
+	mgr := NewManager(config.NewEstuary("test"), zap.NewNop().Sugar())
+	_, err = mgr.MarkCommpDone(contIDs, db)
+	assert.NoError(t, err)
+	// the deal check found a deal to be made for each of them
+	for _, contID := range contIDs {
+		mgr.DealCheckComplete(contID, 1, db)
+	}
+
+	// let the marked entries become eligible
+	time.Sleep(10 * time.Millisecond)
+
+	var lk sync.Mutex
+	claims := make(map[uint64]string)
+	var wg sync.WaitGroup
+	for _, worker := range []string{"worker-1", "worker-2"} {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			for {
+				task, err := mgr.ClaimNext(worker, db)
+				if !assert.NoError(t, err) || task == nil {
+					return
+				}
+
+				lk.Lock()
+				prev, ok := claims[task.ContID]
+				claims[task.ContID] = worker
+				lk.Unlock()
+				assert.False(t, ok, "cont %d claimed by %s and %s", task.ContID, prev, worker)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	assert.Len(t, claims, len(contIDs))
+
+	var tasks []*model.DealQueue
+	assert.NoError(t, db.Find(&tasks).Error)
+	for _, task := range tasks {
+		assert.Equal(t, claims[task.ContID], task.ClaimedBy)
+		assert.True(t, task.DealNextAttemptAt.After(time.Now()), "cont %d lease", task.ContID)
+	}
+}
+
+func TestResetStalledCommp(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Now().UTC()
+
+	for contID, e := range map[uint64]struct {
+		attempted uint
+		done      bool
+		next      time.Time
+	}{
+		1: {attempted: 1, next: now.Add(48 * time.Hour)},             // stalled
+		2: {attempted: 2, next: now.Add(23 * time.Hour)},             // within the threshold
+		3: {attempted: 0, next: now.Add(48 * time.Hour)},             // never attempted
+		4: {attempted: 1, done: true, next: now.Add(48 * time.Hour)}, // completed
+		5: {attempted: 3, next: now.Add(48 * time.Hour)},             // out of attempts
+		6: {attempted: 1, next: now.Add(24*time.Hour + time.Minute)}, // just past the threshold
+	} {
+		if err := db.Create(&model.DealQueue{
+			UserID:                 1,
+			ContID:                 contID,
+			CommpDone:              e.done,
+			CommpAttempted:         e.attempted,
+			CommpNextAttemptAt:     e.next,
+			DealCheckNextAttemptAt: now,
+			DealNextAttemptAt:      now,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reset, err := ResetStalledCommp(db, 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), reset)
+
+	var tasks []*model.DealQueue
+	assert.NoError(t, db.Order("cont_id asc").Find(&tasks).Error)
+	for _, task := range tasks {
+		wasReset := task.ContID == 1 || task.ContID == 6
+		assert.Equal(t, wasReset, !task.CommpNextAttemptAt.After(time.Now()), "cont %d commp_next_attempt_at", task.ContID)
+	}
+}
+
+func TestDealQueueDepths(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Now().UTC()
+
+	for contID, e := range map[uint64]struct {
+		attempted uint
+		done      bool
+		canDeal   bool
+		dealCount int
+		dealNext  time.Time
+	}{
+		1: {},                                                                         // awaiting commp
+		2: {attempted: 1},                                                             // retrying commp
+		3: {attempted: 3},                                                             // out of commp attempts
+		4: {done: true, canDeal: true, dealCount: 2, dealNext: now.Add(-time.Minute)}, // awaiting deal
+		5: {done: true, canDeal: true, dealCount: 1, dealNext: now.Add(time.Hour)},    // retrying deal
+		6: {done: true, canDeal: true, dealCount: 0, dealNext: now.Add(-time.Minute)}, // has its deals
+		7: {done: true, dealCount: 1, dealNext: now.Add(-time.Minute)},                // awaiting deal check
+	} {
+		if err := db.Create(&model.DealQueue{
+			UserID:                 1,
+			ContID:                 contID,
+			CommpDone:              e.done,
+			CommpAttempted:         e.attempted,
+			CommpNextAttemptAt:     now,
+			CanDeal:                e.canDeal,
+			DealCount:              e.dealCount,
+			DealCheckNextAttemptAt: now,
+			DealNextAttemptAt:      e.dealNext,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	depths, err := DealQueueDepths(db)
+	assert.NoError(t, err)
+	assert.Equal(t, &QueueDepths{
+		AwaitingCommp:     1,
+		RetryingCommp:     1,
+		AwaitingDealCheck: 1,
+		AwaitingDeal:      1,
+		RetryingDeal:      1,
+	}, depths)
+}
+
+func TestGetThroughput(t *testing.T) {
+	db := setupTestDB(t)
+	queueContents(t, db, 1, 2, 3, 4)
+
+	mgr := NewManager(config.NewEstuary("test"), zap.NewNop().Sugar())
+	mgr.DealComplete(1, db)
+	mgr.DealComplete(2, db)
+	// completed before the window
+	assert.NoError(t, db.Model(model.DealQueue{}).Where("cont_id = ?", 3).UpdateColumn("deal_completed_at", time.Now().Add(-3*time.Hour).UTC()).Error)
+
+	tp, err := GetThroughput(db, 2*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), tp.Completed)
+	assert.Equal(t, 1.0, tp.PerHour)
+
+	tp, err = GetThroughput(db, 4*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), tp.Completed)
+}
+
+// util.Content's indexes can't be created by sqlite, so the columns the queue reads are created by hand
+func createContentsTable(t *testing.T, db *gorm.DB) {
+	if err := db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime, cid blob, user_id integer, size integer, active numeric, aggregated_in integer, dag_split numeric, split_from integer, replication integer)").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testContent struct {
+	id           uint64
+	size         int64
+	active       bool
+	aggregatedIn uint64
+	dagSplit     bool
+	splitFrom    uint64
+	deleted      bool
+}
+
+func createContents(t *testing.T, db *gorm.DB, contents ...testContent) {
+	c, err := cid.Decode("bafkqaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cont := range contents {
+		var deletedAt *time.Time
+		if cont.deleted {
+			now := time.Now()
+			deletedAt = &now
+		}
+		if err := db.Exec("INSERT INTO contents (id, created_at, updated_at, deleted_at, cid, user_id, size, active, aggregated_in, dag_split, split_from) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			cont.id, time.Now(), time.Now(), deletedAt, c.Bytes(), 1, cont.size, cont.active, cont.aggregatedIn, cont.dagSplit, cont.splitFrom).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func queuedContents(t *testing.T, db *gorm.DB) []uint64 {
+	var contIDs []uint64
+	assert.NoError(t, db.Model(model.DealQueue{}).Order("cont_id asc").Pluck("cont_id", &contIDs).Error)
+	return contIDs
+}
+
+func TestReconcileDealQueueRemovesDeletedContents(t *testing.T) {
+	db := setupTestDB(t)
+	createContentsTable(t, db)
+
+	createContents(t, db,
+		testContent{id: 1, size: 100, active: true},
+		testContent{id: 2, size: 100, active: true, deleted: true},
+	)
+	// 3 no longer exists at all
+	queueContents(t, db, 1, 2, 3)
+
+	rec, err := ReconcileDealQueue(db, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), rec.Removed)
+	assert.Equal(t, int64(0), rec.Queued)
+	assert.Equal(t, []uint64{1}, queuedContents(t, db))
+
+	// nothing left to do
+	rec, err = ReconcileDealQueue(db, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, &Reconciliation{}, rec)
+}
+
+func TestReconcileDealQueueQueuesMissingContents(t *testing.T) {
+	db := setupTestDB(t)
+	createContentsTable(t, db)
+
+	createContents(t, db,
+		testContent{id: 1, size: 100, active: true},                  // already queued
+		testContent{id: 2, size: 100, active: true},                  // missing
+		testContent{id: 3, size: 100},                                // not pinned
+		testContent{id: 4, size: 100, active: true, aggregatedIn: 9}, // staged
+		testContent{id: 5, size: 100, active: true, dagSplit: true},  // split root
+		testContent{id: 6, size: 100, active: true, dagSplit: true, splitFrom: 5},
+		testContent{id: 7, size: 5, active: true},                  // too small
+		testContent{id: 8, size: 100, active: true, deleted: true}, // deleted
+	)
+	queueContents(t, db, 1)
+
+	rec, err := ReconcileDealQueue(db, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), rec.Removed)
+	assert.Equal(t, int64(2), rec.Queued)
+	assert.Equal(t, []uint64{1, 2, 6}, queuedContents(t, db))
+
+	var task model.DealQueue
+	assert.NoError(t, db.First(&task, "cont_id = ?", 2).Error)
+	assert.False(t, task.CommpDone)
+	assert.False(t, task.CanDeal)
+	assert.Equal(t, uint(1), task.UserID)
+
+	rec, err = ReconcileDealQueue(db, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, &Reconciliation{}, rec)
+}
+
+func TestDealTarget(t *testing.T) {
+	db := setupTestDB(t)
+	createContentsTable(t, db)
+	createContents(t, db, testContent{id: 1, size: 100, active: true})
+	queueContents(t, db, 1)
+
+	mgr := NewManager(config.NewEstuary("test"), zap.NewNop().Sugar())
+	_, err := mgr.MarkCommpDone([]uint64{1}, db)
+	assert.NoError(t, err)
+
+	// the content has as many deals as its target
+	mgr.DealCheckComplete(1, 0, db)
+	assert.NoError(t, db.Model(model.DealQueue{}).Where("cont_id = ?", 1).UpdateColumn("can_deal", true).Error)
+	claimed, err := mgr.ClaimNext("worker", db)
+	assert.NoError(t, err)
+	assert.Nil(t, claimed, "contents with no deals to be made aren't picked")
+
+	dt, err := GetDealTarget(db, 6, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, dt.Target)
+	assert.True(t, dt.Default)
+	assert.True(t, dt.Queued)
+
+	dt, err = SetDealTarget(db, 6, 1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, dt.Target)
+	assert.False(t, dt.Default)
+	assert.False(t, dt.CanDeal)
+	assert.False(t, dt.DealCheckNextAttemptAt.After(time.Now()), "the content is checked again right away")
+
+	// the deal check counts the deals missing to reach the raised target
+	mgr.DealCheckComplete(1, 4, db)
+	assert.NoError(t, db.Model(model.DealQueue{}).Where("cont_id = ?", 1).UpdateColumn("deal_next_attempt_at", time.Now().Add(-time.Minute).UTC()).Error)
+	claimed, err = mgr.ClaimNext("worker", db)
+	assert.NoError(t, err)
+	if assert.NotNil(t, claimed) {
+		assert.Equal(t, 4, claimed.DealCount)
+	}
+
+	dt, err = SetDealTarget(db, 6, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, dt.Target)
+	assert.True(t, dt.Default)
+
+	_, err = SetDealTarget(db, 6, 2, 3)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	_, err = SetDealTarget(db, 6, 1, -1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/model"
+	"github.com/application-research/estuary/util"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// DealTarget is the number of deals a content is replicated to, and where its deal queue entry stands
+type DealTarget struct {
+	ContID uint64 `json:"contId"`
+	Target int    `json:"target"`
+	// the content has no target of its own and uses the default
+	Default bool `json:"default"`
+	// the content has a deal queue entry
+	Queued bool `json:"queued"`
+	// deals still to be made to reach the target, as of the last deal check
+	DealsToBeMade          int       `json:"dealsToBeMade"`
+	CanDeal                bool      `json:"canDeal"`
+	DealCheckNextAttemptAt time.Time `json:"dealCheckNextAttemptAt,omitempty"`
+}
+
+// TargetReplication returns the number of deals the content is replicated to, its own target if it has one or else
+// the default
+func TargetReplication(defaultTarget int, cont *util.Content) int {
+	if cont.Replication > 0 {
+		return cont.Replication
+	}
+	return defaultTarget
+}
+
+// GetDealTarget returns the deal target of the content
+func GetDealTarget(db *gorm.DB, defaultTarget int, contID uint64) (*DealTarget, error) {
+	var cont util.Content
+	if err := db.First(&cont, "id = ?", contID).Error; err != nil {
+		return nil, err
+	}
+
+	dt := &DealTarget{
+		ContID:  contID,
+		Target:  TargetReplication(defaultTarget, &cont),
+		Default: cont.Replication <= 0,
+	}
+
+	var task model.DealQueue
+	if err := db.First(&task, "cont_id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return dt, nil
+		}
+		return nil, err
+	}
+	dt.Queued = true
+	dt.DealsToBeMade = task.DealCount
+	dt.CanDeal = task.CanDeal
+	dt.DealCheckNextAttemptAt = task.DealCheckNextAttemptAt
+	return dt, nil
+}
+
+// SetDealTarget sets the number of deals the content is replicated to, 0 makes it use the default. The content's
+// deal queue entry is checked again right away, so that a content that now has fewer deals than its target is
+// picked by deal making again, and one that has enough stops being picked.
+func SetDealTarget(db *gorm.DB, defaultTarget int, contID uint64, target int) (*DealTarget, error) {
+	if target < 0 {
+		return nil, fmt.Errorf("invalid deal target %d", target)
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(util.Content{}).Where("id = ?", contID).UpdateColumn("replication", target)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return tx.Model(model.DealQueue{}).Where("cont_id = ?", contID).UpdateColumns(map[string]interface{}{
+			"can_deal":                   false,
+			"deal_count":                 0,
+			"deal_check_next_attempt_at": time.Now().UTC(),
+		}).Error
+	}); err != nil {
+		return nil, err
+	}
+	return GetDealTarget(db, defaultTarget, contID)
+}
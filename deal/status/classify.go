@@ -0,0 +1,66 @@
+package status
+
+import "strings"
+
+// FailureCategory tells whether a deal failure is worth retrying
+type FailureCategory string
+
+const (
+	// the failure is transient (e.g. a dropped connection), the deal can be
+	// retried right away
+	FailureRetryable FailureCategory = "retryable"
+	// the failure won't go away by retrying (e.g. the miner rejected the deal)
+	FailureTerminal FailureCategory = "terminal"
+	// no rule matched the failure message
+	FailureUnknown FailureCategory = "unknown"
+)
+
+type failureRule struct {
+	substr   string
+	category FailureCategory
+}
+
+// failureRules map known substrings of failure messages (lower case) to their
+// category, the first matching rule wins so terminal rules go first: a miner
+// rejecting a deal because it timed out on its side is still a rejection. The
+// substrings are specific to deal failures, words like "invalid" also show up in
+// unrelated transient errors. Asking prices change over time, so a deal refused
+// over its price is left unclassified rather than terminal.
+var failureRules = []failureRule{
+	{"deal rejected", FailureTerminal},
+	{"proposal rejected", FailureTerminal},
+	{"proposalrejected", FailureTerminal},
+	{"not accepting", FailureTerminal},
+	{"piece size", FailureTerminal},
+	{"unsupported deal protocol", FailureTerminal},
+	{"invalid deal proposal", FailureTerminal},
+	{"invalid piece cid", FailureTerminal},
+
+	// funding errors are about our own wallet or market balance, not the
+	// miner, and go away once it is topped up
+	{"insufficient funds", FailureRetryable},
+	{"not enough funds", FailureRetryable},
+
+	{"connection reset", FailureRetryable},
+	{"connection refused", FailureRetryable},
+	{"broken pipe", FailureRetryable},
+	{"stream reset", FailureRetryable},
+	{"no route to host", FailureRetryable},
+	{"failed to dial", FailureRetryable},
+	{"resource limit exceeded", FailureRetryable},
+	{"i/o timeout", FailureRetryable},
+	{"context deadline exceeded", FailureRetryable},
+	{"timed out", FailureRetryable},
+	{"temporarily unavailable", FailureRetryable},
+}
+
+// ClassifyFailure categorizes a deal failure by its message
+func ClassifyFailure(msg string) FailureCategory {
+	msg = strings.ToLower(msg)
+	for _, rule := range failureRules {
+		if strings.Contains(msg, rule.substr) {
+			return rule.category
+		}
+	}
+	return FailureUnknown
+}
@@ -0,0 +1,62 @@
+package status
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/application-research/estuary/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	for msg, category := range map[string]FailureCategory{
+		"failure from shuttle shuttle-1: status: 9(Failed), message: stream reset":                    FailureRetryable,
+		"failure from shuttle local: status: 9(Failed), message: read tcp 10.0.0.1:4001: i/o timeout": FailureRetryable,
+		"failed to dial 12D3KooW: all dials failed":                                                   FailureRetryable,
+		"Connection Refused": FailureRetryable,
+		"deal rejected: miner is not accepting online deals":                                                FailureTerminal,
+		"failure from shuttle shuttle-1: status: 9(Failed), message: deal rejected after a timed out fetch": FailureTerminal,
+		"storage price per epoch less than asking price":                                                    FailureUnknown,
+		"failed to add funds: not enough funds in wallet":                                                   FailureRetryable,
+		"insufficient funds for market balance":                                                             FailureRetryable,
+		"deal proposal rejected: miner is full":                                                             FailureTerminal,
+		"failed to open stream: resource limit exceeded":                                                    FailureRetryable,
+		"stream was rejected by the resource manager, timed out":                                            FailureRetryable,
+		"invalid memory address or nil pointer dereference":                                                 FailureUnknown,
+		"failed to get price from miner":                                                                    FailureUnknown,
+		"something unexpected happened":                                                                     FailureUnknown,
+		"":                                                                                                  FailureUnknown,
+	} {
+		assert.Equal(t, category, ClassifyFailure(msg), msg)
+	}
+}
+
+func TestRecordDealFailureCategory(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.AutoMigrate(&model.DfeRecord{}))
+
+	up := NewUpdater(db, zap.NewNop().Sugar())
+
+	dfe := &DealFailureError{Content: 1, Phase: "data-transfer-remote", Message: "connection reset by peer"}
+	assert.NoError(t, up.RecordDealFailure(dfe))
+	assert.Equal(t, FailureRetryable, dfe.Category)
+	assert.True(t, dfe.Retryable())
+
+	// a category set by the caller is kept
+	dfe = &DealFailureError{Content: 2, Phase: "send-proposal", Message: "connection reset by peer", Category: FailureTerminal}
+	assert.NoError(t, up.RecordDealFailure(dfe))
+	assert.False(t, dfe.Retryable())
+
+	var recs []model.DfeRecord
+	assert.NoError(t, db.Order("content asc").Find(&recs).Error)
+	if assert.Len(t, recs, 2) {
+		assert.Equal(t, "retryable", recs[0].Category)
+		assert.Equal(t, "terminal", recs[1].Category)
+	}
+}
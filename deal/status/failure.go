@@ -2,10 +2,12 @@ package status
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/application-research/estuary/model"
 	"github.com/filecoin-project/go-address"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"gorm.io/gorm"
 )
 
 type DealFailureError struct {
@@ -18,6 +20,8 @@ type DealFailureError struct {
 	MinerAddress        string
 	DealProtocolVersion protocol.ID
 	MinerVersion        string
+	// classified from the message when the failure is recorded, unless set
+	Category FailureCategory
 }
 
 func (dfe *DealFailureError) record() *model.DfeRecord {
@@ -30,9 +34,42 @@ func (dfe *DealFailureError) record() *model.DfeRecord {
 		UserID:              dfe.UserID,
 		MinerVersion:        dfe.MinerVersion,
 		DealProtocolVersion: dfe.DealProtocolVersion,
+		Category:            string(dfe.Category),
 	}
 }
 
+// Retryable reports whether the failure is transient, so that the deal can be
+// retried right away
+func (dfe *DealFailureError) Retryable() bool {
+	return dfe.Category == FailureRetryable
+}
+
 func (dfe *DealFailureError) Error() string {
 	return fmt.Sprintf("deal %s with miner %s failed in phase %s: %s", dfe.DealUUID, dfe.Message, dfe.Phase, dfe.Message)
 }
+
+// DealFailuresForContent returns the deal failures recorded for a content
+// across all miners and phases, newest first
+func DealFailuresForContent(db *gorm.DB, contID uint64) ([]model.DfeRecord, error) {
+	var recs []model.DfeRecord
+	if err := db.Where("content = ?", contID).Order("created_at desc, id desc").Find(&recs).Error; err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// TerminalFailureMiners returns the miners a content's deals failed with for good since the given time, most
+// recent first and at most max of them. New deals for the content shouldn't be proposed to them again for a while,
+// the window and the cap keep a miner from being left out for good over a failure that later went away.
+func TerminalFailureMiners(db *gorm.DB, contID uint64, since time.Time, max int) ([]string, error) {
+	var miners []string
+	if err := db.Model(model.DfeRecord{}).
+		Where("content = ? and category = ? and created_at >= ?", contID, string(FailureTerminal), since).
+		Group("miner").
+		Order("max(created_at) desc").
+		Limit(max).
+		Pluck("miner", &miners).Error; err != nil {
+		return nil, err
+	}
+	return miners, nil
+}
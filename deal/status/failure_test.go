@@ -0,0 +1,99 @@
+package status
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestDealFailuresForContent(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.AutoMigrate(&model.DfeRecord{}))
+
+	now := time.Now()
+	assert.NoError(t, db.Create(&[]model.DfeRecord{
+		{Model: gorm.Model{CreatedAt: now.Add(-2 * time.Hour)}, Content: 1, Miner: "f01000", Phase: "send-proposal", Message: "rejected"},
+		{Model: gorm.Model{CreatedAt: now}, Content: 1, Miner: "f02000", Phase: "transfer-timeout", Message: "timed out"},
+		{Model: gorm.Model{CreatedAt: now.Add(-time.Hour)}, Content: 2, Miner: "f01000", Phase: "send-proposal", Message: "rejected"},
+		{Model: gorm.Model{CreatedAt: now.Add(-time.Hour)}, Content: 1, Miner: "f03000", Phase: "data-transfer-remote", Message: "connection reset"},
+	}).Error)
+
+	recs, err := DealFailuresForContent(db, 1)
+	assert.NoError(t, err)
+	assert.Len(t, recs, 3)
+
+	var miners []string
+	for _, rec := range recs {
+		miners = append(miners, rec.Miner)
+	}
+	assert.Equal(t, []string{"f02000", "f03000", "f01000"}, miners)
+
+	recs, err = DealFailuresForContent(db, 3)
+	assert.NoError(t, err)
+	assert.Empty(t, recs)
+}
+
+func TestRecordDealFailureTxRollsBack(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.AutoMigrate(&model.DfeRecord{}))
+
+	up := NewUpdater(db, zap.NewNop().Sugar())
+
+	rollback := fmt.Errorf("rollback")
+	assert.Equal(t, rollback, db.Transaction(func(tx *gorm.DB) error {
+		if err := up.RecordDealFailureTx(&DealFailureError{Content: 1, Phase: "data-transfer-remote", Message: "connection reset by peer"}, tx); err != nil {
+			return err
+		}
+		return rollback
+	}))
+
+	recs, err := DealFailuresForContent(db, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, recs)
+}
+
+func TestTerminalFailureMiners(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.AutoMigrate(&model.DfeRecord{}))
+
+	now := time.Now()
+	assert.NoError(t, db.Create(&[]model.DfeRecord{
+		{Model: gorm.Model{CreatedAt: now.Add(-3 * time.Hour)}, Content: 1, Miner: "f01000", Phase: "send-proposal", Message: "deal rejected", Category: "terminal"},
+		{Model: gorm.Model{CreatedAt: now.Add(-time.Hour)}, Content: 1, Miner: "f01000", Phase: "send-proposal", Message: "deal rejected", Category: "terminal"},
+		{Model: gorm.Model{CreatedAt: now.Add(-2 * time.Hour)}, Content: 1, Miner: "f05000", Phase: "send-proposal", Message: "deal rejected", Category: "terminal"},
+		{Model: gorm.Model{CreatedAt: now}, Content: 1, Miner: "f02000", Phase: "data-transfer-remote", Message: "connection reset", Category: "retryable"},
+		{Model: gorm.Model{CreatedAt: now}, Content: 1, Miner: "f03000", Phase: "fault", Message: "miner faulted on deal: 1"},
+		{Model: gorm.Model{CreatedAt: now}, Content: 2, Miner: "f04000", Phase: "send-proposal", Message: "deal rejected", Category: "terminal"},
+		// too long ago to still be left out
+		{Model: gorm.Model{CreatedAt: now.Add(-30 * 24 * time.Hour)}, Content: 1, Miner: "f06000", Phase: "send-proposal", Message: "deal rejected", Category: "terminal"},
+	}).Error)
+
+	weekAgo := now.Add(-7 * 24 * time.Hour)
+	miners, err := TerminalFailureMiners(db, 1, weekAgo, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"f01000", "f05000"}, miners)
+
+	// the most recent ones are kept under the cap
+	miners, err = TerminalFailureMiners(db, 1, weekAgo, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"f01000"}, miners)
+
+	miners, err = TerminalFailureMiners(db, 3, weekAgo, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, miners)
+}
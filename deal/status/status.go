@@ -7,6 +7,8 @@ import (
 
 type IUpdater interface {
 	RecordDealFailure(dfe *DealFailureError) error
+	// RecordDealFailureTx records the failure in tx, so it is only committed with it
+	RecordDealFailureTx(dfe *DealFailureError, tx *gorm.DB) error
 }
 
 type updater struct {
@@ -22,7 +24,14 @@ func NewUpdater(db *gorm.DB, log *zap.SugaredLogger) IUpdater {
 }
 
 func (up *updater) RecordDealFailure(dfe *DealFailureError) error {
-	up.log.Debugw("deal failure error", "miner", dfe.Miner, "uuid", dfe.DealUUID, "phase", dfe.Phase, "msg", dfe.Message, "content", dfe.Content)
+	return up.RecordDealFailureTx(dfe, up.db)
+}
+
+func (up *updater) RecordDealFailureTx(dfe *DealFailureError, tx *gorm.DB) error {
+	if dfe.Category == "" {
+		dfe.Category = ClassifyFailure(dfe.Message)
+	}
+	up.log.Debugw("deal failure error", "miner", dfe.Miner, "uuid", dfe.DealUUID, "phase", dfe.Phase, "msg", dfe.Message, "content", dfe.Content, "category", dfe.Category)
 	rec := dfe.record()
-	return up.db.Create(rec).Error
+	return tx.Create(rec).Error
 }
@@ -26,6 +26,11 @@ func (m *manager) subscribeEventListener(ctx context.Context) error {
 			if trk != nil && trk.Last.Status == fst.Status {
 				return
 			}
+
+			var ok bool
+			if dbid, ok = m.eventDealID(dbid, &fst); !ok {
+				return
+			}
 			m.trackTransfer(&fst.ChannelID, dbid, &fst)
 
 			m.log.Debugf("recieved data transfer event: %s", fst.StatusStr)
@@ -51,6 +56,22 @@ func (m *manager) subscribeEventListener(ctx context.Context) error {
 	return err
 }
 
+// eventDealID returns the ID of the deal a data transfer event belongs to. Events of transfers restarted outside of
+// estuary carry no deal, so it is found by the channel; when no deal has the channel, the event is logged and false
+// is returned.
+func (m *manager) eventDealID(dbid uint, fst *filclient.ChannelState) (uint, bool) {
+	if dbid != 0 {
+		return dbid, true
+	}
+
+	deal, err := DealByChannelID(m.db, fst.TransferID)
+	if err != nil {
+		m.log.Errorf("dropping data transfer event %s of channel %s (transfer %s), failed to find its deal: %s", fst.StatusStr, fst.ChannelID, fst.TransferID, err)
+		return 0, false
+	}
+	return deal.ID, true
+}
+
 func (m *manager) trackTransfer(chanid *datatransfer.ChannelID, dealdbid uint, st *filclient.ChannelState) {
 	m.tcLk.Lock()
 	defer m.tcLk.Unlock()
@@ -0,0 +1,54 @@
+package transfer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/filclient"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestEventDealID(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// content deal indexes are created concurrently on postgres, which sqlite doesn't support, so the table is
+	// created by hand
+	assert.NoError(t, db.Exec("CREATE TABLE content_deals (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime, content integer, dt_chan text)").Error)
+	assert.NoError(t, db.Exec("INSERT INTO content_deals (id, created_at, updated_at, content, dt_chan) VALUES (7, ?, ?, 70, 'transfer-1')", time.Now(), time.Now()).Error)
+
+	core, logs := observer.New(zap.ErrorLevel)
+	m := &manager{db: db, log: zap.New(core).Sugar()}
+
+	chanid := datatransfer.ChannelID{Initiator: peer.ID("initiator"), Responder: peer.ID("responder"), ID: 42}
+	event := func(transferID string) *filclient.ChannelState {
+		return &filclient.ChannelState{ChannelID: chanid, TransferID: transferID, StatusStr: "Ongoing"}
+	}
+
+	// events carrying their deal aren't looked up
+	dbid, ok := m.eventDealID(3, event("unknown"))
+	assert.True(t, ok)
+	assert.Equal(t, uint(3), dbid)
+
+	dbid, ok = m.eventDealID(0, event("transfer-1"))
+	assert.True(t, ok)
+	assert.Equal(t, uint(7), dbid)
+	assert.Zero(t, logs.Len())
+
+	_, ok = m.eventDealID(0, event("transfer-2"))
+	assert.False(t, ok)
+	if assert.Equal(t, 1, logs.Len(), "the dropped event is logged") {
+		msg := logs.All()[0].Message
+		assert.Contains(t, msg, chanid.String())
+		assert.Contains(t, msg, "transfer-2")
+	}
+}
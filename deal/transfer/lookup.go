@@ -0,0 +1,31 @@
+package transfer
+
+import (
+	"fmt"
+
+	"github.com/application-research/estuary/model"
+	"gorm.io/gorm"
+)
+
+// DealByChannelID returns the deal whose data transfer runs on the channel (or boost transfer ID), to correlate
+// transfer events that only carry the channel back to their deal. A channel is never shared by deals, so it fails
+// rather than pick one if several deals have it.
+func DealByChannelID(db *gorm.DB, chanid string) (*model.ContentDeal, error) {
+	if chanid == "" {
+		return nil, model.ErrNoChannelID
+	}
+
+	var deals []*model.ContentDeal
+	if err := db.Where("dt_chan = ?", chanid).Order("id asc").Limit(2).Find(&deals).Error; err != nil {
+		return nil, err
+	}
+
+	switch len(deals) {
+	case 0:
+		return nil, fmt.Errorf("no deal with data transfer channel %s: %w", chanid, gorm.ErrRecordNotFound)
+	case 1:
+		return deals[0], nil
+	default:
+		return nil, fmt.Errorf("data transfer channel %s is shared by deals %d and %d", chanid, deals[0].ID, deals[1].ID)
+	}
+}
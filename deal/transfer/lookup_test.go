@@ -0,0 +1,44 @@
+package transfer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/model"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestDealByChannelID(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// content deal indexes are created concurrently on postgres, which sqlite doesn't support, so the table is
+	// created by hand
+	assert.NoError(t, db.Exec("CREATE TABLE content_deals (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime, content integer, dt_chan text)").Error)
+	for id, ch := range map[int]string{1: "chan-1", 2: "chan-2", 3: "chan-2", 4: "chan-3"} {
+		assert.NoError(t, db.Exec("INSERT INTO content_deals (id, created_at, updated_at, content, dt_chan) VALUES (?, ?, ?, ?, ?)", id, time.Now(), time.Now(), id*10, ch).Error)
+	}
+	assert.NoError(t, db.Exec("UPDATE content_deals SET deleted_at = ? WHERE id = 4", time.Now()).Error)
+
+	deal, err := DealByChannelID(db, "chan-1")
+	assert.NoError(t, err)
+	if assert.NotNil(t, deal) {
+		assert.Equal(t, uint(1), deal.ID)
+		assert.Equal(t, uint64(10), deal.Content)
+	}
+
+	_, err = DealByChannelID(db, "chan-2")
+	assert.Error(t, err, "a channel shared by deals isn't resolved to either")
+	assert.NotErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	_, err = DealByChannelID(db, "chan-3")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound, "deleted deals are ignored")
+
+	_, err = DealByChannelID(db, "")
+	assert.ErrorIs(t, err, model.ErrNoChannelID)
+}
@@ -0,0 +1,157 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	dealstatus "github.com/application-research/estuary/deal/status"
+	"github.com/application-research/estuary/model"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+)
+
+// how often deals are checked for transfers running past their timeout
+const transferTimeoutCheckInterval = 10 * time.Minute
+
+// runTransferTimeoutChecker periodically fails the deals whose data transfer
+// started longer ago than the timeout of their size tier without finishing,
+// so that a shuttle going quiet doesn't leave them in progress forever
+func (m *manager) runTransferTimeoutChecker(ctx context.Context) {
+	ticker := time.NewTicker(transferTimeoutCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			failed, err := m.failTimedOutTransfers(ctx, time.Now())
+			if err != nil {
+				m.log.Errorf("failed to check for timed out transfers: %s", err)
+				continue
+			}
+			if failed > 0 {
+				m.log.Infof("failed %d deals whose data transfer timed out", failed)
+			}
+		}
+	}
+}
+
+// failTimedOutTransfers fails the deals whose transfer timed out at now and
+// cancels their transfer, it returns how many deals were failed
+func (m *manager) failTimedOutTransfers(ctx context.Context, now time.Time) (int, error) {
+	minTimeout := m.minTransferTimeout()
+	if minTimeout == 0 {
+		return 0, nil
+	}
+
+	var deals []model.ContentDeal
+	if err := m.db.Model(model.ContentDeal{}).
+		Where("not failed and deal_id = 0 and transfer_started > ? and transfer_started < ?", time.Time{}, now.Add(-minTimeout)).
+		Find(&deals).Error; err != nil {
+		return 0, err
+	}
+
+	var failed int
+	for _, d := range deals {
+		// a finished transfer is waiting on the deal to be published
+		if !d.TransferFinished.Before(d.TransferStarted) {
+			continue
+		}
+
+		// a content that can't be found mustn't hold up the other deals
+		var cont util.Content
+		if err := m.db.First(&cont, "id = ?", d.Content).Error; err != nil {
+			m.log.Errorf("failed to get content %d of deal %d: %s", d.Content, d.ID, err)
+			continue
+		}
+
+		timeout := m.cfg.Deal.TransferTimeout(cont.Size)
+		if timeout == 0 || now.Sub(d.TransferStarted) < timeout {
+			continue
+		}
+
+		if err := m.failTimedOutTransfer(ctx, d, cont, timeout); err != nil {
+			m.log.Errorf("failed to fail timed out transfer of deal %d: %s", d.ID, err)
+			continue
+		}
+		failed++
+	}
+	return failed, nil
+}
+
+func (m *manager) failTimedOutTransfer(ctx context.Context, d model.ContentDeal, cont util.Content, timeout time.Duration) error {
+	miner, err := d.MinerAddr()
+	if err != nil {
+		return err
+	}
+
+	if err := m.dealStatusUpdater.RecordDealFailure(&dealstatus.DealFailureError{
+		Miner:               miner,
+		Phase:               "transfer-timeout",
+		Message:             fmt.Sprintf("data transfer started at %s did not finish within %s", d.TransferStarted, timeout),
+		Content:             d.Content,
+		UserID:              d.UserID,
+		DealProtocolVersion: d.DealProtocolVersion,
+		MinerVersion:        d.MinerVersion,
+	}); err != nil {
+		return err
+	}
+
+	if err := m.db.Model(model.ContentDeal{}).Where("id = ?", d.ID).UpdateColumns(map[string]interface{}{
+		"failed":    true,
+		"failed_at": time.Now(),
+	}).Error; err != nil {
+		return err
+	}
+
+	// the deal is replaced right away rather than on the next deal check
+	if err := m.dealQueueMgr.RecheckDeals(d.Content, m.db); err != nil {
+		return err
+	}
+
+	if cont.Location != constants.ContentLocationLocal {
+		// the shuttle acknowledges with a cancelled transfer status
+		return m.shuttleMgr.CancelTransfer(ctx, cont.Location, &d)
+	}
+	return m.cancelLocalTransfer(ctx, d)
+}
+
+// cancelLocalTransfer aborts a legacy data transfer run by this node, boost
+// transfers are driven by the provider
+func (m *manager) cancelLocalTransfer(ctx context.Context, d model.ContentDeal) error {
+	chanid, err := d.ChannelID()
+	if err != nil {
+		return nil
+	}
+
+	st, err := m.fc.TransferStatus(ctx, &chanid)
+	if err != nil && err != filclient.ErrNoTransferFound {
+		return err
+	}
+
+	if st != nil && util.CanRestartTransfer(st) {
+		if err := m.fc.GetDtMgr().CloseDataTransferChannel(ctx, chanid); err != nil {
+			return fmt.Errorf("failed to cancel data transfer %s: %w", d.DTChan, err)
+		}
+	}
+
+	m.tcLk.Lock()
+	delete(m.trackingChannels, chanid.String())
+	m.tcLk.Unlock()
+	return nil
+}
+
+// minTransferTimeout returns the shortest configured transfer timeout, 0 if
+// transfers never time out
+func (m *manager) minTransferTimeout() time.Duration {
+	var min time.Duration
+	for _, tier := range m.cfg.Deal.TransferTimeouts {
+		if tier.Timeout > 0 && (min == 0 || tier.Timeout < min) {
+			min = tier.Timeout
+		}
+	}
+	return min
+}
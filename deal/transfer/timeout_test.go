@@ -0,0 +1,82 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/constants"
+	dealqueuemgr "github.com/application-research/estuary/deal/queue"
+	dealstatus "github.com/application-research/estuary/deal/status"
+	"github.com/application-research/estuary/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestFailTimedOutTransfers(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.AutoMigrate(&model.DfeRecord{}, &model.DealQueue{}))
+
+	// content and content deal indexes are created concurrently on postgres, which sqlite doesn't support, so the
+	// tables are created by hand
+	assert.NoError(t, db.Exec("CREATE TABLE contents (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime, size integer, location text)").Error)
+	assert.NoError(t, db.Exec("CREATE TABLE content_deals (id integer primary key, created_at datetime, updated_at datetime, deleted_at datetime, content integer, user_id integer, miner text, deal_id integer, failed boolean, failed_at datetime, transfer_started datetime, transfer_finished datetime, dt_chan text)").Error)
+
+	now := time.Now().UTC()
+	assert.NoError(t, db.Exec("INSERT INTO contents (id, created_at, updated_at, size, location) VALUES (2, ?, ?, 1024, ?)", now, now, constants.ContentLocationLocal).Error)
+	// the content of deal 1 was deleted, deal 2 is stuck
+	for id := 1; id <= 2; id++ {
+		assert.NoError(t, db.Exec(
+			"INSERT INTO content_deals (id, created_at, updated_at, content, user_id, miner, deal_id, failed, transfer_started, transfer_finished, dt_chan) VALUES (?, ?, ?, ?, 1, 'f01000', 0, false, ?, ?, '')",
+			id, now, now, id, now.Add(-2*time.Hour), time.Time{},
+		).Error)
+	}
+	assert.NoError(t, db.Create(&model.DealQueue{
+		UserID:                 1,
+		ContID:                 2,
+		CommpDone:              true,
+		DealCheckNextAttemptAt: now.Add(10 * time.Hour),
+		DealNextAttemptAt:      now.Add(10 * time.Hour),
+		CommpNextAttemptAt:     now,
+	}).Error)
+
+	cfg := config.NewEstuary("test")
+	cfg.Deal.TransferTimeouts = []config.TransferTimeoutTier{{Timeout: time.Hour}}
+	log := zap.NewNop().Sugar()
+	m := &manager{
+		db:                db,
+		cfg:               cfg,
+		log:               log,
+		dealStatusUpdater: dealstatus.NewUpdater(db, log),
+		dealQueueMgr:      dealqueuemgr.NewManager(cfg, log),
+	}
+
+	failed, err := m.failTimedOutTransfers(context.Background(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, failed, "the missing content doesn't stop the sweep")
+
+	var deals []model.ContentDeal
+	assert.NoError(t, db.Order("id asc").Find(&deals).Error)
+	if assert.Len(t, deals, 2) {
+		assert.False(t, deals[0].Failed)
+		assert.True(t, deals[1].Failed)
+	}
+
+	recs, err := dealstatus.DealFailuresForContent(db, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, "transfer-timeout", recs[0].Phase)
+	}
+
+	// a replacement deal is due right away
+	var task model.DealQueue
+	assert.NoError(t, db.First(&task, "cont_id = ?", 2).Error)
+	assert.False(t, task.DealCheckNextAttemptAt.After(time.Now()))
+}
@@ -7,7 +7,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/application-research/estuary/config"
 	"github.com/application-research/estuary/constants"
+	dealqueuemgr "github.com/application-research/estuary/deal/queue"
 	dealstatus "github.com/application-research/estuary/deal/status"
 	"github.com/application-research/estuary/model"
 	"github.com/application-research/estuary/shuttle"
@@ -33,29 +35,35 @@ type IManager interface {
 
 type manager struct {
 	db                *gorm.DB
+	cfg               *config.Estuary
 	log               *zap.SugaredLogger
 	fc                *filclient.FilClient
 	tracer            trace.Tracer
 	shuttleMgr        shuttle.IManager
 	dealStatusUpdater dealstatus.IUpdater
+	dealQueueMgr      dealqueuemgr.IManager
 	tcLk              sync.Mutex
 	trackingChannels  map[string]*util.ChanTrack
 }
 
-func NewManager(ctx context.Context, db *gorm.DB, fc *filclient.FilClient, log *zap.SugaredLogger, shuttleMgr shuttle.IManager) (IManager, error) {
+func NewManager(ctx context.Context, db *gorm.DB, cfg *config.Estuary, fc *filclient.FilClient, log *zap.SugaredLogger, shuttleMgr shuttle.IManager) (IManager, error) {
 	m := &manager{
 		db:                db,
+		cfg:               cfg,
 		log:               log,
 		fc:                fc,
 		tracer:            otel.Tracer("replicator"),
 		shuttleMgr:        shuttleMgr,
 		dealStatusUpdater: dealstatus.NewUpdater(db, log),
+		dealQueueMgr:      dealqueuemgr.NewManager(cfg, log),
 		trackingChannels:  make(map[string]*util.ChanTrack),
 	}
 
 	if err := m.subscribeEventListener(ctx); err != nil {
 		return nil, err
 	}
+
+	go m.runTransferTimeoutChecker(ctx)
 	return m, nil
 }
 
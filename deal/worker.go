@@ -2,10 +2,16 @@ package deal
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
+	dealqueuemgr "github.com/application-research/estuary/deal/queue"
+	"github.com/application-research/estuary/metrics"
 	"github.com/application-research/estuary/model"
 	"github.com/application-research/estuary/util"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
 	"gorm.io/gorm"
 )
 
@@ -18,6 +24,10 @@ func (m *manager) runWorkers(ctx context.Context) {
 
 	go m.runDealWorker(ctx)
 
+	go m.runDealQueueReconcileWorker(ctx)
+
+	go m.runDealQueueDepthWorker(ctx)
+
 	m.log.Infof("spun up deal workers")
 }
 
@@ -78,33 +88,52 @@ func (m *manager) runDealBackFillWorker(ctx context.Context) {
 	}
 }
 
+// how many workers make deals at once, each claiming its own contents from the queue
+const dealWorkerCount = 4
+
 func (m *manager) runDealWorker(ctx context.Context) {
 	timer := time.NewTicker(m.cfg.WorkerIntervals.DealInterval)
 	for {
 		select {
 		case <-ctx.Done():
-			m.log.Info("shutting down deal check worker")
+			m.log.Info("shutting down deal worker")
 			return
 		case <-timer.C:
 			m.log.Debug("running deal worker")
 
-			var tasks []*model.DealQueue
-			if err := m.db.Where("commp_done and can_deal and deal_next_attempt_at < ?", time.Now().UTC()).Order("id asc").FindInBatches(&tasks, 2000, func(tx *gorm.DB, batch int) error {
-				m.log.Debugf("trying to make deals for total of %d contents", len(tasks))
-				for _, t := range tasks {
-					m.log.Debugf("making %d deal(s) for content: %d", t.DealCount, t.ContID)
-					if err := m.makeDealsForContent(ctx, t.ContID, t.DealCount); err != nil {
-						m.log.Errorf("failed to make more deals for cont: %d - %s", t.ContID, err)
-						m.dealQueueMgr.DealFailed(t.ContID, m.db)
-						continue
-					}
-					m.dealQueueMgr.DealComplete(t.ContID, m.db)
-				}
-				return nil
-			}).Error; err != nil {
-				m.log.Warnf("failed to make content deals - %s", err)
+			var wg sync.WaitGroup
+			for i := 0; i < dealWorkerCount; i++ {
+				wg.Add(1)
+				go func(workerID string) {
+					defer wg.Done()
+					m.makeClaimedDeals(ctx, workerID)
+				}(fmt.Sprintf("deal-worker-%d", i))
 			}
+			wg.Wait()
+		}
+	}
+}
+
+// makeClaimedDeals makes deals for the contents the worker claims from the queue, until there is none left to
+// claim. Contents that have as many deals as their target aren't claimed, until their target is raised.
+func (m *manager) makeClaimedDeals(ctx context.Context, workerID string) {
+	for ctx.Err() == nil {
+		t, err := m.dealQueueMgr.ClaimNext(workerID, m.db)
+		if err != nil {
+			m.log.Warnf("failed to claim content for deal making - %s", err)
+			return
+		}
+		if t == nil {
+			return
+		}
+
+		m.log.Debugf("making %d deal(s) for content: %d", t.DealCount, t.ContID)
+		if err := m.makeDealsForContent(ctx, t.ContID, t.DealCount); err != nil {
+			m.log.Errorf("failed to make more deals for cont: %d - %s", t.ContID, err)
+			m.dealQueueMgr.DealFailed(t.ContID, m.db)
+			continue
 		}
+		m.dealQueueMgr.DealComplete(t.ContID, m.db)
 	}
 }
 
@@ -138,6 +167,68 @@ func (m *manager) runDealCheckWorker(ctx context.Context) {
 	}
 }
 
+// how often the deal queue is reconciled with the contents table
+const dealQueueReconcileInterval = 6 * time.Hour
+
+func (m *manager) runDealQueueReconcileWorker(ctx context.Context) {
+	timer := time.NewTicker(dealQueueReconcileInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			m.log.Info("shutting down deal queue reconcile worker")
+			return
+		case <-timer.C:
+			m.log.Debug("running deal queue reconcile worker")
+
+			rec, err := dealqueuemgr.ReconcileDealQueue(m.db, m.cfg.Content.MinSize)
+			if err != nil {
+				m.log.Warnf("failed to reconcile deal queue - %s", err)
+				continue
+			}
+			if rec.Removed > 0 || rec.Queued > 0 {
+				m.log.Infof("reconciled deal queue, removed %d entries of deleted contents, queued %d contents", rec.Removed, rec.Queued)
+			}
+		}
+	}
+}
+
+// how often the deal queue depth metrics are recorded
+const dealQueueDepthInterval = 1 * time.Minute
+
+func (m *manager) runDealQueueDepthWorker(ctx context.Context) {
+	timer := time.NewTicker(dealQueueDepthInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			m.log.Info("shutting down deal queue depth worker")
+			return
+		case <-timer.C:
+			m.log.Debug("running deal queue depth worker")
+
+			depths, err := dealqueuemgr.DealQueueDepths(m.db)
+			if err != nil {
+				m.log.Warnf("failed to get deal queue depths - %s", err)
+				continue
+			}
+
+			for phase, depth := range map[string]int64{
+				"awaiting_commp":      depths.AwaitingCommp,
+				"retrying_commp":      depths.RetryingCommp,
+				"awaiting_deal_check": depths.AwaitingDealCheck,
+				"awaiting_deal":       depths.AwaitingDeal,
+				"retrying_deal":       depths.RetryingDeal,
+			} {
+				tctx, err := tag.New(ctx, tag.Upsert(metrics.DealQueuePhase, phase))
+				if err != nil {
+					m.log.Warnf("failed to tag deal queue depth metric - %s", err)
+					continue
+				}
+				stats.Record(tctx, metrics.DealQueueDepth.M(depth))
+			}
+		}
+	}
+}
+
 func (m *manager) getQueueTracker() (*model.DealQueueTracker, error) {
 	var trks []*model.DealQueueTracker
 	if err := m.db.Find(&trks).Error; err != nil {
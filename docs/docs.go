@@ -983,6 +983,12 @@ const docTemplate = `{
                         "description": "Directory",
                         "name": "dir",
                         "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Handle of the shuttle to add the content on (admins only)",
+                        "name": "shuttle",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -1440,7 +1446,7 @@ const docTemplate = `{
         },
         "/content/failures/{content}": {
             "get": {
-                "description": "This endpoint returns all failures for a content",
+                "description": "This endpoint returns all deal failures for a content, newest first",
                 "produces": [
                     "application/json"
                 ],
@@ -219,20 +219,116 @@ func getAppFlags(cfg *config.Estuary) []cli.Flag {
 			Name:  "deal-protocol-version",
 			Usage: "sets the deal protocol version. defaults to v110 (go-fil-markets) and v120 (boost)",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
+			Name:  "deal-transfer-timeout",
+			Usage: "sets how long the data transfer of deals up to a size may run before the deal is failed, as size=timeout (e.g. '4GiB=12h', '*' matches any size), can be repeated for several size tiers",
+			Value: cli.NewStringSlice(transferTimeoutTiers(cfg.Deal.TransferTimeouts)...),
+		},
+		&cli.StringSliceFlag{
 			Name:  "indexer-url",
-			Usage: "sets the indexer advertisement url",
-			Value: cfg.Node.IndexerURL,
+			Usage: "sets the indexer advertisement url, can be repeated to announce to several indexers",
+			Value: cli.NewStringSlice(cfg.Node.IndexerURLs...),
 		},
 		&cli.StringFlag{
 			Name:  "indexer-advertisement-interval",
 			Usage: "sets the indexer advertisement interval using a Go time string (e.g. '1m30s')",
 			Value: cfg.Node.IndexerAdvertisementInterval.String(),
 		},
+		&cli.StringFlag{
+			Name:  "indexer-refresh-interval",
+			Usage: "sets how old an unchanged advertisement can get before it is re-announced to the indexer using a Go time string (e.g. '24h'), 0 disables refreshing",
+			Value: cfg.Node.IndexerRefreshInterval.String(),
+		},
+		&cli.StringFlag{
+			Name:  "indexer-prune-interval",
+			Usage: "sets how often the published batches of deregistered autoretrieves are deleted using a Go time string (e.g. '24h'), 0 disables pruning",
+			Value: cfg.Node.IndexerPruneInterval.String(),
+		},
+		&cli.BoolFlag{
+			Name:  "indexer-prune-notify-remove",
+			Usage: "if set, the advertisements of pruned batches are removed from the indexer before the batches are deleted",
+		},
+		&cli.BoolFlag{
+			Name:  "indexer-pause-notify-remove",
+			Usage: "if set, the advertisements of paused autoretrieves are removed from the indexer until they are resumed",
+		},
+		&cli.BoolFlag{
+			Name:  "indexer-iteration-cache",
+			Usage: "if set, the multihashes of a batch are read once per advertisement tick and reused for every autoretrieve",
+		},
+		&cli.StringFlag{
+			Name:  "indexer-reap-interval",
+			Usage: "sets how often the advertisements of batches whose contents were all deleted are removed using a Go time string (e.g. '24h'), 0 disables reaping",
+			Value: cfg.Node.IndexerReapInterval.String(),
+		},
+		&cli.StringFlag{
+			Name:  "indexer-reap-pace",
+			Usage: "sets the pause between each page of published batches checked by the reaper using a Go time string (e.g. '1s')",
+			Value: cfg.Node.IndexerReapPace.String(),
+		},
+		&cli.Uint64Flag{
+			Name:  "indexer-max-entries-per-ad",
+			Usage: "sets the maximum amount of multihashes in one advertisement, batches with more are split over several advertisements, 0 disables splitting",
+			Value: cfg.Node.IndexerMaxEntriesPerAd,
+		},
+		&cli.StringFlag{
+			Name:  "indexer-recent-content-age",
+			Usage: "sets how new content must be for its batch to be checked for advertisement every tick using a Go time string (e.g. '24h'), 0 checks every batch every tick",
+			Value: cfg.Node.IndexerRecentContentAge.String(),
+		},
+		&cli.Uint64Flag{
+			Name:  "indexer-cold-batch-ticks",
+			Usage: "sets every how many advertisement ticks batches without recent content are checked, used with --indexer-recent-content-age",
+			Value: cfg.Node.IndexerColdBatchTicks,
+		},
+		&cli.Uint64Flag{
+			Name:  "indexer-lookback-batches",
+			Usage: "sets how many of the last batches have their multihashes recounted every tick, so obj_refs written after their batch was advertised get re-published, 0 disables the lookback",
+			Value: cfg.Node.IndexerLookbackBatches,
+		},
+		&cli.Float64Flag{
+			Name:  "indexer-min-batch-fill",
+			Usage: "sets the fraction of the batch size (e.g. 0.5) the trailing, incomplete batch must reach before it is advertised, 0 advertises it right away",
+			Value: cfg.Node.IndexerMinBatchFill,
+		},
+		&cli.StringFlag{
+			Name:  "indexer-min-batch-fill-max-age",
+			Usage: "sets how long after its first content was added an incomplete batch is advertised regardless of --indexer-min-batch-fill using a Go time string (e.g. '1h'), 0 waits until it is filled",
+			Value: cfg.Node.IndexerMinBatchFillMaxAge.String(),
+		},
+		&cli.Uint64Flag{
+			Name:  "indexer-schedule-passes",
+			Usage: "sets how many passes the advertisement loop makes per interval, each advertising only the autoretrieves scheduled for it, to spread the load over the interval, 0 advertises every autoretrieve on every tick",
+			Value: cfg.Node.IndexerSchedulePasses,
+		},
+		&cli.Float64Flag{
+			Name:  "indexer-schedule-jitter",
+			Usage: "sets the fraction of the interval (e.g. 0.1) each autoretrieve's next advertisement is randomly shifted by, used with --indexer-schedule-passes",
+			Value: cfg.Node.IndexerScheduleJitter,
+		},
+		&cli.Float64Flag{
+			Name:  "indexer-query-rate",
+			Usage: "sets how many queries per second the advertisement loop runs at most for its batches, to keep a tick from contending with serving requests, 0 doesn't limit them",
+			Value: cfg.Node.IndexerQueryRate,
+		},
+		&cli.BoolFlag{
+			Name:  "indexer-content-expiry",
+			Usage: "if set, contents stop being advertised once their expiry has passed, and batches are re-published without them",
+		},
+		&cli.StringFlag{
+			Name:  "indexer-offline-grace",
+			Usage: "sets how long past a missed heartbeat an autoretrieve is still advertised using a Go time string (e.g. '5m'), 0 stops advertising it as soon as a heartbeat is missed",
+			Value: cfg.Node.IndexerOfflineGrace.String(),
+		},
 		&cli.BoolFlag{
 			Name:  "advertise-offline-autoretrieves",
 			Usage: "if set, registered autoretrieves will be advertised even if they are not currently online",
 		},
+		&cli.StringFlag{
+			Name:  "indexer-obj-ref-strategy",
+			Usage: "sets how advertised multihashes are read from the database: 'join' (single join of objects on obj_refs) or 'two-step' (object IDs first, then CIDs by primary key)",
+			Value: cfg.Node.IndexerObjRefStrategy,
+		},
 		&cli.StringFlag{
 			Name:  "max-price",
 			Usage: "sets the max price for non-verified deals",
@@ -274,3 +370,11 @@ func getSetupFlags(cfg *config.Estuary) []cli.Flag {
 		},
 	}
 }
+
+func transferTimeoutTiers(tiers []config.TransferTimeoutTier) []string {
+	out := make([]string, 0, len(tiers))
+	for _, tier := range tiers {
+		out = append(out, tier.String())
+	}
+	return out
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/multiformats/go-multiaddr"
@@ -45,6 +46,8 @@ import (
 	"github.com/application-research/estuary/util"
 	"github.com/application-research/filclient"
 	"github.com/google/uuid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	gsimpl "github.com/ipfs/go-graphsync/impl"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p/core/protocol"
@@ -191,15 +194,81 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 		case "staging-bucket":
 			cfg.StagingBucket.Enabled = cctx.Bool("staging-bucket")
 		case "indexer-url":
-			cfg.Node.IndexerURL = cctx.String("indexer-url")
+			cfg.Node.IndexerURLs = cctx.StringSlice("indexer-url")
 		case "indexer-advertisement-interval":
 			value, err := time.ParseDuration(cctx.String("indexer-advertisement-interval"))
 			if err != nil {
 				return fmt.Errorf("failed to parse indexer advertisement interval: %v", err)
 			}
 			cfg.Node.IndexerAdvertisementInterval = value
+		case "indexer-refresh-interval":
+			value, err := time.ParseDuration(cctx.String("indexer-refresh-interval"))
+			if err != nil {
+				return fmt.Errorf("failed to parse indexer refresh interval: %v", err)
+			}
+			cfg.Node.IndexerRefreshInterval = value
+		case "indexer-prune-interval":
+			value, err := time.ParseDuration(cctx.String("indexer-prune-interval"))
+			if err != nil {
+				return fmt.Errorf("failed to parse indexer prune interval: %v", err)
+			}
+			cfg.Node.IndexerPruneInterval = value
+		case "indexer-prune-notify-remove":
+			cfg.Node.IndexerPruneNotifyRemove = cctx.Bool("indexer-prune-notify-remove")
+		case "indexer-pause-notify-remove":
+			cfg.Node.IndexerPauseNotifyRemove = cctx.Bool("indexer-pause-notify-remove")
+		case "indexer-iteration-cache":
+			cfg.Node.IndexerIterationCache = cctx.Bool("indexer-iteration-cache")
+		case "indexer-reap-interval":
+			value, err := time.ParseDuration(cctx.String("indexer-reap-interval"))
+			if err != nil {
+				return fmt.Errorf("failed to parse indexer reap interval: %v", err)
+			}
+			cfg.Node.IndexerReapInterval = value
+		case "indexer-reap-pace":
+			value, err := time.ParseDuration(cctx.String("indexer-reap-pace"))
+			if err != nil {
+				return fmt.Errorf("failed to parse indexer reap pace: %v", err)
+			}
+			cfg.Node.IndexerReapPace = value
+		case "indexer-max-entries-per-ad":
+			cfg.Node.IndexerMaxEntriesPerAd = cctx.Uint64("indexer-max-entries-per-ad")
+		case "indexer-recent-content-age":
+			value, err := time.ParseDuration(cctx.String("indexer-recent-content-age"))
+			if err != nil {
+				return fmt.Errorf("failed to parse indexer recent content age: %v", err)
+			}
+			cfg.Node.IndexerRecentContentAge = value
+		case "indexer-cold-batch-ticks":
+			cfg.Node.IndexerColdBatchTicks = cctx.Uint64("indexer-cold-batch-ticks")
+		case "indexer-lookback-batches":
+			cfg.Node.IndexerLookbackBatches = cctx.Uint64("indexer-lookback-batches")
+		case "indexer-min-batch-fill":
+			cfg.Node.IndexerMinBatchFill = cctx.Float64("indexer-min-batch-fill")
+		case "indexer-min-batch-fill-max-age":
+			value, err := time.ParseDuration(cctx.String("indexer-min-batch-fill-max-age"))
+			if err != nil {
+				return fmt.Errorf("failed to parse indexer min batch fill max age: %v", err)
+			}
+			cfg.Node.IndexerMinBatchFillMaxAge = value
+		case "indexer-schedule-passes":
+			cfg.Node.IndexerSchedulePasses = cctx.Uint64("indexer-schedule-passes")
+		case "indexer-schedule-jitter":
+			cfg.Node.IndexerScheduleJitter = cctx.Float64("indexer-schedule-jitter")
+		case "indexer-query-rate":
+			cfg.Node.IndexerQueryRate = cctx.Float64("indexer-query-rate")
+		case "indexer-content-expiry":
+			cfg.Node.IndexerContentExpiry = cctx.Bool("indexer-content-expiry")
+		case "indexer-offline-grace":
+			value, err := time.ParseDuration(cctx.String("indexer-offline-grace"))
+			if err != nil {
+				return fmt.Errorf("failed to parse indexer offline grace: %v", err)
+			}
+			cfg.Node.IndexerOfflineGrace = value
 		case "advertise-offline-autoretrieves":
 			cfg.Node.AdvertiseOfflineAutoretrieves = cctx.Bool("advertise-offline-autoretrieves")
+		case "indexer-obj-ref-strategy":
+			cfg.Node.IndexerObjRefStrategy = cctx.String("indexer-obj-ref-strategy")
 		case "deal-protocol-version":
 			dprs := make(map[protocol.ID]bool, 0)
 			for _, dprv := range cctx.StringSlice("deal-protocol-version") {
@@ -214,6 +283,17 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 				cfg.Deal.EnabledDealProtocolsVersions = dprs
 			}
 
+		case "deal-transfer-timeout":
+			var tiers []config.TransferTimeoutTier
+			for _, t := range cctx.StringSlice("deal-transfer-timeout") {
+				tier, err := config.ParseTransferTimeoutTier(t)
+				if err != nil {
+					return err
+				}
+				tiers = append(tiers, tier)
+			}
+			cfg.Deal.TransferTimeouts = tiers
+
 		case "max-price":
 			maxPrice, err := types.ParseFIL(cctx.String("max-price"))
 			if err != nil {
@@ -329,6 +409,72 @@ func main() {
 				log.Infof(`{"handle":"%s","token":"%s"}`, shuttle.Handle, shuttle.Token)
 				return nil
 			},
+		}, {
+			Name:  "autoretrieve-dry-run",
+			Usage: "Estimates the size of the advertisement of every autoretrieve batch without publishing anything",
+			Flags: []cli.Flag{
+				&cli.Uint64Flag{
+					Name:  "batch-size",
+					Usage: "amount of contents per batch",
+					Value: constants.AutoretrieveProviderBatchSize,
+				},
+				&cli.Uint64Flag{
+					Name:  "max-ad-size",
+					Usage: "marks the batches whose advertisements are estimated to be larger than this many bytes, e.g. the indexer's limit",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				configFile := cctx.String("config")
+				if err := cfg.Load(configFile); err != nil && err != config.ErrNotInitialized { // still want to report parsing errors
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				batchSize := cctx.Uint64("batch-size")
+				if batchSize == 0 {
+					return errors.New("batch size must be greater than 0")
+				}
+
+				db, err := setupDatabase(cfg.DatabaseConnString)
+				if err != nil {
+					return err
+				}
+
+				estimates, err := autoretrieve.DryRunReport(db, batchSize, cfg.Node.IndexerMaxEntriesPerAd)
+				if err != nil {
+					return err
+				}
+
+				maxAdSize := cctx.Uint64("max-ad-size")
+				var entries, bytes uint64
+				var oversized int
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "FIRST CONTENT\tCOUNT\tENTRIES\tADS\tCHUNKS\tEST. BYTES\t")
+				for _, est := range estimates {
+					mark := ""
+					// with several advertisements, compare the average one
+					if maxAdSize != 0 && est.Bytes/est.Advertisements > maxAdSize {
+						mark = "too large"
+						oversized++
+					}
+					fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%s\n", est.FirstContentID, est.Count, est.Entries, est.Advertisements, est.Chunks, est.Bytes, mark)
+					entries += est.Entries
+					bytes += est.Bytes
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+
+				fmt.Printf("%d batches, %d entries, %d estimated bytes", len(estimates), entries, bytes)
+				if maxAdSize != 0 {
+					fmt.Printf(", %d batches over %d bytes", oversized, maxAdSize)
+				}
+				fmt.Println()
+				return nil
+			},
 		},
 	}
 	app.Action = func(cctx *cli.Context) error {
@@ -397,6 +543,7 @@ func migrateSchemas(db *gorm.DB) error {
 		&autoretrieve.Autoretrieve{},
 		&model.SanityCheck{},
 		&autoretrieve.PublishedBatch{},
+		&autoretrieve.AdvertisementHistory{},
 		&model.ShuttleConnection{},
 		&model.StagingZone{},
 		&model.StagingZoneTracker{},
@@ -570,7 +717,7 @@ func Run(ctx context.Context, cfg *config.Estuary) error {
 	}
 
 	// stand up transfer manager
-	transferMgr, err := transfer.NewManager(ctx, db, fc, log, shuttleMgr)
+	transferMgr, err := transfer.NewManager(ctx, db, cfg, fc, log, shuttleMgr)
 	if err != nil {
 		return err
 	}
@@ -607,14 +754,35 @@ func Run(ctx context.Context, cfg *config.Estuary) error {
 	pinmgr := pinner.NewEstuaryPinManager(ctx, pinOpts, contMgr, cfg, shuttleMgr, db, nd, log)
 
 	// Start autoretrieve if not disabled
+	var ap *autoretrieve.Provider
 	if !cfg.DisableAutoRetrieve {
 		init.trackingBstore.SetCidReqFunc(contMgr.RefreshContentForCid)
 
-		ap, err := autoretrieve.NewProvider(
+		objRefStrategy, err := autoretrieve.ParseObjRefStrategy(cfg.Node.IndexerObjRefStrategy)
+		if err != nil {
+			return err
+		}
+
+		ap, err = autoretrieve.NewProvider(
 			db,
 			cfg.Node.IndexerAdvertisementInterval,
-			cfg.Node.IndexerURL,
+			cfg.Node.IndexerURLs,
 			cfg.Node.AdvertiseOfflineAutoretrieves,
+			autoretrieve.WithObjRefStrategy(objRefStrategy),
+			autoretrieve.WithOfflineGrace(cfg.Node.IndexerOfflineGrace),
+			autoretrieve.WithRefreshInterval(cfg.Node.IndexerRefreshInterval),
+			autoretrieve.WithPruneInterval(cfg.Node.IndexerPruneInterval, cfg.Node.IndexerPruneNotifyRemove),
+			autoretrieve.WithPauseRemoval(cfg.Node.IndexerPauseNotifyRemove),
+			autoretrieve.WithIterationCache(cfg.Node.IndexerIterationCache),
+			autoretrieve.WithEmptyBatchReaper(cfg.Node.IndexerReapInterval, cfg.Node.IndexerReapPace),
+			autoretrieve.WithMaxEntriesPerAd(cfg.Node.IndexerMaxEntriesPerAd),
+			autoretrieve.WithLookback(cfg.Node.IndexerLookbackBatches),
+			autoretrieve.WithMinBatchFill(cfg.Node.IndexerMinBatchFill, cfg.Node.IndexerMinBatchFillMaxAge),
+			autoretrieve.WithAgePriority(cfg.Node.IndexerRecentContentAge, cfg.Node.IndexerColdBatchTicks),
+			autoretrieve.WithScheduling(cfg.Node.IndexerSchedulePasses, cfg.Node.IndexerScheduleJitter),
+			autoretrieve.WithQueryRate(cfg.Node.IndexerQueryRate),
+			autoretrieve.WithContentExpiry(cfg.Node.IndexerContentExpiry),
+			autoretrieve.WithEngineDatastore(namespace.Wrap(nd.Datastore, datastore.NewKey("/autoretrieve/engine"))),
 		)
 		if err != nil {
 			return err
@@ -645,7 +813,7 @@ func Run(ctx context.Context, cfg *config.Estuary) error {
 	// stand up api server
 	apiTracer := otel.Tracer("api")
 
-	apiV1 := apiv1.NewAPIV1(cfg, db, nd, fc, gatewayApi, sbmgr, contMgr, cacher, extendedCacher, minerMgr, pinmgr, log, apiTracer, shuttleMgr, transferMgr, dealMgr, stgZoneMgr)
+	apiV1 := apiv1.NewAPIV1(cfg, db, nd, fc, gatewayApi, sbmgr, contMgr, cacher, extendedCacher, minerMgr, pinmgr, log, apiTracer, shuttleMgr, transferMgr, dealMgr, stgZoneMgr, ap)
 	apiV2 := apiv2.NewAPIV2(cfg, db, nd, fc, gatewayApi, sbmgr, contMgr, cacher, minerMgr, extendedCacher, pinmgr, log, apiTracer)
 
 	apiEngine := api.NewEngine(cfg, apiTracer, log)
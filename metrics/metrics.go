@@ -27,6 +27,12 @@ var (
 	Direction, _  = tag.NewKey("direction")
 	UseFD, _      = tag.NewKey("use_fd")
 	Op, _         = tag.NewKey("op")
+
+	// autoretrieve
+	AutoretrieveHandle, _ = tag.NewKey("autoretrieve_handle")
+
+	// deal queue
+	DealQueuePhase, _ = tag.NewKey("phase")
 )
 
 // Measures
@@ -43,6 +49,14 @@ var (
 	RcmgrProto  = stats.Int64("rcmgr/proto", "Number of allowed streams attached to a protocol", stats.UnitDimensionless)
 	RcmgrSvc    = stats.Int64("rcmgr/svc", "Number of streams attached to a service", stats.UnitDimensionless)
 	RcmgrMem    = stats.Int64("rcmgr/mem", "Number of memory reservations", stats.UnitDimensionless)
+
+	// autoretrieve
+	AutoretrieveBatchesPublished = stats.Int64("autoretrieve/batches_published", "Number of batches advertised to the indexers", stats.UnitDimensionless)
+	AutoretrieveBatchesRemoved   = stats.Int64("autoretrieve/batches_removed", "Number of batch advertisements removed from the indexers", stats.UnitDimensionless)
+	AutoretrieveBatchesFailed    = stats.Int64("autoretrieve/batches_failed", "Number of batches that failed to be advertised", stats.UnitDimensionless)
+	AutoretrieveCoverage         = stats.Float64("autoretrieve/coverage", "Percentage of batches completely advertised", stats.UnitDimensionless)
+
+	DealQueueDepth = stats.Int64("deal_queue/depth", "Number of deal queue entries waiting in a phase", stats.UnitDimensionless)
 )
 
 var (
@@ -89,6 +103,38 @@ var (
 		Measure:     RcmgrMem,
 		Aggregation: view.Count(),
 	}
+
+	// autoretrieve
+	AutoretrieveBatchesPublishedView = &view.View{
+		Measure:     AutoretrieveBatchesPublished,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{AutoretrieveHandle},
+	}
+
+	AutoretrieveBatchesRemovedView = &view.View{
+		Measure:     AutoretrieveBatchesRemoved,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{AutoretrieveHandle},
+	}
+
+	AutoretrieveBatchesFailedView = &view.View{
+		Measure:     AutoretrieveBatchesFailed,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{AutoretrieveHandle},
+	}
+
+	AutoretrieveCoverageView = &view.View{
+		Measure:     AutoretrieveCoverage,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{AutoretrieveHandle},
+	}
+
+	// deal queue
+	DealQueueDepthView = &view.View{
+		Measure:     DealQueueDepth,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{DealQueuePhase},
+	}
 )
 
 // DefaultViews is an array of OpenCensus views for metric gathering purposes
@@ -101,6 +147,11 @@ var DefaultViews = func() []*view.View {
 		RcmgrProtoView,
 		RcmgrSvcView,
 		RcmgrMemView,
+		AutoretrieveBatchesPublishedView,
+		AutoretrieveBatchesRemovedView,
+		AutoretrieveBatchesFailedView,
+		AutoretrieveCoverageView,
+		DealQueueDepthView,
 	}
 	views = append(views, blockstore.DefaultViews...)
 	views = append(views, rpcmetrics.DefaultViews...)
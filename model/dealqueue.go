@@ -20,4 +20,7 @@ type DealQueue struct {
 	DealCount              int        `gorm:"not null" json:"-"`
 	DealCheckNextAttemptAt time.Time  `gorm:"index:can_deal_commp_done_deal_next_attempt_at;index:can_deal_commp_done_deal_check_next_attempt_at;not null" json:"-"`
 	DealNextAttemptAt      time.Time  `gorm:"index; not null" json:"-"`
+	ClaimedBy              string     `json:"-"`
+	// when deal making for the content last completed, nil if it never did
+	DealCompletedAt *time.Time `gorm:"index" json:"-"`
 }
@@ -15,4 +15,7 @@ type DfeRecord struct {
 	MinerVersion        string      `json:"minerVersion"`
 	UserID              uint        `json:"user_id" gorm:"index"`
 	DealProtocolVersion protocol.ID `json:"deal_protocol_version"`
+	// retryable, terminal or unknown, empty for failures recorded before they
+	// were classified
+	Category string `json:"category"`
 }
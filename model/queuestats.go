@@ -0,0 +1,136 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"gorm.io/gorm"
+)
+
+// StatsQueue is implemented by queue models whose entries are retried on a schedule
+type StatsQueue interface {
+	// QueuePhases lists the phases an entry goes through, each retried on its own schedule
+	QueuePhases() []QueuePhase
+}
+
+// QueuePhase describes the entries of a queue waiting in one phase
+type QueuePhase struct {
+	Name string
+	// PendingCondition selects entries that still have work to be done in the phase
+	PendingCondition string
+	// FailingCondition selects entries whose last attempt of the phase failed, empty when the queue doesn't
+	// record it
+	FailingCondition string
+	// NextAttemptColumn is the column holding when an entry can next be worked on in the phase
+	NextAttemptColumn string
+}
+
+type QueuePhaseSummary struct {
+	Eligible      int64      `json:"eligible"`
+	Scheduled     int64      `json:"scheduled"`
+	Failing       int64      `json:"failing"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt"`
+}
+
+// QueueSummary sums up the phases of a queue, NextAttemptAt being the soonest of them
+type QueueSummary struct {
+	Total         int64                         `json:"total"`
+	Eligible      int64                         `json:"eligible"`
+	Scheduled     int64                         `json:"scheduled"`
+	Failing       int64                         `json:"failing"`
+	NextAttemptAt *time.Time                    `json:"nextAttemptAt"`
+	Phases        map[string]*QueuePhaseSummary `json:"phases"`
+}
+
+func (DealQueue) QueuePhases() []QueuePhase {
+	return []QueuePhase{
+		{
+			Name:              "commp",
+			PendingCondition:  fmt.Sprintf("not commp_done and commp_attempted < %d", constants.DealQueueCommpMaxAttempts),
+			FailingCondition:  "not commp_done and commp_attempted > 0",
+			NextAttemptColumn: "commp_next_attempt_at",
+		},
+		{
+			// failed deal checks are only pushed back, like successful ones
+			Name:              "deal_check",
+			PendingCondition:  "not can_deal and commp_done",
+			NextAttemptColumn: "deal_check_next_attempt_at",
+		},
+		{
+			// failed deals are only pushed back, like claimed ones
+			Name:              "deal",
+			PendingCondition:  "can_deal and commp_done and deal_count > 0",
+			NextAttemptColumn: "deal_next_attempt_at",
+		},
+	}
+}
+
+func (SplitQueue) QueuePhases() []QueuePhase {
+	return []QueuePhase{
+		{
+			Name:              "split",
+			PendingCondition:  fmt.Sprintf("attempted < %d", constants.SplitQueueMaxAttempts),
+			FailingCondition:  "failing",
+			NextAttemptColumn: "next_attempt_at",
+		},
+	}
+}
+
+// QueueStats reports how many entries of a queue are eligible for work now, scheduled for later or failing,
+// along with the soonest time pending work will be picked up, per phase and summed over the phases
+func QueueStats(db *gorm.DB, q StatsQueue) (*QueueSummary, error) {
+	now := time.Now().UTC()
+
+	summary := QueueSummary{
+		Phases: make(map[string]*QueuePhaseSummary),
+	}
+	if err := db.Model(q).Count(&summary.Total).Error; err != nil {
+		return nil, err
+	}
+
+	for _, phase := range q.QueuePhases() {
+		ps, err := queuePhaseStats(db, q, phase, now)
+		if err != nil {
+			return nil, err
+		}
+		summary.Phases[phase.Name] = ps
+
+		summary.Eligible += ps.Eligible
+		summary.Scheduled += ps.Scheduled
+		summary.Failing += ps.Failing
+		if ps.NextAttemptAt != nil && (summary.NextAttemptAt == nil || ps.NextAttemptAt.Before(*summary.NextAttemptAt)) {
+			summary.NextAttemptAt = ps.NextAttemptAt
+		}
+	}
+	return &summary, nil
+}
+
+func queuePhaseStats(db *gorm.DB, q StatsQueue, phase QueuePhase, now time.Time) (*QueuePhaseSummary, error) {
+	col := phase.NextAttemptColumn
+
+	var ps QueuePhaseSummary
+	if err := db.Model(q).Where(phase.PendingCondition).Where(col+" <= ?", now).Count(&ps.Eligible).Error; err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(q).Where(phase.PendingCondition).Where(col+" > ?", now).Count(&ps.Scheduled).Error; err != nil {
+		return nil, err
+	}
+
+	if phase.FailingCondition != "" {
+		if err := db.Model(q).Where(phase.FailingCondition).Count(&ps.Failing).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	var next []time.Time
+	if err := db.Model(q).Where(phase.PendingCondition).Order(col+" asc").Limit(1).Pluck(col, &next).Error; err != nil {
+		return nil, err
+	}
+
+	if len(next) > 0 {
+		ps.NextAttemptAt = &next[0]
+	}
+	return &ps, nil
+}
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestDealQueueStats(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.AutoMigrate(&DealQueue{}))
+
+	now := time.Now().UTC()
+	soon := now.Add(time.Hour)
+	later := now.Add(10 * time.Hour)
+	for contID, e := range map[uint64]DealQueue{
+		1: {CommpNextAttemptAt: now.Add(-time.Minute)},                                              // commp eligible
+		2: {CommpAttempted: 1, CommpNextAttemptAt: soon},                                            // commp failed, scheduled
+		3: {CommpAttempted: 3, CommpNextAttemptAt: soon},                                            // out of commp attempts
+		4: {CommpDone: true, DealCheckNextAttemptAt: now.Add(-time.Minute)},                         // deal check eligible
+		5: {CommpDone: true, DealCheckNextAttemptAt: later},                                         // deal check scheduled
+		6: {CommpDone: true, CanDeal: true, DealCount: 2, DealNextAttemptAt: now.Add(-time.Minute)}, // deal eligible
+		7: {CommpDone: true, CanDeal: true, DealCount: 1, DealNextAttemptAt: soon},                  // deal scheduled
+	} {
+		e.UserID = 1
+		e.ContID = contID
+		if e.CommpNextAttemptAt.IsZero() {
+			e.CommpNextAttemptAt = later
+		}
+		if e.DealCheckNextAttemptAt.IsZero() {
+			e.DealCheckNextAttemptAt = later
+		}
+		if e.DealNextAttemptAt.IsZero() {
+			e.DealNextAttemptAt = later
+		}
+		assert.NoError(t, db.Create(&e).Error)
+	}
+
+	summary, err := QueueStats(db, DealQueue{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(7), summary.Total)
+	assert.Equal(t, int64(3), summary.Eligible)
+	assert.Equal(t, int64(3), summary.Scheduled)
+	assert.Equal(t, int64(2), summary.Failing)
+
+	commp := summary.Phases["commp"]
+	if assert.NotNil(t, commp) {
+		assert.Equal(t, int64(1), commp.Eligible)
+		assert.Equal(t, int64(1), commp.Scheduled)
+		assert.Equal(t, int64(2), commp.Failing)
+	}
+
+	dealCheck := summary.Phases["deal_check"]
+	if assert.NotNil(t, dealCheck) {
+		assert.Equal(t, int64(1), dealCheck.Eligible)
+		assert.Equal(t, int64(1), dealCheck.Scheduled)
+	}
+
+	deal := summary.Phases["deal"]
+	if assert.NotNil(t, deal) {
+		assert.Equal(t, int64(1), deal.Eligible)
+		assert.Equal(t, int64(1), deal.Scheduled)
+		if assert.NotNil(t, deal.NextAttemptAt) {
+			assert.True(t, deal.NextAttemptAt.Before(now))
+		}
+	}
+
+	if assert.NotNil(t, summary.NextAttemptAt) {
+		assert.True(t, summary.NextAttemptAt.Before(now))
+	}
+}
+
+func TestSplitQueueStats(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.AutoMigrate(&SplitQueue{}))
+
+	now := time.Now().UTC()
+	assert.NoError(t, db.Create(&[]SplitQueue{
+		{UserID: 1, ContID: 1, NextAttemptAt: now.Add(-time.Minute)},
+		{UserID: 1, ContID: 2, Failing: true, Attempted: 1, NextAttemptAt: now.Add(time.Hour)},
+		{UserID: 1, ContID: 3, Failing: true, Attempted: 3, NextAttemptAt: now.Add(time.Hour)},
+	}).Error)
+
+	summary, err := QueueStats(db, SplitQueue{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), summary.Total)
+	assert.Equal(t, int64(1), summary.Eligible)
+	assert.Equal(t, int64(1), summary.Scheduled)
+	assert.Equal(t, int64(2), summary.Failing)
+	assert.Len(t, summary.Phases, 1)
+}
@@ -19,7 +19,11 @@ type ShuttleConnection struct {
 	SpaceLow              bool
 	BlockstoreSize        uint64
 	BlockstoreFree        uint64
+	PinnedBytes           uint64 `gorm:"default:0"`
 	PinCount              int64
 	PinQueueLength        int64
 	QueueEngEnabled       bool
+	// reported by the shuttle's libp2p identify, Protocols is comma separated
+	AgentVersion string
+	Protocols    string
 }
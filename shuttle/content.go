@@ -2,6 +2,8 @@ package shuttle
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 
 	rpcevent "github.com/application-research/estuary/shuttle/rpc/event"
 	"github.com/application-research/estuary/util"
@@ -53,6 +55,34 @@ func (m *manager) PinContent(ctx context.Context, loc string, cont util.Content,
 	})
 }
 
+// RetryPin asks the shuttle holding a failed pin to attempt it again, instead of re-ingesting the content
+func (m *manager) RetryPin(ctx context.Context, loc string, contID uint64) error {
+	var cont util.Content
+	if err := m.db.First(&cont, "id = ?", contID).Error; err != nil {
+		return err
+	}
+
+	if cont.Location != loc {
+		return fmt.Errorf("content %d is located on %s, not %s", contID, cont.Location, loc)
+	}
+
+	var origins []*peer.AddrInfo
+	// when retrying, use content origins if available
+	if cont.Origins != "" {
+		_ = json.Unmarshal([]byte(cont.Origins), &origins) // no need to handle or log err, its just a nice to have
+	}
+
+	return m.sendRPCMessage(ctx, loc, &rpcevent.Command{
+		Op: rpcevent.CMD_RetryPin,
+		Params: rpcevent.CmdParams{
+			RetryPin: &rpcevent.RetryPin{
+				DBID:  contID,
+				Peers: origins,
+			},
+		},
+	})
+}
+
 func (m *manager) CommPContent(ctx context.Context, loc string, data cid.Cid) error {
 	m.log.Infof("sending commp")
 	return m.sendRPCMessage(ctx, loc, &rpcevent.Command{
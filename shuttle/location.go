@@ -65,6 +65,15 @@ func (m *manager) GetLocationForStorage(ctx context.Context, obj cid.Cid, uid ui
 		return lsJ
 	})
 
+	// and above all, shuttles that are not failing most of their operations
+	degraded := make(map[string]bool, len(shuttles))
+	for _, sh := range shuttles {
+		degraded[sh.Handle] = m.rpcMgr.Degraded(sh.Handle)
+	}
+	sort.SliceStable(shuttles, func(i, j int) bool {
+		return !degraded[shuttles[i].Handle] && degraded[shuttles[j].Handle]
+	})
+
 	if len(shuttles) == 0 {
 		if m.cfg.Content.DisableLocalAdding {
 			return "", fmt.Errorf("no shuttles available and local content adding disabled")
@@ -80,7 +89,7 @@ func (m *manager) GetLocationForStorage(ctx context.Context, obj cid.Cid, uid ui
 	}
 
 	if ploc != "" {
-		if allShuttlesLowSpace || !lowSpace[ploc] {
+		if (allShuttlesLowSpace || !lowSpace[ploc]) && !degraded[ploc] {
 			for _, sh := range shuttles {
 				if sh.Handle == ploc {
 					return ploc, nil
@@ -191,11 +200,7 @@ func (m *manager) GetPreferredUploadEndpoints(u *util.User) ([]string, error) {
 
 	var out []string
 	for _, sh := range shuttles {
-		host := "https://" + sh.Host
-		if strings.HasPrefix(sh.Host, "http://") || strings.HasPrefix(sh.Host, "https://") {
-			host = sh.Host
-		}
-		out = append(out, host+"/content/add")
+		out = append(out, uploadEndpoint(sh))
 	}
 
 	if !m.cfg.Content.DisableLocalAdding {
@@ -203,3 +208,54 @@ func (m *manager) GetPreferredUploadEndpoints(u *util.User) ([]string, error) {
 	}
 	return out, nil
 }
+
+// GetUploadEndpointForShuttle returns the upload endpoint of a shuttle, to
+// route an upload to it, failing if it doesn't accept uploads or, like
+// GetLocationForStorage, is private or degraded
+func (m *manager) GetUploadEndpointForShuttle(handle string) (string, error) {
+	connectedShuttles, err := m.getConnections()
+	if err != nil {
+		return "", err
+	}
+
+	for _, sh := range connectedShuttles {
+		if sh.Handle != handle {
+			continue
+		}
+
+		if sh.Private {
+			return "", fmt.Errorf("shuttle %s is private", handle)
+		}
+
+		if sh.ContentAddingDisabled {
+			return "", fmt.Errorf("shuttle %s has content adding disabled", handle)
+		}
+
+		if m.rpcMgr.Degraded(handle) {
+			return "", fmt.Errorf("shuttle %s is degraded", handle)
+		}
+
+		if sh.Hostname == "" {
+			return "", fmt.Errorf("shuttle %s has an empty hostname", handle)
+		}
+
+		var shuttle model.Shuttle
+		if err := m.db.First(&shuttle, "handle = ?", handle).Error; err != nil {
+			return "", err
+		}
+
+		if !shuttle.Open {
+			return "", fmt.Errorf("shuttle %s is not open", handle)
+		}
+		return uploadEndpoint(shuttle), nil
+	}
+	return "", fmt.Errorf("shuttle %s is not connected", handle)
+}
+
+func uploadEndpoint(sh model.Shuttle) string {
+	host := "https://" + sh.Host
+	if strings.HasPrefix(sh.Host, "http://") || strings.HasPrefix(sh.Host, "https://") {
+		host = sh.Host
+	}
+	return host + "/content/add"
+}
@@ -0,0 +1,153 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	rpcevent "github.com/application-research/estuary/shuttle/rpc/event"
+	"github.com/application-research/estuary/util"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// shuttles walk the content's blocks before answering, which takes a while for large contents
+	contentStatsTimeout = 5 * time.Minute
+	// number of content stats reports kept once their queries got them
+	contentStatsCacheSize = 10000
+)
+
+type contentStatsKey struct {
+	handle  string
+	content uint64
+}
+
+// contentStatsReplies hands the content stats shuttles report to the queries waiting for them, and keeps the
+// last report of each content
+type contentStatsReplies struct {
+	lk      sync.Mutex
+	waiters map[contentStatsKey][]chan *rpcevent.ContentStats
+	last    *lru.ARCCache
+}
+
+func newContentStatsReplies() (*contentStatsReplies, error) {
+	cache, err := lru.NewARC(contentStatsCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &contentStatsReplies{
+		waiters: make(map[contentStatsKey][]chan *rpcevent.ContentStats),
+		last:    cache,
+	}, nil
+}
+
+// await registers for the next report of the content by the shuttle, it has to be called before the request is
+// sent so that a quick reply isn't missed. The returned func unregisters it.
+func (r *contentStatsReplies) await(handle string, content uint64) (<-chan *rpcevent.ContentStats, func()) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	key := contentStatsKey{handle: handle, content: content}
+	ch := make(chan *rpcevent.ContentStats, 1)
+	r.waiters[key] = append(r.waiters[key], ch)
+
+	return ch, func() {
+		r.lk.Lock()
+		defer r.lk.Unlock()
+
+		waiters := r.waiters[key]
+		for i, w := range waiters {
+			if w == ch {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(r.waiters, key)
+			return
+		}
+		r.waiters[key] = waiters
+	}
+}
+
+// deliver stores the report and acks every query waiting for it
+func (r *contentStatsReplies) deliver(handle string, stats *rpcevent.ContentStats) {
+	key := contentStatsKey{handle: handle, content: stats.Content}
+	if stats.ErrMsg == "" {
+		r.last.Add(key, toShuttleContentStats(handle, stats))
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	for _, ch := range r.waiters[key] {
+		ch <- stats
+	}
+	delete(r.waiters, key)
+}
+
+// lastReport returns the last stats the shuttle reported for the content, or nil if it didn't report any yet
+func (r *contentStatsReplies) lastReport(handle string, content uint64) *util.ShuttleContentStats {
+	val, ok := r.last.Get(contentStatsKey{handle: handle, content: content})
+	if !ok {
+		return nil
+	}
+	return val.(*util.ShuttleContentStats)
+}
+
+// QueryContentStats asks the shuttle how many blocks of the content it holds, and waits for its answer, to audit
+// what the database thinks the shuttle holds against what it actually has
+func (m *manager) QueryContentStats(ctx context.Context, handle string, contID uint64) (*util.ShuttleContentStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, contentStatsTimeout)
+	defer cancel()
+
+	reply, unregister := m.contentStats.await(handle, contID)
+	defer unregister()
+
+	if err := m.SendPriorityRPCMessage(ctx, handle, &rpcevent.Command{
+		Op: rpcevent.CMD_RequestContentStats,
+		Params: rpcevent.CmdParams{
+			RequestContentStats: &rpcevent.RequestContentStats{
+				Content: contID,
+			},
+		},
+	}, rpcevent.PriorityHigh); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for shuttle %s to report stats of content %d: %w", handle, contID, ctx.Err())
+	case stats := <-reply:
+		if stats.ErrMsg != "" {
+			return nil, fmt.Errorf("shuttle %s failed to report stats of content %d: %s", handle, contID, stats.ErrMsg)
+		}
+		return toShuttleContentStats(handle, stats), nil
+	}
+}
+
+func toShuttleContentStats(handle string, stats *rpcevent.ContentStats) *util.ShuttleContentStats {
+	return &util.ShuttleContentStats{
+		Handle:        handle,
+		ContentID:     stats.Content,
+		Blocks:        stats.Blocks,
+		Size:          stats.Size,
+		MissingBlocks: stats.MissingBlocks,
+		ReceivedAt:    time.Now(),
+	}
+}
+
+// ContentStats returns the last stats the shuttle reported for the content without asking it again, or nil if
+// they aren't known
+func (m *manager) ContentStats(handle string, contID uint64) *util.ShuttleContentStats {
+	return m.contentStats.lastReport(handle, contID)
+}
+
+func (m *manager) handleRpcContentStats(ctx context.Context, handle string, param *rpcevent.ContentStats) error {
+	if param.Content == 0 {
+		return fmt.Errorf("received content stats with no content")
+	}
+	m.contentStats.deliver(handle, param)
+	return nil
+}
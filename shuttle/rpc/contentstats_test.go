@@ -0,0 +1,50 @@
+package rpc
+
+import (
+	"testing"
+
+	rpcevent "github.com/application-research/estuary/shuttle/rpc/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentStatsReplies(t *testing.T) {
+	r, err := newContentStatsReplies()
+	assert.NoError(t, err)
+
+	first, unregisterFirst := r.await("shuttle", 1)
+	defer unregisterFirst()
+	second, unregisterSecond := r.await("shuttle", 1)
+	other, unregisterOther := r.await("other", 1)
+
+	// a query that gave up isn't acked
+	unregisterSecond()
+
+	r.deliver("shuttle", &rpcevent.ContentStats{Content: 1, Blocks: 3, Size: 300, MissingBlocks: 1})
+
+	select {
+	case stats := <-first:
+		assert.Equal(t, int64(3), stats.Blocks)
+	default:
+		t.Fatal("waiting query was not acked")
+	}
+	assert.Empty(t, second)
+	assert.Empty(t, other, "reports are matched by shuttle")
+
+	last := r.lastReport("shuttle", 1)
+	if assert.NotNil(t, last) {
+		assert.Equal(t, int64(300), last.Size)
+		assert.Equal(t, int64(1), last.MissingBlocks)
+	}
+	assert.Nil(t, r.lastReport("other", 1))
+
+	// failed lookups are acked but not stored
+	r.deliver("other", &rpcevent.ContentStats{Content: 1, ErrMsg: "no pin"})
+	stats := <-other
+	assert.Equal(t, "no pin", stats.ErrMsg)
+	assert.Nil(t, r.lastReport("other", 1))
+	unregisterOther()
+
+	r.lk.Lock()
+	assert.Empty(t, r.waiters)
+	r.lk.Unlock()
+}
@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	rpcevent "github.com/application-research/estuary/shuttle/rpc/event"
+	"github.com/application-research/estuary/util"
+)
+
+var ErrInvalidQueueSize = fmt.Errorf("invalid command queue size")
+
+// how many times the configured size a shuttle's command queue may grow to,
+// through the shuttle's hello or a boost
+const maxQueueGrowth = 16
+
+// cmdQueue holds the commands waiting to be written to a shuttle, it is
+// replaced as a whole when the queue is resized
+type cmdQueue struct {
+	cmds       chan *rpcevent.Command
+	urgentCmds chan *rpcevent.Command
+	// closed once the queue is replaced, which wakes up the senders and the
+	// write loop waiting on it
+	replaced chan struct{}
+	// senders that took the queue and may still put commands into it
+	senders sync.WaitGroup
+}
+
+func newCmdQueue(size int) *cmdQueue {
+	return &cmdQueue{
+		cmds:       make(chan *rpcevent.Command, size),
+		urgentCmds: make(chan *rpcevent.Command, size),
+		replaced:   make(chan struct{}),
+	}
+}
+
+// BoostQueue grows the command queue to size for at least d, so that a burst
+// of commands, like bulk onboarding to the shuttle, doesn't block its senders.
+// Pending commands are carried over to the larger queue. Once d has passed and
+// what is pending fits into the default size again, the queue shrinks back.
+// Boosting a boosted queue extends the boost and never shrinks it.
+func (sc *Connection) BoostQueue(size int, d time.Duration) error {
+	if sc.Ctx.Err() != nil {
+		return ErrNoShuttleConnection
+	}
+	if d <= 0 {
+		return fmt.Errorf("invalid boost duration %s", d)
+	}
+
+	sc.queueLk.Lock()
+	defer sc.queueLk.Unlock()
+
+	if size <= sc.defaultQueueSize {
+		return fmt.Errorf("%w: %d is not larger than the default of %d", ErrInvalidQueueSize, size, sc.defaultQueueSize)
+	}
+
+	if until := time.Now().Add(d); until.After(sc.boostedUntil) {
+		expired := make(chan struct{})
+		time.AfterFunc(d, func() { close(expired) })
+		sc.boostedUntil = until
+		sc.boostExpired = expired
+	}
+	if size > cap(sc.queue.cmds) {
+		sc.replaceQueue(size)
+	}
+	return nil
+}
+
+// sendQueue returns the queue for a sender, which has to mark itself done on
+// the queue's senders once it stopped sending to it
+func (sc *Connection) sendQueue() *cmdQueue {
+	sc.queueLk.Lock()
+	defer sc.queueLk.Unlock()
+
+	sc.queue.senders.Add(1)
+	return sc.queue
+}
+
+// writeQueue returns the queue for the write loop, shrinking a boosted queue
+// back if the boost is over and the burst subsided. While the queue is
+// boosted, it also returns a channel closed once the boost is over.
+func (sc *Connection) writeQueue(now time.Time) (*cmdQueue, <-chan struct{}) {
+	sc.queueLk.Lock()
+	defer sc.queueLk.Unlock()
+
+	if sc.boostedUntil.IsZero() {
+		return sc.queue, nil
+	}
+	if now.Before(sc.boostedUntil) {
+		return sc.queue, sc.boostExpired
+	}
+
+	// the write loop comes back here with every command it takes, until what
+	// is pending fits into the default size
+	if len(sc.queue.cmds) <= sc.defaultQueueSize && len(sc.queue.urgentCmds) <= sc.defaultQueueSize {
+		sc.boostedUntil = time.Time{}
+		sc.boostExpired = nil
+		sc.replaceQueue(sc.defaultQueueSize)
+	}
+	return sc.queue, nil
+}
+
+// replaceQueue replaces the queue with one of size, moving the pending
+// commands over. The queue lock must be held.
+func (sc *Connection) replaceQueue(size int) {
+	old := sc.queue
+	q := newCmdQueue(size)
+	moveCommands(old.cmds, q.cmds)
+	moveCommands(old.urgentCmds, q.urgentCmds)
+	sc.queue = q
+	close(old.replaced)
+
+	// senders that took the old queue before it was replaced may still put
+	// commands into it, requeue those once all of them are done
+	go func() {
+		old.senders.Wait()
+		sc.requeue(old.cmds, rpcevent.PriorityNormal)
+		sc.requeue(old.urgentCmds, rpcevent.PriorityHigh)
+	}()
+}
+
+// moveCommands moves pending commands as long as the new queue has room for
+// them, what is left is requeued by replaceQueue
+func moveCommands(from chan *rpcevent.Command, to chan *rpcevent.Command) {
+	for len(to) < cap(to) {
+		select {
+		case cmd := <-from:
+			to <- cmd
+		default:
+			return
+		}
+	}
+}
+
+func (sc *Connection) requeue(cmds chan *rpcevent.Command, priority rpcevent.Priority) {
+	for {
+		select {
+		case cmd := <-cmds:
+			// SendMessage tracks it again
+			sc.trackPending(cmd, priority >= rpcevent.PriorityHigh, -1)
+			// only fails once the connection is closed, which drops all of its commands
+			if err := sc.SendMessage(context.Background(), cmd, priority); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// trackPending counts a command of the queue in or out of the pending ops
+func (sc *Connection) trackPending(cmd *rpcevent.Command, urgent bool, delta int) {
+	sc.pendingLk.Lock()
+	defer sc.pendingLk.Unlock()
+
+	ops := sc.pendingOps
+	if urgent {
+		ops = sc.pendingUrgent
+	}
+	// a command can be taken before its sender got to count it in, so a
+	// count may briefly go below zero
+	ops[cmd.Op] += delta
+	if ops[cmd.Op] == 0 {
+		delete(ops, cmd.Op)
+	}
+}
+
+// PeekQueue returns a snapshot of the commands waiting to be written to the
+// shuttle, counted by op, without taking them off the queue. Senders still
+// waiting for room in a full queue aren't counted.
+func (sc *Connection) PeekQueue() *util.ShuttleQueueSnapshot {
+	sc.queueLk.Lock()
+	snap := &util.ShuttleQueueSnapshot{
+		Handle:        sc.Handle,
+		Size:          cap(sc.queue.cmds),
+		DefaultSize:   sc.defaultQueueSize,
+		Pending:       len(sc.queue.cmds),
+		UrgentPending: len(sc.queue.urgentCmds),
+	}
+	if !sc.boostedUntil.IsZero() {
+		until := sc.boostedUntil
+		snap.BoostedUntil = &until
+	}
+	sc.queueLk.Unlock()
+
+	sc.pendingLk.Lock()
+	defer sc.pendingLk.Unlock()
+
+	snap.Ops = make(map[string]int, len(sc.pendingOps))
+	for op, n := range sc.pendingOps {
+		if n > 0 {
+			snap.Ops[op] = n
+		}
+	}
+	snap.UrgentOps = make(map[string]int, len(sc.pendingUrgent))
+	for op, n := range sc.pendingUrgent {
+		if n > 0 {
+			snap.UrgentOps[op] = n
+		}
+	}
+	return snap
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,7 +14,10 @@ import (
 	rpcevent "github.com/application-research/estuary/shuttle/rpc/event"
 	"github.com/application-research/estuary/shuttle/rpc/types"
 	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
 	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 	gwebsocket "golang.org/x/net/websocket"
 
 	"github.com/application-research/estuary/config"
@@ -23,31 +28,159 @@ import (
 
 var ErrNoShuttleConnection = fmt.Errorf("no connection to requested shuttle")
 
+var (
+	ErrInvalidHostname = fmt.Errorf("shuttle hello has an invalid hostname")
+	ErrInvalidAddrInfo = fmt.Errorf("shuttle hello has invalid addr info")
+	ErrUndialable      = fmt.Errorf("shuttle hello has addr info that can't be dialed")
+	ErrInvalidAddress  = fmt.Errorf("shuttle hello has an invalid filecoin address")
+	ErrPeerIDConflict  = fmt.Errorf("shuttle handle is registered with another peer id")
+)
+
+// validateHello checks a shuttle's hello before it is registered, so a broken
+// shuttle never enters the live set
+func validateHello(hello rpcevent.Hello) error {
+	if hello.Host == "" {
+		return fmt.Errorf("%w: hostname is empty", ErrInvalidHostname)
+	}
+	// shuttles usually advertise a bare hostname, served over https
+	hostURL := hello.Host
+	if !strings.Contains(hostURL, "://") {
+		hostURL = "https://" + hostURL
+	}
+	u, err := url.Parse(hostURL)
+	if err != nil {
+		return fmt.Errorf("%w %q: %s", ErrInvalidHostname, hello.Host, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w %q: scheme must be http or https", ErrInvalidHostname, hello.Host)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w %q: no host", ErrInvalidHostname, hello.Host)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("%w %q: must only be a host", ErrInvalidHostname, hello.Host)
+	}
+
+	if err := hello.AddrInfo.ID.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAddrInfo, err)
+	}
+	if hello.PeerID != "" && hello.PeerID != hello.AddrInfo.ID.String() {
+		return fmt.Errorf("%w: peer id %s does not match addr info id %s", ErrInvalidAddrInfo, hello.PeerID, hello.AddrInfo.ID)
+	}
+	if len(hello.AddrInfo.Addrs) == 0 {
+		return fmt.Errorf("%w: no addresses to dial %s on", ErrInvalidAddrInfo, hello.AddrInfo.ID)
+	}
+
+	if hello.Address == address.Undef {
+		return fmt.Errorf("%w: address is undefined", ErrInvalidAddress)
+	}
+	return nil
+}
+
+// dialHello checks that the shuttle can be dialed on the addresses of its hello, the connection is then reused
+// to identify it
+func (m *manager) dialHello(ctx context.Context, ai peer.AddrInfo) error {
+	if m.host == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, helloDialTimeout)
+	defer cancel()
+
+	if err := m.host.Connect(ctx, ai); err != nil {
+		return fmt.Errorf("%w: %s", ErrUndialable, err)
+	}
+	return nil
+}
+
+// checkPeerID rejects a shuttle connecting with a peer id other than the one last recorded for its handle, which
+// means two shuttle processes share the handle. A shuttle whose identity legitimately changed has to have the
+// peer id of its shuttles row cleared first.
+func checkPeerID(db *gorm.DB, handle string, id peer.ID) error {
+	var shuttles []model.Shuttle
+	if err := db.Find(&shuttles, "handle = ?", handle).Error; err != nil {
+		return err
+	}
+	if len(shuttles) == 0 || shuttles[0].PeerID == "" {
+		return nil
+	}
+	if known := shuttles[0].PeerID; known != id.String() {
+		return fmt.Errorf("%w: connected as %s but last known as %s, check that no other shuttle uses handle %s", ErrPeerIDConflict, id, known, handle)
+	}
+	return nil
+}
+
+// high priority commands written in a row before a waiting normal priority
+// command gets its turn, so that a steady stream of urgent commands can't
+// starve bulk ones
+const maxUrgentStreak = 8
+
 type Connection struct {
 	Handle string
 	Ctx    context.Context
-	cmds   chan *rpcevent.Command
+	cancel context.CancelFunc
+
+	queueLk sync.Mutex
+	queue   *cmdQueue
+	// size the queue returns to after a boost
+	defaultQueueSize int
+	// when a boosted queue may shrink back, zero if it isn't boosted
+	boostedUntil time.Time
+	// closed once boostedUntil has passed
+	boostExpired chan struct{}
+
+	// ops of the commands buffered in the queue, which can't be read from the
+	// channels without taking the commands
+	pendingLk     sync.Mutex
+	pendingOps    map[string]int
+	pendingUrgent map[string]int
+
+	// high priority commands taken in a row, only used by the write loop
+	urgentStreak int
+}
+
+func newConnection(handle string, outgoingQueueSize int) *Connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Connection{
+		Handle:           handle,
+		Ctx:              ctx,
+		cancel:           cancel,
+		queue:            newCmdQueue(outgoingQueueSize),
+		defaultQueueSize: outgoingQueueSize,
+		pendingOps:       make(map[string]int),
+		pendingUrgent:    make(map[string]int),
+	}
 }
 
 type IEstuaryRpcEngine interface {
 	Connect(c echo.Context, handle string, done chan struct{}) error
 	GetShuttleConnection(handle string) (*Connection, bool)
+	BoostQueue(handle string, size int, d time.Duration) error
+	PeekQueue(handle string) (*util.ShuttleQueueSnapshot, error)
 }
 
+// how long identifying a newly connected shuttle may take
+const identifyTimeout = 30 * time.Second
+
+// how long dialing the addresses of a shuttle's hello may take before it is rejected
+const helloDialTimeout = 30 * time.Second
+
 type manager struct {
 	db           *gorm.DB
 	cfg          *config.Estuary
 	log          *zap.SugaredLogger
+	host         host.Host
 	shuttlesLk   sync.Mutex
 	shuttles     map[string]*Connection
 	rpcWebsocket chan *rpcevent.Message
 }
 
-func NewEstuaryRpcEngine(ctx context.Context, db *gorm.DB, cfg *config.Estuary, log *zap.SugaredLogger, handlerFn types.MessageHandlerFn) IEstuaryRpcEngine {
+func NewEstuaryRpcEngine(ctx context.Context, db *gorm.DB, cfg *config.Estuary, log *zap.SugaredLogger, h host.Host, handlerFn types.MessageHandlerFn) IEstuaryRpcEngine {
 	wbsMgr := &manager{
 		db:           db,
 		cfg:          cfg,
 		log:          log,
+		host:         h,
 		shuttles:     make(map[string]*Connection, 0),
 		rpcWebsocket: make(chan *rpcevent.Message, cfg.RpcEngine.Websocket.IncomingQueueSize),
 	}
@@ -73,9 +206,19 @@ func (m *manager) Connect(c echo.Context, handle string, done chan struct{}) err
 			return
 		}
 
-		if _, err := url.Parse(hello.Host); err != nil {
-			m.log.Errorf("shuttle had invalid hostname %q: %s", hello.Host, err)
-			hello.Host = ""
+		if err := validateHello(hello); err != nil {
+			m.log.Errorf("rejecting shuttle %s: %s", handle, err)
+			return
+		}
+
+		if err := m.dialHello(ws.Request().Context(), hello.AddrInfo); err != nil {
+			m.log.Errorf("rejecting shuttle %s: %s", handle, err)
+			return
+		}
+
+		if err := checkPeerID(m.db, handle, hello.AddrInfo.ID); err != nil {
+			m.log.Errorf("rejecting shuttle %s: %s", handle, err)
+			return
 		}
 
 		s := &model.ShuttleConnection{
@@ -105,20 +248,17 @@ func (m *manager) Connect(c echo.Context, handle string, done chan struct{}) err
 			return
 		}
 
-		ctx, cancel := context.WithCancel(context.Background())
-
-		sc := &Connection{
-			cmds: make(chan *rpcevent.Command, m.cfg.RpcEngine.Websocket.OutgoingQueueSize),
-			Ctx:  ctx,
-		}
+		sc := newConnection(handle, m.queueSize(hello.CommandQueueSize))
 
 		m.shuttlesLk.Lock()
 		m.shuttles[handle] = sc
 		m.shuttlesLk.Unlock()
 
+		go m.identifyShuttle(sc.Ctx, handle, hello.AddrInfo)
+
 		// clean up on exit
 		defer func() {
-			cancel()
+			sc.Close()
 			m.shuttlesLk.Lock()
 			outd, ok := m.shuttles[handle]
 			if ok {
@@ -131,24 +271,12 @@ func (m *manager) Connect(c echo.Context, handle string, done chan struct{}) err
 
 		// write to shuttles
 		go func() {
-			for {
-				select {
-				case msg := <-sc.cmds:
-					go func() {
-						msgBytes, err := json.Marshal(msg)
-						if err != nil {
-							m.log.Errorf("failed to serialize message: %s", err)
-							return
-						}
-
-						if err = gwebsocket.Message.Send(ws, msgBytes); err != nil {
-							m.log.Errorf("failed to write command to shuttle: %s", err)
-							return
-						}
-					}()
-				case <-done:
-					return
-				}
+			if err := sc.writeCommands(done, func(msgBytes []byte) error {
+				return gwebsocket.Message.Send(ws, msgBytes)
+			}, m.log); err != nil {
+				m.log.Errorf("failed to write command to shuttle %s: %s", handle, err)
+				// ends the read loop, which unregisters the shuttle
+				ws.Close()
 			}
 		}()
 
@@ -180,15 +308,185 @@ func (m *manager) Connect(c echo.Context, handle string, done chan struct{}) err
 	return nil
 }
 
-func (sc *Connection) SendMessage(ctx context.Context, cmd *rpcevent.Command) error {
+// identifyShuttle dials the shuttle and records the agent version and protocols it reported through identify,
+// so version skew across shuttles can be spotted
+func (m *manager) identifyShuttle(ctx context.Context, handle string, ai peer.AddrInfo) {
+	if m.host == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, identifyTimeout)
+	defer cancel()
+
+	// Connect waits for identify to finish on new connections
+	if err := m.host.Connect(ctx, ai); err != nil {
+		m.log.Warnf("failed to dial shuttle %s for identify: %s", handle, err)
+		return
+	}
+
+	var agentVersion string
+	if av, err := m.host.Peerstore().Get(ai.ID, "AgentVersion"); err == nil {
+		agentVersion, _ = av.(string)
+	}
+
+	protocols, err := m.host.Peerstore().GetProtocols(ai.ID)
+	if err != nil {
+		m.log.Warnf("failed to get protocols of shuttle %s: %s", handle, err)
+	}
+	sort.Strings(protocols)
+
+	if err := m.db.Model(model.ShuttleConnection{}).Where("handle = ?", handle).UpdateColumns(map[string]interface{}{
+		"agent_version": agentVersion,
+		"protocols":     strings.Join(protocols, ","),
+	}).Error; err != nil {
+		m.log.Errorf("failed to record identify info of shuttle %s: %s", handle, err)
+	}
+}
+
+func (sc *Connection) SendMessage(ctx context.Context, cmd *rpcevent.Command, priority rpcevent.Priority) error {
+	// a closed connection must never accept commands, even if there is still room in the queue
+	if sc.Ctx.Err() != nil {
+		return ErrNoShuttleConnection
+	}
+
+	for {
+		sent, err := sc.send(ctx, sc.sendQueue(), cmd, priority)
+		if sent || err != nil {
+			return err
+		}
+		// the queue was replaced while waiting for room, retry on the new one
+	}
+}
+
+func (sc *Connection) send(ctx context.Context, q *cmdQueue, cmd *rpcevent.Command, priority rpcevent.Priority) (bool, error) {
+	defer q.senders.Done()
+
+	urgent := priority >= rpcevent.PriorityHigh
+	cmds := q.cmds
+	if urgent {
+		cmds = q.urgentCmds
+	}
+
 	select {
-	case sc.cmds <- cmd:
-		return nil
+	case cmds <- cmd:
+		sc.trackPending(cmd, urgent, 1)
+		return true, nil
+	case <-q.replaced:
+		return false, nil
 	case <-sc.Ctx.Done():
-		return ErrNoShuttleConnection
+		return false, ErrNoShuttleConnection
 	case <-ctx.Done():
-		return ctx.Err()
+		return false, ctx.Err()
+	}
+}
+
+// nextCommand waits for the next command to write to the shuttle, preferring
+// high priority commands unless maxUrgentStreak of them were just taken while
+// normal ones wait. It returns false once the connection is closed.
+func (sc *Connection) nextCommand(done chan struct{}) (*rpcevent.Command, bool) {
+	for {
+		q, revert := sc.writeQueue(time.Now())
+
+		if sc.urgentStreak < maxUrgentStreak {
+			select {
+			case cmd := <-q.urgentCmds:
+				sc.urgentStreak++
+				sc.trackPending(cmd, true, -1)
+				return cmd, true
+			default:
+			}
+		} else {
+			select {
+			case cmd := <-q.cmds:
+				sc.urgentStreak = 0
+				sc.trackPending(cmd, false, -1)
+				return cmd, true
+			default:
+			}
+		}
+
+		select {
+		case cmd := <-q.urgentCmds:
+			sc.urgentStreak++
+			sc.trackPending(cmd, true, -1)
+			return cmd, true
+		case cmd := <-q.cmds:
+			sc.urgentStreak = 0
+			sc.trackPending(cmd, false, -1)
+			return cmd, true
+		case <-q.replaced:
+		case <-revert:
+		case <-sc.Ctx.Done():
+			return nil, false
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+// writeCommands writes the commands of the queue to the shuttle one at a time, in the order nextCommand picks
+// them, until the connection is closed or a write fails. Commands wait in the queue while a write is in progress,
+// so that urgent ones still get ahead of the others.
+func (sc *Connection) writeCommands(done chan struct{}, write func(msgBytes []byte) error, log *zap.SugaredLogger) error {
+	for {
+		msg, ok := sc.nextCommand(done)
+		if !ok {
+			return nil
+		}
+
+		msgBytes, err := json.Marshal(msg)
+		if err != nil {
+			log.Errorf("failed to serialize message: %s", err)
+			continue
+		}
+
+		if err := write(msgBytes); err != nil {
+			return err
+		}
+	}
+}
+
+// Close marks the connection as closed, which stops its write loop and makes any pending
+// or future SendMessage call return ErrNoShuttleConnection. It is safe to call more than once.
+func (sc *Connection) Close() {
+	sc.cancel()
+}
+
+// BoostQueue grows the command queue of a connected shuttle to size for at least d, see Connection.BoostQueue
+func (m *manager) BoostQueue(handle string, size int, d time.Duration) error {
+	if max := m.cfg.RpcEngine.Websocket.OutgoingQueueSize * maxQueueGrowth; size > max {
+		return fmt.Errorf("%w: %d is over the limit of %d", ErrInvalidQueueSize, size, max)
+	}
+
+	sc, ok := m.GetShuttleConnection(handle)
+	if !ok {
+		return ErrNoShuttleConnection
+	}
+	return sc.BoostQueue(size, d)
+}
+
+// PeekQueue returns what is queued for a connected shuttle, see Connection.PeekQueue
+func (m *manager) PeekQueue(handle string) (*util.ShuttleQueueSnapshot, error) {
+	sc, ok := m.GetShuttleConnection(handle)
+	if !ok {
+		return nil, ErrNoShuttleConnection
+	}
+	return sc.PeekQueue(), nil
+}
+
+// queueSize is the size of the command queue of a shuttle asking for hinted
+// commands to be queued, the hint can't shrink the queue below the configured
+// size nor grow it past its limit
+func (m *manager) queueSize(hinted int) int {
+	size := m.cfg.RpcEngine.Websocket.OutgoingQueueSize
+	if hinted <= size {
+		return size
+	}
+	if max := size * maxQueueGrowth; hinted > max {
+		m.log.Warnf("shuttle asked for a command queue of %d, limiting it to %d", hinted, max)
+		return max
 	}
+	return hinted
 }
 
 func (m *manager) GetShuttleConnection(handle string) (*Connection, bool) {
@@ -0,0 +1,428 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/model"
+	rpcevent "github.com/application-research/estuary/shuttle/rpc/event"
+	"github.com/filecoin-project/go-address"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestSendMessageRacingClose(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		// nothing reads from the unbuffered queue, so the send can only finish through Close
+		sc := newConnection("shuttle", 0)
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- sc.SendMessage(context.Background(), &rpcevent.Command{Op: rpcevent.CMD_UnpinContent}, rpcevent.PriorityNormal)
+		}()
+		sc.Close()
+
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, ErrNoShuttleConnection)
+		case <-time.After(5 * time.Second):
+			t.Fatal("SendMessage did not return after Close")
+		}
+	}
+}
+
+func TestSendMessageAfterClose(t *testing.T) {
+	sc := newConnection("shuttle", 10)
+	sc.Close()
+	sc.Close()
+
+	err := sc.SendMessage(context.Background(), &rpcevent.Command{Op: rpcevent.CMD_UnpinContent}, rpcevent.PriorityNormal)
+	assert.ErrorIs(t, err, ErrNoShuttleConnection)
+	assert.Len(t, sc.queue.cmds, 0)
+}
+
+func TestNextCommandPriority(t *testing.T) {
+	sc := newConnection("shuttle", 20)
+	done := make(chan struct{})
+
+	send := func(op string, priority rpcevent.Priority) {
+		assert.NoError(t, sc.SendMessage(context.Background(), &rpcevent.Command{Op: op}, priority))
+	}
+
+	send(rpcevent.CMD_AddPin, rpcevent.PriorityNormal)
+	send(rpcevent.CMD_AddPin, rpcevent.PriorityNormal)
+	for i := 0; i < maxUrgentStreak+2; i++ {
+		send(rpcevent.CMD_CancelTransfer, rpcevent.PriorityHigh)
+	}
+
+	var ops []string
+	for i := 0; i < maxUrgentStreak+4; i++ {
+		cmd, ok := sc.nextCommand(done)
+		assert.True(t, ok)
+		ops = append(ops, cmd.Op)
+	}
+
+	// urgent commands jump the queue, but a waiting normal command gets its
+	// turn after a streak of them
+	var expected []string
+	for i := 0; i < maxUrgentStreak; i++ {
+		expected = append(expected, rpcevent.CMD_CancelTransfer)
+	}
+	expected = append(expected, rpcevent.CMD_AddPin, rpcevent.CMD_CancelTransfer, rpcevent.CMD_CancelTransfer, rpcevent.CMD_AddPin)
+	assert.Equal(t, expected, ops)
+
+	sc.Close()
+	_, ok := sc.nextCommand(done)
+	assert.False(t, ok)
+}
+
+// blockingWriter records the ops of the commands written, each write waits
+// until it is released
+type blockingWriter struct {
+	written chan string
+	release chan struct{}
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{written: make(chan string, 16), release: make(chan struct{})}
+}
+
+func (w *blockingWriter) write(msgBytes []byte) error {
+	var cmd rpcevent.Command
+	if err := json.Unmarshal(msgBytes, &cmd); err != nil {
+		return err
+	}
+	w.written <- cmd.Op
+	<-w.release
+	return nil
+}
+
+func (w *blockingWriter) next(t *testing.T) string {
+	select {
+	case op := <-w.written:
+		return op
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command was written")
+		return ""
+	}
+}
+
+func TestWriteCommands(t *testing.T) {
+	sc := newConnection("shuttle", 4)
+	done := make(chan struct{})
+	w := newBlockingWriter()
+
+	send := func(op string, priority rpcevent.Priority) {
+		assert.NoError(t, sc.SendMessage(context.Background(), &rpcevent.Command{Op: op}, priority))
+	}
+
+	send(rpcevent.CMD_AddPin, rpcevent.PriorityNormal)
+	written := make(chan error, 1)
+	go func() {
+		written <- sc.writeCommands(done, w.write, zap.NewNop().Sugar())
+	}()
+	assert.Equal(t, rpcevent.CMD_AddPin, w.next(t))
+
+	// queued behind the write in progress, the urgent command goes first
+	send(rpcevent.CMD_UnpinContent, rpcevent.PriorityNormal)
+	send(rpcevent.CMD_CancelTransfer, rpcevent.PriorityHigh)
+
+	w.release <- struct{}{}
+	assert.Equal(t, rpcevent.CMD_CancelTransfer, w.next(t))
+	w.release <- struct{}{}
+	assert.Equal(t, rpcevent.CMD_UnpinContent, w.next(t))
+	w.release <- struct{}{}
+
+	sc.Close()
+	select {
+	case err := <-written:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeCommands did not return after the connection was closed")
+	}
+}
+
+func TestValidateHello(t *testing.T) {
+	pid, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	maddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/6745")
+	assert.NoError(t, err)
+	addr, err := address.NewIDAddress(1000)
+	assert.NoError(t, err)
+
+	valid := func() rpcevent.Hello {
+		return rpcevent.Hello{
+			Host:     "shuttle-1.example.com",
+			PeerID:   pid.String(),
+			Address:  addr,
+			AddrInfo: peer.AddrInfo{ID: pid, Addrs: []multiaddr.Multiaddr{maddr}},
+		}
+	}
+	assert.NoError(t, validateHello(valid()))
+
+	hello := valid()
+	hello.Host = ""
+	assert.ErrorIs(t, validateHello(hello), ErrInvalidHostname)
+
+	hello = valid()
+	hello.Host = "http://shuttle 1"
+	assert.ErrorIs(t, validateHello(hello), ErrInvalidHostname)
+
+	hello = valid()
+	hello.Host = "https://shuttle-1.example.com"
+	assert.NoError(t, validateHello(hello))
+
+	for _, bad := range []string{"ftp://shuttle-1.example.com", "https://", "shuttle-1.example.com/gw", "https://user@shuttle-1.example.com"} {
+		hello = valid()
+		hello.Host = bad
+		assert.ErrorIs(t, validateHello(hello), ErrInvalidHostname, bad)
+	}
+
+	hello = valid()
+	hello.AddrInfo.ID = ""
+	assert.ErrorIs(t, validateHello(hello), ErrInvalidAddrInfo)
+
+	hello = valid()
+	hello.PeerID = "12D3KooWBogus"
+	assert.ErrorIs(t, validateHello(hello), ErrInvalidAddrInfo)
+
+	hello = valid()
+	hello.AddrInfo.Addrs = nil
+	assert.ErrorIs(t, validateHello(hello), ErrInvalidAddrInfo)
+
+	hello = valid()
+	hello.Address = address.Undef
+	assert.ErrorIs(t, validateHello(hello), ErrInvalidAddress)
+}
+
+func TestDialHello(t *testing.T) {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	assert.NoError(t, err)
+	defer h.Close()
+	shuttle, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	assert.NoError(t, err)
+	defer shuttle.Close()
+
+	m := &manager{host: h}
+	ctx := context.Background()
+	assert.NoError(t, m.dialHello(ctx, peer.AddrInfo{ID: shuttle.ID(), Addrs: shuttle.Addrs()}))
+
+	// nothing listens there
+	closed, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	assert.NoError(t, err)
+	other, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, m.dialHello(ctx, peer.AddrInfo{ID: other, Addrs: []multiaddr.Multiaddr{closed}}), ErrUndialable)
+}
+
+func TestCheckPeerID(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, db.AutoMigrate(&model.Shuttle{}))
+
+	first, err := peer.Decode("12D3KooWGKJv5cv2FTZmuHsSqDPkPDf6WT2ErqtUoV5ch7PcSnuv")
+	assert.NoError(t, err)
+	second, err := peer.Decode("12D3KooWBnmsaeNRP6SCdNbhzaNHihQQBPDhmDvjVGsR1EbswncV")
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Create(&model.Shuttle{Handle: "shuttle-1"}).Error)
+
+	// the first connection records the peer id
+	assert.NoError(t, checkPeerID(db, "shuttle-1", first))
+	assert.NoError(t, db.Model(model.Shuttle{}).Where("handle = ?", "shuttle-1").UpdateColumn("peer_id", first.String()).Error)
+
+	// reconnecting as the same peer is fine, another process with the same handle is not
+	assert.NoError(t, checkPeerID(db, "shuttle-1", first))
+	assert.ErrorIs(t, checkPeerID(db, "shuttle-1", second), ErrPeerIDConflict)
+
+	// once the recorded peer id is cleared, the new one is accepted
+	assert.NoError(t, db.Model(model.Shuttle{}).Where("handle = ?", "shuttle-1").UpdateColumn("peer_id", "").Error)
+	assert.NoError(t, checkPeerID(db, "shuttle-1", second))
+}
+
+func TestBoostQueue(t *testing.T) {
+	sc := newConnection("shuttle", 2)
+	done := make(chan struct{})
+
+	send := func(handle string) error {
+		return sc.SendMessage(context.Background(), &rpcevent.Command{Op: rpcevent.CMD_AddPin, Handle: handle}, rpcevent.PriorityNormal)
+	}
+
+	assert.NoError(t, send("1"))
+	assert.NoError(t, send("2"))
+
+	// the queue is full, so this sender waits until the queue is boosted
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- send("3")
+	}()
+
+	assert.ErrorIs(t, sc.BoostQueue(2, time.Hour), ErrInvalidQueueSize)
+	assert.NoError(t, sc.BoostQueue(4, time.Hour))
+	select {
+	case err := <-blocked:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendMessage did not return after the queue was boosted")
+	}
+	assert.NoError(t, send("4"))
+
+	// the burst hasn't subsided yet, so the boost outlasts its duration
+	q, _ := sc.writeQueue(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, 4, cap(q.cmds))
+
+	// no command is lost while the queue is replaced
+	var handles []string
+	for i := 0; i < 4; i++ {
+		cmd, ok := sc.nextCommand(done)
+		assert.True(t, ok)
+		handles = append(handles, cmd.Handle)
+	}
+	assert.ElementsMatch(t, []string{"1", "2", "3", "4"}, handles)
+
+	q, _ = sc.writeQueue(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, 2, cap(q.cmds))
+
+	sc.Close()
+	assert.ErrorIs(t, sc.BoostQueue(4, time.Hour), ErrNoShuttleConnection)
+}
+
+func TestWriteCommandsAfterBoost(t *testing.T) {
+	sc := newConnection("shuttle", 2)
+	done := make(chan struct{})
+	w := newBlockingWriter()
+
+	send := func(handle string, priority rpcevent.Priority) error {
+		return sc.SendMessage(context.Background(), &rpcevent.Command{Op: rpcevent.CMD_AddPin, Handle: handle}, priority)
+	}
+
+	assert.NoError(t, send("1", rpcevent.PriorityNormal))
+	go sc.writeCommands(done, func(msgBytes []byte) error {
+		var cmd rpcevent.Command
+		if err := json.Unmarshal(msgBytes, &cmd); err != nil {
+			return err
+		}
+		w.written <- cmd.Handle
+		<-w.release
+		return nil
+	}, zap.NewNop().Sugar())
+	defer sc.Close()
+	assert.Equal(t, "1", w.next(t))
+
+	// the write in progress holds the queue up until it is full
+	assert.NoError(t, send("2", rpcevent.PriorityNormal))
+	assert.NoError(t, send("3", rpcevent.PriorityNormal))
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- send("4", rpcevent.PriorityNormal)
+	}()
+
+	assert.NoError(t, sc.BoostQueue(4, time.Hour))
+	select {
+	case err := <-blocked:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendMessage did not return after the queue was boosted")
+	}
+
+	// the boosted queue still puts an urgent command ahead of the waiting ones
+	assert.NoError(t, send("urgent", rpcevent.PriorityHigh))
+
+	var handles []string
+	for i := 0; i < 4; i++ {
+		w.release <- struct{}{}
+		handles = append(handles, w.next(t))
+	}
+	assert.Equal(t, "urgent", handles[0])
+	assert.ElementsMatch(t, []string{"2", "3", "4"}, handles[1:])
+	w.release <- struct{}{}
+}
+
+func TestPeekQueue(t *testing.T) {
+	sc := newConnection("shuttle", 2)
+	done := make(chan struct{})
+
+	send := func(op string, priority rpcevent.Priority) {
+		assert.NoError(t, sc.SendMessage(context.Background(), &rpcevent.Command{Op: op}, priority))
+	}
+
+	send(rpcevent.CMD_AddPin, rpcevent.PriorityNormal)
+	send(rpcevent.CMD_AddPin, rpcevent.PriorityNormal)
+	send(rpcevent.CMD_CancelTransfer, rpcevent.PriorityHigh)
+
+	snap := sc.PeekQueue()
+	assert.Equal(t, 2, snap.Size)
+	assert.Equal(t, 2, snap.Pending)
+	assert.Equal(t, 1, snap.UrgentPending)
+	assert.Equal(t, map[string]int{rpcevent.CMD_AddPin: 2}, snap.Ops)
+	assert.Equal(t, map[string]int{rpcevent.CMD_CancelTransfer: 1}, snap.UrgentOps)
+	assert.Nil(t, snap.BoostedUntil)
+
+	// peeking takes nothing off the queue
+	cmd, ok := sc.nextCommand(done)
+	assert.True(t, ok)
+	assert.Equal(t, rpcevent.CMD_CancelTransfer, cmd.Op)
+
+	// pending commands are still counted once the queue is replaced
+	assert.NoError(t, sc.BoostQueue(4, time.Hour))
+	send(rpcevent.CMD_UnpinContent, rpcevent.PriorityNormal)
+
+	snap = sc.PeekQueue()
+	assert.Equal(t, 4, snap.Size)
+	assert.Equal(t, 2, snap.DefaultSize)
+	assert.NotNil(t, snap.BoostedUntil)
+	assert.Equal(t, 3, snap.Pending)
+	assert.Equal(t, map[string]int{rpcevent.CMD_AddPin: 2, rpcevent.CMD_UnpinContent: 1}, snap.Ops)
+	assert.Empty(t, snap.UrgentOps)
+}
+
+func TestPeekQueueWhileWriting(t *testing.T) {
+	sc := newConnection("shuttle", 4)
+	done := make(chan struct{})
+	w := newBlockingWriter()
+
+	send := func(op string, priority rpcevent.Priority) {
+		assert.NoError(t, sc.SendMessage(context.Background(), &rpcevent.Command{Op: op}, priority))
+	}
+
+	send(rpcevent.CMD_AddPin, rpcevent.PriorityNormal)
+	go sc.writeCommands(done, w.write, zap.NewNop().Sugar())
+	defer sc.Close()
+	assert.Equal(t, rpcevent.CMD_AddPin, w.next(t))
+
+	// a slow shuttle backs the queue up, which the snapshot shows
+	send(rpcevent.CMD_AddPin, rpcevent.PriorityNormal)
+	send(rpcevent.CMD_AddPin, rpcevent.PriorityNormal)
+	send(rpcevent.CMD_CancelTransfer, rpcevent.PriorityHigh)
+
+	snap := sc.PeekQueue()
+	assert.Equal(t, 2, snap.Pending)
+	assert.Equal(t, 1, snap.UrgentPending)
+	assert.Equal(t, map[string]int{rpcevent.CMD_AddPin: 2}, snap.Ops)
+	assert.Equal(t, map[string]int{rpcevent.CMD_CancelTransfer: 1}, snap.UrgentOps)
+
+	// and shrinks as the commands are written
+	w.release <- struct{}{}
+	assert.Equal(t, rpcevent.CMD_CancelTransfer, w.next(t))
+	snap = sc.PeekQueue()
+	assert.Equal(t, 2, snap.Pending)
+	assert.Equal(t, 0, snap.UrgentPending)
+	assert.Empty(t, snap.UrgentOps)
+
+	for i := 0; i < 2; i++ {
+		w.release <- struct{}{}
+		assert.Equal(t, rpcevent.CMD_AddPin, w.next(t))
+	}
+	snap = sc.PeekQueue()
+	assert.Equal(t, 0, snap.Pending)
+	assert.Empty(t, snap.Ops)
+	w.release <- struct{}{}
+}
@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/pinner/status"
+	rpcevent "github.com/application-research/estuary/shuttle/rpc/event"
+)
+
+const (
+	// outcomes older than this no longer count towards a shuttle's error rate
+	errorRateWindow = 15 * time.Minute
+	// a shuttle failing more than this fraction of its operations is degraded
+	errorRateThreshold = 0.5
+	// a shuttle is only considered degraded with at least this many outcomes in the window
+	errorRateMinSamples = 10
+)
+
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+// errorRates keeps the pin and transfer outcomes each shuttle reported within the window
+type errorRates struct {
+	lk       sync.Mutex
+	window   time.Duration
+	outcomes map[string][]outcome
+	now      func() time.Time
+}
+
+func newErrorRates(window time.Duration) *errorRates {
+	return &errorRates{
+		window:   window,
+		outcomes: make(map[string][]outcome),
+		now:      time.Now,
+	}
+}
+
+func (er *errorRates) record(handle string, failed bool) {
+	er.lk.Lock()
+	defer er.lk.Unlock()
+
+	now := er.now()
+	er.outcomes[handle] = append(er.expire(handle, now), outcome{at: now, failed: failed})
+}
+
+// rate returns the fraction of failed outcomes of the shuttle within the window, and the amount of outcomes
+func (er *errorRates) rate(handle string) (float64, int) {
+	er.lk.Lock()
+	defer er.lk.Unlock()
+
+	outcomes := er.expire(handle, er.now())
+	if len(outcomes) == 0 {
+		return 0, 0
+	}
+
+	var failed int
+	for _, o := range outcomes {
+		if o.failed {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(outcomes)), len(outcomes)
+}
+
+// expire drops the outcomes of the shuttle that fell out of the window, must be called with lk held
+func (er *errorRates) expire(handle string, now time.Time) []outcome {
+	outcomes := er.outcomes[handle]
+
+	i := 0
+	for i < len(outcomes) && now.Sub(outcomes[i].at) > er.window {
+		i++
+	}
+
+	outcomes = outcomes[i:]
+	if len(outcomes) == 0 {
+		delete(er.outcomes, handle)
+		return nil
+	}
+	er.outcomes[handle] = outcomes
+	return outcomes
+}
+
+// recordOutcomes counts the pin and transfer results reported by a message, progress updates are not outcomes
+func (er *errorRates) recordOutcomes(msg *rpcevent.Message) {
+	switch msg.Op {
+	case rpcevent.OP_UpdatePinStatus:
+		if msg.Params.UpdatePinStatus != nil && msg.Params.UpdatePinStatus.Status == status.PinningStatusFailed {
+			er.record(msg.Handle, true)
+		}
+	case rpcevent.OP_PinComplete:
+		if msg.Params.PinComplete != nil {
+			er.record(msg.Handle, false)
+		}
+	case rpcevent.OP_TransferFinished:
+		if msg.Params.TransferFinished != nil {
+			er.record(msg.Handle, false)
+		}
+	case rpcevent.OP_TransferStatus:
+		er.recordTransferStatus(msg.Handle, msg.Params.TransferStatus)
+	case rpcevent.OP_TransferStatusBatch:
+		if msg.Params.TransferStatusBatch != nil {
+			for _, st := range msg.Params.TransferStatusBatch.Statuses {
+				er.recordTransferStatus(msg.Handle, st)
+			}
+		}
+	}
+}
+
+func (er *errorRates) recordTransferStatus(handle string, st *rpcevent.TransferStatus) {
+	// transfers cancelled on request are not the shuttle's failure
+	if st != nil && st.Failed && !st.Cancelled {
+		er.record(handle, true)
+	}
+}
+
+// ErrorRate returns the fraction of the pin and transfer operations the shuttle reported as failed recently,
+// and the amount of operations it is computed from
+func (m *manager) ErrorRate(handle string) (float64, int) {
+	return m.errorRates.rate(handle)
+}
+
+// Degraded reports whether the shuttle is failing too many of its operations to be preferred for new ones
+func (m *manager) Degraded(handle string) bool {
+	rate, samples := m.errorRates.rate(handle)
+	return samples >= errorRateMinSamples && rate > errorRateThreshold
+}
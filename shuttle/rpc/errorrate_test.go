@@ -0,0 +1,41 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/status"
+	rpcevent "github.com/application-research/estuary/shuttle/rpc/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorRates(t *testing.T) {
+	now := time.Now()
+	er := newErrorRates(time.Minute)
+	er.now = func() time.Time { return now }
+
+	rate, samples := er.rate("shuttle")
+	assert.Equal(t, 0.0, rate)
+	assert.Equal(t, 0, samples)
+
+	er.recordOutcomes(&rpcevent.Message{Op: rpcevent.OP_PinComplete, Handle: "shuttle", Params: rpcevent.MsgParams{PinComplete: &rpcevent.PinComplete{}}})
+	er.recordOutcomes(&rpcevent.Message{Op: rpcevent.OP_UpdatePinStatus, Handle: "shuttle", Params: rpcevent.MsgParams{UpdatePinStatus: &rpcevent.UpdatePinStatus{Status: status.PinningStatusPinning}}})
+	er.recordOutcomes(&rpcevent.Message{Op: rpcevent.OP_UpdatePinStatus, Handle: "shuttle", Params: rpcevent.MsgParams{UpdatePinStatus: &rpcevent.UpdatePinStatus{Status: status.PinningStatusFailed}}})
+	er.recordOutcomes(&rpcevent.Message{Op: rpcevent.OP_TransferStatusBatch, Handle: "shuttle", Params: rpcevent.MsgParams{TransferStatusBatch: &rpcevent.TransferStatusBatch{
+		Statuses: []*rpcevent.TransferStatus{{Failed: true}, {Failed: true, Cancelled: true}, nil},
+	}}})
+
+	rate, samples = er.rate("shuttle")
+	assert.Equal(t, 3, samples, "progress updates and cancellations are not outcomes")
+	assert.InDelta(t, 2.0/3, rate, 0.001)
+
+	rate, samples = er.rate("other")
+	assert.Equal(t, 0.0, rate)
+	assert.Equal(t, 0, samples)
+
+	now = now.Add(2 * time.Minute)
+	er.record("shuttle", false)
+	rate, samples = er.rate("shuttle")
+	assert.Equal(t, 1, samples, "outcomes out of the window are dropped")
+	assert.Equal(t, 0.0, rate)
+}
@@ -12,18 +12,20 @@ import (
 
 // add new shuttle operation topic here, so estaury consumers can be registered for them
 var MessageTopics = map[string]bool{
-	OP_UpdatePinStatus:  true,
-	OP_PinComplete:      true,
-	OP_CommPComplete:    true,
-	OP_CommPFailed:      true,
-	OP_TransferStarted:  true,
-	OP_TransferFinished: true,
-	OP_TransferStatus:   true,
-	OP_ShuttleUpdate:    true,
-	OP_GarbageCheck:     true,
-	OP_SplitComplete:    true,
-	OP_SplitFailed:      true,
-	OP_SanityCheck:      true,
+	OP_UpdatePinStatus:     true,
+	OP_PinComplete:         true,
+	OP_CommPComplete:       true,
+	OP_CommPFailed:         true,
+	OP_TransferStarted:     true,
+	OP_TransferFinished:    true,
+	OP_TransferStatus:      true,
+	OP_TransferStatusBatch: true,
+	OP_ShuttleUpdate:       true,
+	OP_GarbageCheck:        true,
+	OP_SplitComplete:       true,
+	OP_SplitFailed:         true,
+	OP_SanityCheck:         true,
+	OP_ContentStats:        true,
 }
 
 // add new estuary command topic here, so shuttle consumers can be registered for them
@@ -40,8 +42,21 @@ var CommandTopics = map[string]bool{
 	CMD_RetrieveContent:        true,
 	CMD_UnpinContent:           true,
 	CMD_RestartTransfer:        true,
+	CMD_CancelTransfer:         true,
+	CMD_RetryPin:               true,
+	CMD_RequestStorageStats:    true,
+	CMD_RequestContentStats:    true,
 }
 
+// Priority decides which of the commands waiting to be written to a shuttle
+// goes first, high priority commands jump ahead of queued normal ones
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+)
+
 type Hello struct {
 	Host                  string
 	PeerID                string
@@ -51,6 +66,9 @@ type Hello struct {
 	Private               bool
 	ContentAddingDisabled bool
 	QueueEngEnabled       bool
+	// size of the command queue the shuttle asks estuary to keep for it, 0
+	// leaves it to estuary
+	CommandQueueSize int
 }
 
 type Hi struct {
@@ -89,6 +107,10 @@ type CmdParams struct {
 	RetrieveContent        *RetrieveContent        `json:",omitempty"`
 	UnpinContent           *UnpinContent           `json:",omitempty"`
 	RestartTransfer        *RestartTransfer        `json:",omitempty"`
+	CancelTransfer         *CancelTransfer         `json:",omitempty"`
+	RetryPin               *RetryPin               `json:",omitempty"`
+	RequestStorageStats    *RequestStorageStats    `json:",omitempty"`
+	RequestContentStats    *RequestContentStats    `json:",omitempty"`
 }
 
 const CMD_ComputeCommP = "ComputeCommP"
@@ -195,6 +217,36 @@ type RestartTransfer struct {
 	ContentID uint64
 }
 
+const CMD_CancelTransfer = "CancelTransfer"
+
+type CancelTransfer struct {
+	DealDBID uint
+	ChanID   string
+}
+
+const CMD_RetryPin = "RetryPin"
+
+// RetryPin asks the shuttle to pin a content again after its pin failed,
+// the outcome is reported with OP_UpdatePinStatus and OP_PinComplete
+type RetryPin struct {
+	DBID  uint64
+	Peers []*peer.AddrInfo
+}
+
+const CMD_RequestStorageStats = "RequestStorageStats"
+
+// RequestStorageStats asks the shuttle for a fresh storage report, it answers
+// with an OP_ShuttleUpdate
+type RequestStorageStats struct{}
+
+const CMD_RequestContentStats = "RequestContentStats"
+
+// RequestContentStats asks the shuttle which blocks of a content it has in
+// its blockstore, it answers with an OP_ContentStats
+type RequestContentStats struct {
+	Content uint64
+}
+
 type ContentFetch struct {
 	ID     uint64
 	Cid    cid.Cid
@@ -208,18 +260,20 @@ func (m *Message) HasTraceCarrier() bool {
 }
 
 type MsgParams struct {
-	UpdatePinStatus  *UpdatePinStatus           `json:",omitempty"`
-	PinComplete      *PinComplete               `json:",omitempty"`
-	CommPComplete    *CommPComplete             `json:",omitempty"`
-	CommPFailed      *CommPFailed               `json:",omitempty"`
-	TransferStatus   *TransferStatus            `json:",omitempty"`
-	TransferStarted  *TransferStartedOrFinished `json:",omitempty"`
-	TransferFinished *TransferStartedOrFinished `json:",omitempty"`
-	ShuttleUpdate    *ShuttleUpdate             `json:",omitempty"`
-	GarbageCheck     *GarbageCheck              `json:",omitempty"`
-	SplitComplete    *SplitComplete             `json:",omitempty"`
-	SplitFailed      *SplitFailed               `json:",omitempty"`
-	SanityCheck      *SanityCheck               `json:",omitempty"`
+	UpdatePinStatus     *UpdatePinStatus           `json:",omitempty"`
+	PinComplete         *PinComplete               `json:",omitempty"`
+	CommPComplete       *CommPComplete             `json:",omitempty"`
+	CommPFailed         *CommPFailed               `json:",omitempty"`
+	TransferStatus      *TransferStatus            `json:",omitempty"`
+	TransferStatusBatch *TransferStatusBatch       `json:",omitempty"`
+	TransferStarted     *TransferStartedOrFinished `json:",omitempty"`
+	TransferFinished    *TransferStartedOrFinished `json:",omitempty"`
+	ShuttleUpdate       *ShuttleUpdate             `json:",omitempty"`
+	GarbageCheck        *GarbageCheck              `json:",omitempty"`
+	SplitComplete       *SplitComplete             `json:",omitempty"`
+	SplitFailed         *SplitFailed               `json:",omitempty"`
+	SanityCheck         *SanityCheck               `json:",omitempty"`
+	ContentStats        *ContentStats              `json:",omitempty"`
 }
 
 const OP_UpdatePinStatus = "UpdateContentPinStatus"
@@ -275,6 +329,16 @@ type TransferStatus struct {
 	DealDBID uint
 	State    *filclient.ChannelState
 	Failed   bool
+	// set when the transfer was aborted following a CancelTransfer command
+	Cancelled bool
+}
+
+const OP_TransferStatusBatch = "TransferStatusBatch"
+
+// TransferStatusBatch reports the status of many transfers at once, e.g. all
+// the tracked transfers after a shuttle reconnects
+type TransferStatusBatch struct {
+	Statuses []*TransferStatus
 }
 
 const OP_ShuttleUpdate = "ShuttleUpdate"
@@ -284,6 +348,8 @@ type ShuttleUpdate struct {
 	BlockstoreFree uint64
 	NumPins        int64
 	PinQueueSize   int
+	// total size of the active pins
+	PinnedBytes uint64
 }
 
 const OP_GarbageCheck = "GarbageCheck"
@@ -310,3 +376,17 @@ type SanityCheck struct {
 	CID    cid.Cid
 	ErrMsg string
 }
+
+const OP_ContentStats = "ContentStats"
+
+type ContentStats struct {
+	Content uint64
+	// blocks of the content the shuttle has in its blockstore, and their
+	// total size
+	Blocks int64
+	Size   int64
+	// blocks the shuttle has a record of that are missing from its blockstore
+	MissingBlocks int64
+	// set when the shuttle couldn't look the content up, e.g. it doesn't pin it
+	ErrMsg string
+}
@@ -14,6 +14,7 @@ import (
 	transferstatus "github.com/application-research/estuary/deal/transfer/status"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p/core/host"
 
 	"github.com/application-research/estuary/config"
 	"github.com/application-research/estuary/constants"
@@ -47,7 +48,14 @@ type transferStatusRecord struct {
 type IManager interface {
 	Connect(c echo.Context, handle string, done chan struct{}) error
 	SendRPCMessage(ctx context.Context, handle string, cmd *rpcevent.Command) error
+	SendPriorityRPCMessage(ctx context.Context, handle string, cmd *rpcevent.Command, priority rpcevent.Priority) error
 	GetTransferStatus(dealID uint) (*filclient.ChannelState, error)
+	ErrorRate(handle string) (float64, int)
+	Degraded(handle string) bool
+	BoostCommandQueue(handle string, size int, d time.Duration) error
+	PeekCommandQueue(handle string) (*util.ShuttleQueueSnapshot, error)
+	QueryContentStats(ctx context.Context, handle string, contID uint64) (*util.ShuttleContentStats, error)
+	ContentStats(handle string, contID uint64) *util.ShuttleContentStats
 }
 
 type manager struct {
@@ -66,14 +74,22 @@ type manager struct {
 	splitQueueMgr         splitqueuemgr.IManager
 	commpStatusUpdater    commpstatus.IUpdater
 	pinStatusUpdater      status.IUpdater
+	errorRates            *errorRates
+	contentStats          *contentStatsReplies
 }
 
-func NewEstuaryRpcManager(ctx context.Context, db *gorm.DB, cfg *config.Estuary, log *zap.SugaredLogger, sanitycheckMgr sanitycheck.IManager) (IManager, error) {
+func NewEstuaryRpcManager(ctx context.Context, db *gorm.DB, cfg *config.Estuary, log *zap.SugaredLogger, sanitycheckMgr sanitycheck.IManager, h host.Host) (IManager, error) {
 	cache, err := lru.NewARC(50000)
 	if err != nil {
 		return nil, err
 	}
 
+	contentStats, err := newContentStatsReplies()
+	if err != nil {
+		return nil, err
+	}
+
+	dealQueueMgr := dealqueuemgr.NewManager(cfg, log)
 	rpcMgr := &manager{
 		db:                    db,
 		cfg:                   cfg,
@@ -84,13 +100,15 @@ func NewEstuaryRpcManager(ctx context.Context, db *gorm.DB, cfg *config.Estuary,
 		dealStatusUpdater:     dealstatus.NewUpdater(db, log),
 		transferStatuses:      cache,
 		stgZoneQueueMgr:       stgzonequeuemgr.NewManager(log),
-		dealQueueMgr:          dealqueuemgr.NewManager(cfg, log),
+		dealQueueMgr:          dealQueueMgr,
 		splitQueueMgr:         splitqueuemgr.NewManager(log),
-		commpStatusUpdater:    commpstatus.NewUpdater(db, log),
+		commpStatusUpdater:    commpstatus.NewUpdater(db, log, dealQueueMgr),
 		pinStatusUpdater:      status.NewUpdater(db, log),
+		errorRates:            newErrorRates(errorRateWindow),
+		contentStats:          contentStats,
 	}
 
-	rpcMgr.websocketEng = websocketeng.NewEstuaryRpcEngine(ctx, db, cfg, log, rpcMgr.processMessage)
+	rpcMgr.websocketEng = websocketeng.NewEstuaryRpcEngine(ctx, db, cfg, log, h, rpcMgr.processMessage)
 
 	if cfg.RpcEngine.Queue.Enabled {
 		rpcEng, err := queue.NewEstuaryRpcEngine(cfg, log, rpcMgr.processMessage)
@@ -107,6 +125,12 @@ func (m *manager) Connect(c echo.Context, handle string, done chan struct{}) err
 }
 
 func (m *manager) SendRPCMessage(ctx context.Context, handle string, cmd *rpcevent.Command) error {
+	return m.SendPriorityRPCMessage(ctx, handle, cmd, rpcevent.PriorityNormal)
+}
+
+// SendPriorityRPCMessage sends the command ahead of the shuttle's queued commands of lower priority, the queue
+// engine has no priorities and sends it as any other
+func (m *manager) SendPriorityRPCMessage(ctx context.Context, handle string, cmd *rpcevent.Command, priority rpcevent.Priority) error {
 	if handle == "" || handle == constants.ContentLocationLocal {
 		return fmt.Errorf("attempted to send command to empty shuttle handle or local")
 	}
@@ -123,11 +147,28 @@ func (m *manager) SendRPCMessage(ctx context.Context, handle string, cmd *rpceve
 	d, ok := m.websocketEng.GetShuttleConnection(handle)
 	if ok {
 		m.log.Debugf("sending rpc message: %s, to shuttle: %s using websocket engine", cmd.Op, handle)
-		return d.SendMessage(ctx, cmd)
+		return d.SendMessage(ctx, cmd, priority)
 	}
 	return websocketeng.ErrNoShuttleConnection
 }
 
+// BoostCommandQueue grows the queue of commands to the shuttle for a while, commands sent through the queue engine
+// aren't queued by estuary
+func (m *manager) BoostCommandQueue(handle string, size int, d time.Duration) error {
+	if m.cfg.RpcEngine.Queue.Enabled && m.queueEng != nil {
+		return fmt.Errorf("commands are sent through the queue engine, which has no command queue to boost")
+	}
+	return m.websocketEng.BoostQueue(handle, size, d)
+}
+
+// PeekCommandQueue returns what is queued for the shuttle without taking it off the queue
+func (m *manager) PeekCommandQueue(handle string) (*util.ShuttleQueueSnapshot, error) {
+	if m.cfg.RpcEngine.Queue.Enabled && m.queueEng != nil {
+		return nil, fmt.Errorf("commands are sent through the queue engine, which has no command queue to inspect")
+	}
+	return m.websocketEng.PeekQueue(handle)
+}
+
 func (m *manager) processMessage(msg *rpcevent.Message, source string) error {
 	ctx := context.TODO()
 
@@ -142,6 +183,8 @@ func (m *manager) processMessage(msg *rpcevent.Message, source string) error {
 
 	m.log.Debugf("handling rpc message: %s, from shuttle: %s using %s engine", msg.Op, msg.Handle, source)
 
+	m.errorRates.recordOutcomes(msg)
+
 	switch msg.Op {
 	case rpcevent.OP_UpdatePinStatus:
 		ups := msg.Params.UpdatePinStatus
@@ -209,6 +252,16 @@ func (m *manager) processMessage(msg *rpcevent.Message, source string) error {
 			m.log.Errorf("handling transfer status message from shuttle %s: %s", msg.Handle, err)
 		}
 		return nil
+	case rpcevent.OP_TransferStatusBatch:
+		param := msg.Params.TransferStatusBatch
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := m.handleRpcTransferStatusBatch(ctx, msg.Handle, param); err != nil {
+			m.log.Errorf("handling transfer status batch message from shuttle %s: %s", msg.Handle, err)
+		}
+		return nil
 	case rpcevent.OP_ShuttleUpdate:
 		param := msg.Params.ShuttleUpdate
 		if param == nil {
@@ -258,6 +311,16 @@ func (m *manager) processMessage(msg *rpcevent.Message, source string) error {
 			m.sanityCheckMgr.HandleMissingBlocks(sc.CID, sc.ErrMsg)
 		}()
 		return nil
+	case rpcevent.OP_ContentStats:
+		param := msg.Params.ContentStats
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := m.handleRpcContentStats(ctx, msg.Handle, param); err != nil {
+			m.log.Errorf("handling content stats message from shuttle %s: %s", msg.Handle, err)
+		}
+		return nil
 	default:
 		return fmt.Errorf("unrecognized message op: %q", msg.Op)
 	}
@@ -268,6 +331,7 @@ func (m *manager) handleRpcShuttleUpdate(ctx context.Context, handle string, par
 		"space_low":        param.BlockstoreFree < (param.BlockstoreSize / 10),
 		"blockstore_free":  param.BlockstoreFree,
 		"blockstore_size":  param.BlockstoreSize,
+		"pinned_bytes":     param.PinnedBytes,
 		"pin_count":        param.NumPins,
 		"pin_queue_length": int64(param.PinQueueSize),
 		"updated_at":       time.Now().UTC(),
@@ -508,26 +572,86 @@ func (m *manager) HandleRpcTransferStatus(ctx context.Context, handle string, pa
 		return fmt.Errorf("received transfer status update with no identifier")
 	}
 
+	if err := m.applyTransferStatus(m.db, handle, param); err != nil {
+		return err
+	}
+
+	m.updateTransferStatus(ctx, handle, param.DealDBID, param.State)
+	return nil
+}
+
+// handleRpcTransferStatusBatch applies all the statuses in a single
+// transaction, updates for deals that don't exist are skipped
+func (m *manager) handleRpcTransferStatusBatch(ctx context.Context, handle string, param *rpcevent.TransferStatusBatch) error {
+	var applied []*rpcevent.TransferStatus
+	if err := m.db.Transaction(func(tx *gorm.DB) error {
+		for _, st := range param.Statuses {
+			if st == nil || st.DealDBID == 0 {
+				m.log.Warnf("received transfer status update with no identifier from shuttle %s", handle)
+				continue
+			}
+
+			if err := m.applyTransferStatus(tx, handle, st); err != nil {
+				if xerrors.Is(err, gorm.ErrRecordNotFound) {
+					m.log.Warnf("received transfer status update for unknown deal %d from shuttle %s", st.DealDBID, handle)
+					continue
+				}
+				return err
+			}
+			applied = append(applied, st)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// only cache the statuses once they are committed
+	for _, st := range applied {
+		m.updateTransferStatus(ctx, handle, st.DealDBID, st.State)
+	}
+	return nil
+}
+
+// applyTransferStatus records the status of the deal in the database, and
+// sets param.State to the state that should be cached for it
+func (m *manager) applyTransferStatus(tx *gorm.DB, handle string, param *rpcevent.TransferStatus) error {
 	var cd model.ContentDeal
-	if err := m.db.First(&cd, "id = ?", param.DealDBID).Error; err != nil {
+	if err := tx.First(&cd, "id = ?", param.DealDBID).Error; err != nil {
 		return err
 	}
 
 	if cd.DTChan == "" {
-		if err := m.db.Model(model.ContentDeal{}).Where("id = ?", param.DealDBID).UpdateColumns(map[string]interface{}{
+		if err := tx.Model(model.ContentDeal{}).Where("id = ?", param.DealDBID).UpdateColumns(map[string]interface{}{
 			"dt_chan": param.Chanid,
 		}).Error; err != nil {
 			return err
 		}
 	}
 
+	if param.Cancelled {
+		if err := tx.Model(model.ContentDeal{}).Where("id = ?", cd.ID).UpdateColumns(map[string]interface{}{
+			"failed":            true,
+			"failed_at":         time.Now(),
+			"transfer_finished": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		param.State = &filclient.ChannelState{
+			Status:  datatransfer.Cancelled,
+			Message: fmt.Sprintf("transfer cancelled on shuttle %s: %s", handle, param.Message),
+		}
+		m.log.Debugw("Cancelled data transfer on shuttle", "dealDBID", cd.ID, "shuttle", handle)
+		return nil
+	}
+
 	if param.Failed {
 		miner, err := cd.MinerAddr()
 		if err != nil {
 			return err
 		}
 
-		if oerr := m.dealStatusUpdater.RecordDealFailure(&dealstatus.DealFailureError{
+		dfe := &dealstatus.DealFailureError{
 			Miner:               miner,
 			Phase:               "data-transfer-remote",
 			Message:             fmt.Sprintf("failure from shuttle %s: %s", handle, param.Message),
@@ -536,17 +660,25 @@ func (m *manager) HandleRpcTransferStatus(ctx context.Context, handle string, pa
 			MinerVersion:        cd.MinerVersion,
 			DealProtocolVersion: cd.DealProtocolVersion,
 			DealUUID:            cd.DealUUID,
-		}); oerr != nil {
+		}
+		if oerr := m.dealStatusUpdater.RecordDealFailureTx(dfe, tx); oerr != nil {
 			return oerr
 		}
 
-		if err := m.db.Model(model.ContentDeal{}).Where("id = ?", cd.ID).UpdateColumns(map[string]interface{}{
+		if err := tx.Model(model.ContentDeal{}).Where("id = ?", cd.ID).UpdateColumns(map[string]interface{}{
 			"failed":    true,
 			"failed_at": time.Now(),
 		}).Error; err != nil {
 			return err
 		}
 
+		// a transient failure gets the deal replaced right away, terminal ones keep the miner out of new deals
+		if dfe.Retryable() {
+			if err := m.dealQueueMgr.RecheckDeals(cd.Content, tx); err != nil {
+				return err
+			}
+		}
+
 		sts := datatransfer.Failed
 		if param.State != nil {
 			sts = param.State.Status
@@ -557,9 +689,6 @@ func (m *manager) HandleRpcTransferStatus(ctx context.Context, handle string, pa
 			Message: fmt.Sprintf("failure from shuttle %s: %s", handle, param.Message),
 		}
 	}
-
-	m.updateTransferStatus(ctx, handle, cd.ID, param.State)
-
 	return nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -40,20 +41,26 @@ import (
 var ErrNilParams = fmt.Errorf("shuttle message had nil params")
 var ErrNoShuttleConnection = fmt.Errorf("no connection to requested shuttle")
 
+// shuttles send a heartbeat update every minute
+const storageStatsPollInterval = time.Minute
+
 type IManager interface {
 	Connect(c echo.Context, handle string, done chan struct{}) error
 	IsOnline(handle string) (bool, error)
 	CanAddContent(handle string) (bool, error)
 	HostName(handle string) (string, error)
 	StorageStats(handle string) (*util.ShuttleStorageStats, error)
+	RequestStorageStats(ctx context.Context, handle string) error
 	AddrInfo(handle string) (*peer.AddrInfo, error)
 
 	GetShuttlesConfig(u *util.User) (interface{}, error)
 	StartTransfer(ctx context.Context, loc string, cd *model.ContentDeal, datacid cid.Cid) error
 	RestartTransfer(ctx context.Context, loc string, chanid datatransfer.ChannelID, d model.ContentDeal) error
+	CancelTransfer(ctx context.Context, loc string, d *model.ContentDeal) error
 	GetTransferStatus(ctx context.Context, contLoc string, d *model.ContentDeal) (*filclient.ChannelState, error)
 	UnpinContent(ctx context.Context, loc string, conts []uint64) error
 	PinContent(ctx context.Context, loc string, cont util.Content, origins []*peer.AddrInfo) error
+	RetryPin(ctx context.Context, loc string, contID uint64) error
 	ConsolidateContent(ctx context.Context, loc string, contents []util.Content) error
 	AggregateContent(ctx context.Context, loc string, zone *util.Content, zoneContents []util.Content) error
 	CommPContent(ctx context.Context, loc string, data cid.Cid) error
@@ -63,7 +70,14 @@ type IManager interface {
 	CleanupPreparedRequest(ctx context.Context, loc string, dbid uint, authToken string) error
 	PrepareForDataRequest(ctx context.Context, loc string, dbid uint, authToken string, propCid cid.Cid, payloadCid cid.Cid, size uint64) error
 	GetPreferredUploadEndpoints(u *util.User) ([]string, error)
+	GetUploadEndpointForShuttle(handle string) (string, error)
 	GetByAuth(auth string) (*model.Shuttle, error)
+	ConnectedShuttles() ([]*model.ShuttleConnection, error)
+	ErrorRate(handle string) (float64, int)
+	BoostCommandQueue(handle string, size int, d time.Duration) error
+	PeekCommandQueue(handle string) (*util.ShuttleQueueSnapshot, error)
+	QueryContentStats(ctx context.Context, handle string, contID uint64) (*util.ShuttleContentStats, error)
+	ContentStats(handle string, contID uint64) *util.ShuttleContentStats
 }
 
 type manager struct {
@@ -85,12 +99,12 @@ func NewManager(
 	log *zap.SugaredLogger,
 	sanitycheckMgr sanitycheck.IManager,
 ) (IManager, error) {
-	rpcMgr, err := rpc.NewEstuaryRpcManager(ctx, db, cfg, log, sanitycheckMgr)
+	rpcMgr, err := rpc.NewEstuaryRpcManager(ctx, db, cfg, log, sanitycheckMgr, nd.Host)
 	if err != nil {
 		return nil, err
 	}
 
-	return &manager{
+	m := &manager{
 		db:                    db,
 		cfg:                   cfg,
 		nd:                    nd,
@@ -99,7 +113,9 @@ func NewManager(
 		transferStatusUpdater: transferstatus.NewUpdater(db),
 		dealStatusUpdater:     dealstatus.NewUpdater(db, log),
 		rpcMgr:                rpcMgr,
-	}, nil
+	}
+	go m.runStorageStatsPoller(ctx)
+	return m, nil
 }
 
 // replace this with ping
@@ -168,13 +184,69 @@ func (m *manager) StorageStats(handle string) (*util.ShuttleStorageStats, error)
 		return &util.ShuttleStorageStats{
 			BlockstoreSize: d.BlockstoreSize,
 			BlockstoreFree: d.BlockstoreFree,
+			PinnedBytes:    d.PinnedBytes,
 			PinCount:       d.PinCount,
 			PinQueueLength: d.PinQueueLength,
+			UpdatedAt:      d.UpdatedAt,
 		}, nil
 	}
 	return nil, nil
 }
 
+// RequestStorageStats asks the shuttle for a fresh storage report, StorageStats
+// returns it once the shuttle answered
+func (m *manager) RequestStorageStats(ctx context.Context, handle string) error {
+	return m.sendUrgentRPCMessage(ctx, handle, &rpcevent.Command{
+		Op: rpcevent.CMD_RequestStorageStats,
+		Params: rpcevent.CmdParams{
+			RequestStorageStats: &rpcevent.RequestStorageStats{},
+		},
+	})
+}
+
+// runStorageStatsPoller requests a storage report from every connected shuttle
+// on the heartbeat interval, so that shuttle selection and the admin views work
+// with fresh capacity numbers
+func (m *manager) runStorageStatsPoller(ctx context.Context) {
+	ticker := time.NewTicker(storageStatsPollInterval)
+	defer ticker.Stop()
+
+	// handles of the shuttles whose last request is still waiting for room in their queue
+	var requesting sync.Map
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			shuttles, err := m.ConnectedShuttles()
+			if err != nil {
+				m.log.Errorf("failed to get connected shuttles: %s", err)
+				continue
+			}
+
+			// a shuttle whose queue is full must not hold up the requests to the others
+			for _, sh := range shuttles {
+				handle := sh.Handle
+				if _, inflight := requesting.LoadOrStore(handle, struct{}{}); inflight {
+					continue
+				}
+
+				go func() {
+					defer requesting.Delete(handle)
+
+					reqCtx, cancel := context.WithTimeout(ctx, storageStatsPollInterval)
+					defer cancel()
+
+					if err := m.RequestStorageStats(reqCtx, handle); err != nil {
+						m.log.Warnf("failed to request storage stats from shuttle %s: %s", handle, err)
+					}
+				}()
+			}
+		}
+	}
+}
+
 func (m *manager) GetShuttlesConfig(u *util.User) (interface{}, error) {
 	var shts []interface{}
 	connectedShuttles, err := m.getConnections()
@@ -240,6 +312,12 @@ func (m *manager) sendRPCMessage(ctx context.Context, handle string, cmd *rpceve
 	return m.rpcMgr.SendRPCMessage(ctx, handle, cmd)
 }
 
+// sendUrgentRPCMessage sends a command that should not wait behind bulk commands, like cancellations and status
+// queries
+func (m *manager) sendUrgentRPCMessage(ctx context.Context, handle string, cmd *rpcevent.Command) error {
+	return m.rpcMgr.SendPriorityRPCMessage(ctx, handle, cmd, rpcevent.PriorityHigh)
+}
+
 func (m *manager) Connect(c echo.Context, handle string, done chan struct{}) error {
 	return m.rpcMgr.Connect(c, handle, done)
 }
@@ -263,6 +341,43 @@ func (m *manager) getConnectionByHandle(handle string) (*model.ShuttleConnection
 	return shuttle, nil
 }
 
+// ErrorRate returns the fraction of the pin and transfer operations the shuttle reported as failed recently, and
+// the amount of operations it is computed from
+func (m *manager) ErrorRate(handle string) (float64, int) {
+	return m.rpcMgr.ErrorRate(handle)
+}
+
+// BoostCommandQueue grows the queue of commands to the shuttle to size for at least d, e.g. while bulk onboarding
+// content to it
+func (m *manager) BoostCommandQueue(handle string, size int, d time.Duration) error {
+	return m.rpcMgr.BoostCommandQueue(handle, size, d)
+}
+
+// PeekCommandQueue returns the commands queued for the shuttle, counted by op, to debug a backed up shuttle
+func (m *manager) PeekCommandQueue(handle string) (*util.ShuttleQueueSnapshot, error) {
+	return m.rpcMgr.PeekCommandQueue(handle)
+}
+
+// QueryContentStats asks the shuttle for the blocks of the content it holds and waits for its answer
+func (m *manager) QueryContentStats(ctx context.Context, handle string, contID uint64) (*util.ShuttleContentStats, error) {
+	return m.rpcMgr.QueryContentStats(ctx, handle, contID)
+}
+
+// ContentStats returns the last stats the shuttle reported for the content, or nil if it wasn't queried lately
+func (m *manager) ContentStats(handle string, contID uint64) *util.ShuttleContentStats {
+	return m.rpcMgr.ContentStats(handle, contID)
+}
+
+// ConnectedShuttles returns the connections of the shuttles that are online, including the agent version and
+// protocols they reported through identify
+func (m *manager) ConnectedShuttles() ([]*model.ShuttleConnection, error) {
+	var shuttles []*model.ShuttleConnection
+	if err := m.db.Where("updated_at > ?", time.Now().Add(-5*time.Minute).UTC()).Order("handle asc").Find(&shuttles).Error; err != nil {
+		return nil, err
+	}
+	return shuttles, nil
+}
+
 func (m *manager) getConnections() ([]*model.ShuttleConnection, error) {
 	var shuttles []*model.ShuttleConnection
 	if err := m.db.Find(&shuttles).Error; err != nil {
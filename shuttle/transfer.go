@@ -32,7 +32,7 @@ func (m *manager) StartTransfer(ctx context.Context, loc string, cd *model.Conte
 }
 
 func (m *manager) RequestTransferStatus(ctx context.Context, loc string, dealid uint, chid string) error {
-	return m.sendRPCMessage(ctx, loc, &rpcevent.Command{
+	return m.sendUrgentRPCMessage(ctx, loc, &rpcevent.Command{
 		Op: rpcevent.CMD_ReqTxStatus,
 		Params: rpcevent.CmdParams{
 			ReqTxStatus: &rpcevent.ReqTxStatus{
@@ -56,6 +56,20 @@ func (m *manager) RestartTransfer(ctx context.Context, loc string, chanid datatr
 	})
 }
 
+// CancelTransfer asks the shuttle holding the deal's data to abort its data transfer,
+// the shuttle acknowledges with a cancelled transfer status
+func (m *manager) CancelTransfer(ctx context.Context, loc string, d *model.ContentDeal) error {
+	return m.sendUrgentRPCMessage(ctx, loc, &rpcevent.Command{
+		Op: rpcevent.CMD_CancelTransfer,
+		Params: rpcevent.CmdParams{
+			CancelTransfer: &rpcevent.CancelTransfer{
+				DealDBID: d.ID,
+				ChanID:   d.DTChan,
+			},
+		},
+	})
+}
+
 func (m *manager) GetTransferStatus(ctx context.Context, contLoc string, d *model.ContentDeal) (*filclient.ChannelState, error) {
 	st, err := m.rpcMgr.GetTransferStatus(d.ID)
 	if err != nil {
@@ -95,10 +95,28 @@ type Content struct {
 	DagSplit  bool   `json:"dagSplit"`
 	SplitFrom uint64 `json:"splitFrom"`
 
+	// If set, the content is only stored temporarily, and stops being
+	// advertised to the indexers once this has passed
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" gorm:"index"`
+
 	PinningStatus string `json:"pinningStatus" gorm:"-"`
 	DealStatus    string `json:"dealStatus" gorm:"-"`
 }
 
+// SetContentExpiry sets when the content stops being advertised to the
+// indexers, nil makes it permanent again. It returns gorm.ErrRecordNotFound if
+// there is no such content.
+func SetContentExpiry(db *gorm.DB, contID uint64, expiresAt *time.Time) error {
+	res := db.Model(&Content{}).Where("id = ?", contID).UpdateColumn("expires_at", expiresAt)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
 type ContentWithPath struct {
 	Content
 	Path string `json:"path"`
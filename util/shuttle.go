@@ -16,8 +16,11 @@ type InitShuttleResponse struct {
 type ShuttleStorageStats struct {
 	BlockstoreSize uint64 `json:"blockstoreSize"`
 	BlockstoreFree uint64 `json:"blockstoreFree"`
+	PinnedBytes    uint64 `json:"pinnedBytes"`
 	PinCount       int64  `json:"pinCount"`
 	PinQueueLength int64  `json:"pinQueueLength"`
+	// when the shuttle last reported the stats
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 type ShuttleListResponse struct {
@@ -28,10 +31,49 @@ type ShuttleListResponse struct {
 	AddrInfo       *peer.AddrInfo  `json:"addrInfo"`
 	Address        address.Address `json:"address"`
 	Hostname       string          `json:"hostname"`
+	AgentVersion   string          `json:"agentVersion,omitempty"`
+	Protocols      []string        `json:"protocols,omitempty"`
+	// fraction of recent pin and transfer operations that failed
+	ErrorRate        float64 `json:"errorRate"`
+	ErrorRateSamples int     `json:"errorRateSamples"`
 
 	StorageStats *ShuttleStorageStats `json:"storageStats"`
 }
 
+type ShuttleBoostQueueBody struct {
+	// number of commands the queue holds while boosted
+	Size int `json:"size"`
+	// how long the boost lasts at least, e.g. "2h"
+	Duration string `json:"duration"`
+}
+
+type ShuttleQueueSnapshot struct {
+	Handle string `json:"handle"`
+	// number of commands the queue holds, more than DefaultSize while boosted
+	Size         int        `json:"size"`
+	DefaultSize  int        `json:"defaultSize"`
+	BoostedUntil *time.Time `json:"boostedUntil,omitempty"`
+	// commands waiting to be written to the shuttle
+	Pending       int `json:"pending"`
+	UrgentPending int `json:"urgentPending"`
+	// pending commands counted by op
+	Ops       map[string]int `json:"ops"`
+	UrgentOps map[string]int `json:"urgentOps"`
+}
+
+// ShuttleContentStats is what a shuttle reported holding of a content, to
+// compare with what the database thinks it holds
+type ShuttleContentStats struct {
+	Handle    string `json:"handle"`
+	ContentID uint64 `json:"contentId"`
+	// blocks of the content in the shuttle's blockstore, and their total size
+	Blocks int64 `json:"blocks"`
+	Size   int64 `json:"size"`
+	// blocks the shuttle has a record of that are missing from its blockstore
+	MissingBlocks int64     `json:"missingBlocks"`
+	ReceivedAt    time.Time `json:"receivedAt"`
+}
+
 type ShuttleCreateContentBody struct {
 	ContentCreateBody
 	Collections  []string `json:"collections"`
@@ -42,4 +84,6 @@ type ShuttleCreateContentBody struct {
 type ChanTrack struct {
 	Dbid uint
 	Last *filclient.ChannelState
+	// whether estuary was sent Last
+	Reported bool
 }